@@ -0,0 +1,162 @@
+// Package mail sends the forum's outgoing email. A Sender delivers a
+// Message through SMTP, writes it to the log for local development, or
+// drops it. Messages carry a plain text body and optionally an HTML one,
+// rendered from the templates in a directory by Templates.
+//
+// Config is read from FORUM_MAIL_* and FORUM_SMTP_* environment variables,
+// or from a file of the same KEY=value lines named by FORUM_MAIL_CONFIG,
+// with the environment taking precedence.
+package mail
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Message is one email to one recipient. HTML is optional; when it is set
+// the message is sent with both bodies for the client to choose from.
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Sender delivers messages
+type Sender interface {
+	Send(m Message) error
+}
+
+// LogSender writes messages to the log instead of sending them, for local
+// development
+type LogSender struct{}
+
+// Send logs the message's recipient, subject and plain text body
+func (LogSender) Send(m Message) error {
+	log.Printf("Mail to %s: %s\n%s", m.To, m.Subject, m.Text)
+	return nil
+}
+
+// NopSender drops every message
+type NopSender struct{}
+
+// Send does nothing
+func (NopSender) Send(Message) error {
+	return nil
+}
+
+// Backends a Config can pick
+const (
+	BackendSMTP = "smtp"
+	BackendLog  = "log"
+	BackendNone = "none"
+)
+
+// Config chooses and sets up a Sender. Backend defaults to smtp when Host
+// is set and to log otherwise.
+type Config struct {
+	Backend  string
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+// configKeys maps each setting to the variable it is read from
+var configKeys = map[string]func(c *Config, value string) error{
+	"FORUM_MAIL_BACKEND":  func(c *Config, v string) error { c.Backend = v; return nil },
+	"FORUM_MAIL_FROM":     func(c *Config, v string) error { c.From = v; return nil },
+	"FORUM_SMTP_HOST":     func(c *Config, v string) error { c.Host = v; return nil },
+	"FORUM_SMTP_USERNAME": func(c *Config, v string) error { c.Username = v; return nil },
+	"FORUM_SMTP_PASSWORD": func(c *Config, v string) error { c.Password = v; return nil },
+	"FORUM_SMTP_PORT": func(c *Config, v string) error {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("FORUM_SMTP_PORT must be a number, got %q", v)
+		}
+		c.Port = port
+		return nil
+	},
+}
+
+// LoadConfig reads the mail settings from the file at path, when path
+// isn't empty, and then from the environment
+func LoadConfig(path string) (Config, error) {
+	c := Config{Port: 587, From: "ForumHub <noreply@localhost>"}
+	if path != "" {
+		if err := c.readFile(path); err != nil {
+			return c, err
+		}
+	}
+	for key, set := range configKeys {
+		if v := os.Getenv(key); v != "" {
+			if err := set(&c, v); err != nil {
+				return c, err
+			}
+		}
+	}
+	return c, nil
+}
+
+// readFile applies the KEY=value lines of a config file. Blank lines and
+// lines starting with # are skipped, and values may be quoted.
+func (c *Config) readFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected KEY=value", path, n)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		set, known := configKeys[key]
+		if !known {
+			return fmt.Errorf("%s:%d: unknown setting %s", path, n, key)
+		}
+		if err := set(c, value); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// New returns the Sender c chooses
+func New(c Config) (Sender, error) {
+	backend := c.Backend
+	if backend == "" {
+		backend = BackendLog
+		if c.Host != "" {
+			backend = BackendSMTP
+		}
+	}
+
+	switch backend {
+	case BackendSMTP:
+		if c.Host == "" {
+			return nil, fmt.Errorf("the smtp mail backend needs FORUM_SMTP_HOST")
+		}
+		return &SMTPSender{Host: c.Host, Port: c.Port, Username: c.Username, Password: c.Password, From: c.From}, nil
+	case BackendLog:
+		return LogSender{}, nil
+	case BackendNone:
+		return NopSender{}, nil
+	}
+	return nil, fmt.Errorf("unknown mail backend %q; use smtp, log or none", backend)
+}
@@ -0,0 +1,45 @@
+package mail
+
+import (
+	htmltemplate "html/template"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+)
+
+// Templates renders email bodies from a directory. Each email has a plain
+// text template, <name>.txt, and may have an HTML one, <name>.html. The
+// text template isn't escaped, so user content passed to it must already
+// be plain text; the HTML template escapes it as any web page would.
+type Templates struct {
+	Dir string
+}
+
+// Render fills in the bodies of the named email with data, leaving HTML
+// empty when the email has no HTML template
+func (t Templates) Render(name string, data any) (text, html string, err error) {
+	textTmpl, err := texttemplate.ParseFiles(filepath.Join(t.Dir, name+".txt"))
+	if err != nil {
+		return "", "", err
+	}
+	var b strings.Builder
+	if err := textTmpl.Execute(&b, data); err != nil {
+		return "", "", err
+	}
+	text = b.String()
+
+	htmlPath := filepath.Join(t.Dir, name+".html")
+	if _, err := os.Stat(htmlPath); os.IsNotExist(err) {
+		return text, "", nil
+	}
+	htmlTmpl, err := htmltemplate.ParseFiles(htmlPath)
+	if err != nil {
+		return "", "", err
+	}
+	b.Reset()
+	if err := htmlTmpl.Execute(&b, data); err != nil {
+		return "", "", err
+	}
+	return text, b.String(), nil
+}
@@ -0,0 +1,401 @@
+// Package notify records the in-site notifications users get when others
+// comment on, reply to, like or mention what they wrote, or comment on a
+// post they watch, or when staff warn them, and reads them back for the
+// notifications page.
+//
+// Users pick a Channel for each kind of notification: in the site only,
+// by email as well, or not at all. Those to be emailed are marked so, and
+// picked up by Unmailed until MarkMailed.
+//
+// Likes are batched: while a user hasn't read the notification about likes
+// of a post or comment, more likes are added to it rather than sent on
+// their own, so a popular post doesn't flood its author's inbox.
+//
+// It works on a *sql.DB or a *sql.Tx, so an event can be recorded in the
+// same transaction as the change that caused it. Times are stored as
+// RFC 3339 text in UTC, like everywhere else in the forum's database.
+package notify
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+)
+
+// Kind is what happened to cause a notification
+type Kind string
+
+const (
+	// Comment is a new top-level comment on the recipient's post
+	Comment Kind = "comment"
+	// Reply is a reply to the recipient's comment
+	Reply Kind = "reply"
+	// Watch is a new comment on someone else's post the recipient watches
+	Watch Kind = "watch"
+	// Like is a like of the recipient's comment
+	Like Kind = "like"
+	// Mention is an @mention of the recipient in a post or comment
+	Mention Kind = "mention"
+	// Warning is a warning staff issued to the recipient. It is about no
+	// post, so PostID is 0.
+	Warning Kind = "warning"
+)
+
+// Kinds lists every kind of notification users pick a channel for, in the
+// order the preferences page shows them. Warnings aren't among them: they
+// always reach the site, whatever the preferences.
+var Kinds = []Kind{Comment, Reply, Watch, Like, Mention}
+
+// Label describes the kind for the preferences page
+func (k Kind) Label() string {
+	switch k {
+	case Comment:
+		return "Comments on my posts"
+	case Reply:
+		return "Replies to my comments"
+	case Watch:
+		return "Comments on posts I watch"
+	case Like:
+		return "Likes of my posts and comments"
+	case Mention:
+		return "Mentions of me"
+	}
+	return string(k)
+}
+
+// PreferenceKey is the user preference holding the Channel for the kind
+func (k Kind) PreferenceKey() string {
+	return "notify_" + string(k)
+}
+
+// Channel is how a user wants to hear about a kind of event
+type Channel string
+
+const (
+	// InApp only lists the notification on the notifications page
+	InApp Channel = "in_app"
+	// Email lists it and emails it too
+	Email Channel = "email"
+	// Off drops the event
+	Off Channel = "off"
+)
+
+// Channels lists every channel, in the order the preferences page shows
+// them
+var Channels = []Channel{InApp, Email, Off}
+
+// Label describes the channel for the preferences page
+func (c Channel) Label() string {
+	switch c {
+	case InApp:
+		return "In the forum"
+	case Email:
+		return "In the forum and by email"
+	case Off:
+		return "Off"
+	}
+	return string(c)
+}
+
+// batched reports whether events of the kind are gathered into one
+// notification per post or comment while it is unread
+func (k Kind) batched() bool {
+	return k == Like
+}
+
+// repeatable reports whether the same actor causing the kind again is a
+// new event, rather than the same thing done twice
+func (k Kind) repeatable() bool {
+	return k == Warning
+}
+
+// Event is something a user is told about. CommentID is the comment the
+// event is about, or 0 when it is about the post itself. PostID is 0 for
+// events about no post, which are stored with a NULL post_id.
+type Event struct {
+	Kind      Kind
+	Recipient string
+	Actor     string
+	PostID    int
+	CommentID int
+	At        time.Time
+}
+
+// Execer runs statements; *sql.DB and *sql.Tx are both Execers
+type Execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// Querier runs queries; *sql.DB and *sql.Tx are both Queriers
+type Querier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// Send records an event for its recipient on the channel they picked for
+// its kind. Users aren't told about what they did themselves, and the same
+// actor doing the same thing to the same post or comment twice, like
+// liking a comment again after taking the like back, is only recorded
+// once, unless the kind is repeatable.
+func Send(ex Execer, e Event, ch Channel) error {
+	if e.Recipient == "" || e.Recipient == e.Actor || ch == Off {
+		return nil
+	}
+	if e.Kind.batched() {
+		return sendBatched(ex, e, ch)
+	}
+	_, err := ex.Exec(
+		`INSERT INTO notifications (user_uuid, kind, actor_uuid, post_id, comment_id, created_at, email)
+		SELECT ?1, ?2, ?3, NULLIF(?4, 0), ?5, ?6, ?7
+		WHERE ?8 OR NOT EXISTS (
+			SELECT 1 FROM notifications
+			WHERE user_uuid = ?1 AND kind = ?2 AND actor_uuid = ?3 AND post_id = ?4 AND comment_id = ?5
+		)`,
+		e.Recipient, string(e.Kind), e.Actor, e.PostID, e.CommentID, formatTime(e.At), ch == Email, e.Kind.repeatable(),
+	)
+	return err
+}
+
+// sendBatched adds the actor to the recipient's unread notification about
+// the same kind of event on the same post or comment, making it the latest
+// actor and moving the notification up, or starts a new one when there is
+// none. Actors already counted in any of these notifications, read or not,
+// aren't counted again. A batch that was already emailed isn't emailed
+// again as it grows.
+func sendBatched(ex Execer, e Event, ch Channel) error {
+	at := formatTime(e.At)
+	res, err := ex.Exec(
+		`UPDATE notifications SET actor_uuid = ?1, created_at = ?6, email = email OR ?7
+		WHERE id = (
+			SELECT MAX(id) FROM notifications
+			WHERE user_uuid = ?2 AND kind = ?3 AND post_id = ?4 AND comment_id = ?5 AND read_at = ''
+		)
+		AND NOT EXISTS (
+			SELECT 1 FROM notification_actors a JOIN notifications n ON n.id = a.notification_id
+			WHERE n.user_uuid = ?2 AND n.kind = ?3 AND n.post_id = ?4 AND n.comment_id = ?5 AND a.actor_uuid = ?1
+		)`,
+		e.Actor, e.Recipient, string(e.Kind), e.PostID, e.CommentID, at, ch == Email,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		res, err = ex.Exec(
+			`INSERT INTO notifications (user_uuid, kind, actor_uuid, post_id, comment_id, created_at, email)
+			SELECT ?2, ?3, ?1, ?4, ?5, ?6, ?7
+			WHERE NOT EXISTS (
+				SELECT 1 FROM notification_actors a JOIN notifications n ON n.id = a.notification_id
+				WHERE n.user_uuid = ?2 AND n.kind = ?3 AND n.post_id = ?4 AND n.comment_id = ?5 AND a.actor_uuid = ?1
+			)
+			AND NOT EXISTS (
+				SELECT 1 FROM notifications
+				WHERE user_uuid = ?2 AND kind = ?3 AND post_id = ?4 AND comment_id = ?5 AND read_at = ''
+			)`,
+			e.Actor, e.Recipient, string(e.Kind), e.PostID, e.CommentID, at, ch == Email,
+		)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return nil
+		}
+	}
+	_, err = ex.Exec(
+		`INSERT INTO notification_actors (notification_id, actor_uuid, created_at)
+		SELECT MAX(id), ?, ? FROM notifications WHERE user_uuid = ? AND kind = ? AND post_id = ? AND comment_id = ?`,
+		e.Actor, at, e.Recipient, string(e.Kind), e.PostID, e.CommentID,
+	)
+	return err
+}
+
+// Notification is a recorded event as its recipient sees it. Actor is the
+// latest to cause it, and Others how many more a batched one gathered.
+// Text is the source of the comment or post it is about, for context, or
+// empty once that is deleted or hidden.
+type Notification struct {
+	ID        int
+	Recipient string
+	Kind      Kind
+	Actor     string
+	Others    int
+	PostID    int
+	PostTitle string
+	CommentID int
+	Text      string
+	CreatedAt time.Time
+	Read      bool
+}
+
+// Actors names who caused the notification: "alice", or "alice and 3
+// others" for a batch
+func (n Notification) Actors() string {
+	switch n.Others {
+	case 0:
+		return n.Actor
+	case 1:
+		return n.Actor + " and 1 other"
+	}
+	return n.Actor + " and " + strconv.Itoa(n.Others) + " others"
+}
+
+// Message describes the notification, naming who caused it
+func (n Notification) Message() string {
+	switch n.Kind {
+	case Comment:
+		return n.Actors() + " commented on your post"
+	case Reply:
+		return n.Actors() + " replied to your comment"
+	case Watch:
+		return n.Actors() + " commented on a post you watch"
+	case Like:
+		if n.CommentID == 0 {
+			return n.Actors() + " liked your post"
+		}
+		return n.Actors() + " liked your comment"
+	case Mention:
+		if n.CommentID != 0 {
+			return n.Actors() + " mentioned you in a comment"
+		}
+		return n.Actors() + " mentioned you in a post"
+	case Warning:
+		return n.Actors() + " sent you a warning"
+	}
+	return n.Actors() + " did something"
+}
+
+// Link is where the notification leads: the comment's permalink, or the
+// post, or for a warning the recipient's warnings
+func (n Notification) Link() string {
+	if n.Kind == Warning {
+		return "/warnings"
+	}
+	if n.CommentID != 0 {
+		return "/comment/" + strconv.Itoa(n.CommentID)
+	}
+	return "/post/" + strconv.Itoa(n.PostID)
+}
+
+// selectNotifications reads notifications with what they are about, for
+// scanNotifications. Queries add their WHERE clause and order.
+const selectNotifications = `SELECT n.id, n.user_uuid, n.kind, COALESCE(a.username, ''),
+		MAX((SELECT COUNT(*) FROM notification_actors na WHERE na.notification_id = n.id) - 1, 0),
+		COALESCE(n.post_id, 0), COALESCE(p.title, ''), n.comment_id,
+		CASE
+			WHEN n.comment_id = 0 AND p.deleted_at = '' THEN p.content
+			WHEN c.deleted_at = '' AND c.hidden_at = '' THEN c.content
+			ELSE ''
+		END,
+		n.created_at, n.read_at != ''
+	FROM notifications n
+	LEFT JOIN users a ON a.uuid = n.actor_uuid
+	LEFT JOIN posts p ON p.id = n.post_id
+	LEFT JOIN comments c ON c.id = n.comment_id`
+
+func scanNotifications(rows *sql.Rows, err error) ([]Notification, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []Notification
+	for rows.Next() {
+		var (
+			n         Notification
+			createdAt string
+		)
+		if err := rows.Scan(&n.ID, &n.Recipient, &n.Kind, &n.Actor, &n.Others, &n.PostID, &n.PostTitle, &n.CommentID, &n.Text, &createdAt, &n.Read); err != nil {
+			return nil, err
+		}
+		n.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+		list = append(list, n)
+	}
+	return list, rows.Err()
+}
+
+// List returns a page of a user's notifications, the latest first. A batch
+// counts as late as the last event added to it.
+func List(q Querier, recipient string, limit, offset int) ([]Notification, error) {
+	return scanNotifications(q.Query(
+		selectNotifications+`
+		WHERE n.user_uuid = ?
+		ORDER BY n.created_at DESC, n.id DESC
+		LIMIT ? OFFSET ?`,
+		recipient, limit, offset,
+	))
+}
+
+// Unmailed returns up to limit notifications waiting to be emailed, by
+// recipient and then oldest first
+func Unmailed(q Querier, limit int) ([]Notification, error) {
+	return scanNotifications(q.Query(
+		selectNotifications+`
+		WHERE n.email AND n.emailed_at = ''
+		ORDER BY n.user_uuid, n.id
+		LIMIT ?`,
+		limit,
+	))
+}
+
+// UnreadUnmailed returns up to limit of a user's unread notifications that
+// haven't been emailed, the latest first
+func UnreadUnmailed(q Querier, recipient string, limit int) ([]Notification, error) {
+	return scanNotifications(q.Query(
+		selectNotifications+`
+		WHERE n.user_uuid = ? AND n.read_at = '' AND n.emailed_at = ''
+		ORDER BY n.created_at DESC, n.id DESC
+		LIMIT ?`,
+		recipient, limit,
+	))
+}
+
+// MarkMailed records that notifications were emailed at the given time
+func MarkMailed(ex Execer, ids []int, at time.Time) error {
+	for _, id := range ids {
+		if _, err := ex.Exec("UPDATE notifications SET emailed_at = ? WHERE id = ?", formatTime(at), id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get returns one of a user's notifications, or sql.ErrNoRows
+func Get(q Querier, recipient string, id int) (*Notification, error) {
+	list, err := scanNotifications(q.Query(selectNotifications+" WHERE n.id = ? AND n.user_uuid = ?", id, recipient))
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &list[0], nil
+}
+
+// Count returns how many notifications a user has, and how many of them
+// are unread
+func Count(q Querier, recipient string) (total, unread int, err error) {
+	err = q.QueryRow(
+		"SELECT COUNT(*), COALESCE(SUM(read_at = ''), 0) FROM notifications WHERE user_uuid = ?",
+		recipient,
+	).Scan(&total, &unread)
+	return total, unread, err
+}
+
+// MarkRead marks one of a user's notifications as read at the given time,
+// or all of them when id is 0
+func MarkRead(ex Execer, recipient string, id int, at time.Time) error {
+	_, err := ex.Exec(
+		"UPDATE notifications SET read_at = ? WHERE user_uuid = ? AND read_at = '' AND (? = 0 OR id = ?)",
+		formatTime(at), recipient, id, id,
+	)
+	return err
+}
+
+// MarkUnread marks one of a user's notifications as unread again
+func MarkUnread(ex Execer, recipient string, id int) error {
+	_, err := ex.Exec("UPDATE notifications SET read_at = '' WHERE user_uuid = ? AND id = ?", recipient, id)
+	return err
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"net/http"
+	"os"
 
 	"forum/utils"
 
@@ -15,16 +16,139 @@ func main() {
 		log.Fatal("Failed to connect to database:", err)
 	}
 
+	// Maintenance commands run against the database and exit
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "integrity":
+			os.Exit(utils.IntegrityCommand(os.Args[2:], os.Stdout))
+		default:
+			log.Fatalf("Unknown command %q; the only command is integrity", os.Args[1])
+		}
+	}
+	if err := utils.CheckPasswordHashing(); err != nil {
+		log.Fatal("Password hashing self-check failed:", err)
+	}
+	if err := utils.SetupMail(); err != nil {
+		log.Fatal("Failed to set up outgoing email:", err)
+	}
+	utils.StartScheduler()
+
 	fs := http.FileServer(http.Dir("./static"))
 	http.Handle("/static/", http.StripPrefix("/static/", fs))
 
+	http.HandleFunc("/manifest.webmanifest", utils.ManifestHandler)
+	http.HandleFunc("/sw.js", utils.ServiceWorkerHandler)
+	http.HandleFunc("/offline", utils.OfflineHandler)
+
 	http.HandleFunc("/", utils.DefaultHandler)
 	http.HandleFunc("/home", utils.HomeHandler)
+	http.HandleFunc("/feed.xml", utils.FeedHandler)
 	http.HandleFunc("/login", utils.LoginHandler)
+	http.HandleFunc("/login/magic", utils.MagicLinkHandler)
+	http.HandleFunc("/login/magic/{token}", utils.MagicLoginHandler)
 	http.HandleFunc("/logout", utils.LogoutHandler)
 	http.HandleFunc("/guest", utils.GuestHandler)
 	http.HandleFunc("/register", utils.RegisterHandler)
+	http.HandleFunc("/users/search", utils.UserSearchHandler)
+	http.HandleFunc("/mentions/suggest", utils.MentionSuggestHandler)
+	http.HandleFunc("/user/{username}", utils.ProfileHandler)
+	http.HandleFunc("/user/{username}/feed.xml", utils.UserFeedHandler)
+	http.HandleFunc("/avatars/{file}", utils.AvatarHandler)
+	http.HandleFunc("/imported/{file}", utils.ImportedFileHandler)
+	http.HandleFunc("/uploads/{file}", utils.UploadHandler)
+	http.HandleFunc("/attachments/{id}", utils.AttachmentHandler)
+	http.HandleFunc("/settings", utils.SettingsHandler)
+	http.HandleFunc("/settings/privacy", utils.PrivacySettingsHandler)
+	http.HandleFunc("/settings/notifications", utils.NotificationSettingsHandler)
+	http.HandleFunc("/settings/export", utils.DataExportHandler)
+	http.HandleFunc("/settings/export/{id}", utils.DownloadExportHandler)
+	http.HandleFunc("/warnings", utils.MyWarningsHandler)
+	http.HandleFunc("/appeal", utils.AppealHandler)
+	http.HandleFunc("/categories", utils.CategoriesHandler)
+	http.HandleFunc("/category/{id}", utils.CategoryHandler)
+	http.HandleFunc("/category/{id}/feed.xml", utils.CategoryFeedHandler)
+	http.HandleFunc("/post/{id}/comments/feed.xml", utils.PostCommentsFeedHandler)
+	http.HandleFunc("/post/{id}", utils.PostHandler)
+	http.HandleFunc("/post/{id}/comment", utils.Transactional(utils.AddCommentHandler))
+	http.HandleFunc("/post/{id}/draft", utils.CommentDraftHandler)
+	http.HandleFunc("/post/{id}/reactors", utils.ReactorsHandler)
+	http.HandleFunc("/notifications", utils.NotificationsHandler)
+	http.HandleFunc("/notifications/{id}", utils.OpenNotificationHandler)
+	http.HandleFunc("/notifications/read", utils.MarkNotificationsHandler)
+	http.HandleFunc("/notifications/unread", utils.UnreadNotificationsHandler)
+	http.HandleFunc("/post/{id}/report", utils.ReportPostHandler)
+	http.HandleFunc("/post/{id}/accept", utils.AcceptAnswerHandler)
+	http.HandleFunc("/post/{id}/react", utils.ReactHandler)
+	http.HandleFunc("/post/{id}/vote", utils.VoteHandler)
+	http.HandleFunc("/post/{id}/coauthors", utils.CoAuthorsHandler)
+	http.HandleFunc("/post/{id}/watch", utils.WatchPostHandler)
+	http.HandleFunc("/comment/like", utils.CommentLikeHandler)
+	http.HandleFunc("/comment/{id}", utils.CommentPermalinkHandler)
+	http.HandleFunc("/comment/{id}/report", utils.ReportCommentHandler)
+	http.HandleFunc("/comment/{id}/edit", utils.EditCommentHandler)
+	http.HandleFunc("/comment/{id}/delete", utils.DeleteCommentHandler)
+	http.HandleFunc("/comment/{id}/hide", utils.HideCommentHandler)
+	http.HandleFunc("/post/{id}/export", utils.ExportPostHandler)
+	http.HandleFunc("/post/{id}/revisions", utils.PostRevisionsHandler)
+	http.HandleFunc("/post/new", utils.NewPostHandler)
+	http.HandleFunc("/post/similar", utils.SimilarPostsHandler)
+	http.HandleFunc("/post/preview", utils.PreviewHandler)
+	http.HandleFunc("/out/{post}/{token}", utils.OutboundHandler)
+	http.HandleFunc("/link-preview/{id}/image", utils.LinkPreviewImageHandler)
+	http.HandleFunc("/search", utils.SearchHandler)
+	http.HandleFunc("/post/move", utils.MovePostHandler)
+	http.HandleFunc("/post/merge", utils.MergePostHandler)
+	http.HandleFunc("/post/merge/undo", utils.UndoMergeHandler)
+	http.HandleFunc("/post/announce", utils.AnnouncePostHandler)
+	http.HandleFunc("/post/pin", utils.PinPostHandler)
+	http.HandleFunc("/post/lock", utils.LockPostHandler)
+	http.HandleFunc("/post/bookmark", utils.BookmarkHandler)
+	http.HandleFunc("/bookmarks", utils.BookmarksHandler)
+	http.HandleFunc("/post/edit", utils.EditPostHandler)
+	http.HandleFunc("/post/delete", utils.DeletePostHandler)
+	http.HandleFunc("/post/restore", utils.RestorePostHandler)
+	http.HandleFunc("/trash", utils.TrashHandler)
+	http.HandleFunc("/drafts", utils.DraftsHandler)
+	http.HandleFunc("/invitations", utils.InvitationsHandler)
+
+	http.HandleFunc("/admin", utils.AdminDashboardHandler)
+	http.HandleFunc("/admin/categories", utils.AdminCategoriesHandler)
+	http.HandleFunc("/admin/categories/archive", utils.ArchiveCategoryHandler)
+	http.HandleFunc("/admin/categories/qa", utils.QACategoryHandler)
+	http.HandleFunc("/admin/categories/merge", utils.MergeCategoryHandler)
+	http.HandleFunc("/admin/categories/save", utils.SaveCategoryHandler)
+	http.HandleFunc("/admin/categories/reorder", utils.ReorderCategoryHandler)
+	http.HandleFunc("/admin/categories/delete", utils.DeleteCategoryHandler)
+	http.HandleFunc("/admin/categories/moderators", utils.CategoryModeratorHandler)
+	http.HandleFunc("/admin/categories/template", utils.SavePostTemplateHandler)
+	http.HandleFunc("/admin/users/{username}", utils.AdminUserHandler)
+	http.HandleFunc("/admin/users/{username}/notes", utils.AddUserNoteHandler)
+	http.HandleFunc("/admin/users/{username}/warnings", utils.IssueWarningHandler)
+	http.HandleFunc("/admin/users/{username}/unsuspend", utils.LiftSuspensionHandler)
+	http.HandleFunc("/admin/warnings", utils.WarningThresholdsHandler)
+	http.HandleFunc("/admin/maintenance", utils.MaintenanceHandler)
+	http.HandleFunc("/admin/velocity", utils.VelocityHandler)
+	http.HandleFunc("/admin/reports", utils.AdminReportsHandler)
+	http.HandleFunc("/admin/reports/close", utils.CloseReportsHandler)
+	http.HandleFunc("/admin/appeals", utils.AdminAppealsHandler)
+	http.HandleFunc("/admin/appeals/decide", utils.DecideAppealHandler)
+	http.HandleFunc("/admin/import", utils.AdminImportHandler)
+	http.HandleFunc("/admin/audit", utils.AuditExportHandler)
+	http.HandleFunc("/admin/snippets", utils.SnippetsHandler)
+	http.HandleFunc("/metrics", utils.MetricsHandler)
+
+	http.HandleFunc("/.well-known/webfinger", utils.WebFingerHandler)
+	http.HandleFunc("/ap/category/{id}", utils.CategoryActorHandler)
+	http.HandleFunc("/ap/category/{id}/inbox", utils.CategoryInboxHandler)
+	http.HandleFunc("/ap/category/{id}/outbox", utils.CategoryOutboxHandler)
+	http.HandleFunc("/ap/category/{id}/followers", utils.CategoryFollowersHandler)
+	http.HandleFunc("/ap/post/{id}", utils.PostObjectHandler)
+
+	if utils.TestMode {
+		http.HandleFunc("/test/clock", utils.TestClockHandler)
+		http.HandleFunc("/test/jobs/{name}", utils.RunJobHandler)
+	}
 
 	log.Println("Server running on http://localhost:8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	log.Fatal(http.ListenAndServe(":8080", utils.RecoverPanics(utils.MaintenanceGate(http.DefaultServeMux))))
 }
@@ -7,15 +7,35 @@ create table if not exists users (
     password text not null,
     notregistered boolean not null,
     lastseen text not null,
-    loggedin boolean not null
+    loggedin boolean not null,
+    role text not null default 'user',
+    suspendeduntil text not null default '',
+    dormant_warned_at text not null default '',
+    dormant_locked_at text not null default '',
+    anonymized_at text not null default '',
+    avatarkey text not null default ''
 );
 
+-- avatar keys name users' identicons, so each must be unique
+create unique index if not exists idx_users_avatarkey on users(avatarkey) where avatarkey != '';
+
 -- posts
 create table if not exists posts (
     id integer primary key autoincrement,
     title text not null,
     content text not null,
     author_uuid text not null,
+    created_at text not null default '',
+    edited_at text not null default '',
+    deleted_at text not null default '',
+    deleted_by text not null default '',
+    status text not null default 'published',
+    views integer not null default 0,
+    locked_at text not null default '',
+    archived_at text not null default '',
+    nsfw integer not null default 0,
+    spoiler integer not null default 0,
+    accepted_comment_id integer not null default 0,
     foreign key(author_uuid) references users(uuid)
 );
 
@@ -25,10 +45,19 @@ create table if not exists comments (
     content text not null,
     comment_author_uuid text not null,
     post_id integer not null,
+    created_at text not null default '',
+    parent_comment_id integer not null default 0,
+    edited_at text not null default '',
+    -- deleted comments keep their place in the thread without their content
+    deleted_at text not null default '',
+    -- hidden comments are only shown to their author and moderators
+    hidden_at text not null default '',
     foreign key(comment_author_uuid) references users(uuid),
     foreign key(post_id) references posts(id)
 );
 
+create index if not exists idx_comments_parent on comments(parent_comment_id);
+
 -- interactions 
 create table if not exists interactions (
     id integer primary key autoincrement,
@@ -36,8 +65,538 @@ create table if not exists interactions (
     post_id integer not null,
     liked boolean not null default 0,
     disliked boolean not null default 0,
+    created_at text not null default '',
     foreign key(user_uuid) references users(uuid),
     foreign key(post_id) references posts(id)
 );
 
+-- comment interactions are likes and dislikes of comments, one per user
+-- and comment
+create table if not exists comment_interactions (
+    comment_id integer not null,
+    user_uuid text not null,
+    liked boolean not null default 0,
+    disliked boolean not null default 0,
+    created_at text not null,
+    primary key(comment_id, user_uuid),
+    foreign key(comment_id) references comments(id),
+    foreign key(user_uuid) references users(uuid)
+);
+
+-- categories
+create table if not exists categories (
+    id integer primary key autoincrement,
+    name text not null unique,
+    description text not null default '',
+    archived boolean not null default 0,
+    position integer not null default 0,
+    parent_id integer not null default 0,
+    -- posts in Q&A categories can have an accepted answer
+    qa integer not null default 0
+);
+
+-- post_categories
+create table if not exists post_categories (
+    post_id integer not null,
+    category_id integer not null,
+    primary key(post_id, category_id),
+    foreign key(post_id) references posts(id),
+    foreign key(category_id) references categories(id)
+);
+
+-- category_moderators
+create table if not exists category_moderators (
+    category_id integer not null,
+    user_uuid text not null,
+    primary key(category_id, user_uuid),
+    foreign key(category_id) references categories(id),
+    foreign key(user_uuid) references users(uuid)
+);
+
+-- user_preferences
+create table if not exists user_preferences (
+    user_uuid text not null,
+    key text not null,
+    value text not null,
+    primary key(user_uuid, key),
+    foreign key(user_uuid) references users(uuid)
+);
+
+-- post_history
+create table if not exists post_history (
+    id integer primary key autoincrement,
+    post_id integer not null,
+    user_uuid text not null,
+    action text not null,
+    details text not null default '',
+    created_at text not null,
+    foreign key(post_id) references posts(id),
+    foreign key(user_uuid) references users(uuid)
+);
+
+-- user_notes
+create table if not exists user_notes (
+    id integer primary key autoincrement,
+    user_uuid text not null,
+    author_uuid text not null,
+    note text not null,
+    created_at text not null,
+    foreign key(user_uuid) references users(uuid),
+    foreign key(author_uuid) references users(uuid)
+);
+
+-- warnings
+create table if not exists warnings (
+    id integer primary key autoincrement,
+    user_uuid text not null,
+    issuer_uuid text not null,
+    severity text not null,
+    reason text not null,
+    created_at text not null,
+    foreign key(user_uuid) references users(uuid),
+    foreign key(issuer_uuid) references users(uuid)
+);
+
+-- warning_thresholds
+create table if not exists warning_thresholds (
+    points integer not null primary key,
+    suspend_days integer not null
+);
+
+-- maintenance_windows
+create table if not exists maintenance_windows (
+    id integer primary key autoincrement,
+    starts_at text not null,
+    ends_at text not null,
+    message text not null,
+    created_by text not null,
+    foreign key(created_by) references users(uuid)
+);
+
+-- ban_appeals
+create table if not exists ban_appeals (
+    id integer primary key autoincrement,
+    user_uuid text not null,
+    suspended_until text not null,
+    message text not null,
+    status text not null default 'pending',
+    decided_by text,
+    decision_reason text not null default '',
+    created_at text not null,
+    decided_at text not null default '',
+    unique(user_uuid, suspended_until),
+    foreign key(user_uuid) references users(uuid),
+    foreign key(decided_by) references users(uuid)
+);
+
+-- login_tokens
+create table if not exists login_tokens (
+    token_hash text primary key,
+    user_uuid text not null,
+    expires_at text not null,
+    used_at text not null default '',
+    foreign key(user_uuid) references users(uuid)
+);
+
+-- data_exports
+create table if not exists data_exports (
+    id integer primary key autoincrement,
+    user_uuid text not null,
+    status text not null default 'pending',
+    file text not null default '',
+    created_at text not null,
+    completed_at text not null default '',
+    foreign key(user_uuid) references users(uuid)
+);
+
+-- post_translations
+create table if not exists post_translations (
+    post_id integer not null,
+    lang text not null,
+    title text not null,
+    content text not null,
+    provider text not null,
+    source_edited_at text not null,
+    primary key(post_id, lang),
+    foreign key(post_id) references posts(id)
+);
+
+-- post_summaries
+create table if not exists post_summaries (
+    post_id integer primary key,
+    summary text not null,
+    provider text not null,
+    comment_count integer not null,
+    created_at text not null,
+    foreign key(post_id) references posts(id)
+);
+
+-- federation_keys
+create table if not exists federation_keys (
+    id integer primary key check (id = 1),
+    private_key text not null
+);
+
+-- federation_followers
+create table if not exists federation_followers (
+    category_id integer not null,
+    actor text not null,
+    inbox text not null,
+    followed_at text not null,
+    primary key(category_id, actor),
+    foreign key(category_id) references categories(id)
+);
+
+-- federation_published
+create table if not exists federation_published (
+    post_id integer primary key,
+    published_at text not null,
+    foreign key(post_id) references posts(id)
+);
+
+-- import_mappings
+create table if not exists import_mappings (
+    source text not null,
+    kind text not null,
+    external_id text not null,
+    local_id text not null,
+    primary key(source, kind, external_id)
+);
+
+-- post_images
+create table if not exists post_images (
+    id integer primary key autoincrement,
+    post_id integer not null,
+    file text not null unique,
+    uploader_uuid text not null,
+    created_at text not null,
+    foreign key(post_id) references posts(id),
+    foreign key(uploader_uuid) references users(uuid)
+);
+
+-- post_attachments
+create table if not exists post_attachments (
+    id integer primary key autoincrement,
+    post_id integer not null,
+    file text not null unique,
+    name text not null,
+    size integer not null,
+    uploader_uuid text not null,
+    created_at text not null,
+    foreign key(post_id) references posts(id),
+    foreign key(uploader_uuid) references users(uuid)
+);
+
+-- reply_snippets
+create table if not exists reply_snippets (
+    id integer primary key autoincrement,
+    title text not null,
+    body text not null,
+    author_uuid text not null,
+    updated_at text not null,
+    foreign key(author_uuid) references users(uuid)
+);
+
+-- category_announcements
+create table if not exists category_announcements (
+    category_id integer not null,
+    post_id integer not null,
+    created_by text not null,
+    created_at text not null,
+    primary key(category_id, post_id),
+    foreign key(category_id) references categories(id),
+    foreign key(post_id) references posts(id),
+    foreign key(created_by) references users(uuid)
+);
+
+-- post_views remembers who has viewed each post today, so a session is
+-- counted once per post per day
+create table if not exists post_views (
+    post_id integer not null,
+    viewer text not null,
+    day text not null,
+    primary key(post_id, viewer, day)
+);
+
+-- link_clicks counts clicks on external links in posts and their comments
+create table if not exists link_clicks (
+    post_id integer not null,
+    url text not null,
+    clicks integer not null default 0,
+    last_clicked_at text not null,
+    primary key(post_id, url),
+    foreign key(post_id) references posts(id)
+);
+
+-- post_pins keeps posts atop a category's listing, or atop every listing
+-- they appear in for category_id 0
+create table if not exists post_pins (
+    category_id integer not null,
+    post_id integer not null,
+    pinned_by text not null,
+    created_at text not null,
+    primary key(category_id, post_id),
+    foreign key(post_id) references posts(id),
+    foreign key(pinned_by) references users(uuid)
+);
+
+-- mod_digests records when each staff member was last sent the moderation digest
+create table if not exists mod_digests (
+    user_uuid text primary key,
+    sent_at text not null,
+    foreign key(user_uuid) references users(uuid)
+);
+
+-- post_revisions keeps the title and body of a post after every edit. The
+-- first row is the version from before the first edit.
+create table if not exists post_revisions (
+    id integer primary key autoincrement,
+    post_id integer not null,
+    title text not null,
+    content text not null,
+    editor_uuid text not null,
+    created_at text not null,
+    foreign key(post_id) references posts(id),
+    foreign key(editor_uuid) references users(uuid)
+);
+
+-- bookmarks are posts users saved to come back to
+create table if not exists bookmarks (
+    user_uuid text not null,
+    post_id integer not null,
+    created_at text not null,
+    primary key(user_uuid, post_id),
+    foreign key(user_uuid) references users(uuid),
+    foreign key(post_id) references posts(id)
+);
+
+-- post subscriptions record who watches a thread for new comments.
+-- watching = 0 remembers someone who stopped, so commenting again doesn't
+-- subscribe them anew. Authors watch their posts without a row.
+create table if not exists post_subscriptions (
+    post_id integer not null,
+    user_uuid text not null,
+    watching boolean not null default 1,
+    created_at text not null,
+    primary key(post_id, user_uuid),
+    foreign key(post_id) references posts(id),
+    foreign key(user_uuid) references users(uuid)
+);
+
+-- reports flag posts and comments for moderators, at most one open report
+-- per reporter and post or comment. comment_id is 0 for reports of the
+-- post itself.
+create table if not exists reports (
+    id integer primary key autoincrement,
+    post_id integer not null,
+    comment_id integer not null default 0,
+    reporter_uuid text not null,
+    reason text not null,
+    details text not null default '',
+    status text not null default 'open',
+    resolved_by text,
+    resolution text not null default '',
+    created_at text not null,
+    resolved_at text not null default '',
+    foreign key(post_id) references posts(id),
+    foreign key(reporter_uuid) references users(uuid),
+    foreign key(resolved_by) references users(uuid)
+);
+create index if not exists idx_reports_status on reports(status, post_id);
+
+-- polls are attached to posts, at most one each
+create table if not exists polls (
+    post_id integer primary key,
+    question text not null,
+    multiple integer not null default 0,
+    closes_at text not null default '',
+    created_at text not null,
+    foreign key(post_id) references posts(id)
+);
+
+create table if not exists poll_options (
+    id integer primary key autoincrement,
+    post_id integer not null,
+    position integer not null,
+    label text not null,
+    foreign key(post_id) references polls(post_id)
+);
+
+-- poll_votes holds one row per chosen option, so a multiple choice vote
+-- spans several rows
+create table if not exists poll_votes (
+    post_id integer not null,
+    option_id integer not null,
+    user_uuid text not null,
+    created_at text not null,
+    primary key(option_id, user_uuid),
+    foreign key(option_id) references poll_options(id),
+    foreign key(user_uuid) references users(uuid)
+);
+create index if not exists idx_poll_votes_user on poll_votes(post_id, user_uuid);
+
+-- moved_posts are notices a category shows for a while after a post was
+-- moved out of it
+create table if not exists moved_posts (
+    category_id integer not null,
+    post_id integer not null,
+    to_category_id integer not null,
+    moved_by text not null,
+    created_at text not null,
+    primary key(category_id, post_id),
+    foreign key(category_id) references categories(id),
+    foreign key(post_id) references posts(id),
+    foreign key(to_category_id) references categories(id),
+    foreign key(moved_by) references users(uuid)
+);
+
+-- post_merges record posts merged into another, with the comments and
+-- reactions that were moved, so a merge can be undone for a while
+create table if not exists post_merges (
+    id integer primary key autoincrement,
+    source_id integer not null,
+    target_id integer not null,
+    merged_by text not null,
+    created_at text not null,
+    undone_at text not null default '',
+    foreign key(source_id) references posts(id),
+    foreign key(target_id) references posts(id),
+    foreign key(merged_by) references users(uuid)
+);
+
+create index if not exists idx_post_merges_source on post_merges(source_id, undone_at);
+create index if not exists idx_post_merges_target on post_merges(target_id, undone_at);
+
+create table if not exists post_merge_items (
+    merge_id integer not null,
+    kind text not null,
+    item_id integer not null,
+    primary key(merge_id, kind, item_id),
+    foreign key(merge_id) references post_merges(id)
+);
+
+-- category_templates are the bodies new posts in a category start from.
+-- required lists the section headings a post must fill in, one per line.
+create table if not exists category_templates (
+    category_id integer primary key,
+    body text not null,
+    required text not null default '',
+    foreign key(category_id) references categories(id)
+);
+
+-- post_coauthors are users invited to co-author a post. accepted_at stays
+-- empty until the invitee accepts.
+create table if not exists post_coauthors (
+    post_id integer not null,
+    user_uuid text not null,
+    invited_by text not null,
+    created_at text not null,
+    accepted_at text not null default '',
+    primary key(post_id, user_uuid),
+    foreign key(post_id) references posts(id),
+    foreign key(user_uuid) references users(uuid),
+    foreign key(invited_by) references users(uuid)
+);
+
+create index if not exists idx_post_coauthors_user on post_coauthors(user_uuid, accepted_at);
+
+-- Link previews cache what bare URLs in posts point to. Post pages ask
+-- for them by setting requested_at and the link-previews job fetches them.
+create table if not exists link_previews (
+    id integer primary key autoincrement,
+    url text not null unique,
+    title text not null default '',
+    description text not null default '',
+    image text not null default '',
+    status text not null default 'pending',
+    fetched_at text not null default '',
+    requested_at text not null
+);
+
+create index if not exists idx_link_previews_status on link_previews(status, requested_at);
+
+-- mentions record the users a post or comment @mentions. comment_id is 0
+-- for mentions in the post itself.
+create table if not exists mentions (
+    post_id integer not null,
+    comment_id integer not null default 0,
+    user_uuid text not null,
+    author_uuid text not null,
+    created_at text not null,
+    primary key(post_id, comment_id, user_uuid),
+    foreign key(post_id) references posts(id),
+    foreign key(user_uuid) references users(uuid)
+);
+
+create index if not exists idx_mentions_user on mentions(user_uuid, created_at);
+
+-- reactions are emoji reactions to posts and comments, at most one of each
+-- emoji per user. comment_id is 0 for reactions to the post itself.
+create table if not exists reactions (
+    post_id integer not null,
+    comment_id integer not null default 0,
+    user_uuid text not null,
+    emoji text not null,
+    created_at text not null,
+    primary key(post_id, comment_id, user_uuid, emoji),
+    foreign key(post_id) references posts(id),
+    foreign key(user_uuid) references users(uuid)
+);
+
+-- comment_drafts hold the comment a user was writing on a post, so it is
+-- still there when they come back. Stale drafts are purged.
+create table if not exists comment_drafts (
+    post_id integer not null,
+    user_uuid text not null,
+    content text not null,
+    updated_at text not null,
+    primary key(post_id, user_uuid),
+    foreign key(post_id) references posts(id),
+    foreign key(user_uuid) references users(uuid)
+);
+
+-- notifications tell users about comments on, replies to, likes of and
+-- mentions of what they wrote, comments on posts they watch and warnings.
+-- comment_id is 0 when it is about the post, and post_id is null for warnings.
+create table if not exists notifications (
+    id integer primary key autoincrement,
+    user_uuid text not null,
+    kind text not null,
+    actor_uuid text not null,
+    post_id integer,
+    comment_id integer not null default 0,
+    created_at text not null,
+    read_at text not null default '',
+    -- email is set for notifications to be emailed as well
+    email boolean not null default 0,
+    emailed_at text not null default '',
+    foreign key(user_uuid) references users(uuid),
+    foreign key(actor_uuid) references users(uuid),
+    foreign key(post_id) references posts(id)
+);
+
+create index if not exists idx_notifications_user on notifications(user_uuid, read_at);
+
+-- notification actors are everyone gathered into a batched notification,
+-- like all who liked a comment since its author last looked
+create table if not exists notification_actors (
+    notification_id integer not null,
+    actor_uuid text not null,
+    created_at text not null,
+    primary key(notification_id, actor_uuid),
+    foreign key(notification_id) references notifications(id),
+    foreign key(actor_uuid) references users(uuid)
+);
+
+-- notification digests record when each user was last sent their digest
+-- of unread notifications and top posts
+create table if not exists notification_digests (
+    user_uuid text primary key,
+    sent_at text not null,
+    foreign key(user_uuid) references users(uuid)
+);
 
+-- activity indexes
+create index if not exists idx_posts_created_at on posts(created_at);
+create index if not exists idx_comments_created_at on comments(created_at);
+create index if not exists idx_interactions_created_at on interactions(created_at);
@@ -0,0 +1,46 @@
+// Saves what is typed in textareas marked data-draft to the URL it names,
+// a moment after typing stops, so an unsent comment survives leaving the
+// page. The server fills the draft back in when the page is opened again.
+(function () {
+    for (const textarea of document.querySelectorAll('textarea[data-draft]')) {
+        const status = document.createElement('span');
+        status.className = 'muted draft-status';
+        textarea.after(status);
+
+        let timer;
+        let saved = textarea.value;
+
+        function save() {
+            clearTimeout(timer);
+            const content = textarea.value;
+            if (content === saved) {
+                return;
+            }
+            fetch(textarea.dataset.draft, {
+                method: 'POST',
+                credentials: 'same-origin',
+                keepalive: true,
+                body: new URLSearchParams({ content: content }),
+            })
+                .then((res) => (res.ok ? res.json() : Promise.reject(res)))
+                .then(() => {
+                    saved = content;
+                    status.textContent = content ? 'Draft saved' : '';
+                })
+                .catch(() => {
+                    status.textContent = 'Draft not saved';
+                });
+        }
+
+        textarea.addEventListener('input', () => {
+            clearTimeout(timer);
+            timer = setTimeout(save, 1000);
+        });
+        window.addEventListener('pagehide', save);
+        // Posting the comment discards the draft on the server
+        textarea.form.addEventListener('submit', () => {
+            clearTimeout(timer);
+            saved = textarea.value;
+        });
+    }
+})();
@@ -0,0 +1,34 @@
+// Keeps the unread notification badge on links marked data-unread-count
+// current by polling the server while the page is in view. Links that
+// start hidden, as in the shared header, are shown once a count comes back,
+// so visitors who aren't logged in never see them.
+(function () {
+    const links = document.querySelectorAll('a[data-unread-count]');
+    if (links.length === 0) {
+        return;
+    }
+    const interval = 60 * 1000;
+
+    function render(unread) {
+        for (const link of links) {
+            const badge = link.querySelector('.badge');
+            badge.textContent = unread;
+            badge.hidden = unread === 0;
+            link.hidden = false;
+        }
+    }
+
+    function poll() {
+        if (document.visibilityState !== 'visible') {
+            return;
+        }
+        fetch('/notifications/unread', { credentials: 'same-origin' })
+            .then((res) => (res.ok ? res.json() : Promise.reject(res)))
+            .then((data) => render(data.unread))
+            .catch(() => {});
+    }
+
+    poll();
+    setInterval(poll, interval);
+    document.addEventListener('visibilitychange', poll);
+})();
@@ -0,0 +1,44 @@
+// Adds a Preview button under every textarea marked data-preview. The
+// server renders the Markdown, so the preview matches what gets posted;
+// data-preview="comment" previews it with the comment feature set.
+(function () {
+    for (const textarea of document.querySelectorAll('textarea[data-preview]')) {
+        const button = document.createElement('button');
+        button.type = 'button';
+        button.className = 'small-btn';
+        button.textContent = 'Preview';
+
+        const preview = document.createElement('div');
+        preview.className = 'post-content markdown preview-box';
+        preview.hidden = true;
+
+        button.addEventListener('click', () => {
+            if (!preview.hidden) {
+                preview.hidden = true;
+                textarea.hidden = false;
+                button.textContent = 'Preview';
+                return;
+            }
+            fetch('/post/preview', {
+                method: 'POST',
+                credentials: 'same-origin',
+                body: new URLSearchParams({ content: textarea.value, kind: textarea.dataset.preview }),
+            })
+                .then((res) => (res.ok ? res.text() : Promise.reject(res)))
+                .then((html) => {
+                    // The fragment comes from the server's Markdown renderer,
+                    // which escapes everything it doesn't produce itself
+                    preview.innerHTML = html || '<p class="muted">Nothing to preview.</p>';
+                    preview.hidden = false;
+                    textarea.hidden = true;
+                    button.textContent = 'Edit';
+                })
+                .catch(() => {
+                    preview.innerHTML = '<p class="muted">Preview failed.</p>';
+                    preview.hidden = false;
+                });
+        });
+
+        textarea.after(button, preview);
+    }
+})();
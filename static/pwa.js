@@ -0,0 +1,9 @@
+// Registers the service worker so the forum can be installed and shows an
+// offline page instead of the browser's error when the network is down
+if ('serviceWorker' in navigator) {
+    window.addEventListener('load', () => {
+        navigator.serviceWorker.register('/sw.js').catch((err) => {
+            console.warn('Service worker registration failed:', err);
+        });
+    });
+}
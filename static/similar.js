@@ -0,0 +1,67 @@
+// Suggests existing discussions while the title of a new post is typed, so
+// people can join one instead of starting a duplicate
+(function () {
+    const title = document.getElementById('title');
+    const list = document.getElementById('similar-posts');
+    if (!title || !list) {
+        return;
+    }
+
+    let timer;
+    let last = '';
+
+    function render(posts) {
+        list.replaceChildren();
+        if (posts.length === 0) {
+            list.hidden = true;
+            return;
+        }
+        const heading = document.createElement('p');
+        heading.className = 'muted';
+        heading.textContent = 'Similar discussions already exist. Maybe join one of these?';
+        list.append(heading);
+        const ul = document.createElement('ul');
+        ul.className = 'result-list';
+        for (const post of posts) {
+            const li = document.createElement('li');
+            li.className = 'result-item';
+            const link = document.createElement('a');
+            link.href = post.url;
+            link.target = '_blank';
+            link.textContent = post.title;
+            const meta = document.createElement('span');
+            meta.className = 'muted';
+            meta.textContent = ' by ' + post.author + ' · ' + post.comments + (post.comments === 1 ? ' comment' : ' comments');
+            li.append(link, meta);
+            ul.append(li);
+        }
+        list.append(ul);
+        list.hidden = false;
+    }
+
+    function lookup() {
+        const text = title.value.trim();
+        if (text === last) {
+            return;
+        }
+        last = text;
+        if (text.length < 3) {
+            render([]);
+            return;
+        }
+        fetch('/post/similar?title=' + encodeURIComponent(text), { credentials: 'same-origin' })
+            .then((res) => (res.ok ? res.json() : { posts: [] }))
+            .then((data) => {
+                // Ignore answers that arrive after the title changed again
+                if (text === last) {
+                    render(data.posts || []);
+                }
+            })
+            .catch(() => render([]));
+    }
+
+    title.addEventListener('input', () => {
+        clearTimeout(timer);
+        timer = setTimeout(lookup, 300);
+    });
+})();
@@ -0,0 +1,30 @@
+// Service worker: pages always come from the network, since they are
+// personal and change constantly. When the network is down, navigations
+// fall back to the cached offline page.
+const CACHE = 'forum-offline-v1';
+const OFFLINE_URL = '/offline';
+const PRECACHE = [OFFLINE_URL, '/static/styles.css', '/static/icons/icon-192.png'];
+
+self.addEventListener('install', (event) => {
+    event.waitUntil(caches.open(CACHE).then((cache) => cache.addAll(PRECACHE)));
+    self.skipWaiting();
+});
+
+self.addEventListener('activate', (event) => {
+    event.waitUntil(
+        caches.keys().then((keys) =>
+            Promise.all(keys.filter((key) => key !== CACHE).map((key) => caches.delete(key)))
+        ).then(() => self.clients.claim())
+    );
+});
+
+self.addEventListener('fetch', (event) => {
+    if (event.request.mode === 'navigate') {
+        event.respondWith(fetch(event.request).catch(() => caches.match(OFFLINE_URL)));
+        return;
+    }
+    // The offline page's own assets are served from the cache when offline
+    if (PRECACHE.includes(new URL(event.request.url).pathname)) {
+        event.respondWith(fetch(event.request).catch(() => caches.match(event.request)));
+    }
+});
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -17,18 +18,35 @@ var db *DataBase
 
 // DBInitialize connects to SQLite
 func DBInitialize(dataSourceName string) (*DataBase, error) {
-	conn, err := sql.Open("sqlite3", "./"+dataSourceName+".db")
+	path := "./" + dataSourceName + ".db"
+	conn, err := sql.Open("sqlite3", path)
 	if err != nil {
 		return nil, err
 	}
 	if err := conn.Ping(); err != nil {
 		return nil, err
 	}
-	db = &DataBase{Conn: conn}
+	db = &DataBase{Conn: conn, Path: path}
+	// ✅ Bring tables from older databases up to date
+	if err := db.MigrateColumns(); err != nil {
+		fmt.Println("Error migrating tables:", err)
+	}
+	if err := db.MigrateNotificationPosts(); err != nil {
+		fmt.Println("Error migrating notifications:", err)
+	}
 	// ✅ Ensure the users table exists
 	if err := db.ExecuteSQLFile("sql/tables.sql"); err != nil {
 		fmt.Println("Error initializing tables:", err)
 	}
+	if err := db.MigrateAvatarKeys(); err != nil {
+		fmt.Println("Error migrating avatar keys:", err)
+	}
+	if err := db.MigratePreferences(); err != nil {
+		fmt.Println("Error migrating preferences:", err)
+	}
+	if err := db.SetupSearchIndex(); err != nil {
+		fmt.Println("Error setting up the search index:", err)
+	}
 	return db, nil
 }
 
@@ -65,6 +83,158 @@ func (db *DataBase) ExecuteSQLFile(filepath string) error {
 	return nil
 }
 
+// columnMigrations lists columns added to tables after they were first created.
+// "create table if not exists" skips existing tables, so these are added by hand.
+var columnMigrations = []struct {
+	Table      string
+	Column     string
+	Definition string
+}{
+	{"users", "role", "text not null default 'user'"},
+	{"posts", "created_at", "text not null default ''"},
+	{"comments", "created_at", "text not null default ''"},
+	{"interactions", "created_at", "text not null default ''"},
+	{"users", "suspendeduntil", "text not null default ''"},
+	{"posts", "edited_at", "text not null default ''"},
+	{"posts", "deleted_at", "text not null default ''"},
+	{"posts", "deleted_by", "text not null default ''"},
+	{"posts", "status", "text not null default 'published'"},
+	{"categories", "position", "integer not null default 0"},
+	{"categories", "parent_id", "integer not null default 0"},
+	{"posts", "views", "integer not null default 0"},
+	{"posts", "locked_at", "text not null default ''"},
+	{"posts", "nsfw", "integer not null default 0"},
+	{"posts", "spoiler", "integer not null default 0"},
+	{"users", "dormant_warned_at", "text not null default ''"},
+	{"users", "dormant_locked_at", "text not null default ''"},
+	{"users", "anonymized_at", "text not null default ''"},
+	{"posts", "archived_at", "text not null default ''"},
+	{"comments", "parent_comment_id", "integer not null default 0"},
+	{"reports", "comment_id", "integer not null default 0"},
+	{"categories", "qa", "integer not null default 0"},
+	{"posts", "accepted_comment_id", "integer not null default 0"},
+	{"comments", "edited_at", "text not null default ''"},
+	{"comments", "deleted_at", "text not null default ''"},
+	{"comments", "hidden_at", "text not null default ''"},
+	{"notifications", "email", "boolean not null default 0"},
+	{"notifications", "emailed_at", "text not null default ''"},
+	{"users", "avatarkey", "text not null default ''"},
+}
+
+// MigrateColumns adds any missing columnMigrations to tables that already exist
+func (db *DataBase) MigrateColumns() error {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	for _, m := range columnMigrations {
+		rows, err := db.Conn.Query(fmt.Sprintf("PRAGMA table_info(%s)", m.Table))
+		if err != nil {
+			return err
+		}
+
+		tableExists, columnExists := false, false
+		for rows.Next() {
+			var (
+				cid, notnull, pk int
+				name, ctype      string
+				dflt             sql.NullString
+			)
+			if err := rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err != nil {
+				rows.Close()
+				return err
+			}
+			tableExists = true
+			if name == m.Column {
+				columnExists = true
+			}
+		}
+		rows.Close()
+
+		// New tables are created with the column by tables.sql
+		if !tableExists || columnExists {
+			continue
+		}
+
+		stmt := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", m.Table, m.Column, m.Definition)
+		if _, err := db.Conn.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to add column %s.%s: %w", m.Table, m.Column, err)
+		}
+	}
+
+	return nil
+}
+
+// MigrateNotificationPosts lets notifications.post_id be NULL, for
+// notifications about no post like warnings. SQLite can't drop a NOT NULL
+// constraint, so a table from before is copied into a new one, and
+// tables.sql then recreates its index.
+func (db *DataBase) MigrateNotificationPosts() error {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	ctx := context.Background()
+	conn, err := db.Conn.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var notNull bool
+	err = conn.QueryRowContext(ctx, `SELECT "notnull" FROM pragma_table_info('notifications') WHERE name = 'post_id'`).Scan(&notNull)
+	if errors.Is(err, sql.ErrNoRows) || err == nil && !notNull {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// The old table can only be dropped with foreign keys off, and they
+	// can't be switched inside a transaction
+	var foreignKeys bool
+	if err := conn.QueryRowContext(ctx, "PRAGMA foreign_keys").Scan(&foreignKeys); err != nil {
+		return err
+	}
+	if foreignKeys {
+		if _, err := conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF"); err != nil {
+			return err
+		}
+		defer conn.ExecContext(ctx, "PRAGMA foreign_keys = ON")
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range []string{
+		`CREATE TABLE notifications_new (
+			id integer primary key autoincrement,
+			user_uuid text not null,
+			kind text not null,
+			actor_uuid text not null,
+			post_id integer,
+			comment_id integer not null default 0,
+			created_at text not null,
+			read_at text not null default '',
+			email boolean not null default 0,
+			emailed_at text not null default '',
+			foreign key(user_uuid) references users(uuid),
+			foreign key(actor_uuid) references users(uuid),
+			foreign key(post_id) references posts(id)
+		)`,
+		`INSERT INTO notifications_new (id, user_uuid, kind, actor_uuid, post_id, comment_id, created_at, read_at, email, emailed_at)
+		SELECT id, user_uuid, kind, actor_uuid, post_id, comment_id, created_at, read_at, email, emailed_at FROM notifications`,
+		"DROP TABLE notifications",
+		"ALTER TABLE notifications_new RENAME TO notifications",
+	} {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("failed to migrate notifications: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
 // flattenStruct recursively flattens a struct into column names and values
 // It skips unexported fields and ID if it's zero (to allow AUTOINCREMENT)
 func flattenStruct(data interface{}) ([]string, []interface{}) {
@@ -142,19 +312,13 @@ func (db *DataBase) CheckSession(w http.ResponseWriter, uuid string) error {
 		return fmt.Errorf("database error: %w", err)
 	}
 
-	// Try parsing lastseen using RFC3339 format (e.g. "2025-08-26T22:08:38+03:00")
-	lastseen, err := time.Parse(time.RFC3339, lastseenStr)
+	lastseen, err := ParseTimestamp(lastseenStr)
 	if err != nil {
-		// If RFC3339 parsing fails, try the alternative layout with space separator
-		const layout = "2006-01-02 15:04:05.999999999Z07:00"
-		lastseen, err = time.Parse(layout, lastseenStr)
-		if err != nil {
-			return fmt.Errorf("invalid timestamp format in database: %w", err)
-		}
+		return fmt.Errorf("invalid timestamp format in database: %w", err)
 	}
 
 	// Check if session has timed out
-	if time.Since(lastseen) > SessionTimeout {
+	if Now().Sub(lastseen) > SessionTimeout {
 		ClearUserCookie(w)
 		db.DeleteUser(uuid)
 		return errors.New("session timeout")
@@ -163,8 +327,31 @@ func (db *DataBase) CheckSession(w http.ResponseWriter, uuid string) error {
 	return nil
 }
 
+// ParseTimestamp parses a timestamp stored in the database.
+// Values are written as RFC3339 (e.g. "2025-08-26T22:08:38+03:00"), but the
+// driver may hand back time.Time columns with a space separator instead.
+func ParseTimestamp(value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		const layout = "2006-01-02 15:04:05.999999999Z07:00"
+		t, err = time.Parse(layout, value)
+	}
+	return t, err
+}
+
+// Timestamp formats the current time for storage. Times are kept in UTC so
+// that stored values sort and compare correctly as strings.
+func Timestamp() string {
+	return FormatTimestamp(Now())
+}
+
+// FormatTimestamp formats t the same way Timestamp does
+func FormatTimestamp(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
 func (db *DataBase) RefreshSession(uuid string) error {
 	query := "UPDATE users SET lastseen = ? WHERE uuid = ?"
-	_, err := db.Conn.Exec(query, time.Now().Format(time.RFC3339), uuid)
+	_, err := db.Conn.Exec(query, Timestamp(), uuid)
 	return err
 }
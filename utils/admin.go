@@ -0,0 +1,31 @@
+package utils
+
+import (
+	"log"
+	"net/http"
+)
+
+// AdminDashboardHandler handles GET /admin, the overview page linking to
+// the admin tools
+func AdminDashboardHandler(w http.ResponseWriter, r *http.Request) {
+	admin, ok := RequireAdmin(w, r)
+	if !ok {
+		return
+	}
+	if r.Method != http.MethodGet {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats, err := LatestStorageStats()
+	if err != nil {
+		// The rest of the dashboard is still useful without the figures
+		log.Println("Failed to collect storage stats:", err)
+	}
+	data := map[string]interface{}{}
+	if stats != nil {
+		data["Storage"] = stats
+		data["CheckedAt"] = stats.CheckedAt.In(db.GetLocationPreference(admin.UUID))
+	}
+	InitTemplate(w, "templates/admin.html", data)
+}
@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// AnnouncementOption is a category of a post that the viewer may announce
+// the post in, and whether it already is an announcement there
+type AnnouncementOption struct {
+	Category  Category
+	Announced bool
+}
+
+// IsCategoryModerator reports whether the user moderates the category
+func (db *DataBase) IsCategoryModerator(uuid string, categoryID int) (bool, error) {
+	var exists bool
+	err := db.Conn.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM category_moderators WHERE category_id = ? AND user_uuid = ?)",
+		categoryID, uuid,
+	).Scan(&exists)
+	return exists, err
+}
+
+// CanModerateCategory reports whether a user may manage a category's
+// announcements: staff everywhere, category moderators in their categories
+func (db *DataBase) CanModerateCategory(user *User, categoryID int) bool {
+	if user.IsStaff() {
+		return true
+	}
+	if user.NotRegistered {
+		return false
+	}
+	ok, err := db.IsCategoryModerator(user.UUID, categoryID)
+	return err == nil && ok
+}
+
+// ListAnnouncementOptions returns the categories of the post the user may
+// announce it in
+func (db *DataBase) ListAnnouncementOptions(user *User, post *Post) ([]AnnouncementOption, error) {
+	var options []AnnouncementOption
+	for _, c := range post.Categories {
+		if !db.CanModerateCategory(user, c.ID) {
+			continue
+		}
+		var announced bool
+		err := db.Conn.QueryRow(
+			"SELECT EXISTS (SELECT 1 FROM category_announcements WHERE category_id = ? AND post_id = ?)",
+			c.ID, post.ID,
+		).Scan(&announced)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, AnnouncementOption{Category: c, Announced: announced})
+	}
+	return options, nil
+}
+
+// SetAnnouncement makes a post an announcement in one of its categories,
+// or turns that off, and records it in the post's history
+func (db *DataBase) SetAnnouncement(post *Post, category *Category, announce bool, actorUUID string) error {
+	inCategory := false
+	for _, c := range post.Categories {
+		inCategory = inCategory || c.ID == category.ID
+	}
+	if !inCategory {
+		return errors.New("the post isn't in that category")
+	}
+
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	action := "announced"
+	if announce {
+		_, err = tx.Exec(
+			`INSERT OR IGNORE INTO category_announcements (category_id, post_id, created_by, created_at)
+			VALUES (?, ?, ?, ?)`,
+			category.ID, post.ID, actorUUID, Timestamp(),
+		)
+	} else {
+		action = "unannounced"
+		_, err = tx.Exec("DELETE FROM category_announcements WHERE category_id = ? AND post_id = ?", category.ID, post.ID)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := recordPostHistory(tx, post.ID, actorUUID, action, "in "+category.Name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AnnouncePostHandler handles POST /post/announce
+// The form sends post_id, category_id and announce=1 to pin the post atop
+// the category or 0 to unpin it.
+func AnnouncePostHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	postID, err1 := strconv.Atoi(r.FormValue("post_id"))
+	categoryID, err2 := strconv.Atoi(r.FormValue("category_id"))
+	if err1 != nil || err2 != nil {
+		RenderError(w, "Invalid post or category", http.StatusBadRequest)
+		return
+	}
+	post, err := db.GetPost(postID)
+	if err != nil || post.IsDeleted() || post.IsDraft() || post.IsMerged() {
+		RenderError(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	category, err := db.GetCategory(categoryID)
+	if err != nil {
+		RenderError(w, "Category not found", http.StatusNotFound)
+		return
+	}
+	if !db.CanModerateCategory(user, category.ID) {
+		RenderError(w, "Only moderators of this category can manage its announcements", http.StatusForbidden)
+		return
+	}
+
+	if err := db.SetAnnouncement(post, category, r.FormValue("announce") == "1", user.UUID); err != nil {
+		RenderError(w, "Failed to update announcement: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/post/"+strconv.Itoa(post.ID), http.StatusSeeOther)
+}
@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// AcceptedAnswerKarma is the karma an answer earns its author once the
+// question's author accepts it
+const AcceptedAnswerKarma = 15
+
+// IsQuestion reports whether the post is in a Q&A category, where its
+// author can accept an answer
+func (p *Post) IsQuestion() bool {
+	for _, c := range p.Categories {
+		if c.QA {
+			return true
+		}
+	}
+	return false
+}
+
+// AcceptAnswer marks a comment on a post as its accepted answer, replacing
+// any earlier one, or clears it when commentID is 0. It is recorded in the
+// post's history.
+func (db *DataBase) AcceptAnswer(postID, commentID int, actorUUID string) error {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		`UPDATE posts SET accepted_comment_id = ?
+		WHERE id = ? AND accepted_comment_id != ?
+		AND (? = 0 OR EXISTS (SELECT 1 FROM comments WHERE id = ? AND post_id = ?))`,
+		commentID, postID, commentID, commentID, commentID, postID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if commentID == 0 {
+			return errors.New("no answer is accepted")
+		}
+		return errors.New("that comment isn't an answer to this post, or is already accepted")
+	}
+
+	action, details := "accepted", "comment "+strconv.Itoa(commentID)+" as the answer"
+	if commentID == 0 {
+		action, details = "unaccepted", "the answer"
+	}
+	if err := recordPostHistory(tx, postID, actorUUID, action, details); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AcceptAnswerHandler handles POST /post/{id}/accept. The form sends the
+// comment_id to accept, or 0 to take the acceptance back. Only the
+// question's author can accept, and not once the thread is archived.
+func AcceptAnswerHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		RenderError(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	post, err := db.GetPost(id)
+	if err != nil || post.IsDeleted() || post.IsDraft() || post.IsMerged() {
+		RenderError(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	if !post.IsQuestion() || post.Author.UUID != user.UUID {
+		RenderError(w, "Only the author of a question can accept an answer", http.StatusForbidden)
+		return
+	}
+	if post.IsArchived() {
+		RenderError(w, "Archived posts are read-only", http.StatusBadRequest)
+		return
+	}
+
+	commentID, err := strconv.Atoi(r.FormValue("comment_id"))
+	if err != nil {
+		RenderError(w, "Invalid comment", http.StatusBadRequest)
+		return
+	}
+	if err := db.AcceptAnswer(post.ID, commentID, user.UUID); err != nil {
+		RenderError(w, "Failed to accept the answer: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if commentID == 0 {
+		http.Redirect(w, r, "/post/"+strconv.Itoa(post.ID), http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, CommentLink("", post.ID, commentID), http.StatusSeeOther)
+}
@@ -0,0 +1,269 @@
+package utils
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Appeal statuses
+const (
+	AppealPending  = "pending"
+	AppealApproved = "approved"
+	AppealDenied   = "denied"
+)
+
+// DecidedAppealsLimit caps the recent decisions listed under the queue
+const DecidedAppealsLimit = 20
+
+// Suspension describes when the appealed suspension ends
+func (a BanAppeal) Suspension() string {
+	return SuspensionText(a.SuspendedUntil)
+}
+
+// SubmitAppeal files an appeal for a suspended account. Suspended users have
+// no session, so the appeal is authenticated with their credentials instead.
+// Only one appeal can be filed per suspension.
+func (db *DataBase) SubmitAppeal(username, password, message string) error {
+	var uuid, hash, suspended string
+	err := db.Conn.QueryRow(
+		"SELECT uuid, password, suspendeduntil FROM users WHERE username = ? AND notregistered = 0",
+		username,
+	).Scan(&uuid, &hash, &suspended)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errors.New("invalid username or password")
+	}
+	if err != nil {
+		return err
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		return errors.New("invalid username or password")
+	}
+
+	user := User{}
+	user.SuspendedUntil, _ = ParseTimestamp(suspended)
+	if !user.IsSuspended() {
+		return errors.New("this account is not suspended")
+	}
+
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	var exists int
+	err = db.Conn.QueryRow(
+		"SELECT 1 FROM ban_appeals WHERE user_uuid = ? AND suspended_until = ?", uuid, suspended,
+	).Scan(&exists)
+	if err == nil {
+		return errors.New("you have already appealed this suspension")
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	_, err = db.Conn.Exec(
+		"INSERT INTO ban_appeals (user_uuid, suspended_until, message, status, created_at) VALUES (?, ?, ?, ?, ?)",
+		uuid, suspended, message, AppealPending, Timestamp(),
+	)
+	return err
+}
+
+// ListAppeals returns either the pending or the decided appeals. Pending
+// appeals come oldest first so the queue is worked in order; decided ones
+// newest first. A negative limit returns them all.
+func (db *DataBase) ListAppeals(pending bool, limit int) ([]BanAppeal, error) {
+	where, order := "a.status != ?", "a.id DESC"
+	if pending {
+		where, order = "a.status = ?", "a.id"
+	}
+
+	rows, err := db.Conn.Query(
+		`SELECT a.id, u.username, a.suspended_until, a.message, a.status,
+			COALESCE(d.username, ''), a.decision_reason, a.created_at, a.decided_at
+		FROM ban_appeals a
+		JOIN users u ON u.uuid = a.user_uuid
+		LEFT JOIN users d ON d.uuid = a.decided_by
+		WHERE `+where+`
+		ORDER BY `+order+` LIMIT ?`,
+		AppealPending, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var appeals []BanAppeal
+	for rows.Next() {
+		var (
+			a                               BanAppeal
+			suspended, createdAt, decidedAt string
+		)
+		if err := rows.Scan(&a.ID, &a.Username, &suspended, &a.Message, &a.Status,
+			&a.DecidedBy, &a.DecisionReason, &createdAt, &decidedAt); err != nil {
+			return nil, err
+		}
+		a.SuspendedUntil, _ = ParseTimestamp(suspended)
+		a.CreatedAt, _ = ParseTimestamp(createdAt)
+		a.DecidedAt, _ = ParseTimestamp(decidedAt)
+		appeals = append(appeals, a)
+	}
+	return appeals, rows.Err()
+}
+
+// DecideAppeal approves or denies a pending appeal. Approving it lifts the
+// suspension in the same transaction.
+func (db *DataBase) DecideAppeal(id int, staffUUID string, approve bool, reason string) error {
+	status := AppealDenied
+	if approve {
+		status = AppealApproved
+	}
+
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		`UPDATE ban_appeals SET status = ?, decided_by = ?, decision_reason = ?, decided_at = ?
+		WHERE id = ? AND status = ?`,
+		status, staffUUID, reason, Timestamp(), id, AppealPending,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("appeal not found or already decided")
+	}
+
+	if approve {
+		if _, err := tx.Exec(
+			"UPDATE users SET suspendeduntil = '' WHERE uuid = (SELECT user_uuid FROM ban_appeals WHERE id = ?)",
+			id,
+		); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// AppealHandler handles GET and POST /appeal
+func AppealHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		InitTemplate(w, "templates/appeal.html", map[string]bool{"Submitted": false})
+
+	case http.MethodPost:
+		message := strings.TrimSpace(r.FormValue("message"))
+		if message == "" {
+			RenderError(w, "Please explain why the suspension should be lifted", http.StatusBadRequest)
+			return
+		}
+
+		err := db.SubmitAppeal(r.FormValue("username"), r.FormValue("password"), message)
+		if err != nil {
+			RenderError(w, "Appeal not submitted: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		InitTemplate(w, "templates/appeal.html", map[string]bool{"Submitted": true})
+
+	default:
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// AdminAppealsHandler handles GET /admin/appeals
+func AdminAppealsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	staff, ok := RequireStaff(w, r)
+	if !ok {
+		return
+	}
+
+	pending, err := db.ListAppeals(true, -1)
+	if err != nil {
+		RenderError(w, "Failed to load appeals", http.StatusInternalServerError)
+		return
+	}
+	decided, err := db.ListAppeals(false, DecidedAppealsLimit)
+	if err != nil {
+		RenderError(w, "Failed to load appeals", http.StatusInternalServerError)
+		return
+	}
+
+	loc := db.GetLocationPreference(staff.UUID)
+	for _, list := range [][]BanAppeal{pending, decided} {
+		for i := range list {
+			list[i].CreatedAt = list[i].CreatedAt.In(loc)
+			list[i].DecidedAt = list[i].DecidedAt.In(loc)
+			list[i].SuspendedUntil = list[i].SuspendedUntil.In(loc)
+		}
+	}
+
+	snippets, err := db.ListSnippets()
+	if err != nil {
+		RenderError(w, "Failed to load appeals", http.StatusInternalServerError)
+		return
+	}
+
+	InitTemplate(w, "templates/admin_appeals.html", map[string]interface{}{
+		"Pending":  pending,
+		"Decided":  decided,
+		"Snippets": snippets,
+	})
+}
+
+// DecideAppealHandler handles POST /admin/appeals/decide
+func DecideAppealHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	staff, ok := RequireStaff(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		RenderError(w, "Invalid appeal", http.StatusBadRequest)
+		return
+	}
+
+	var username string
+	err = db.Conn.QueryRow(
+		"SELECT u.username FROM ban_appeals a JOIN users u ON u.uuid = a.user_uuid WHERE a.id = ?", id,
+	).Scan(&username)
+	if err != nil {
+		RenderError(w, "Appeal not found", http.StatusNotFound)
+		return
+	}
+
+	approve := r.FormValue("decision") == AppealApproved
+	reason, err := withSnippet(r, strings.TrimSpace(r.FormValue("reason")), username, staff.Username, "")
+	if err != nil {
+		RenderError(w, "Failed to decide appeal: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !approve && reason == "" {
+		RenderError(w, "A reason is required to deny an appeal", http.StatusBadRequest)
+		return
+	}
+
+	if err := db.DecideAppeal(id, staff.UUID, approve, reason); err != nil {
+		RenderError(w, "Failed to decide appeal: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/appeals", http.StatusSeeOther)
+}
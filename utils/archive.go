@@ -0,0 +1,79 @@
+package utils
+
+import "time"
+
+// archiveBatchSize caps how many posts one run of the archive job archives,
+// so the first run on an old forum doesn't hold the write lock for long
+const archiveBatchSize = 200
+
+// postLastActivity is when a post last changed: its latest comment, edit,
+// entry in its history or its creation, for queries where the post is
+// aliased p. History counts so that a thread a moderator unlocks isn't
+// archived again on the next run.
+const postLastActivity = `max(p.created_at, p.edited_at,
+	COALESCE((SELECT MAX(c.created_at) FROM comments c WHERE c.post_id = p.id), ''),
+	COALESCE((SELECT MAX(h.created_at) FROM post_history h WHERE h.post_id = p.id), ''))`
+
+// ArchiveStalePosts archives published posts that have had no new comments,
+// edits or moderation for ArchiveAfterDays. Archived posts are locked and read-only
+// but stay listed and searchable like any other post.
+func ArchiveStalePosts() error {
+	if ArchiveAfterDays <= 0 {
+		return nil
+	}
+	cutoff := FormatTimestamp(Now().Add(-time.Duration(ArchiveAfterDays) * 24 * time.Hour))
+	_, err := db.archivePostsInactiveSince(cutoff, archiveBatchSize)
+	return err
+}
+
+// archivePostsInactiveSince archives up to limit posts with no activity
+// since cutoff and returns how many it archived. Posts locked by hand keep
+// their lock time.
+func (db *DataBase) archivePostsInactiveSince(cutoff string, limit int) (int, error) {
+	rows, err := db.Conn.Query(
+		`SELECT p.id FROM posts p
+		WHERE p.status = ? AND p.deleted_at = '' AND p.archived_at = '' AND `+postLastActivity+` < ?
+		ORDER BY p.id LIMIT ?`,
+		PostPublished, cutoff, limit,
+	)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(ids) == 0 {
+		return 0, err
+	}
+
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// No history entry is recorded: history is kept per user, and
+	// archived_at already says when it happened
+	now := Timestamp()
+	for _, id := range ids {
+		_, err := tx.Exec(
+			`UPDATE posts SET archived_at = ?, locked_at = CASE WHEN locked_at = '' THEN ? ELSE locked_at END
+			WHERE id = ?`,
+			now, now, id,
+		)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(ids), tx.Commit()
+}
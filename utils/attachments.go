@@ -0,0 +1,324 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// AttachmentDir is where files attached to posts are stored
+var AttachmentDir = filepath.Join(UploadDir, "attachments")
+
+// Limits on files attached to posts
+const (
+	MaxAttachmentBytes     = 10 << 20
+	MaxPostAttachmentBytes = 25 << 20
+	maxAttachmentNameRunes = 100
+)
+
+// attachmentType is a kind of file that may be attached to a post. Files
+// must have a listed extension and content that matches it.
+type attachmentType struct {
+	ContentType string
+	Matches     func(data []byte) bool
+}
+
+// attachmentTypes lists the accepted files by extension
+var attachmentTypes = map[string]attachmentType{
+	".pdf": {"application/pdf", func(data []byte) bool {
+		return bytes.HasPrefix(data, []byte("%PDF-"))
+	}},
+	".txt": {"text/plain; charset=utf-8", func(data []byte) bool {
+		return utf8.Valid(data) && bytes.IndexByte(data, 0) < 0
+	}},
+	".zip": {"application/zip", func(data []byte) bool {
+		return bytes.HasPrefix(data, []byte("PK\x03\x04")) || bytes.HasPrefix(data, []byte("PK\x05\x06"))
+	}},
+}
+
+// Attachment is a file attached to a post
+type Attachment struct {
+	ID   int
+	Name string
+	Size int64
+}
+
+// URL is where the attachment is downloaded from
+func (a Attachment) URL() string {
+	return "/attachments/" + strconv.Itoa(a.ID)
+}
+
+// SizeText formats the size for display
+func (a Attachment) SizeText() string {
+	switch {
+	case a.Size >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(a.Size)/(1<<20))
+	case a.Size >= 1<<10:
+		return fmt.Sprintf("%.0f KB", float64(a.Size)/(1<<10))
+	}
+	return fmt.Sprintf("%d bytes", a.Size)
+}
+
+// FileUpload is an uploaded attachment that passed validation but isn't saved yet
+type FileUpload struct {
+	Name string
+	data []byte
+}
+
+// cleanAttachmentName keeps an uploaded file's base name, without control
+// characters and cut to a sensible length
+func cleanAttachmentName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, `\`, "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	ext := filepath.Ext(name)
+	if runes := []rune(strings.TrimSuffix(name, ext)); len(runes) > maxAttachmentNameRunes {
+		name = string(runes[:maxAttachmentNameRunes]) + ext
+	}
+	return name
+}
+
+// ReadFileUploads validates the files uploaded in a form field against
+// attachmentTypes and the size limits
+func ReadFileUploads(r *http.Request, field string) ([]FileUpload, error) {
+	if r.MultipartForm == nil {
+		return nil, nil
+	}
+
+	var (
+		uploads []FileUpload
+		total   int64
+	)
+	for _, fh := range r.MultipartForm.File[field] {
+		if fh.Size == 0 {
+			continue
+		}
+		name := cleanAttachmentName(fh.Filename)
+		t, ok := attachmentTypes[strings.ToLower(filepath.Ext(name))]
+		if !ok {
+			return nil, fmt.Errorf("%s can't be attached; only PDF, TXT and ZIP files can", name)
+		}
+		if fh.Size > MaxAttachmentBytes {
+			return nil, fmt.Errorf("%s is larger than %d MB", name, MaxAttachmentBytes>>20)
+		}
+
+		f, err := fh.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(io.LimitReader(f, MaxAttachmentBytes+1))
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > MaxAttachmentBytes {
+			return nil, fmt.Errorf("%s is larger than %d MB", name, MaxAttachmentBytes>>20)
+		}
+		if !t.Matches(data) {
+			return nil, fmt.Errorf("%s doesn't look like a %s file", name, strings.ToUpper(filepath.Ext(name)[1:]))
+		}
+
+		total += int64(len(data))
+		uploads = append(uploads, FileUpload{Name: name, data: data})
+	}
+	if total > MaxPostAttachmentBytes {
+		return nil, fmt.Errorf("attachments can't add up to more than %d MB", MaxPostAttachmentBytes>>20)
+	}
+	return uploads, nil
+}
+
+// ListPostAttachments returns a post's attachments in upload order
+func (db *DataBase) ListPostAttachments(postID int) ([]Attachment, error) {
+	rows, err := db.Conn.Query("SELECT id, name, size FROM post_attachments WHERE post_id = ? ORDER BY id", postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attachments []Attachment
+	for rows.Next() {
+		var a Attachment
+		if err := rows.Scan(&a.ID, &a.Name, &a.Size); err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, rows.Err()
+}
+
+// savePostAttachments writes uploads to AttachmentDir under random names and
+// attaches them to a post as part of the caller's transaction. Files
+// already written are removed if anything fails.
+func savePostAttachments(ex execer, postID int, uploads []FileUpload, uploaderUUID string) (err error) {
+	if len(uploads) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(AttachmentDir, 0o755); err != nil {
+		return err
+	}
+
+	var written []string
+	defer func() {
+		if err != nil {
+			for _, path := range written {
+				os.Remove(path)
+			}
+		}
+	}()
+
+	for _, up := range uploads {
+		raw := make([]byte, 16)
+		if _, err := rand.Read(raw); err != nil {
+			return err
+		}
+		file := hex.EncodeToString(raw)
+		path := filepath.Join(AttachmentDir, file)
+		if err := os.WriteFile(path, up.data, 0o644); err != nil {
+			return err
+		}
+		written = append(written, path)
+
+		if _, err := ex.Exec(
+			"INSERT INTO post_attachments (post_id, file, name, size, uploader_uuid, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+			postID, file, up.Name, len(up.data), uploaderUUID, Timestamp(),
+		); err != nil {
+			return err
+		}
+	}
+	return recordPostHistory(ex, postID, uploaderUUID, "files attached", strconv.Itoa(len(uploads)))
+}
+
+// UpdatePostAttachments adds uploads to a post and removes the attachments
+// listed in removeIDs, keeping the post within MaxPostAttachmentBytes
+func (db *DataBase) UpdatePostAttachments(postID int, uploads []FileUpload, removeIDs []int, actorUUID string) error {
+	if len(uploads) == 0 && len(removeIDs) == 0 {
+		return nil
+	}
+	current, err := db.ListPostAttachments(postID)
+	if err != nil {
+		return err
+	}
+
+	remove := make(map[int]bool, len(removeIDs))
+	for _, id := range removeIDs {
+		remove[id] = true
+	}
+	var total int64
+	var removed []int
+	for _, a := range current {
+		if remove[a.ID] {
+			removed = append(removed, a.ID)
+		} else {
+			total += a.Size
+		}
+	}
+	for _, up := range uploads {
+		total += int64(len(up.data))
+	}
+	if total > MaxPostAttachmentBytes {
+		return fmt.Errorf("attachments can't add up to more than %d MB", MaxPostAttachmentBytes>>20)
+	}
+
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var files []string
+	for _, id := range removed {
+		var file string
+		if err := tx.QueryRow("DELETE FROM post_attachments WHERE id = ? AND post_id = ? RETURNING file", id, postID).Scan(&file); err != nil {
+			return err
+		}
+		files = append(files, file)
+	}
+	if len(removed) > 0 {
+		if err := recordPostHistory(tx, postID, actorUUID, "files removed", strconv.Itoa(len(removed))); err != nil {
+			return err
+		}
+	}
+	if err := savePostAttachments(tx, postID, uploads, actorUUID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		os.Remove(filepath.Join(AttachmentDir, file))
+	}
+	return nil
+}
+
+// AttachmentHandler handles GET /attachments/{id}. Files are always sent as
+// downloads so a browser never renders them in the forum's origin.
+func AttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		RenderError(w, "File not found", http.StatusNotFound)
+		return
+	}
+	var (
+		postID     int
+		file, name string
+	)
+	err = db.Conn.QueryRow("SELECT post_id, file, name FROM post_attachments WHERE id = ?", id).Scan(&postID, &file, &name)
+	if err != nil {
+		RenderError(w, "File not found", http.StatusNotFound)
+		return
+	}
+	// Files on trashed posts go with them, and drafts' files stay with
+	// their author
+	post, err := db.GetPost(postID)
+	if err != nil || post.IsDeleted() && !CanManagePost(user, post) ||
+		post.IsDraft() && post.Author.UUID != user.UUID {
+		RenderError(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	f, err := os.Open(filepath.Join(AttachmentDir, file))
+	if err != nil {
+		RenderError(w, "File not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		RenderError(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", attachmentTypes[strings.ToLower(filepath.Ext(name))].ContentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
@@ -0,0 +1,207 @@
+package utils
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// auditDateLayout is the date format of the audit export form
+const auditDateLayout = "2006-01-02"
+
+// AuditEntry is one moderation or content event in an audit export
+type AuditEntry struct {
+	Time    string `json:"time"`
+	Kind    string `json:"kind"`
+	Actor   string `json:"actor"`
+	Subject string `json:"subject"`
+	Action  string `json:"action"`
+	Details string `json:"details"`
+}
+
+// AuditRedaction selects what an audit export leaves out
+type AuditRedaction struct {
+	// Actors and Subjects replace usernames with pseudonyms that are
+	// consistent within one export but can't be traced back
+	Actors   bool
+	Subjects bool
+	// Details drops free text such as reasons, notes and appeal messages
+	Details bool
+}
+
+// auditQuery collects every audited record into one timeline. Each part
+// yields time, kind, actor, subject, action and details.
+const auditQuery = `
+	SELECT h.created_at, 'post', COALESCE(a.username, ''), 'post ' || h.post_id, h.action, h.details
+	FROM post_history h LEFT JOIN users a ON a.uuid = h.user_uuid
+	WHERE h.created_at >= ?1 AND h.created_at < ?2
+	UNION ALL
+	SELECT w.created_at, 'warning', COALESCE(a.username, ''), COALESCE(s.username, ''), 'warned (' || w.severity || ')', w.reason
+	FROM warnings w LEFT JOIN users a ON a.uuid = w.issuer_uuid LEFT JOIN users s ON s.uuid = w.user_uuid
+	WHERE w.created_at >= ?1 AND w.created_at < ?2
+	UNION ALL
+	SELECT n.created_at, 'note', COALESCE(a.username, ''), COALESCE(s.username, ''), 'note added', n.note
+	FROM user_notes n LEFT JOIN users a ON a.uuid = n.author_uuid LEFT JOIN users s ON s.uuid = n.user_uuid
+	WHERE n.created_at >= ?1 AND n.created_at < ?2
+	UNION ALL
+	SELECT b.created_at, 'appeal', COALESCE(s.username, ''), COALESCE(s.username, ''), 'appeal submitted', b.message
+	FROM ban_appeals b LEFT JOIN users s ON s.uuid = b.user_uuid
+	WHERE b.created_at >= ?1 AND b.created_at < ?2
+	UNION ALL
+	SELECT b.decided_at, 'appeal', COALESCE(a.username, ''), COALESCE(s.username, ''), 'appeal ' || b.status, b.decision_reason
+	FROM ban_appeals b LEFT JOIN users a ON a.uuid = b.decided_by LEFT JOIN users s ON s.uuid = b.user_uuid
+	WHERE b.decided_at != '' AND b.decided_at >= ?1 AND b.decided_at < ?2
+	UNION ALL
+	SELECT r.created_at, 'report', COALESCE(u.username, ''), 'post ' || r.post_id || CASE WHEN r.comment_id != 0 THEN ' comment ' || r.comment_id ELSE '' END, 'reported (' || r.reason || ')', r.details
+	FROM reports r LEFT JOIN users u ON u.uuid = r.reporter_uuid
+	WHERE r.created_at >= ?1 AND r.created_at < ?2
+	UNION ALL
+	SELECT r.resolved_at, 'report', COALESCE(m.username, ''), 'post ' || r.post_id || CASE WHEN r.comment_id != 0 THEN ' comment ' || r.comment_id ELSE '' END, 'report ' || r.status, r.resolution
+	FROM reports r LEFT JOIN users m ON m.uuid = r.resolved_by
+	WHERE r.resolved_at != '' AND r.resolved_at >= ?1 AND r.resolved_at < ?2
+	ORDER BY 1, 2`
+
+// ListAuditEntries returns the audited events from from up to, but not
+// including, to, oldest first
+func (db *DataBase) ListAuditEntries(from, to time.Time) ([]AuditEntry, error) {
+	rows, err := db.Conn.Query(auditQuery, FormatTimestamp(from), FormatTimestamp(to))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.Time, &e.Kind, &e.Actor, &e.Subject, &e.Action, &e.Details); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// Redact applies the redaction options to entries in place
+func (red AuditRedaction) Redact(entries []AuditEntry) {
+	pseudonyms := make(map[string]string)
+	pseudonym := func(name string) string {
+		if name == "" {
+			return ""
+		}
+		if p, ok := pseudonyms[name]; ok {
+			return p
+		}
+		p := "person-" + strconv.Itoa(len(pseudonyms)+1)
+		pseudonyms[name] = p
+		return p
+	}
+
+	for i := range entries {
+		e := &entries[i]
+		if red.Actors {
+			e.Actor = pseudonym(e.Actor)
+		}
+		// Post and report subjects name a post, not a person
+		if red.Subjects && e.Kind != "post" && e.Kind != "report" {
+			e.Subject = pseudonym(e.Subject)
+		}
+		if red.Details && e.Details != "" {
+			e.Details = "[redacted]"
+		}
+	}
+}
+
+// csvSafe stops spreadsheet programs from running a cell as a formula
+func csvSafe(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// writeAuditCSV writes entries as CSV with a header row
+func writeAuditCSV(w http.ResponseWriter, entries []AuditEntry) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"time", "kind", "actor", "subject", "action", "details"}); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		record := []string{e.Time, e.Kind, e.Actor, e.Subject, e.Action, e.Details}
+		for i := range record {
+			record[i] = csvSafe(record[i])
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// AuditExportHandler handles GET /admin/audit. Without ?from= it shows the
+// export form; with it, it downloads the audit log for the date range.
+func AuditExportHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := RequireAdmin(w, r); !ok {
+		return
+	}
+	if r.Method != http.MethodGet {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	if q.Get("from") == "" {
+		today := Now().UTC().Format(auditDateLayout)
+		InitTemplate(w, "templates/admin_audit.html", map[string]string{
+			"From": Now().UTC().AddDate(0, -1, 0).Format(auditDateLayout),
+			"To":   today,
+		})
+		return
+	}
+
+	// Dates are whole UTC days and the end date is included
+	from, err := time.Parse(auditDateLayout, q.Get("from"))
+	if err != nil {
+		RenderError(w, "Invalid start date", http.StatusBadRequest)
+		return
+	}
+	to, err := time.Parse(auditDateLayout, q.Get("to"))
+	if err != nil {
+		RenderError(w, "Invalid end date", http.StatusBadRequest)
+		return
+	}
+	if to.Before(from) {
+		RenderError(w, "The end date is before the start date", http.StatusBadRequest)
+		return
+	}
+
+	entries, err := db.ListAuditEntries(from, to.AddDate(0, 0, 1))
+	if err != nil {
+		RenderError(w, "Failed to load the audit log", http.StatusInternalServerError)
+		return
+	}
+	AuditRedaction{
+		Actors:   q.Get("redact_actors") != "",
+		Subjects: q.Get("redact_subjects") != "",
+		Details:  q.Get("redact_details") != "",
+	}.Redact(entries)
+	if entries == nil {
+		entries = []AuditEntry{}
+	}
+
+	name := fmt.Sprintf("audit-%s-to-%s", q.Get("from"), q.Get("to"))
+	switch q.Get("format") {
+	case "json":
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.json"`)
+		WriteJSON(w, http.StatusOK, entries)
+	default:
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.csv"`)
+		if err := writeAuditCSV(w, entries); err != nil {
+			RenderError(w, "Failed to write the export", http.StatusInternalServerError)
+		}
+	}
+}
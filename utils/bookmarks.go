@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// IsBookmarked reports whether the user bookmarked the post
+func (db *DataBase) IsBookmarked(uuid string, postID int) (bool, error) {
+	var bookmarked bool
+	err := db.Conn.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM bookmarks WHERE user_uuid = ? AND post_id = ?)", uuid, postID,
+	).Scan(&bookmarked)
+	return bookmarked, err
+}
+
+// CountBookmarks returns how many users bookmarked the post
+func (db *DataBase) CountBookmarks(postID int) (int, error) {
+	var n int
+	err := db.Conn.QueryRow("SELECT COUNT(*) FROM bookmarks WHERE post_id = ?", postID).Scan(&n)
+	return n, err
+}
+
+// ToggleBookmark bookmarks the post for the user, or removes the bookmark
+// if there already is one, and reports whether the post is now bookmarked
+func (db *DataBase) ToggleBookmark(uuid string, postID int) (bool, error) {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	res, err := db.Conn.Exec("DELETE FROM bookmarks WHERE user_uuid = ? AND post_id = ?", uuid, postID)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return false, nil
+	}
+	_, err = db.Conn.Exec(
+		"INSERT INTO bookmarks (user_uuid, post_id, created_at) VALUES (?, ?, ?)", uuid, postID, Timestamp(),
+	)
+	return err == nil, err
+}
+
+// BookmarkHandler handles POST /post/bookmark, toggling the bookmark on the
+// post with the given id
+func BookmarkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if user.NotRegistered {
+		RenderError(w, "Register to bookmark posts", http.StatusForbidden)
+		return
+	}
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		RenderError(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	post, err := db.GetPost(id)
+	if err != nil || post.IsDeleted() || post.IsDraft() || post.IsMerged() {
+		RenderError(w, "Post not found", http.StatusNotFound)
+		return
+	}
+
+	if _, err := db.ToggleBookmark(user.UUID, post.ID); err != nil {
+		RenderError(w, "Failed to update bookmark", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/post/"+strconv.Itoa(post.ID), http.StatusSeeOther)
+}
+
+// BookmarksHandler handles GET /bookmarks, the user's bookmarked posts
+func BookmarksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if user.NotRegistered {
+		RenderError(w, "Register to bookmark posts", http.StatusForbidden)
+		return
+	}
+
+	query := PostQuery{Sort: SortFromRequest(r), Filter: FilterBookmarked, UserUUID: user.UUID}
+	posts, err := db.LoadPostPage(query, PageFromRequest(r), user)
+	if err != nil {
+		log.Println("Failed to load bookmarks:", err)
+		RenderError(w, "Failed to load bookmarks", http.StatusInternalServerError)
+		return
+	}
+	InitTemplate(w, "templates/bookmarks.html", map[string]interface{}{"Posts": posts})
+}
@@ -0,0 +1,797 @@
+package utils
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ListCategories returns categories in the order admins arranged them.
+// Archived categories are only included when includeArchived is true.
+func (db *DataBase) ListCategories(includeArchived bool) ([]Category, error) {
+	query := "SELECT id, name, description, archived, qa, parent_id FROM categories"
+	if !includeArchived {
+		query += " WHERE archived = 0"
+	}
+	query += " ORDER BY position, name COLLATE NOCASE"
+
+	rows, err := db.Conn.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var categories []Category
+	for rows.Next() {
+		var c Category
+		if err := rows.Scan(&c.ID, &c.Name, &c.Description, &c.Archived, &c.QA, &c.ParentID); err != nil {
+			return nil, err
+		}
+		categories = append(categories, c)
+	}
+	return categories, rows.Err()
+}
+
+// GetCategory loads a single category by ID
+func (db *DataBase) GetCategory(id int) (*Category, error) {
+	var c Category
+	err := db.Conn.QueryRow(
+		"SELECT id, name, description, archived, qa, parent_id FROM categories WHERE id = ?", id,
+	).Scan(&c.ID, &c.Name, &c.Description, &c.Archived, &c.QA, &c.ParentID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errors.New("category not found")
+		}
+		return nil, err
+	}
+	return &c, nil
+}
+
+// ListCategoryStats returns the categories like ListCategories, with the
+// number of published posts in each
+func (db *DataBase) ListCategoryStats(includeArchived bool) ([]Category, error) {
+	query := `SELECT c.id, c.name, c.description, c.archived, c.qa, c.parent_id, COUNT(p.id)
+		FROM categories c
+		LEFT JOIN post_categories pc ON pc.category_id = c.id
+		LEFT JOIN posts p ON p.id = pc.post_id AND p.deleted_at = '' AND p.status = ?`
+	if !includeArchived {
+		query += " WHERE c.archived = 0"
+	}
+	query += " GROUP BY c.id ORDER BY c.position, c.name COLLATE NOCASE"
+
+	rows, err := db.Conn.Query(query, PostPublished)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var categories []Category
+	for rows.Next() {
+		var c Category
+		if err := rows.Scan(&c.ID, &c.Name, &c.Description, &c.Archived, &c.QA, &c.ParentID, &c.PostCount); err != nil {
+			return nil, err
+		}
+		categories = append(categories, c)
+	}
+	return categories, rows.Err()
+}
+
+// MaxCategoryDepth bounds how far CategoryPath walks up the tree, in case
+// the parent links ever form a loop
+const MaxCategoryDepth = 32
+
+// CategoryTree nests a flat list of categories under their parents, keeping
+// the list's order among siblings. Categories whose parent isn't in the list
+// become roots.
+func CategoryTree(categories []Category) []Category {
+	present := make(map[int]bool, len(categories))
+	children := make(map[int][]Category)
+	for _, c := range categories {
+		present[c.ID] = true
+	}
+	var roots []Category
+	for _, c := range categories {
+		if c.ParentID != 0 && c.ParentID != c.ID && present[c.ParentID] {
+			children[c.ParentID] = append(children[c.ParentID], c)
+		} else {
+			roots = append(roots, c)
+		}
+	}
+
+	var attach func(list []Category, depth int) []Category
+	attach = func(list []Category, depth int) []Category {
+		if depth > MaxCategoryDepth {
+			return list
+		}
+		for i := range list {
+			list[i].Children = attach(children[list[i].ID], depth+1)
+		}
+		return list
+	}
+	return attach(roots, 0)
+}
+
+// CategoryPath returns a category and its ancestors, outermost first, for
+// breadcrumbs
+func (db *DataBase) CategoryPath(id int) ([]Category, error) {
+	var path []Category
+	seen := make(map[int]bool)
+	for id != 0 && !seen[id] && len(path) < MaxCategoryDepth {
+		seen[id] = true
+		c, err := db.GetCategory(id)
+		if err != nil {
+			return nil, err
+		}
+		path = append([]Category{*c}, path...)
+		id = c.ParentID
+	}
+	return path, nil
+}
+
+// ListSubcategories returns the direct children of a category
+func (db *DataBase) ListSubcategories(id int, includeArchived bool) ([]Category, error) {
+	all, err := db.ListCategoryStats(includeArchived)
+	if err != nil {
+		return nil, err
+	}
+	var children []Category
+	for _, c := range all {
+		if c.ParentID == id && c.ID != id {
+			children = append(children, c)
+		}
+	}
+	return children, nil
+}
+
+// checkCategoryParent fails unless parentID is 0 or an existing category
+// that isn't id itself or one of its descendants
+func (db *DataBase) checkCategoryParent(id, parentID int) error {
+	if parentID == 0 {
+		return nil
+	}
+	path, err := db.CategoryPath(parentID)
+	if err != nil {
+		return errors.New("parent category not found")
+	}
+	for _, c := range path {
+		if id != 0 && c.ID == id {
+			return errors.New("a category can't be placed under itself or its subcategories")
+		}
+	}
+	return nil
+}
+
+// checkCategoryName fails if another category than exceptID already has
+// the name, ignoring case
+func (db *DataBase) checkCategoryName(name string, exceptID int) error {
+	var exists int
+	err := db.Conn.QueryRow(
+		"SELECT 1 FROM categories WHERE name = ? COLLATE NOCASE AND id != ?", name, exceptID,
+	).Scan(&exists)
+	if err == nil {
+		return errors.New("a category with that name already exists")
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	return err
+}
+
+// CreateCategory adds a category at the end of the list, under parentID
+// or at the top level when it is 0
+func (db *DataBase) CreateCategory(name, description string, parentID int) (int, error) {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	if err := db.checkCategoryName(name, 0); err != nil {
+		return 0, err
+	}
+	if err := db.checkCategoryParent(0, parentID); err != nil {
+		return 0, err
+	}
+	res, err := db.Conn.Exec(
+		`INSERT INTO categories (name, description, parent_id, position)
+		VALUES (?, ?, ?, (SELECT COALESCE(MAX(position), 0) + 1 FROM categories))`,
+		name, description, parentID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+// UpdateCategory renames a category, replaces its description and moves
+// it under parentID (0 for the top level)
+func (db *DataBase) UpdateCategory(id int, name, description string, parentID int) error {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	if err := db.checkCategoryName(name, id); err != nil {
+		return err
+	}
+	if err := db.checkCategoryParent(id, parentID); err != nil {
+		return err
+	}
+	res, err := db.Conn.Exec(
+		"UPDATE categories SET name = ?, description = ?, parent_id = ? WHERE id = ?", name, description, parentID, id,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("category not found")
+	}
+	return nil
+}
+
+// ReorderCategory moves a category one place up (offset -1) or down
+// (offset 1) in the list. Positions are renumbered from 1 as a side effect.
+func (db *DataBase) ReorderCategory(id, offset int) error {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT id FROM categories ORDER BY position, name COLLATE NOCASE")
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for rows.Next() {
+		var cid int
+		if err := rows.Scan(&cid); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, cid)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	from := slices.Index(ids, id)
+	if from < 0 {
+		return errors.New("category not found")
+	}
+	to := from + offset
+	if to < 0 || to >= len(ids) {
+		// Already first or last
+		return nil
+	}
+	ids[from], ids[to] = ids[to], ids[from]
+
+	for i, cid := range ids {
+		if _, err := tx.Exec("UPDATE categories SET position = ? WHERE id = ?", i+1, cid); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DeleteCategory deletes a category. When targetID isn't 0 its posts and
+// moderators are reassigned to that category first, as in MergeCategories;
+// otherwise the posts just leave the category. Its subcategories move up to
+// its parent.
+func (db *DataBase) DeleteCategory(id, targetID int) error {
+	if targetID != 0 {
+		return db.MergeCategories(id, targetID)
+	}
+	if _, err := db.GetCategory(id); err != nil {
+		return err
+	}
+
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(reparentChildren, sql.Named("id", id)); err != nil {
+		return err
+	}
+	for _, stmt := range []string{
+		"DELETE FROM post_categories WHERE category_id = ?",
+		"DELETE FROM category_moderators WHERE category_id = ?",
+		"DELETE FROM federation_followers WHERE category_id = ?",
+		"DELETE FROM category_announcements WHERE category_id = ?",
+		"DELETE FROM post_pins WHERE category_id = ?",
+		"DELETE FROM moved_posts WHERE ?1 IN (category_id, to_category_id)",
+		"DELETE FROM category_templates WHERE category_id = ?",
+		"DELETE FROM categories WHERE id = ?",
+	} {
+		if _, err := tx.Exec(stmt, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ListCategoryModerators returns the usernames of each category's
+// moderators, keyed by category ID
+func (db *DataBase) ListCategoryModerators() (map[int][]string, error) {
+	rows, err := db.Conn.Query(
+		`SELECT m.category_id, u.username
+		FROM category_moderators m JOIN users u ON u.uuid = m.user_uuid
+		ORDER BY u.username COLLATE NOCASE`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	moderators := make(map[int][]string)
+	for rows.Next() {
+		var (
+			id       int
+			username string
+		)
+		if err := rows.Scan(&id, &username); err != nil {
+			return nil, err
+		}
+		moderators[id] = append(moderators[id], username)
+	}
+	return moderators, rows.Err()
+}
+
+// SetCategoryModerator adds or removes a user as moderator of a category
+func (db *DataBase) SetCategoryModerator(categoryID int, username string, moderator bool) error {
+	if _, err := db.GetCategory(categoryID); err != nil {
+		return err
+	}
+	user, err := db.GetUserByUsername(username)
+	if err != nil {
+		return err
+	}
+
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	if moderator {
+		_, err = db.Conn.Exec(
+			"INSERT OR IGNORE INTO category_moderators (category_id, user_uuid) VALUES (?, ?)", categoryID, user.UUID,
+		)
+	} else {
+		_, err = db.Conn.Exec(
+			"DELETE FROM category_moderators WHERE category_id = ? AND user_uuid = ?", categoryID, user.UUID,
+		)
+	}
+	return err
+}
+
+// SetCategoryArchived archives or restores a category.
+// Archived categories stay browsable but can't receive new posts.
+func (db *DataBase) SetCategoryArchived(id int, archived bool) error {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	res, err := db.Conn.Exec("UPDATE categories SET archived = ? WHERE id = ?", archived, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("category not found")
+	}
+	return nil
+}
+
+// SetCategoryQA turns Q&A mode on or off for a category. Answers already
+// accepted are kept either way.
+func (db *DataBase) SetCategoryQA(id int, qa bool) error {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	res, err := db.Conn.Exec("UPDATE categories SET qa = ? WHERE id = ?", qa, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("category not found")
+	}
+	return nil
+}
+
+// reparentChildren moves the subcategories of the category being removed
+// up to its own parent
+const reparentChildren = `UPDATE categories SET parent_id = (SELECT parent_id FROM categories WHERE id = @id)
+	WHERE parent_id = @id`
+
+// MergeCategories moves all posts and moderators of source into target,
+// then deletes source. Source's subcategories move up to source's parent.
+// Everything happens in one transaction.
+func (db *DataBase) MergeCategories(sourceID, targetID int) error {
+	if sourceID == targetID {
+		return errors.New("cannot merge a category into itself")
+	}
+	if _, err := db.GetCategory(sourceID); err != nil {
+		return err
+	}
+	if _, err := db.GetCategory(targetID); err != nil {
+		return err
+	}
+
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// INSERT OR IGNORE skips posts/moderators already in the target
+	statements := []string{
+		`INSERT OR IGNORE INTO post_categories (post_id, category_id)
+			SELECT post_id, ? FROM post_categories WHERE category_id = ?`,
+		`INSERT OR IGNORE INTO category_moderators (category_id, user_uuid)
+			SELECT ?, user_uuid FROM category_moderators WHERE category_id = ?`,
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt, targetID, sourceID); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(reparentChildren, sql.Named("id", sourceID)); err != nil {
+		return err
+	}
+	for _, stmt := range []string{
+		"DELETE FROM post_categories WHERE category_id = ?",
+		"DELETE FROM category_moderators WHERE category_id = ?",
+		"DELETE FROM category_announcements WHERE category_id = ?",
+		"DELETE FROM post_pins WHERE category_id = ?",
+		"DELETE FROM moved_posts WHERE ?1 IN (category_id, to_category_id)",
+		"DELETE FROM category_templates WHERE category_id = ?",
+		"DELETE FROM categories WHERE id = ?",
+	} {
+		if _, err := tx.Exec(stmt, sourceID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// CategoriesHandler handles GET /categories, the list of every category
+func CategoriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, err := CurrentUser(w, r); err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	categories, err := db.ListCategoryStats(true)
+	if err != nil {
+		RenderError(w, "Failed to load categories", http.StatusInternalServerError)
+		return
+	}
+
+	InitTemplate(w, "templates/categories.html", map[string]interface{}{
+		"Categories": CategoryTree(categories),
+	})
+}
+
+// CategoryHandler handles GET /category/{id}, one page of a category's posts.
+// With ?fragment=posts only the post list is rendered.
+func CategoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		RenderError(w, "Category not found", http.StatusNotFound)
+		return
+	}
+	category, err := db.GetCategory(id)
+	if err != nil {
+		RenderError(w, "Category not found", http.StatusNotFound)
+		return
+	}
+
+	// Posts from subcategories are listed too unless ?descendants=0
+	query := PostQuery{
+		Sort:               SortFromRequest(r),
+		CategoryID:         category.ID,
+		IncludeDescendants: r.URL.Query().Get("descendants") != "0",
+	}
+	posts, err := db.LoadPostPage(query, PageFromRequest(r), user)
+	if err != nil {
+		RenderError(w, "Failed to load posts", http.StatusInternalServerError)
+		return
+	}
+	// ?fragment=posts returns just the list, for loading more in place
+	if r.URL.Query().Get("fragment") == "posts" {
+		RenderPartial(w, "post_list", posts)
+		return
+	}
+	path, err := db.CategoryPath(category.ID)
+	if err != nil {
+		RenderError(w, "Failed to load category", http.StatusInternalServerError)
+		return
+	}
+	subcategories, err := db.ListSubcategories(category.ID, true)
+	if err != nil {
+		RenderError(w, "Failed to load category", http.StatusInternalServerError)
+		return
+	}
+	moved, err := db.ListMovedNotices(category.ID)
+	if err != nil {
+		RenderError(w, "Failed to load category", http.StatusInternalServerError)
+		return
+	}
+
+	InitTemplate(w, "templates/category.html", map[string]interface{}{
+		"Category":           category,
+		"Breadcrumbs":        path,
+		"Subcategories":      subcategories,
+		"Moved":              moved,
+		"IncludeDescendants": query.IncludeDescendants,
+		"Posts":              posts,
+	})
+}
+
+// AdminCategoriesHandler handles GET /admin/categories
+func AdminCategoriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := RequireAdmin(w, r); !ok {
+		return
+	}
+
+	categories, err := db.ListCategoryStats(true)
+	if err != nil {
+		RenderError(w, "Failed to load categories", http.StatusInternalServerError)
+		return
+	}
+
+	moderators, err := db.ListCategoryModerators()
+	if err != nil {
+		RenderError(w, "Failed to load categories", http.StatusInternalServerError)
+		return
+	}
+
+	templates, err := db.ListPostTemplates()
+	if err != nil {
+		RenderError(w, "Failed to load categories", http.StatusInternalServerError)
+		return
+	}
+
+	InitTemplate(w, "templates/admin_categories.html", map[string]interface{}{
+		"Categories": categories,
+		"Moderators": moderators,
+		"Templates":  templates,
+	})
+}
+
+// ArchiveCategoryHandler handles POST /admin/categories/archive
+// The form sends the category id and archived=1 to archive or 0 to restore.
+func ArchiveCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := RequireAdmin(w, r); !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		RenderError(w, "Invalid category", http.StatusBadRequest)
+		return
+	}
+
+	if err := db.SetCategoryArchived(id, r.FormValue("archived") == "1"); err != nil {
+		RenderError(w, "Failed to update category: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/categories", http.StatusSeeOther)
+}
+
+// QACategoryHandler handles POST /admin/categories/qa
+// The form sends the category id and qa=1 to make it a Q&A category or 0
+// to make it an ordinary one.
+func QACategoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := RequireAdmin(w, r); !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		RenderError(w, "Invalid category", http.StatusBadRequest)
+		return
+	}
+
+	if err := db.SetCategoryQA(id, r.FormValue("qa") == "1"); err != nil {
+		RenderError(w, "Failed to update category: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/categories", http.StatusSeeOther)
+}
+
+// MergeCategoryHandler handles POST /admin/categories/merge
+func MergeCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := RequireAdmin(w, r); !ok {
+		return
+	}
+
+	source, err1 := strconv.Atoi(r.FormValue("source"))
+	target, err2 := strconv.Atoi(r.FormValue("target"))
+	if err1 != nil || err2 != nil {
+		RenderError(w, "Invalid categories", http.StatusBadRequest)
+		return
+	}
+
+	if err := db.MergeCategories(source, target); err != nil {
+		RenderError(w, "Merge failed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/categories", http.StatusSeeOther)
+}
+
+// SaveCategoryHandler handles POST /admin/categories/save. Without an id
+// it creates a category; with one it renames, describes and moves it. The
+// optional parent field places it under another category.
+func SaveCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := RequireAdmin(w, r); !ok {
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	description := strings.TrimSpace(r.FormValue("description"))
+	if name == "" {
+		RenderError(w, "A category needs a name", http.StatusBadRequest)
+		return
+	}
+	parent := 0
+	if r.FormValue("parent") != "" {
+		var err error
+		if parent, err = strconv.Atoi(r.FormValue("parent")); err != nil {
+			RenderError(w, "Invalid parent category", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var err error
+	if r.FormValue("id") == "" {
+		_, err = db.CreateCategory(name, description, parent)
+	} else {
+		id, convErr := strconv.Atoi(r.FormValue("id"))
+		if convErr != nil {
+			RenderError(w, "Invalid category", http.StatusBadRequest)
+			return
+		}
+		err = db.UpdateCategory(id, name, description, parent)
+	}
+	if err != nil {
+		RenderError(w, "Failed to save category: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/categories", http.StatusSeeOther)
+}
+
+// ReorderCategoryHandler handles POST /admin/categories/reorder
+// The form sends the category id and direction=up or down.
+func ReorderCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := RequireAdmin(w, r); !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		RenderError(w, "Invalid category", http.StatusBadRequest)
+		return
+	}
+	offset := 1
+	if r.FormValue("direction") == "up" {
+		offset = -1
+	}
+
+	if err := db.ReorderCategory(id, offset); err != nil {
+		RenderError(w, "Failed to reorder categories: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/categories", http.StatusSeeOther)
+}
+
+// DeleteCategoryHandler handles POST /admin/categories/delete
+// The form sends the category id and, optionally, the target category its
+// posts are reassigned to.
+func DeleteCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := RequireAdmin(w, r); !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		RenderError(w, "Invalid category", http.StatusBadRequest)
+		return
+	}
+	target := 0
+	if r.FormValue("target") != "" {
+		if target, err = strconv.Atoi(r.FormValue("target")); err != nil {
+			RenderError(w, "Invalid category", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := db.DeleteCategory(id, target); err != nil {
+		RenderError(w, "Failed to delete category: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/categories", http.StatusSeeOther)
+}
+
+// CategoryModeratorHandler handles POST /admin/categories/moderators
+// The form sends the category id, a username and action=add or remove.
+func CategoryModeratorHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := RequireAdmin(w, r); !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		RenderError(w, "Invalid category", http.StatusBadRequest)
+		return
+	}
+	username := strings.TrimSpace(r.FormValue("username"))
+
+	if err := db.SetCategoryModerator(id, username, r.FormValue("action") != "remove"); err != nil {
+		RenderError(w, "Failed to update moderators: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/categories", http.StatusSeeOther)
+}
@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Clock tells the time. Anything that compares against the current time,
+// like session expiry or retention, reads it through Now so test mode can
+// control it.
+type Clock interface {
+	Now() time.Time
+}
+
+// IDGenerator creates the unique IDs given to users
+type IDGenerator interface {
+	NewID() (string, error)
+}
+
+// clock and ids are the real ones unless the server runs in test mode
+var (
+	clock Clock       = systemClock{}
+	ids   IDGenerator = uuidGenerator{}
+)
+
+func init() {
+	if !TestMode {
+		return
+	}
+	start, err := time.Parse(time.RFC3339, TestClockStart)
+	if err != nil {
+		log.Fatalf("Invalid FORUM_TEST_CLOCK %q: %v", TestClockStart, err)
+	}
+	clock = &TestClock{now: start}
+	ids = &sequentialIDs{}
+	log.Println("Test mode: clock starts at", TestClockStart)
+}
+
+// Now returns the current time according to the server's clock
+func Now() time.Time {
+	return clock.Now()
+}
+
+// systemClock is the wall clock
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// uuidGenerator creates time+MAC-based UUID v1s
+type uuidGenerator struct{}
+
+func (uuidGenerator) NewID() (string, error) {
+	id, err := uuid.NewUUID()
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
+
+// TestClock only moves when it is set or advanced
+type TestClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *TestClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Set moves the clock to t
+func (c *TestClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+}
+
+// Advance moves the clock forward by d
+func (c *TestClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// sequentialIDs hands out UUID-shaped IDs counting up from 1, so the same
+// test run always creates the same users
+type sequentialIDs struct {
+	mu sync.Mutex
+	n  uint64
+}
+
+func (g *sequentialIDs) NewID() (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.n++
+	return fmt.Sprintf("00000000-0000-4000-8000-%012d", g.n), nil
+}
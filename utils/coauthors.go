@@ -0,0 +1,337 @@
+package utils
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxCoAuthors caps the co-authors a post can have, invitations included
+const MaxCoAuthors = 5
+
+// CoAuthor is a user invited to co-author a post. They can edit it and are
+// credited next to the author once they accept.
+type CoAuthor struct {
+	Username string
+	Accepted bool
+}
+
+// CoAuthorInvite is an invitation waiting for its invitee's answer
+type CoAuthorInvite struct {
+	PostID    int
+	Title     string
+	InvitedBy string
+	CreatedAt time.Time
+}
+
+// InviteCoAuthor invites a registered user to co-author a published post
+func (db *DataBase) InviteCoAuthor(postID int, username, inviterUUID string) error {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var (
+		uuid          string
+		isAuthor      bool
+		notRegistered bool
+	)
+	err = tx.QueryRow(
+		`SELECT uuid, notregistered, uuid = (SELECT author_uuid FROM posts WHERE id = ?)
+		FROM users WHERE username = ?`,
+		postID, username,
+	).Scan(&uuid, &notRegistered, &isAuthor)
+	if errors.Is(err, sql.ErrNoRows) || notRegistered {
+		return errors.New("no such user")
+	}
+	if err != nil {
+		return err
+	}
+	if isAuthor {
+		return errors.New("the author can't co-author their own post")
+	}
+
+	var count int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM post_coauthors WHERE post_id = ?", postID).Scan(&count); err != nil {
+		return err
+	}
+	if count >= MaxCoAuthors {
+		return errors.New("a post can have at most " + strconv.Itoa(MaxCoAuthors) + " co-authors")
+	}
+
+	res, err := tx.Exec(
+		`INSERT OR IGNORE INTO post_coauthors (post_id, user_uuid, invited_by, created_at)
+		VALUES (?, ?, ?, ?)`,
+		postID, uuid, inviterUUID, Timestamp(),
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New(username + " is already invited")
+	}
+	if err := recordPostHistory(tx, postID, inviterUUID, "invited co-author", username); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AnswerCoAuthorInvite accepts or declines an invitation. Declining
+// removes it, so the author can invite the user again later.
+func (db *DataBase) AnswerCoAuthorInvite(postID int, userUUID string, accept bool) error {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var res sql.Result
+	if accept {
+		res, err = tx.Exec(
+			"UPDATE post_coauthors SET accepted_at = ? WHERE post_id = ? AND user_uuid = ? AND accepted_at = ''",
+			Timestamp(), postID, userUUID,
+		)
+	} else {
+		res, err = tx.Exec(
+			"DELETE FROM post_coauthors WHERE post_id = ? AND user_uuid = ? AND accepted_at = ''",
+			postID, userUUID,
+		)
+	}
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("invitation not found")
+	}
+	if accept {
+		if err := recordPostHistory(tx, postID, userUUID, "joined as co-author", ""); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// RemoveCoAuthor withdraws an invitation or removes a co-author. Co-authors
+// can also remove themselves.
+func (db *DataBase) RemoveCoAuthor(postID int, username, actorUUID string) error {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		"DELETE FROM post_coauthors WHERE post_id = ? AND user_uuid = (SELECT uuid FROM users WHERE username = ?)",
+		postID, username,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New(username + " isn't a co-author")
+	}
+	if err := recordPostHistory(tx, postID, actorUUID, "removed co-author", username); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// IsCoAuthor reports whether a user accepted to co-author a post
+func (db *DataBase) IsCoAuthor(postID int, userUUID string) bool {
+	var exists int
+	err := db.Conn.QueryRow(
+		"SELECT 1 FROM post_coauthors WHERE post_id = ? AND user_uuid = ? AND accepted_at != ''",
+		postID, userUUID,
+	).Scan(&exists)
+	return err == nil
+}
+
+// ListCoAuthors returns a post's co-authors and pending invitations, in
+// the order they were invited
+func (db *DataBase) ListCoAuthors(postID int) ([]CoAuthor, error) {
+	rows, err := db.Conn.Query(
+		`SELECT u.username, c.accepted_at != ''
+		FROM post_coauthors c JOIN users u ON u.uuid = c.user_uuid
+		WHERE c.post_id = ?
+		ORDER BY c.created_at, u.username COLLATE NOCASE`,
+		postID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var coauthors []CoAuthor
+	for rows.Next() {
+		var c CoAuthor
+		if err := rows.Scan(&c.Username, &c.Accepted); err != nil {
+			return nil, err
+		}
+		coauthors = append(coauthors, c)
+	}
+	return coauthors, rows.Err()
+}
+
+// ListCoAuthorInvites returns the invitations a user hasn't answered yet,
+// newest first. Invitations to posts since deleted or merged aren't listed.
+func (db *DataBase) ListCoAuthorInvites(userUUID string) ([]CoAuthorInvite, error) {
+	rows, err := db.Conn.Query(
+		`SELECT p.id, p.title, COALESCE(u.username, ''), c.created_at
+		FROM post_coauthors c
+		JOIN posts p ON p.id = c.post_id
+		LEFT JOIN users u ON u.uuid = c.invited_by
+		WHERE c.user_uuid = ? AND c.accepted_at = '' AND p.deleted_at = '' AND p.status = ?
+		ORDER BY c.created_at DESC`,
+		userUUID, PostPublished,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invites []CoAuthorInvite
+	for rows.Next() {
+		var (
+			inv       CoAuthorInvite
+			createdAt string
+		)
+		if err := rows.Scan(&inv.PostID, &inv.Title, &inv.InvitedBy, &createdAt); err != nil {
+			return nil, err
+		}
+		inv.CreatedAt, _ = ParseTimestamp(createdAt)
+		invites = append(invites, inv)
+	}
+	return invites, rows.Err()
+}
+
+// coAuthorCredits selects the usernames of a post's accepted co-authors,
+// joined by newlines, for listing queries where the post is aliased p
+const coAuthorCredits = `COALESCE((
+	SELECT group_concat(cu.username, char(10))
+	FROM post_coauthors ca JOIN users cu ON cu.uuid = ca.user_uuid
+	WHERE ca.post_id = p.id AND ca.accepted_at != ''
+), '')`
+
+// splitCredits turns the result of coAuthorCredits into usernames
+func splitCredits(credits string) []string {
+	if credits == "" {
+		return nil
+	}
+	return strings.Split(credits, "\n")
+}
+
+// CanEditPost reports whether a user may edit a post: those who can manage
+// it, and the co-authors of published posts
+func CanEditPost(user *User, post *Post) bool {
+	if CanManagePost(user, post) {
+		return true
+	}
+	return !post.IsDraft() && db.IsCoAuthor(post.ID, user.UUID)
+}
+
+// CoAuthorsHandler handles POST /post/{id}/coauthors. The form sends a
+// username and action=invite or remove, which only those who can manage
+// the post may do, or action=leave for a co-author stepping down.
+func CoAuthorsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		RenderError(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	post, err := db.GetPost(id)
+	if err != nil || post.IsDeleted() || post.IsDraft() || post.IsMerged() {
+		RenderError(w, "Post not found", http.StatusNotFound)
+		return
+	}
+
+	action := r.FormValue("action")
+	if action != "leave" && !CanManagePost(user, post) {
+		RenderError(w, "You can't change this post's co-authors", http.StatusForbidden)
+		return
+	}
+
+	username := strings.TrimSpace(r.FormValue("username"))
+	switch action {
+	case "invite":
+		err = db.InviteCoAuthor(id, username, user.UUID)
+	case "remove":
+		err = db.RemoveCoAuthor(id, username, user.UUID)
+	case "leave":
+		err = db.RemoveCoAuthor(id, user.Username, user.UUID)
+	default:
+		err = errors.New("unknown action")
+	}
+	if err != nil {
+		RenderError(w, "Failed to update co-authors: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/post/"+strconv.Itoa(id)+"#coauthors", http.StatusSeeOther)
+}
+
+// InvitationsHandler handles GET and POST /invitations. POST answers one
+// invitation: post_id and action=accept or decline.
+func InvitationsHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		invites, err := db.ListCoAuthorInvites(user.UUID)
+		if err != nil {
+			RenderError(w, "Failed to load invitations", http.StatusInternalServerError)
+			return
+		}
+		loc := db.GetLocationPreference(user.UUID)
+		for i := range invites {
+			invites[i].CreatedAt = invites[i].CreatedAt.In(loc)
+		}
+		InitTemplate(w, "templates/invitations.html", map[string]interface{}{"Invites": invites})
+
+	case http.MethodPost:
+		postID, err := strconv.Atoi(r.FormValue("post_id"))
+		if err != nil {
+			RenderError(w, "Invalid post", http.StatusBadRequest)
+			return
+		}
+		accept := r.FormValue("action") == "accept"
+		if err := db.AnswerCoAuthorInvite(postID, user.UUID, accept); err != nil {
+			RenderError(w, "Failed to answer the invitation: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if accept {
+			http.Redirect(w, r, "/post/"+strconv.Itoa(postID), http.StatusSeeOther)
+			return
+		}
+		http.Redirect(w, r, "/invitations", http.StatusSeeOther)
+
+	default:
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
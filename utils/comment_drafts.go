@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// SaveCommentDraft keeps the comment a user is writing on a post. Saving
+// an empty draft discards it.
+func (db *DataBase) SaveCommentDraft(postID int, userUUID, content string) error {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	if content == "" {
+		return discardCommentDraft(db.Conn, postID, userUUID)
+	}
+	_, err := db.Conn.Exec(
+		`INSERT INTO comment_drafts (post_id, user_uuid, content, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(post_id, user_uuid) DO UPDATE SET content = excluded.content, updated_at = excluded.updated_at`,
+		postID, userUUID, content, Timestamp(),
+	)
+	return err
+}
+
+// GetCommentDraft returns a user's draft comment on a post, or "" when
+// they have none or it has gone stale
+func (db *DataBase) GetCommentDraft(postID int, userUUID string) (string, error) {
+	var content string
+	err := db.Conn.QueryRow(
+		"SELECT content FROM comment_drafts WHERE post_id = ? AND user_uuid = ? AND updated_at > ?",
+		postID, userUUID, commentDraftCutoff(),
+	).Scan(&content)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return content, err
+}
+
+// discardCommentDraft deletes a user's draft on a post through ex, which
+// may be a transaction
+func discardCommentDraft(ex execer, postID int, userUUID string) error {
+	_, err := ex.Exec("DELETE FROM comment_drafts WHERE post_id = ? AND user_uuid = ?", postID, userUUID)
+	return err
+}
+
+// commentDraftCutoff is the timestamp drafts saved before are stale
+func commentDraftCutoff() string {
+	return FormatTimestamp(Now().Add(-time.Duration(CommentDraftDays) * 24 * time.Hour))
+}
+
+// PurgeCommentDrafts deletes drafts not saved for CommentDraftDays
+func PurgeCommentDrafts() error {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	_, err := db.Conn.Exec("DELETE FROM comment_drafts WHERE updated_at <= ?", commentDraftCutoff())
+	return err
+}
+
+// CommentDraftHandler handles POST /post/{id}/draft, which the comment form
+// calls as the user types to save the content field. The draft is put
+// back in the form when they return, and discarded once the comment is
+// posted.
+func CommentDraftHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		WriteJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	user, err := CurrentUser(w, r)
+	if err != nil || user.NotRegistered {
+		WriteJSON(w, http.StatusUnauthorized, map[string]string{"error": "not logged in"})
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		WriteJSON(w, http.StatusNotFound, map[string]string{"error": "post not found"})
+		return
+	}
+	post, err := db.GetPost(id)
+	if err != nil || post.IsDeleted() || post.IsDraft() || post.IsMerged() {
+		WriteJSON(w, http.StatusNotFound, map[string]string{"error": "post not found"})
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxPreviewBytes)
+	content := r.PostFormValue("content")
+	if err := CommentLength.CheckMax(content); err != nil {
+		WriteJSON(w, http.StatusRequestEntityTooLarge, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := db.SaveCommentDraft(post.ID, user.UUID, content); err != nil {
+		WriteJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to save draft"})
+		return
+	}
+	WriteJSON(w, http.StatusOK, map[string]bool{"saved": true})
+}
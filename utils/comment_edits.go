@@ -0,0 +1,177 @@
+package utils
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CanEditComment reports whether a user may edit or delete a comment.
+// Staff always can; its author only within CommentEditWindow of posting
+// it. Deleted comments can't be edited.
+func CanEditComment(user *User, c *Comment) bool {
+	if c.IsDeleted() {
+		return false
+	}
+	if user.IsStaff() {
+		return true
+	}
+	if user.NotRegistered || user.UUID != c.Author.UUID {
+		return false
+	}
+	return CommentEditWindow == 0 || Now().Sub(c.CreatedAt) < CommentEditWindow
+}
+
+// errCommentDeleted is returned when editing or deleting a comment that is
+// already deleted
+var errCommentDeleted = errors.New("the comment was deleted")
+
+// EditComment replaces a comment's content, stamps it as edited and
+// updates who it mentions
+func (db *DataBase) EditComment(c *Comment, content string) error {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		"UPDATE comments SET content = ?, edited_at = ? WHERE id = ? AND deleted_at = ''",
+		content, Timestamp(), c.ID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errCommentDeleted
+	}
+	if err := recordMentions(tx, c.Post.ID, c.ID, c.Author.UUID, content); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteComment empties a comment and marks it deleted. The comment keeps
+// its place so replies to it stay in their thread; its mentions and emoji
+// reactions go, and it stops being an accepted answer.
+func (db *DataBase) DeleteComment(c *Comment) error {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		"UPDATE comments SET content = '', deleted_at = ? WHERE id = ? AND deleted_at = ''",
+		Timestamp(), c.ID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errCommentDeleted
+	}
+	for _, query := range []string{
+		"DELETE FROM mentions WHERE comment_id = ?",
+		"DELETE FROM reactions WHERE comment_id = ?",
+		"UPDATE posts SET accepted_comment_id = 0 WHERE accepted_comment_id = ?",
+	} {
+		if _, err := tx.Exec(query, c.ID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// editableComment loads the comment a request is about and checks that
+// the user may still change it, rendering the error when they may not
+func editableComment(w http.ResponseWriter, r *http.Request, user *User) (*Comment, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		RenderError(w, "Comment not found", http.StatusNotFound)
+		return nil, false
+	}
+	comment, err := db.GetComment(id)
+	if err != nil || comment.IsDeleted() {
+		RenderError(w, "Comment not found", http.StatusNotFound)
+		return nil, false
+	}
+	post, err := db.GetPost(comment.Post.ID)
+	if err != nil || post.IsDeleted() || post.IsDraft() || post.IsMerged() {
+		RenderError(w, "Comment not found", http.StatusNotFound)
+		return nil, false
+	}
+	if post.IsArchived() {
+		RenderError(w, "This thread is archived", http.StatusForbidden)
+		return nil, false
+	}
+	if !CanEditComment(user, comment) {
+		if user.UUID == comment.Author.UUID {
+			RenderError(w, "Comments can only be changed for "+strconv.Itoa(int(CommentEditWindow.Minutes()))+" minutes after posting", http.StatusForbidden)
+			return nil, false
+		}
+		RenderError(w, "You can't change this comment", http.StatusForbidden)
+		return nil, false
+	}
+	return comment, true
+}
+
+// EditCommentHandler handles POST /comment/{id}/edit
+func EditCommentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	comment, ok := editableComment(w, r, user)
+	if !ok {
+		return
+	}
+
+	content := strings.TrimSpace(r.FormValue("content"))
+	if err := CommentLength.Check(content); err != nil {
+		RenderError(w, "Couldn't save the comment: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if content != comment.Content {
+		if err := db.EditComment(comment, content); err != nil {
+			RenderError(w, "Failed to save comment: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	http.Redirect(w, r, CommentLink("", comment.Post.ID, comment.ID), http.StatusSeeOther)
+}
+
+// DeleteCommentHandler handles POST /comment/{id}/delete
+func DeleteCommentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	comment, ok := editableComment(w, r, user)
+	if !ok {
+		return
+	}
+
+	if err := db.DeleteComment(comment); err != nil {
+		RenderError(w, "Failed to delete comment: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, CommentLink("", comment.Post.ID, comment.ID), http.StatusSeeOther)
+}
@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CanSeeHiddenComment reports whether a user sees a hidden comment: its
+// author, and those who can moderate the post it is on
+func (db *DataBase) CanSeeHiddenComment(user *User, post *Post, c *Comment) bool {
+	return (!user.NotRegistered && user.UUID == c.Author.UUID) || db.CanLockPost(user, post)
+}
+
+// SetCommentHidden hides a comment from everyone but its author and
+// moderators, or shows it again, and records it with the reason in the
+// post's history
+func (db *DataBase) SetCommentHidden(c *Comment, hidden bool, actorUUID, reason string) error {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query, action, state := "UPDATE comments SET hidden_at = ? WHERE id = ? AND hidden_at = ''", "hid", "hidden"
+	args := []interface{}{Timestamp(), c.ID}
+	if !hidden {
+		query, action, state = "UPDATE comments SET hidden_at = '' WHERE id = ? AND hidden_at != ''", "unhid", "shown"
+		args = []interface{}{c.ID}
+	}
+	res, err := tx.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("comment is already " + state)
+	}
+
+	details := "comment " + strconv.Itoa(c.ID)
+	if reason != "" {
+		details += ": " + reason
+	}
+	if err := recordPostHistory(tx, c.Post.ID, actorUUID, action, details); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// HideCommentHandler handles POST /comment/{id}/hide. The form sends hide=1
+// with an optional reason to hide the comment, or hide=0 to show it again.
+// Those who can lock the post can hide its comments.
+func HideCommentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		RenderError(w, "Comment not found", http.StatusNotFound)
+		return
+	}
+	comment, err := db.GetComment(id)
+	if err != nil || comment.IsDeleted() {
+		RenderError(w, "Comment not found", http.StatusNotFound)
+		return
+	}
+	post, err := db.GetPost(comment.Post.ID)
+	if err != nil || post.IsDeleted() || post.IsDraft() || post.IsMerged() {
+		RenderError(w, "Comment not found", http.StatusNotFound)
+		return
+	}
+	if !db.CanLockPost(user, post) {
+		RenderError(w, "You can't hide comments on this post", http.StatusForbidden)
+		return
+	}
+
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if err := db.SetCommentHidden(comment, r.FormValue("hide") == "1", user.UUID, reason); err != nil {
+		RenderError(w, "Failed to update comment: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, CommentLink("", post.ID, comment.ID), http.StatusSeeOther)
+}
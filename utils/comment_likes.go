@@ -0,0 +1,146 @@
+package utils
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"forum/internal/notify"
+)
+
+// Reactions a user can have to a comment. A user has at most one; the
+// empty string means none.
+const (
+	ReactionLike    = "like"
+	ReactionDislike = "dislike"
+)
+
+// ToggleCommentLike records a user's like or dislike of a comment. Sending
+// the reaction the user already has takes it back; sending the other one
+// switches to it. It returns the user's reaction afterwards.
+func (db *DataBase) ToggleCommentLike(commentID int, userUUID, reaction string) (string, error) {
+	if reaction != ReactionLike && reaction != ReactionDislike {
+		return "", errors.New("unknown reaction")
+	}
+
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var current string
+	err = tx.QueryRow(
+		`SELECT CASE WHEN liked THEN 'like' WHEN disliked THEN 'dislike' ELSE '' END
+		FROM comment_interactions WHERE comment_id = ? AND user_uuid = ?`,
+		commentID, userUUID,
+	).Scan(&current)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+
+	if current == reaction {
+		reaction = ""
+	}
+	_, err = tx.Exec(
+		`INSERT INTO comment_interactions (comment_id, user_uuid, liked, disliked, created_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(comment_id, user_uuid) DO UPDATE SET
+			liked = excluded.liked, disliked = excluded.disliked, created_at = excluded.created_at`,
+		commentID, userUUID, reaction == ReactionLike, reaction == ReactionDislike, Timestamp(),
+	)
+	if err != nil {
+		return "", err
+	}
+	if reaction == ReactionLike {
+		event := notify.Event{Kind: notify.Like, Actor: userUUID, CommentID: commentID, At: Now()}
+		err := tx.QueryRow("SELECT comment_author_uuid, post_id FROM comments WHERE id = ?", commentID).Scan(&event.Recipient, &event.PostID)
+		if err != nil {
+			return "", err
+		}
+		if err := sendNotification(tx, event); err != nil {
+			return "", err
+		}
+	}
+	return reaction, tx.Commit()
+}
+
+// commentLikeCounts selects a comment's likes and dislikes, for queries
+// where the comment is aliased c
+const commentLikeCounts = `COALESCE((SELECT SUM(ci.liked) FROM comment_interactions ci WHERE ci.comment_id = c.id), 0),
+	COALESCE((SELECT SUM(ci.disliked) FROM comment_interactions ci WHERE ci.comment_id = c.id), 0)`
+
+// CommentReactions returns a user's reactions to the comments on a post, by
+// comment ID
+func (db *DataBase) CommentReactions(postID int, userUUID string) (map[int]string, error) {
+	rows, err := db.Conn.Query(
+		`SELECT ci.comment_id, CASE WHEN ci.liked THEN 'like' ELSE 'dislike' END
+		FROM comment_interactions ci JOIN comments c ON c.id = ci.comment_id
+		WHERE c.post_id = ? AND ci.user_uuid = ? AND (ci.liked OR ci.disliked)`,
+		postID, userUUID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reactions := make(map[int]string)
+	for rows.Next() {
+		var (
+			id       int
+			reaction string
+		)
+		if err := rows.Scan(&id, &reaction); err != nil {
+			return nil, err
+		}
+		reactions[id] = reaction
+	}
+	return reactions, rows.Err()
+}
+
+// CommentLikeHandler handles POST /comment/like. The form sends comment_id
+// and reaction=like or dislike.
+func CommentLikeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if user.NotRegistered {
+		RenderError(w, "Register to react to comments", http.StatusForbidden)
+		return
+	}
+
+	commentID, err := strconv.Atoi(r.FormValue("comment_id"))
+	if err != nil {
+		RenderError(w, "Comment not found", http.StatusNotFound)
+		return
+	}
+	var postID int
+	if err := db.Conn.QueryRow("SELECT post_id FROM comments WHERE id = ?", commentID).Scan(&postID); err != nil {
+		RenderError(w, "Comment not found", http.StatusNotFound)
+		return
+	}
+	post, err := db.GetPost(postID)
+	if err != nil || post.IsDeleted() || post.IsDraft() || post.IsMerged() {
+		RenderError(w, "Comment not found", http.StatusNotFound)
+		return
+	}
+	if post.IsArchived() {
+		RenderError(w, "This thread is archived", http.StatusForbidden)
+		return
+	}
+
+	if _, err := db.ToggleCommentLike(commentID, user.UUID, r.FormValue("reaction")); err != nil {
+		RenderError(w, "Failed to save reaction: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, CommentLink("", postID, commentID), http.StatusSeeOther)
+}
@@ -0,0 +1,372 @@
+package utils
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ReplyExcerptLength caps how much of a reply is quoted in notification emails
+const ReplyExcerptLength = 300
+
+// errNoParentComment is returned when a reply names a comment that isn't
+// on the same post
+var errNoParentComment = errors.New("the comment being replied to doesn't exist")
+
+// AddComment stores a comment on a post and returns its ID. parentID is the
+// comment it replies to, or 0.
+func (db *DataBase) AddComment(postID, parentID int, authorUUID, content string) (int, error) {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	return addComment(db.Conn, postID, parentID, authorUUID, content)
+}
+
+// addComment inserts a comment through ex, which may be a transaction
+func addComment(ex execer, postID, parentID int, authorUUID, content string) (int, error) {
+	res, err := ex.Exec(
+		`INSERT INTO comments (content, comment_author_uuid, post_id, created_at, parent_comment_id)
+		SELECT ?, ?, ?, ?, ?
+		WHERE ? = 0 OR EXISTS (SELECT 1 FROM comments WHERE id = ? AND post_id = ?)`,
+		content, authorUUID, postID, Timestamp(), parentID, parentID, parentID, postID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return 0, errNoParentComment
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+// ListComments returns the comments on a post, oldest first, leaving out
+// those a moderator hid
+func (db *DataBase) ListComments(postID int) ([]Comment, error) {
+	rows, err := db.Conn.Query(
+		`SELECT c.id, c.content, u.uuid, u.username, c.created_at, `+commentLikeCounts+`
+		FROM comments c JOIN users u ON u.uuid = c.comment_author_uuid
+		WHERE c.post_id = ? AND c.hidden_at = ''
+		ORDER BY c.id`,
+		postID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var comments []Comment
+	for rows.Next() {
+		var (
+			c         Comment
+			createdAt string
+		)
+		if err := rows.Scan(&c.ID, &c.Content, &c.Author.UUID, &c.Author.Username, &createdAt, &c.Likes, &c.Dislikes); err != nil {
+			return nil, err
+		}
+		c.Post.ID = postID
+		c.CreatedAt, _ = ParseTimestamp(createdAt)
+		comments = append(comments, c)
+	}
+	return comments, rows.Err()
+}
+
+// GetComment returns a comment with its author and the ID of its post
+func (db *DataBase) GetComment(id int) (*Comment, error) {
+	var (
+		c                                        Comment
+		createdAt, editedAt, deletedAt, hiddenAt string
+	)
+	err := db.Conn.QueryRow(
+		`SELECT c.id, c.content, c.post_id, c.parent_comment_id, u.uuid, u.username, c.created_at, c.edited_at, c.deleted_at, c.hidden_at
+		FROM comments c JOIN users u ON u.uuid = c.comment_author_uuid
+		WHERE c.id = ?`,
+		id,
+	).Scan(&c.ID, &c.Content, &c.Post.ID, &c.ParentID, &c.Author.UUID, &c.Author.Username, &createdAt, &editedAt, &deletedAt, &hiddenAt)
+	if err != nil {
+		return nil, err
+	}
+	c.CreatedAt, _ = ParseTimestamp(createdAt)
+	c.EditedAt, _ = ParseTimestamp(editedAt)
+	c.DeletedAt, _ = ParseTimestamp(deletedAt)
+	c.HiddenAt, _ = ParseTimestamp(hiddenAt)
+	return &c, nil
+}
+
+// Comment orderings offered on post pages
+const (
+	CommentSortOldest = "oldest"
+	CommentSortNewest = "newest"
+	CommentSortLiked  = "liked"
+)
+
+// CommentSorts lists the comment orderings; the first is the default
+var CommentSorts = []SortMode{
+	{CommentSortOldest, "Oldest"},
+	{CommentSortNewest, "Newest"},
+	{CommentSortLiked, "Most liked"},
+}
+
+// commentOrderings maps each comment sort to how comments are ordered
+// among their siblings in rankedComments
+var commentOrderings = map[string]string{
+	CommentSortOldest: "id",
+	CommentSortNewest: "id DESC",
+	CommentSortLiked:  "likes DESC, id",
+}
+
+// CommentSortFromRequest returns the ?sort= of a post page, or the default
+func CommentSortFromRequest(r *http.Request) string {
+	sort := r.URL.Query().Get("sort")
+	if _, ok := commentOrderings[sort]; !ok {
+		return CommentSorts[0].Key
+	}
+	return sort
+}
+
+// CommentPage is one page of a post's comments. Pages are made of
+// top-level comments, so a conversation is never split between pages.
+type CommentPage struct {
+	Comments []Comment
+	Sort     string
+	Sorts    []SortMode
+	// Total counts every comment on the post, replies included
+	Total      int
+	Page       int
+	TotalPages int
+	PrevPage   int
+	NextPage   int
+}
+
+// rootComment is the condition for top-level comments on post ?. Comments
+// whose parent is missing, say after a merge was undone, count as
+// top-level.
+const rootComment = "parent_comment_id NOT IN (SELECT id FROM comments WHERE post_id = ?)"
+
+// rankedComments is a common table expression numbering the comments on
+// post ? (given twice) among their siblings in the given sort: top-level
+// comments among themselves, replies among the other replies to the same
+// comment. Likes are counted here so sorting by them stays in SQL.
+func rankedComments(sort string) string {
+	return `ranked AS (
+		SELECT id, parent_comment_id, root,
+			ROW_NUMBER() OVER (
+				PARTITION BY CASE WHEN root THEN 0 ELSE parent_comment_id END
+				ORDER BY ` + commentOrderings[sort] + `
+			) AS n
+		FROM (
+			SELECT c.id, c.parent_comment_id, c.` + rootComment + ` AS root,
+				COALESCE((SELECT SUM(ci.liked) FROM comment_interactions ci WHERE ci.comment_id = c.id), 0) AS likes
+			FROM comments c WHERE c.post_id = ?
+		)
+	)`
+}
+
+// CountComments returns how many comments a post has, and how many of them
+// are top-level
+func (db *DataBase) CountComments(postID int) (total, threads int, err error) {
+	err = db.Conn.QueryRow(
+		"SELECT COUNT(*), COALESCE(SUM("+rootComment+"), 0) FROM comments WHERE post_id = ?",
+		postID, postID,
+	).Scan(&total, &threads)
+	return total, threads, err
+}
+
+// LoadCommentPage returns a page of a post's comments in thread order,
+// sorted by sort. Pages past the last one show the last.
+func (db *DataBase) LoadCommentPage(postID, page int, sort string) (*CommentPage, error) {
+	total, threads, err := db.CountComments(postID)
+	if err != nil {
+		return nil, err
+	}
+	data := &CommentPage{
+		Sort:       sort,
+		Sorts:      CommentSorts,
+		Total:      total,
+		TotalPages: (threads + CommentsPerPage - 1) / CommentsPerPage,
+	}
+	data.Page = max(min(page, data.TotalPages), 1)
+	if data.Page > 1 {
+		data.PrevPage = data.Page - 1
+	}
+	if data.Page < data.TotalPages {
+		data.NextPage = data.Page + 1
+	}
+	if data.Comments, err = db.ListCommentTree(postID, sort, CommentsPerPage, (data.Page-1)*CommentsPerPage); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// CommentPageOf returns the page a comment is on when a post's comments
+// are sorted by sort, or 1 when it isn't on the post
+func (db *DataBase) CommentPageOf(postID, commentID int, sort string) (int, error) {
+	var rank int
+	err := db.Conn.QueryRow(
+		`WITH RECURSIVE `+rankedComments(sort)+`,
+		up(id, parent, root) AS (
+			SELECT id, parent_comment_id, root FROM ranked WHERE id = ?
+			UNION ALL
+			SELECT r.id, r.parent_comment_id, r.root FROM ranked r JOIN up ON r.id = up.parent AND NOT up.root
+		)
+		SELECT n FROM ranked WHERE id = (SELECT id FROM up WHERE root)`,
+		postID, postID, commentID,
+	).Scan(&rank)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 1, nil
+	}
+	if err != nil {
+		return 1, err
+	}
+	return (rank-1)/CommentsPerPage + 1, nil
+}
+
+// ListCommentTree returns limit top-level comments on a post from offset,
+// each followed by its replies, in thread order. Siblings at every level
+// are ordered by sort. The tree is walked by one recursive query.
+func (db *DataBase) ListCommentTree(postID int, sort string, limit, offset int) ([]Comment, error) {
+	rows, err := db.Conn.Query(
+		`WITH RECURSIVE `+rankedComments(sort)+`,
+		thread(id, depth, path) AS (
+			SELECT id, 0, printf('%010d', n) FROM (
+				SELECT id, n FROM ranked WHERE root ORDER BY n LIMIT ? OFFSET ?
+			)
+			UNION ALL
+			SELECT r.id, t.depth + 1, t.path || printf('%010d', r.n)
+			FROM ranked r JOIN thread t ON r.parent_comment_id = t.id AND NOT r.root
+		)
+		SELECT c.id, c.content, u.uuid, u.username, c.created_at, c.edited_at, c.deleted_at, c.hidden_at, c.parent_comment_id, t.depth,
+			COALESCE(pu.username, ''), `+commentLikeCounts+`
+		FROM thread t
+		JOIN comments c ON c.id = t.id
+		JOIN users u ON u.uuid = c.comment_author_uuid
+		LEFT JOIN comments pc ON pc.id = c.parent_comment_id
+		LEFT JOIN users pu ON pu.uuid = pc.comment_author_uuid
+		ORDER BY t.path`,
+		postID, postID, limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var comments []Comment
+	for rows.Next() {
+		var (
+			c                                        Comment
+			createdAt, editedAt, deletedAt, hiddenAt string
+			parent                                   string
+		)
+		if err := rows.Scan(&c.ID, &c.Content, &c.Author.UUID, &c.Author.Username, &createdAt, &editedAt, &deletedAt, &hiddenAt, &c.ParentID, &c.Depth, &parent,
+			&c.Likes, &c.Dislikes); err != nil {
+			return nil, err
+		}
+		c.Post.ID = postID
+		c.CreatedAt, _ = ParseTimestamp(createdAt)
+		c.EditedAt, _ = ParseTimestamp(editedAt)
+		c.DeletedAt, _ = ParseTimestamp(deletedAt)
+		c.HiddenAt, _ = ParseTimestamp(hiddenAt)
+		c.threadDepth = c.Depth
+		if c.Depth > CommentMaxDepth {
+			c.Depth, c.ReplyTo = CommentMaxDepth, parent
+		}
+		comments = append(comments, c)
+	}
+	return comments, rows.Err()
+}
+
+// CommentLink returns the absolute link to a comment on its post page. The
+// comment parameter has the post page open on the page the comment is on.
+func CommentLink(baseURL string, postID, commentID int) string {
+	id := strconv.Itoa(commentID)
+	return baseURL + "/post/" + strconv.Itoa(postID) + "?comment=" + id + "#comment-" + id
+}
+
+// AddCommentHandler handles POST /post/{id}/comment. It is served through
+// Transactional.
+func AddCommentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if user.NotRegistered {
+		RenderError(w, "Guests can't comment; register to join the discussion", http.StatusForbidden)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		RenderError(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	post, err := db.GetPost(id)
+	if err != nil || post.IsDeleted() || post.IsDraft() || post.IsMerged() {
+		RenderError(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	if post.IsLocked() {
+		RenderError(w, "This thread is locked to new comments", http.StatusForbidden)
+		return
+	}
+
+	content := strings.TrimSpace(r.FormValue("content"))
+	if user.IsStaff() {
+		if content, err = withSnippet(r, content, post.Author.Username, user.Username, post.Title); err != nil {
+			RenderError(w, "Failed to save comment: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	// parent_id is set by the reply forms under each comment
+	parentID, _ := strconv.Atoi(r.FormValue("parent_id"))
+	if err := CommentLength.Check(content); err != nil {
+		renderPostPage(w, r, user, post, CommentForm{Content: content, ParentID: parentID, Error: "Couldn't save the comment: " + err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	tx, err := RequestTx(r)
+	if err != nil {
+		RenderError(w, "Failed to save comment", http.StatusInternalServerError)
+		return
+	}
+	commentID, err := addComment(tx, post.ID, parentID, user.UUID, content)
+	if errors.Is(err, errNoParentComment) {
+		RenderError(w, "Failed to save comment: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		RenderError(w, "Failed to save comment", http.StatusInternalServerError)
+		return
+	}
+	if err := recordMentions(tx, post.ID, commentID, user.UUID, content); err != nil {
+		RenderError(w, "Failed to save comment", http.StatusInternalServerError)
+		return
+	}
+	if err := notifyComment(tx, post, parentID, commentID, user.UUID); err != nil {
+		RenderError(w, "Failed to save comment", http.StatusInternalServerError)
+		return
+	}
+	// Only the comment form at the bottom of the page keeps a draft
+	if parentID == 0 {
+		if err := discardCommentDraft(tx, post.ID, user.UUID); err != nil {
+			RenderError(w, "Failed to save comment", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if watch, _ := db.GetBoolPreference(user.UUID, PrefWatchCommented); watch {
+		if err := watchCommentedPost(tx, post, user.UUID); err != nil {
+			RenderError(w, "Failed to save comment", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	http.Redirect(w, r, CommentLink("", post.ID, commentID), http.StatusSeeOther)
+}
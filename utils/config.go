@@ -0,0 +1,188 @@
+package utils
+
+import (
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DevMode enables developer diagnostics such as stack traces on error pages.
+// It is switched on by running the server with FORUM_ENV=dev.
+var DevMode = os.Getenv("FORUM_ENV") == "dev"
+
+// TranslateURL is the base URL of a LibreTranslate-compatible service used to
+// translate posts, and TranslateKey its optional API key. Translation is
+// unavailable while FORUM_TRANSLATE_URL is unset.
+var (
+	TranslateURL = os.Getenv("FORUM_TRANSLATE_URL")
+	TranslateKey = os.Getenv("FORUM_TRANSLATE_KEY")
+)
+
+// SummarizeURL is the endpoint of a service that writes summaries of long
+// threads, and SummarizeKey its optional bearer token. Threads with at
+// least SummaryMinComments comments are summarized, and summarized again
+// once SummaryRefreshComments more have arrived. Summaries are off while
+// FORUM_SUMMARIZE_URL is unset.
+var (
+	SummarizeURL           = os.Getenv("FORUM_SUMMARIZE_URL")
+	SummarizeKey           = os.Getenv("FORUM_SUMMARIZE_KEY")
+	SummaryMinComments     = max(envInt("FORUM_SUMMARY_MIN_COMMENTS", 20), 1)
+	SummaryRefreshComments = max(envInt("FORUM_SUMMARY_REFRESH_COMMENTS", 10), 1)
+)
+
+// FederationDomain is the public host name the forum is served under. Setting
+// FORUM_FEDERATION_DOMAIN opts in to ActivityPub federation of categories.
+var FederationDomain = os.Getenv("FORUM_FEDERATION_DOMAIN")
+
+// TestMode makes the server deterministic for end-to-end tests: the clock
+// stands still at FORUM_TEST_CLOCK until moved through /test/clock, user IDs
+// are sequential, and background jobs only run when triggered through
+// /test/jobs/{name}. It is switched on with FORUM_ENV=test.
+var (
+	TestMode       = os.Getenv("FORUM_ENV") == "test"
+	TestClockStart = envOr("FORUM_TEST_CLOCK", "2025-01-01T00:00:00Z")
+)
+
+// BcryptCost is the bcrypt work factor for new password hashes, set with
+// FORUM_BCRYPT_COST. CheckPasswordHashing validates it at startup.
+var BcryptCost = envInt("FORUM_BCRYPT_COST", DefaultCost)
+
+// DBSizeLimitMB and DBRowLimit are soft quotas on the database, set with
+// FORUM_DB_SIZE_LIMIT_MB and FORUM_DB_ROW_LIMIT. Nothing is refused when they
+// are exceeded; the storage job only raises an alert. 0 turns a quota off.
+var (
+	DBSizeLimitMB = envInt("FORUM_DB_SIZE_LIMIT_MB", 0)
+	DBRowLimit    = envInt("FORUM_DB_ROW_LIMIT", 0)
+)
+
+// ErrorWebhook is a URL that internal errors and alerts are posted to as
+// JSON, set with FORUM_ERROR_WEBHOOK. They are only logged while it is unset.
+var ErrorWebhook = os.Getenv("FORUM_ERROR_WEBHOOK")
+
+// MetricsToken lets a scraper read /metrics with an
+// "Authorization: Bearer <token>" header, set with FORUM_METRICS_TOKEN.
+// Without it only signed-in admins can read the metrics.
+var MetricsToken = os.Getenv("FORUM_METRICS_TOKEN")
+
+// IntegrityRepair lets the integrity job fix the orphaned rows it finds
+// instead of only reporting them, set with FORUM_INTEGRITY_REPAIR=1
+var IntegrityRepair = os.Getenv("FORUM_INTEGRITY_REPAIR") == "1"
+
+// LinkPreviews turns bare URLs in posts into preview cards, fetched from
+// the linked sites by the server, set with FORUM_LINK_PREVIEWS=1
+var LinkPreviews = os.Getenv("FORUM_LINK_PREVIEWS") == "1"
+
+// ThemeDir is a directory whose partials/*.html replace the built-in
+// partials of the same name, set with FORUM_THEME_DIR
+var ThemeDir = os.Getenv("FORUM_THEME_DIR")
+
+// SiteURL is the address the forum is reached at, set with FORUM_SITE_URL.
+// Absolute links in emails, feeds and exports are built from it, never
+// from a request's Host header, which the client controls.
+var SiteURL = envOr("FORUM_SITE_URL", "http://localhost:8080")
+
+// MailConfigFile is an optional file of KEY=value lines setting up outgoing
+// email, set with FORUM_MAIL_CONFIG. It takes the same settings as the
+// environment, which wins over it: FORUM_MAIL_BACKEND picks smtp, log or
+// none, and defaults to smtp when FORUM_SMTP_HOST is set and to writing
+// mail to the log otherwise. FORUM_SMTP_PORT, 587 by default,
+// FORUM_SMTP_USERNAME and FORUM_SMTP_PASSWORD reach the server, and
+// FORUM_MAIL_FROM is the sender address.
+var MailConfigFile = os.Getenv("FORUM_MAIL_CONFIG")
+
+// DigestVelocityThreshold is how many posts, comments and reactions an
+// account creates in a day before the moderation digest points it out, set
+// with FORUM_DIGEST_VELOCITY
+var DigestVelocityThreshold = max(envInt("FORUM_DIGEST_VELOCITY", 50), 1)
+
+// InactivityWarnMonths, InactivityLockMonths and InactivityAnonymizeMonths
+// set the lifecycle of unused accounts: after that many months without
+// use their owner is warned by email, the account is locked until a new
+// password is chosen, and finally it is anonymized. Set them with
+// FORUM_INACTIVITY_WARN_MONTHS, FORUM_INACTIVITY_LOCK_MONTHS and
+// FORUM_INACTIVITY_ANONYMIZE_MONTHS; 0, the default, skips that stage.
+var (
+	InactivityWarnMonths      = envInt("FORUM_INACTIVITY_WARN_MONTHS", 0)
+	InactivityLockMonths      = envInt("FORUM_INACTIVITY_LOCK_MONTHS", 0)
+	InactivityAnonymizeMonths = envInt("FORUM_INACTIVITY_ANONYMIZE_MONTHS", 0)
+)
+
+// EmbedProviders lists the video sites whose links in posts play in place,
+// comma-separated, set with FORUM_EMBED_PROVIDERS. The known providers are
+// youtube and vimeo; "none" turns embeds off.
+var EmbedProviders = envOr("FORUM_EMBED_PROVIDERS", "youtube,vimeo")
+
+// ArchiveAfterDays is how long a thread can go without new comments or
+// edits before it is archived, set with FORUM_ARCHIVE_AFTER_DAYS, for
+// example 90. The default of 0 never archives.
+var ArchiveAfterDays = max(envInt("FORUM_ARCHIVE_AFTER_DAYS", 0), 0)
+
+// CommentMaxDepth is how deeply replies to comments are indented, set
+// with FORUM_COMMENT_MAX_DEPTH. Replies can go deeper but are shown at
+// this depth.
+var CommentMaxDepth = max(envInt("FORUM_COMMENT_MAX_DEPTH", 4), 0)
+
+// CommentCollapseDepth is the depth from which replies are collapsed on
+// post pages until their thread is opened, set with
+// FORUM_COMMENT_COLLAPSE_DEPTH. 0 shows every reply.
+var CommentCollapseDepth = max(envInt("FORUM_COMMENT_COLLAPSE_DEPTH", 3), 0)
+
+// CommentEditWindow is how long after posting a comment its author can
+// still edit or delete it, set in minutes with FORUM_COMMENT_EDIT_MINUTES.
+// Staff can edit and delete comments at any time; 0 lifts the limit.
+var CommentEditWindow = time.Duration(max(envInt("FORUM_COMMENT_EDIT_MINUTES", 15), 0)) * time.Minute
+
+// CommentDraftDays is how long an unsent comment is kept for its author
+// to come back to, set with FORUM_COMMENT_DRAFT_DAYS
+var CommentDraftDays = max(envInt("FORUM_COMMENT_DRAFT_DAYS", 7), 1)
+
+// CommentsPerPage is how many top-level comments a post page shows at a
+// time, each with all of its replies, set with FORUM_COMMENTS_PER_PAGE
+var CommentsPerPage = max(envInt("FORUM_COMMENTS_PER_PAGE", 50), 1)
+
+// ReactionEmojis are the emoji reactions offered on posts and comments, in
+// order, set with FORUM_REACTIONS as a space-separated list. "none" turns
+// them off.
+var ReactionEmojis = slices.DeleteFunc(strings.Fields(envOr("FORUM_REACTIONS", "❤️ 😂 🎉 👀")), func(s string) bool {
+	return s == "none"
+})
+
+// PostsPerPage is how many posts a listing shows per page, set with
+// FORUM_POSTS_PER_PAGE
+var PostsPerPage = max(envInt("FORUM_POSTS_PER_PAGE", 20), 1)
+
+// TitleLength, BodyLength and CommentLength bound what can be posted, in
+// characters. Set them with FORUM_TITLE_MIN_LENGTH, FORUM_TITLE_MAX_LENGTH
+// and the same for FORUM_BODY and FORUM_COMMENT; a maximum of 0 turns it off.
+// Drafts only have to respect the maximum body length.
+var (
+	TitleLength   = envLengthLimit("title", "FORUM_TITLE", 1, 200)
+	BodyLength    = envLengthLimit("body", "FORUM_BODY", 1, 50000)
+	CommentLength = envLengthLimit("comment", "FORUM_COMMENT", 1, 10000)
+)
+
+// envOr returns the environment variable key, or fallback when it is unset
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// envInt returns the environment variable key as an integer, or fallback
+// when it is unset or not a number
+func envInt(key string, fallback int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("Ignoring %s=%q: not a number", key, v)
+		return fallback
+	}
+	return n
+}
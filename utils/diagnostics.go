@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// diagnosticsTemplate is kept in code so it still renders when the
+// templates directory itself is what's broken
+var diagnosticsTemplate = template.Must(template.New("diagnostics").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <title>500 - {{.Title}}</title>
+    <style>
+        body { font-family: monospace; background: #191414; color: #f8fafc; padding: 2rem; }
+        h1 { color: #ff4c4c; }
+        h2 { color: #ff6b6b; margin-top: 2rem; }
+        pre { background: #0f172a; padding: 1rem; border-radius: 8px; overflow-x: auto; white-space: pre-wrap; }
+    </style>
+</head>
+<body>
+    <h1>500 - {{.Title}}</h1>
+    <p>Shown because the server runs with FORUM_ENV=dev.</p>
+    <h2>Error</h2>
+    <pre>{{.Error}}</pre>
+    {{if .Template}}<h2>Template</h2><pre>{{.Template}}</pre>{{end}}
+    {{if .Data}}<h2>Data</h2><pre>{{.Data}}</pre>{{end}}
+    {{if .Stack}}<h2>Stack trace</h2><pre>{{.Stack}}</pre>{{end}}
+</body>
+</html>`))
+
+// Diagnostics describes an internal error for the dev-mode error page
+type Diagnostics struct {
+	Title    string `json:"title"`
+	Error    string `json:"error"`
+	Template string `json:"template,omitempty"`
+	Data     string `json:"data,omitempty"`
+	Stack    string `json:"stack,omitempty"`
+}
+
+// errorWebhookClient posts reports to ErrorWebhook
+var errorWebhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// ReportError is the error-reporting hook. Every report is logged, and
+// also posted to ErrorWebhook when one is configured. Posting happens in
+// the background so a slow webhook never holds up a request.
+func ReportError(d Diagnostics) {
+	log.Printf("%s: %s", d.Title, d.Error)
+	if ErrorWebhook == "" {
+		return
+	}
+
+	body, err := json.Marshal(d)
+	if err != nil {
+		log.Println("Failed to encode error report:", err)
+		return
+	}
+	go func() {
+		resp, err := errorWebhookClient.Post(ErrorWebhook, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Println("Failed to post error report:", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("Error webhook answered %s", resp.Status)
+		}
+	}()
+}
+
+// RenderInternalError reports a 500. In dev mode the full diagnostics are
+// shown; in production the user only gets the generic error page.
+func RenderInternalError(w http.ResponseWriter, d Diagnostics) {
+	ReportError(d)
+	if !DevMode {
+		RenderError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := diagnosticsTemplate.Execute(&buf, d); err != nil {
+		log.Println("Diagnostics template error:", err)
+		http.Error(w, d.Title+": "+d.Error, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusInternalServerError)
+	buf.WriteTo(w)
+}
+
+// renderTemplateError reports a template that failed to parse or execute
+func renderTemplateError(w http.ResponseWriter, file string, data interface{}, err error) {
+	RenderInternalError(w, Diagnostics{
+		Title:    "Template error",
+		Error:    err.Error(),
+		Template: file,
+		Data:     fmt.Sprintf("%+v", data),
+		Stack:    string(debug.Stack()),
+	})
+}
+
+// RecoverPanics turns a panic in any handler into a 500 response instead of
+// a dropped connection
+func RecoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				// Let net/http handle its own sentinel for aborted responses
+				if rec == http.ErrAbortHandler {
+					panic(rec)
+				}
+				RenderInternalError(w, Diagnostics{
+					Title: "Panic in " + r.Method + " " + r.URL.Path,
+					Error: fmt.Sprint(rec),
+					Stack: string(debug.Stack()),
+				})
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,186 @@
+package utils
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+// Moderation digest frequencies a staff member can pick in their settings
+const (
+	DigestOff    = "off"
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+)
+
+// DigestFrequencies lists the choices offered on the settings page
+var DigestFrequencies = []string{DigestOff, DigestDaily, DigestWeekly}
+
+// digestIntervals is how long a digest waits after the last one was sent
+var digestIntervals = map[string]time.Duration{
+	DigestDaily:  24 * time.Hour,
+	DigestWeekly: 7 * 24 * time.Hour,
+}
+
+// digestQueue is one part of the moderation queue counted in the digest.
+// Query counts what is waiting; @since is a day ago and @velocity is
+// DigestVelocityThreshold.
+type digestQueue struct {
+	Label string
+	Path  string
+	Query string
+}
+
+// digestQueues lists what the moderation digest reports on
+var digestQueues = []digestQueue{
+	{
+		Label: "Reported posts and comments",
+		Path:  "/admin/reports",
+		Query: "SELECT COUNT(*) FROM (SELECT DISTINCT post_id, comment_id FROM reports WHERE status = 'open')",
+	},
+	{
+		Label: "Pending ban appeals",
+		Path:  "/admin/appeals",
+		Query: "SELECT COUNT(*) FROM ban_appeals WHERE status = 'pending'",
+	},
+	{
+		Label: "Accounts with unusually high activity in the last day",
+		Path:  "/admin/velocity?window=day",
+		Query: `SELECT COUNT(*) FROM (
+			SELECT uuid FROM (
+				SELECT author_uuid AS uuid FROM posts WHERE created_at >= @since
+				UNION ALL
+				SELECT comment_author_uuid FROM comments WHERE created_at >= @since
+				UNION ALL
+				SELECT user_uuid FROM interactions WHERE created_at >= @since
+				UNION ALL
+				SELECT user_uuid FROM comment_interactions WHERE created_at >= @since
+				UNION ALL
+				SELECT user_uuid FROM reactions WHERE created_at >= @since
+			) GROUP BY uuid HAVING COUNT(*) >= @velocity
+		)`,
+	},
+}
+
+// DigestItem is one line of the moderation digest
+type DigestItem struct {
+	Label string
+	Count int
+	Link  string
+}
+
+// DigestMailData is passed to the moderation digest email template
+type DigestMailData struct {
+	Recipient    string
+	Items        []DigestItem
+	SettingsLink string
+}
+
+// ModerationQueue counts what is waiting in each of digestQueues, leaving
+// out the empty ones
+func (db *DataBase) ModerationQueue() ([]DigestItem, error) {
+	args := []interface{}{
+		sql.Named("since", FormatTimestamp(Now().Add(-24*time.Hour))),
+		sql.Named("velocity", DigestVelocityThreshold),
+	}
+
+	var items []DigestItem
+	for _, q := range digestQueues {
+		var n int
+		if err := db.Conn.QueryRow(q.Query, args...).Scan(&n); err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			items = append(items, DigestItem{Label: q.Label, Count: n, Link: SiteURL + q.Path})
+		}
+	}
+	return items, nil
+}
+
+// digestRecipient is a staff member who may get the moderation digest
+type digestRecipient struct {
+	UUID, Username, Email string
+	LastSent              time.Time
+}
+
+// listDigestRecipients returns staff and when they were last sent a digest
+func (db *DataBase) listDigestRecipients() ([]digestRecipient, error) {
+	rows, err := db.Conn.Query(
+		`SELECT u.uuid, u.username, u.email, COALESCE(d.sent_at, '')
+		FROM users u LEFT JOIN mod_digests d ON d.user_uuid = u.uuid
+		WHERE u.role IN (?, ?)`,
+		RoleModerator, RoleAdmin,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []digestRecipient
+	for rows.Next() {
+		var (
+			d      digestRecipient
+			sentAt string
+		)
+		if err := rows.Scan(&d.UUID, &d.Username, &d.Email, &sentAt); err != nil {
+			return nil, err
+		}
+		d.LastSent, _ = ParseTimestamp(sentAt)
+		list = append(list, d)
+	}
+	return list, rows.Err()
+}
+
+// markDigestSent records that a staff member was just sent a digest
+func (db *DataBase) markDigestSent(uuid string) error {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	_, err := db.Conn.Exec(
+		`INSERT INTO mod_digests (user_uuid, sent_at) VALUES (?, ?)
+		ON CONFLICT(user_uuid) DO UPDATE SET sent_at = excluded.sent_at`,
+		uuid, Timestamp(),
+	)
+	return err
+}
+
+// SendModerationDigests emails each staff member whose digest is due a
+// summary of the moderation queue. Nothing is sent while the queue is
+// empty, so the next digest goes out as soon as something comes in.
+func SendModerationDigests() error {
+	items, err := db.ModerationQueue()
+	if err != nil || len(items) == 0 {
+		return err
+	}
+	recipients, err := db.listDigestRecipients()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, d := range recipients {
+		frequency, err := db.GetPreference(d.UUID, PrefModDigest)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		interval, ok := digestIntervals[frequency]
+		if !ok || Now().Sub(d.LastSent) < interval {
+			continue
+		}
+
+		data := DigestMailData{Recipient: d.Username, Items: items, SettingsLink: SiteURL + "/settings"}
+		if err := SendTemplateMail(d.Email, "Moderation queue digest", "mod_digest", data); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := db.markDigestSent(d.UUID); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		log.Printf("Failed to send %d of %d moderation digests", len(errs), len(recipients))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// embedProvider turns links to a video site into the address of its
+// player, or "" when the link isn't to a video
+type embedProvider func(u *url.URL) string
+
+var (
+	youtubeID = regexp.MustCompile(`^[A-Za-z0-9_-]{11}$`)
+	vimeoID   = regexp.MustCompile(`^[0-9]+$`)
+)
+
+// embedProviders are the video sites that can be embedded, by the names
+// used in EmbedProviders. Players are loaded from their privacy-enhanced
+// variants, which don't track viewers until they press play.
+var embedProviders = map[string]embedProvider{
+	"youtube": func(u *url.URL) string {
+		var id string
+		switch strings.TrimPrefix(u.Hostname(), "www.") {
+		case "youtube.com", "m.youtube.com":
+			if u.Path == "/watch" {
+				id = u.Query().Get("v")
+			} else if rest, ok := strings.CutPrefix(u.Path, "/shorts/"); ok {
+				id = rest
+			}
+		case "youtu.be":
+			id = strings.TrimPrefix(u.Path, "/")
+		}
+		if !youtubeID.MatchString(id) {
+			return ""
+		}
+		return "https://www.youtube-nocookie.com/embed/" + id
+	},
+	"vimeo": func(u *url.URL) string {
+		if strings.TrimPrefix(u.Hostname(), "www.") != "vimeo.com" {
+			return ""
+		}
+		id := strings.TrimPrefix(u.Path, "/")
+		if !vimeoID.MatchString(id) {
+			return ""
+		}
+		return "https://player.vimeo.com/video/" + id + "?dnt=1"
+	},
+}
+
+// videoEmbedURL returns the player address for a link to a video on one of
+// the enabled providers, or ""
+func videoEmbedURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	for _, name := range strings.Split(EmbedProviders, ",") {
+		if provider, ok := embedProviders[strings.TrimSpace(name)]; ok {
+			if src := provider(u); src != "" {
+				return src
+			}
+		}
+	}
+	return ""
+}
+
+// videoLinkParagraph matches a paragraph holding nothing but a bare URL, as
+// RenderMarkdown writes it
+var videoLinkParagraph = regexp.MustCompile(`<p><a href="(https?://[^"]*)" rel="nofollow ugc noopener">([^<]*)</a></p>`)
+
+// embedVideos replaces bare video links that sit on a line of their own
+// with the provider's player. Links with text of their own, or in the
+// middle of a sentence, stay links. The player address is built from the
+// video id alone, never copied from the post, so the sanitized output
+// can't be used to frame anything else.
+func embedVideos(rendered string) string {
+	return videoLinkParagraph.ReplaceAllStringFunc(rendered, func(p string) string {
+		m := videoLinkParagraph.FindStringSubmatch(p)
+		if m[1] != m[2] {
+			return p
+		}
+		src := videoEmbedURL(html.UnescapeString(m[1]))
+		if src == "" {
+			return p
+		}
+		return `<div class="video-embed"><iframe src="` + html.EscapeString(src) + `" title="Embedded video"` +
+			` loading="lazy" allow="fullscreen; picture-in-picture; encrypted-media" referrerpolicy="strict-origin"` +
+			` sandbox="allow-scripts allow-same-origin allow-presentation allow-popups"></iframe></div>`
+	})
+}
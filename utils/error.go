@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"bytes"
 	"html/template"
 	"log"
 	"net/http"
@@ -13,12 +14,22 @@ func RenderError(w http.ResponseWriter, message string, statusCode int) {
 		log.Println("Template parse error in RenderError:", err)
 		return
 	}
-	w.WriteHeader(statusCode)
-	err = tmpl.Execute(w, map[string]interface{}{
+
+	// Render into a buffer first so a failure doesn't leave a half-written page
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, map[string]interface{}{
 		"StatusCode": statusCode,
 		"Message":    message,
 	})
 	if err != nil {
 		log.Println("Template execute error in RenderError:", err)
+		http.Error(w, message, statusCode)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(statusCode)
+	if _, err := buf.WriteTo(w); err != nil {
+		log.Println("Failed to write error page:", err)
 	}
 }
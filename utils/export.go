@@ -0,0 +1,394 @@
+package utils
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Export statuses
+const (
+	ExportPending = "pending"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+// ExportDir is where finished data export archives are written
+const ExportDir = "cache/exports"
+
+// ExportRetention is how long an export stays downloadable
+const ExportRetention = 7 * 24 * time.Hour
+
+// UserArchive is the content of data.json in a data export
+type UserArchive struct {
+	GeneratedAt string            `json:"generated_at"`
+	Profile     ArchiveProfile    `json:"profile"`
+	Preferences map[string]string `json:"preferences"`
+	Sessions    []ArchiveSession  `json:"sessions"`
+	Posts       []ArchivePost     `json:"posts"`
+	Comments    []ArchiveComment  `json:"comments"`
+	Reactions   []ArchiveReaction `json:"reactions"`
+}
+
+// ArchiveProfile holds the account details in an export
+type ArchiveProfile struct {
+	Username       string `json:"username"`
+	Email          string `json:"email"`
+	Role           string `json:"role"`
+	SuspendedUntil string `json:"suspended_until,omitempty"`
+}
+
+// ArchiveSession describes a login session in an export. Sessions aren't
+// stored individually, so this is the current one.
+type ArchiveSession struct {
+	LastSeen string `json:"last_seen"`
+	Active   bool   `json:"active"`
+}
+
+// ArchivePost is a post in an export
+type ArchivePost struct {
+	ID        int    `json:"id"`
+	Title     string `json:"title"`
+	Content   string `json:"content"`
+	CreatedAt string `json:"created_at"`
+}
+
+// ArchiveComment is a comment in an export
+type ArchiveComment struct {
+	ID        int    `json:"id"`
+	PostID    int    `json:"post_id"`
+	Content   string `json:"content"`
+	CreatedAt string `json:"created_at"`
+}
+
+// ArchiveReaction is a like, dislike or emoji reaction in an export, of a
+// post or of one of its comments
+type ArchiveReaction struct {
+	PostID    int    `json:"post_id"`
+	CommentID int    `json:"comment_id,omitempty"`
+	Reaction  string `json:"reaction"`
+	CreatedAt string `json:"created_at"`
+}
+
+// RequestDataExport queues an export of the user's data
+func (db *DataBase) RequestDataExport(uuid string) error {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	var pending int
+	err := db.Conn.QueryRow(
+		"SELECT COUNT(*) FROM data_exports WHERE user_uuid = ? AND status = ?", uuid, ExportPending,
+	).Scan(&pending)
+	if err != nil {
+		return err
+	}
+	if pending > 0 {
+		return errors.New("an export is already being prepared")
+	}
+
+	_, err = db.Conn.Exec(
+		"INSERT INTO data_exports (user_uuid, status, created_at) VALUES (?, ?, ?)",
+		uuid, ExportPending, Timestamp(),
+	)
+	return err
+}
+
+// ListDataExports returns a user's exports, newest first
+func (db *DataBase) ListDataExports(uuid string) ([]DataExport, error) {
+	rows, err := db.Conn.Query(
+		"SELECT id, status, created_at, completed_at FROM data_exports WHERE user_uuid = ? ORDER BY id DESC",
+		uuid,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var exports []DataExport
+	for rows.Next() {
+		var (
+			e                      DataExport
+			createdAt, completedAt string
+		)
+		if err := rows.Scan(&e.ID, &e.Status, &createdAt, &completedAt); err != nil {
+			return nil, err
+		}
+		e.CreatedAt, _ = ParseTimestamp(createdAt)
+		e.CompletedAt, _ = ParseTimestamp(completedAt)
+		exports = append(exports, e)
+	}
+	return exports, rows.Err()
+}
+
+// CollectUserArchive gathers everything stored about a user
+func (db *DataBase) CollectUserArchive(uuid string) (*UserArchive, error) {
+	archive := &UserArchive{
+		GeneratedAt: Timestamp(),
+		Sessions:    []ArchiveSession{},
+		Posts:       []ArchivePost{},
+		Comments:    []ArchiveComment{},
+		Reactions:   []ArchiveReaction{},
+	}
+
+	var (
+		session   ArchiveSession
+		suspended string
+		p         = &archive.Profile
+	)
+	err := db.Conn.QueryRow(
+		"SELECT username, email, role, suspendeduntil, lastseen, loggedin FROM users WHERE uuid = ?", uuid,
+	).Scan(&p.Username, &p.Email, &p.Role, &suspended, &session.LastSeen, &session.Active)
+	if err != nil {
+		return nil, err
+	}
+	if until, _ := ParseTimestamp(suspended); Now().Before(until) {
+		p.SuspendedUntil = FormatTimestamp(until)
+	}
+	archive.Sessions = append(archive.Sessions, session)
+
+	if archive.Preferences, err = db.GetPreferences(uuid); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Conn.Query("SELECT id, title, content, created_at FROM posts WHERE author_uuid = ? ORDER BY id", uuid)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var post ArchivePost
+		if err := rows.Scan(&post.ID, &post.Title, &post.Content, &post.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		archive.Posts = append(archive.Posts, post)
+	}
+	rows.Close()
+
+	rows, err = db.Conn.Query("SELECT id, post_id, content, created_at FROM comments WHERE comment_author_uuid = ? ORDER BY id", uuid)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var c ArchiveComment
+		if err := rows.Scan(&c.ID, &c.PostID, &c.Content, &c.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		archive.Comments = append(archive.Comments, c)
+	}
+	rows.Close()
+
+	rows, err = db.Conn.Query(
+		`SELECT post_id, 0, CASE WHEN liked THEN 'like' ELSE 'dislike' END, created_at
+		FROM interactions WHERE user_uuid = ? AND (liked OR disliked)
+		UNION ALL
+		SELECT c.post_id, ci.comment_id, CASE WHEN ci.liked THEN 'like' ELSE 'dislike' END, ci.created_at
+		FROM comment_interactions ci JOIN comments c ON c.id = ci.comment_id
+		WHERE ci.user_uuid = ? AND (ci.liked OR ci.disliked)
+		UNION ALL
+		SELECT post_id, comment_id, emoji, created_at FROM reactions WHERE user_uuid = ?
+		ORDER BY 4`,
+		uuid, uuid, uuid,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var re ArchiveReaction
+		if err := rows.Scan(&re.PostID, &re.CommentID, &re.Reaction, &re.CreatedAt); err != nil {
+			return nil, err
+		}
+		archive.Reactions = append(archive.Reactions, re)
+	}
+	return archive, rows.Err()
+}
+
+// writeExportArchive writes the archive as data.json inside a zip file
+func writeExportArchive(path string, archive *UserArchive) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	zw := zip.NewWriter(f)
+	entry, err := zw.Create("data.json")
+	if err == nil {
+		enc := json.NewEncoder(entry)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(archive)
+	}
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// buildDataExport builds one pending export and records the outcome
+func (db *DataBase) buildDataExport(id int, uuid string) error {
+	status, file := ExportReady, filepath.Join(ExportDir, strconv.Itoa(id)+".zip")
+
+	archive, err := db.CollectUserArchive(uuid)
+	if err == nil {
+		err = writeExportArchive(file, archive)
+	}
+	if err != nil {
+		log.Printf("Data export %d failed: %v", id, err)
+		status, file = ExportFailed, ""
+	}
+
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	_, err = db.Conn.Exec(
+		"UPDATE data_exports SET status = ?, file = ?, completed_at = ? WHERE id = ?",
+		status, file, Timestamp(), id,
+	)
+	return err
+}
+
+// ProcessDataExports builds pending exports and deletes expired ones.
+// It runs as a scheduler job.
+func ProcessDataExports() error {
+	if err := os.MkdirAll(ExportDir, 0o755); err != nil {
+		return err
+	}
+
+	rows, err := db.Conn.Query("SELECT id, user_uuid FROM data_exports WHERE status = ? ORDER BY id", ExportPending)
+	if err != nil {
+		return err
+	}
+	type pendingExport struct {
+		id   int
+		uuid string
+	}
+	var pending []pendingExport
+	for rows.Next() {
+		var p pendingExport
+		if err := rows.Scan(&p.id, &p.uuid); err != nil {
+			rows.Close()
+			return err
+		}
+		pending = append(pending, p)
+	}
+	rows.Close()
+
+	for _, p := range pending {
+		if err := db.buildDataExport(p.id, p.uuid); err != nil {
+			return err
+		}
+	}
+
+	return db.purgeDataExports()
+}
+
+// purgeDataExports deletes exports older than ExportRetention with their files
+func (db *DataBase) purgeDataExports() error {
+	cutoff := FormatTimestamp(Now().Add(-ExportRetention))
+
+	rows, err := db.Conn.Query("SELECT file FROM data_exports WHERE created_at < ? AND status != ?", cutoff, ExportPending)
+	if err != nil {
+		return err
+	}
+	var files []string
+	for rows.Next() {
+		var file string
+		if err := rows.Scan(&file); err != nil {
+			rows.Close()
+			return err
+		}
+		files = append(files, file)
+	}
+	rows.Close()
+
+	for _, file := range files {
+		if file != "" {
+			if err := os.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	_, err = db.Conn.Exec("DELETE FROM data_exports WHERE created_at < ? AND status != ?", cutoff, ExportPending)
+	return err
+}
+
+// DataExportHandler handles GET and POST /settings/export.
+// POST queues a new export for the background job.
+func DataExportHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := CurrentUser(w, r)
+	if err != nil || user.NotRegistered {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		exports, err := db.ListDataExports(user.UUID)
+		if err != nil {
+			RenderError(w, "Failed to load exports", http.StatusInternalServerError)
+			return
+		}
+		loc := db.GetLocationPreference(user.UUID)
+		for i := range exports {
+			exports[i].CreatedAt = exports[i].CreatedAt.In(loc)
+			exports[i].CompletedAt = exports[i].CompletedAt.In(loc)
+		}
+		InitTemplate(w, "templates/export.html", map[string]interface{}{
+			"Exports":       exports,
+			"RetentionDays": int(ExportRetention.Hours() / 24),
+		})
+
+	case http.MethodPost:
+		if err := db.RequestDataExport(user.UUID); err != nil {
+			RenderError(w, "Failed to request export: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, "/settings/export", http.StatusSeeOther)
+
+	default:
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// DownloadExportHandler handles GET /settings/export/{id}
+func DownloadExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	// Only the owner's own ready exports can be downloaded
+	var file string
+	err = db.Conn.QueryRow(
+		"SELECT file FROM data_exports WHERE id = ? AND user_uuid = ? AND status = ?",
+		r.PathValue("id"), user.UUID, ExportReady,
+	).Scan(&file)
+	if err != nil {
+		RenderError(w, "Export not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", `attachment; filename="forumhub-data.zip"`)
+	http.ServeFile(w, r, file)
+}
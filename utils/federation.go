@@ -0,0 +1,630 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ActivityPub media types and contexts
+const (
+	activityContentType = "application/activity+json"
+	activityStreamsNS   = "https://www.w3.org/ns/activitystreams"
+	securityNS          = "https://w3id.org/security/v1"
+	publicAudience      = activityStreamsNS + "#Public"
+)
+
+// FederationOutboxSize is how many recent posts a category outbox lists
+const FederationOutboxSize = 20
+
+// maxInboxBody caps the size of activities accepted by inboxes
+const maxInboxBody = 1 << 20
+
+// federationClient fetches remote actors and delivers activities. Remote
+// servers choose the actor and inbox URLs, so like linkPreviewClient it
+// only reaches public hosts and ignores proxy settings.
+var federationClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 5 * time.Second, Control: dialPublic}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+}
+
+// FederationEnabled reports whether ActivityPub federation is switched on
+func FederationEnabled() bool {
+	return FederationDomain != ""
+}
+
+// federationBaseURL is the public origin used in ActivityPub IDs.
+// Dev mode uses plain http so federation can be tried out locally.
+func federationBaseURL() string {
+	if DevMode {
+		return "http://" + FederationDomain
+	}
+	return "https://" + FederationDomain
+}
+
+func categoryActorID(categoryID int) string {
+	return federationBaseURL() + "/ap/category/" + strconv.Itoa(categoryID)
+}
+
+func postObjectID(postID int) string {
+	return federationBaseURL() + "/ap/post/" + strconv.Itoa(postID)
+}
+
+// categoryHandle is the user part of a category's fediverse handle.
+// It uses the ID so renaming a category doesn't break follows.
+func categoryHandle(categoryID int) string {
+	return "category-" + strconv.Itoa(categoryID)
+}
+
+// federationKey holds the instance signing key once loaded
+var federationKey struct {
+	sync.Mutex
+	key *rsa.PrivateKey
+}
+
+// FederationKey returns the key every category actor signs with,
+// generating and storing it on first use
+func (db *DataBase) FederationKey() (*rsa.PrivateKey, error) {
+	federationKey.Lock()
+	defer federationKey.Unlock()
+	if federationKey.key != nil {
+		return federationKey.key, nil
+	}
+
+	var stored string
+	err := db.Conn.QueryRow("SELECT private_key FROM federation_keys WHERE id = 1").Scan(&stored)
+	switch {
+	case err == nil:
+		block, _ := pem.Decode([]byte(stored))
+		if block == nil {
+			return nil, errors.New("stored federation key is invalid")
+		}
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		federationKey.key = key
+
+	case errors.Is(err, sql.ErrNoRows):
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		encoded := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+		db.Write.Lock()
+		_, err = db.Conn.Exec("INSERT INTO federation_keys (id, private_key) VALUES (1, ?)", string(encoded))
+		db.Write.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		federationKey.key = key
+
+	default:
+		return nil, err
+	}
+	return federationKey.key, nil
+}
+
+// postArticle renders a post as an ActivityPub Article published by a category
+func postArticle(post *Post, categoryID int, published string) map[string]interface{} {
+	content := "<p>" + strings.ReplaceAll(html.EscapeString(post.Content), "\n", "<br>") + "</p>"
+	return map[string]interface{}{
+		"id":           postObjectID(post.ID),
+		"type":         "Article",
+		"name":         post.Title,
+		"content":      content,
+		"url":          federationBaseURL() + "/post/" + strconv.Itoa(post.ID),
+		"attributedTo": categoryActorID(categoryID),
+		"published":    published,
+		"to":           []string{publicAudience},
+		"cc":           []string{categoryActorID(categoryID) + "/followers"},
+	}
+}
+
+// createActivity wraps an article in the Create activity sent to followers
+func createActivity(article map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"@context":  activityStreamsNS,
+		"id":        article["id"].(string) + "#create",
+		"type":      "Create",
+		"actor":     article["attributedTo"],
+		"published": article["published"],
+		"to":        article["to"],
+		"cc":        article["cc"],
+		"object":    article,
+	}
+}
+
+// postPublished returns when a post was created, in ActivityPub's format
+func (db *DataBase) postPublished(postID int) string {
+	var createdAt string
+	db.Conn.QueryRow("SELECT created_at FROM posts WHERE id = ?", postID).Scan(&createdAt)
+	t, err := ParseTimestamp(createdAt)
+	if err != nil {
+		return ""
+	}
+	return FormatTimestamp(t)
+}
+
+// remoteActor holds the parts of a remote actor document the forum needs
+type remoteActor struct {
+	ID        string `json:"id"`
+	Inbox     string `json:"inbox"`
+	PublicKey struct {
+		ID           string `json:"id"`
+		Owner        string `json:"owner"`
+		PublicKeyPem string `json:"publicKeyPem"`
+	} `json:"publicKey"`
+}
+
+// checkRemoteURL only lets the forum contact other servers over https
+func checkRemoteURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return errors.New("invalid remote URL")
+	}
+	if u.Scheme != "https" && !(DevMode && u.Scheme == "http") {
+		return errors.New("remote URLs must use https")
+	}
+	return nil
+}
+
+// fetchActor loads a remote actor document
+func fetchActor(actorURL string) (*remoteActor, error) {
+	if err := checkRemoteURL(actorURL); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, actorURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", activityContentType)
+
+	resp, err := federationClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching actor: status %d", resp.StatusCode)
+	}
+
+	var actor remoteActor
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxInboxBody)).Decode(&actor); err != nil {
+		return nil, err
+	}
+	if actor.ID == "" || checkRemoteURL(actor.Inbox) != nil {
+		return nil, errors.New("actor has no usable inbox")
+	}
+	return &actor, nil
+}
+
+// deliver posts a signed activity to a remote inbox on behalf of a category
+func (db *DataBase) deliver(inbox string, categoryID int, activity interface{}) error {
+	if err := checkRemoteURL(inbox); err != nil {
+		return err
+	}
+	key, err := db.FederationKey()
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(activity)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, inbox, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", activityContentType)
+	if err := SignRequest(req, body, categoryActorID(categoryID)+"#main-key", key); err != nil {
+		return err
+	}
+
+	resp, err := federationClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("delivery to %s: status %d", inbox, resp.StatusCode)
+	}
+	return nil
+}
+
+// PublishFederatedPosts delivers new posts to the followers of their
+// categories. Followers only receive posts created after they followed.
+// It runs as a scheduler job and does nothing unless federation is enabled.
+func PublishFederatedPosts() error {
+	if !FederationEnabled() {
+		return nil
+	}
+
+	rows, err := db.Conn.Query(
+		`SELECT p.id, MIN(pc.category_id), f.inbox
+		FROM posts p
+		JOIN post_categories pc ON pc.post_id = p.id
+		JOIN federation_followers f ON f.category_id = pc.category_id AND f.followed_at <= p.created_at
+		WHERE p.deleted_at = '' AND p.status = 'published' AND p.id NOT IN (SELECT post_id FROM federation_published)
+		GROUP BY p.id, f.inbox
+		ORDER BY p.id`,
+	)
+	if err != nil {
+		return err
+	}
+	type delivery struct {
+		postID, categoryID int
+		inbox              string
+	}
+	var deliveries []delivery
+	for rows.Next() {
+		var d delivery
+		if err := rows.Scan(&d.postID, &d.categoryID, &d.inbox); err != nil {
+			rows.Close()
+			return err
+		}
+		deliveries = append(deliveries, d)
+	}
+	rows.Close()
+
+	published := make(map[int]bool)
+	for _, d := range deliveries {
+		post, err := db.GetPost(d.postID)
+		if err != nil {
+			return err
+		}
+		// Deliveries aren't retried; a follower that is down misses the post
+		activity := createActivity(postArticle(post, d.categoryID, db.postPublished(post.ID)))
+		if err := db.deliver(d.inbox, d.categoryID, activity); err != nil {
+			log.Printf("Federation: post %d: %v", d.postID, err)
+		}
+		published[d.postID] = true
+	}
+
+	db.Write.Lock()
+	defer db.Write.Unlock()
+	for postID := range published {
+		if _, err := db.Conn.Exec(
+			"INSERT OR IGNORE INTO federation_published (post_id, published_at) VALUES (?, ?)",
+			postID, Timestamp(),
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeActivityJSON writes an ActivityPub document
+func writeActivityJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", activityContentType)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("JSON encode error:", err)
+	}
+}
+
+// federatedCategory resolves the {id} of a federation request to a category.
+// It answers 404 itself when federation is off or the category is unknown.
+func federatedCategory(w http.ResponseWriter, r *http.Request) (*Category, bool) {
+	if !FederationEnabled() {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	category, err := db.GetCategory(id)
+	if err != nil {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	return category, true
+}
+
+// WebFingerHandler handles GET /.well-known/webfinger?resource=acct:category-{id}@domain
+func WebFingerHandler(w http.ResponseWriter, r *http.Request) {
+	if !FederationEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+
+	resource := r.URL.Query().Get("resource")
+	handle, ok := strings.CutPrefix(resource, "acct:")
+	user, domain, _ := strings.Cut(handle, "@")
+	idText, isCategory := strings.CutPrefix(user, "category-")
+	if !ok || !isCategory || !strings.EqualFold(domain, FederationDomain) {
+		http.NotFound(w, r)
+		return
+	}
+	id, err := strconv.Atoi(idText)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if _, err := db.GetCategory(id); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/jrd+json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"subject": resource,
+		"links": []map[string]string{
+			{"rel": "self", "type": activityContentType, "href": categoryActorID(id)},
+		},
+	})
+}
+
+// CategoryActorHandler handles GET /ap/category/{id}, the category's actor document
+func CategoryActorHandler(w http.ResponseWriter, r *http.Request) {
+	category, ok := federatedCategory(w, r)
+	if !ok {
+		return
+	}
+	key, err := db.FederationKey()
+	if err != nil {
+		http.Error(w, "federation key unavailable", http.StatusInternalServerError)
+		return
+	}
+	publicKey, err := encodePublicKey(&key.PublicKey)
+	if err != nil {
+		http.Error(w, "federation key unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	actor := categoryActorID(category.ID)
+	writeActivityJSON(w, http.StatusOK, map[string]interface{}{
+		"@context":          []string{activityStreamsNS, securityNS},
+		"id":                actor,
+		"type":              "Group",
+		"preferredUsername": categoryHandle(category.ID),
+		"name":              category.Name,
+		"summary":           html.EscapeString(category.Description),
+		"url":               federationBaseURL() + "/home",
+		"inbox":             actor + "/inbox",
+		"outbox":            actor + "/outbox",
+		"followers":         actor + "/followers",
+		"publicKey": map[string]string{
+			"id":           actor + "#main-key",
+			"owner":        actor,
+			"publicKeyPem": publicKey,
+		},
+	})
+}
+
+// CategoryOutboxHandler handles GET /ap/category/{id}/outbox
+func CategoryOutboxHandler(w http.ResponseWriter, r *http.Request) {
+	category, ok := federatedCategory(w, r)
+	if !ok {
+		return
+	}
+
+	rows, err := db.Conn.Query(
+		`SELECT pc.post_id FROM post_categories pc JOIN posts p ON p.id = pc.post_id
+		WHERE pc.category_id = ? AND p.deleted_at = '' AND p.status = 'published'
+		ORDER BY pc.post_id DESC LIMIT ?`,
+		category.ID, FederationOutboxSize,
+	)
+	if err != nil {
+		http.Error(w, "failed to load outbox", http.StatusInternalServerError)
+		return
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			http.Error(w, "failed to load outbox", http.StatusInternalServerError)
+			return
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	items := []interface{}{}
+	for _, id := range ids {
+		post, err := db.GetPost(id)
+		if err != nil {
+			continue
+		}
+		items = append(items, createActivity(postArticle(post, category.ID, db.postPublished(id))))
+	}
+
+	writeActivityJSON(w, http.StatusOK, map[string]interface{}{
+		"@context":     activityStreamsNS,
+		"id":           categoryActorID(category.ID) + "/outbox",
+		"type":         "OrderedCollection",
+		"totalItems":   len(items),
+		"orderedItems": items,
+	})
+}
+
+// CategoryFollowersHandler handles GET /ap/category/{id}/followers.
+// Only the count is public.
+func CategoryFollowersHandler(w http.ResponseWriter, r *http.Request) {
+	category, ok := federatedCategory(w, r)
+	if !ok {
+		return
+	}
+
+	var count int
+	if err := db.Conn.QueryRow(
+		"SELECT COUNT(*) FROM federation_followers WHERE category_id = ?", category.ID,
+	).Scan(&count); err != nil {
+		http.Error(w, "failed to load followers", http.StatusInternalServerError)
+		return
+	}
+
+	writeActivityJSON(w, http.StatusOK, map[string]interface{}{
+		"@context":   activityStreamsNS,
+		"id":         categoryActorID(category.ID) + "/followers",
+		"type":       "OrderedCollection",
+		"totalItems": count,
+	})
+}
+
+// PostObjectHandler handles GET /ap/post/{id}, a post as an ActivityPub Article
+func PostObjectHandler(w http.ResponseWriter, r *http.Request) {
+	if !FederationEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	post, err := db.GetPost(id)
+	// Posts outside any category, drafts and merged posts aren't federated
+	if err != nil || len(post.Categories) == 0 || post.IsDraft() || post.IsMerged() {
+		http.NotFound(w, r)
+		return
+	}
+	if post.IsDeleted() {
+		writeActivityJSON(w, http.StatusGone, map[string]interface{}{
+			"@context": activityStreamsNS,
+			"id":       postObjectID(id),
+			"type":     "Tombstone",
+			"deleted":  FormatTimestamp(post.DeletedAt),
+		})
+		return
+	}
+
+	article := postArticle(post, post.Categories[0].ID, db.postPublished(id))
+	article["@context"] = activityStreamsNS
+	writeActivityJSON(w, http.StatusOK, article)
+}
+
+// CategoryInboxHandler handles POST /ap/category/{id}/inbox. Only signed
+// Follow and Undo Follow activities are acted on; everything else is ignored.
+func CategoryInboxHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	category, ok := federatedCategory(w, r)
+	if !ok {
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxInboxBody))
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+
+	// Resolve the signer's key from their actor document, keeping the
+	// document for its inbox
+	var signer *remoteActor
+	_, err = VerifyRequest(r, body, func(keyID string) (*rsa.PublicKey, error) {
+		actorURL, _, _ := strings.Cut(keyID, "#")
+		actor, err := fetchActor(actorURL)
+		if err != nil {
+			return nil, err
+		}
+		// The document must be the actor it was fetched as, and own the
+		// key, or anyone could host a copy claiming another server's actor
+		if actor.ID != actorURL || actor.PublicKey.Owner != actor.ID {
+			return nil, errors.New("actor document does not match its URL")
+		}
+		if actor.PublicKey.ID != keyID {
+			return nil, errors.New("key does not belong to actor")
+		}
+		signer = actor
+		return decodePublicKey(actor.PublicKey.PublicKeyPem)
+	})
+	if err != nil {
+		http.Error(w, "signature check failed: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var activity struct {
+		ID     string          `json:"id"`
+		Type   string          `json:"type"`
+		Actor  string          `json:"actor"`
+		Object json.RawMessage `json:"object"`
+	}
+	if err := json.Unmarshal(body, &activity); err != nil {
+		http.Error(w, "invalid activity", http.StatusBadRequest)
+		return
+	}
+	if activity.Actor != signer.ID {
+		http.Error(w, "activity actor does not match signer", http.StatusForbidden)
+		return
+	}
+
+	switch activity.Type {
+	case "Follow":
+		var object string
+		if json.Unmarshal(activity.Object, &object) != nil || object != categoryActorID(category.ID) {
+			http.Error(w, "follow object is not this category", http.StatusBadRequest)
+			return
+		}
+
+		db.Write.Lock()
+		_, err := db.Conn.Exec(
+			`INSERT INTO federation_followers (category_id, actor, inbox, followed_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT(category_id, actor) DO UPDATE SET inbox = excluded.inbox`,
+			category.ID, signer.ID, signer.Inbox, Timestamp(),
+		)
+		db.Write.Unlock()
+		if err != nil {
+			http.Error(w, "failed to store follower", http.StatusInternalServerError)
+			return
+		}
+
+		accept := map[string]interface{}{
+			"@context": activityStreamsNS,
+			"id":       categoryActorID(category.ID) + "#accept-" + strconv.FormatInt(time.Now().UnixNano(), 36),
+			"type":     "Accept",
+			"actor":    categoryActorID(category.ID),
+			"object":   json.RawMessage(body),
+		}
+		go func() {
+			if err := db.deliver(signer.Inbox, category.ID, accept); err != nil {
+				log.Println("Federation: accept:", err)
+			}
+		}()
+
+	case "Undo":
+		var undone struct {
+			Type string `json:"type"`
+		}
+		if json.Unmarshal(activity.Object, &undone) == nil && undone.Type == "Follow" {
+			db.Write.Lock()
+			_, err := db.Conn.Exec(
+				"DELETE FROM federation_followers WHERE category_id = ? AND actor = ?", category.ID, signer.ID,
+			)
+			db.Write.Unlock()
+			if err != nil {
+				http.Error(w, "failed to remove follower", http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,261 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// FeedSize is how many of the newest posts a feed lists
+const FeedSize = 20
+
+// FeedMaxAge is how long feed readers and proxies may cache a feed
+const FeedMaxAge = 5 * time.Minute
+
+// atomFeed and the types below are the parts of an Atom document
+// (RFC 4287) the forum's feeds use
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	Title     string     `xml:"title"`
+	ID        string     `xml:"id"`
+	Published string     `xml:"published"`
+	Updated   string     `xml:"updated"`
+	Author    atomAuthor `xml:"author"`
+	Link      atomLink   `xml:"link"`
+	Summary   string     `xml:"summary"`
+	Content   atomText   `xml:"content"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// feedSource lists the entries of a feed, newest first, and when the feed
+// last changed. baseURL makes the entries' links absolute.
+type feedSource func(baseURL string) ([]atomEntry, time.Time, error)
+
+// postFeed is the source of a feed of the newest posts q selects. It
+// serves the site-wide, category and author feeds alike.
+func postFeed(q PostQuery) feedSource {
+	return func(baseURL string) ([]atomEntry, time.Time, error) {
+		q.Sort = SortNew
+		posts, _, err := db.ListPosts(q, FeedSize, 0)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+
+		// An empty feed is as old as the forum's clock says
+		updated := Now()
+		if len(posts) > 0 {
+			updated = posts[0].CreatedAt
+		}
+		var entries []atomEntry
+		for _, p := range posts {
+			link := baseURL + "/post/" + strconv.Itoa(p.ID)
+			rendered := string(RenderMarkdown(p.Content))
+			entries = append(entries, atomEntry{
+				Title:     p.Title,
+				ID:        link,
+				Published: FormatTimestamp(p.CreatedAt),
+				Updated:   FormatTimestamp(p.CreatedAt),
+				Author:    atomAuthor{Name: p.Author.Username, URI: baseURL + "/user/" + p.Author.Username},
+				Link:      atomLink{Rel: "alternate", Type: "text/html", Href: link},
+				Summary:   HTMLExcerpt(rendered, PostExcerptLength),
+				Content:   atomText{Type: "html", Body: rendered},
+			})
+		}
+		return entries, updated, nil
+	}
+}
+
+// buildFeed renders the entries of source as an Atom feed. path is the
+// page the feed belongs to and self the feed's own path.
+func buildFeed(baseURL, title, path, self string, source feedSource) ([]byte, time.Time, error) {
+	entries, updated, err := source(baseURL)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	feed := atomFeed{
+		Title:   title,
+		ID:      baseURL + self,
+		Updated: FormatTimestamp(updated),
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: baseURL + self},
+			{Rel: "alternate", Type: "text/html", Href: baseURL + path},
+		},
+		Entries: entries,
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	if err := enc.Encode(feed); err != nil {
+		return nil, time.Time{}, err
+	}
+	return buf.Bytes(), updated, nil
+}
+
+// serveFeed writes a feed built by buildFeed with caching headers,
+// answering conditional requests with 304 Not Modified when it is unchanged
+func serveFeed(w http.ResponseWriter, r *http.Request, title, path, self string, source feedSource) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, updated, err := buildFeed(SiteURL, title, path, self, source)
+	if err != nil {
+		log.Printf("Failed to build feed %s: %v", self, err)
+		RenderError(w, "Failed to build feed", http.StatusInternalServerError)
+		return
+	}
+
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", updated.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(FeedMaxAge.Seconds())))
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && r.Header.Get("If-None-Match") == "" &&
+		!updated.Truncate(time.Second).After(since) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write(body)
+}
+
+// FeedHandler handles GET /feed.xml, an Atom feed of the newest posts
+func FeedHandler(w http.ResponseWriter, r *http.Request) {
+	serveFeed(w, r, "ForumHub: latest posts", "/home", "/feed.xml", postFeed(PostQuery{}))
+}
+
+// CategoryFeedHandler handles GET /category/{id}/feed.xml. Like the
+// category page it includes posts from subcategories.
+func CategoryFeedHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		RenderError(w, "Category not found", http.StatusNotFound)
+		return
+	}
+	category, err := db.GetCategory(id)
+	if err != nil {
+		RenderError(w, "Category not found", http.StatusNotFound)
+		return
+	}
+
+	path := "/category/" + strconv.Itoa(category.ID)
+	serveFeed(w, r, "ForumHub: "+category.Name, path, path+"/feed.xml",
+		postFeed(PostQuery{CategoryID: category.ID, IncludeDescendants: true}))
+}
+
+// UserFeedHandler handles GET /user/{username}/feed.xml, the posts of one
+// author. Authors who hide their activity on their profile have no feed.
+func UserFeedHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := db.GetUserByUsername(r.PathValue("username"))
+	if err != nil {
+		RenderError(w, "User not found", http.StatusNotFound)
+		return
+	}
+	settings, err := db.GetPrivacySettings(user.UUID)
+	if err != nil {
+		RenderError(w, "Failed to build feed", http.StatusInternalServerError)
+		return
+	}
+	if !settings.ShowActivity {
+		RenderError(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	path := "/user/" + user.Username
+	serveFeed(w, r, "ForumHub: posts by "+user.Username, path, path+"/feed.xml",
+		postFeed(PostQuery{Filter: FilterMine, UserUUID: user.UUID}))
+}
+
+// commentFeed is the source of a feed of the newest comments on a post.
+// Deleted comments are left out, as ListComments leaves out hidden ones.
+func commentFeed(post *Post) feedSource {
+	return func(baseURL string) ([]atomEntry, time.Time, error) {
+		comments, err := db.ListComments(post.ID)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+
+		// A post without comments changed when it was written
+		updated := post.CreatedAt
+		var entries []atomEntry
+		for i := len(comments) - 1; i >= 0 && len(entries) < FeedSize; i-- {
+			c := comments[i]
+			if c.Content == "" {
+				continue
+			}
+			if len(entries) == 0 {
+				updated = c.CreatedAt
+			}
+			link := baseURL + "/comment/" + strconv.Itoa(c.ID)
+			rendered := string(RenderCommentMarkdown(c.Content))
+			entries = append(entries, atomEntry{
+				Title:     "Comment by " + c.Author.Username + " on " + post.Title,
+				ID:        link,
+				Published: FormatTimestamp(c.CreatedAt),
+				Updated:   FormatTimestamp(c.CreatedAt),
+				Author:    atomAuthor{Name: c.Author.Username, URI: baseURL + "/user/" + c.Author.Username},
+				Link:      atomLink{Rel: "alternate", Type: "text/html", Href: link},
+				Summary:   HTMLExcerpt(rendered, PostExcerptLength),
+				Content:   atomText{Type: "html", Body: rendered},
+			})
+		}
+		return entries, updated, nil
+	}
+}
+
+// PostCommentsFeedHandler handles GET /post/{id}/comments/feed.xml, the
+// newest comments on one post, for following a discussion
+func PostCommentsFeedHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		RenderError(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	post, err := db.GetPost(id)
+	if err != nil || post.IsDeleted() || post.IsDraft() || post.IsMerged() {
+		RenderError(w, "Post not found", http.StatusNotFound)
+		return
+	}
+
+	path := "/post/" + strconv.Itoa(post.ID)
+	serveFeed(w, r, "ForumHub: comments on "+post.Title, path, path+"/comments/feed.xml", commentFeed(post))
+}
@@ -1,29 +1,119 @@
 package utils
 
 import (
+	"bytes"
 	"database/sql"
 	"errors"
 	"html/template"
 	"log"
 	"net/http"
-	"time"
+	"path/filepath"
+	"sort"
 )
 
 var tpl *template.Template
 
-// InitTemplate parses and executes a template
+// PopularCategoriesLimit is how many categories the home page features
+const PopularCategoriesLimit = 3
+
+// PartialsDir holds the named blocks shared by every page template, like
+// "nav", "pagination", "post_card" and "comment"
+const PartialsDir = "templates/partials"
+
+// templateFuncs are the functions available to every page template
+var templateFuncs = template.FuncMap{
+	"markdown":        RenderMarkdown,
+	"postMarkdown":    RenderPostMarkdown,
+	"commentMarkdown": RenderPostCommentMarkdown,
+	"dict":            dict,
+}
+
+// dict builds a map from alternating keys and values, so a template can
+// hand a partial more than one value
+func dict(pairs ...interface{}) (map[string]interface{}, error) {
+	if len(pairs)%2 != 0 {
+		return nil, errors.New("dict needs key and value pairs")
+	}
+	m := make(map[string]interface{}, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		key, ok := pairs[i].(string)
+		if !ok {
+			return nil, errors.New("dict keys must be strings")
+		}
+		m[key] = pairs[i+1]
+	}
+	return m, nil
+}
+
+// parseTemplates parses the partials, then the page template file if one
+// is given, then the theme's partials so a theme can replace any single
+// block by defining it again
+func parseTemplates(name, file string) (*template.Template, error) {
+	t, err := template.New(name).Funcs(templateFuncs).ParseGlob(filepath.Join(PartialsDir, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+	if file != "" {
+		if t, err = t.ParseFiles(file); err != nil {
+			return nil, err
+		}
+	}
+	if ThemeDir != "" {
+		themed, err := filepath.Glob(filepath.Join(ThemeDir, "partials", "*.html"))
+		if err != nil {
+			return nil, err
+		}
+		if len(themed) > 0 {
+			if t, err = t.ParseFiles(themed...); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return t, nil
+}
+
+// InitTemplate parses and executes a template.
+// Output is buffered so a template failing midway never sends half a page;
+// the error page is rendered instead.
 func InitTemplate(w http.ResponseWriter, file string, data interface{}) {
 	var err error
-	tpl, err = template.ParseFiles(file)
+	tpl, err = parseTemplates(filepath.Base(file), file)
 	if err != nil {
-		http.Error(w, "Template parsing error: "+err.Error(), http.StatusInternalServerError)
+		renderTemplateError(w, file, data, err)
 		return
 	}
 
-	if err := tpl.Execute(w, data); err != nil {
-		http.Error(w, "Template execution error: "+err.Error(), http.StatusInternalServerError)
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, data); err != nil {
+		renderTemplateError(w, file, data, err)
 		return
 	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if _, err := buf.WriteTo(w); err != nil {
+		log.Println("Failed to write response:", err)
+	}
+}
+
+// RenderPartial executes a single partial on its own, for endpoints that
+// return a fragment of a page rather than all of it
+func RenderPartial(w http.ResponseWriter, name string, data interface{}) {
+	t, err := parseTemplates(name, "")
+	if err != nil {
+		renderTemplateError(w, name, data, err)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := t.ExecuteTemplate(&buf, name, data); err != nil {
+		renderTemplateError(w, name, data, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if _, err := buf.WriteTo(w); err != nil {
+		log.Println("Failed to write response:", err)
+	}
 }
 
 // DefaultHandler redirects "/" to "/login"
@@ -123,28 +213,63 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func HomeHandler(w http.ResponseWriter, r *http.Request) {
-	// Get UUID from cookie
-	uuid, err := GetUserFromCookie(r)
-	if err != nil || uuid == "" {
+	user, err := CurrentUser(w, r)
+	if err != nil {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
-	// Check if session is still valid
-	if err := db.CheckSession(w, uuid); err != nil {
-		log.Println(err)
-		RenderError(w, "Session expired. Please log in again.", http.StatusUnauthorized)
+	theme, err := db.GetPreference(user.UUID, PrefTheme)
+	if err != nil {
+		log.Printf("Failed to load theme for uuid %s: %v", user.UUID, err)
+	}
+
+	upcoming, err := db.UpcomingMaintenance()
+	if err != nil {
+		log.Println("Failed to load maintenance schedule:", err)
+	}
+
+	query := PostQuery{
+		Sort:     SortFromRequest(r),
+		Filter:   FilterFromRequest(r, user),
+		UserUUID: user.UUID,
+	}
+	posts, err := db.LoadPostPage(query, PageFromRequest(r), user)
+	if err != nil {
+		log.Println("Failed to load posts:", err)
+		RenderError(w, "Failed to load posts", http.StatusInternalServerError)
 		return
 	}
 
-	// Refresh session (update lastseen)
-	if err := db.RefreshSession(uuid); err != nil {
-		log.Printf("Failed to refresh session for uuid %s: %v", uuid, err)
-		// You may want to log the user out or ignore silently depending on use-case
+	categories, err := db.ListCategoryStats(false)
+	if err != nil {
+		log.Println("Failed to load categories:", err)
+	}
+	invites, err := db.ListCoAuthorInvites(user.UUID)
+	if err != nil {
+		log.Println("Failed to load co-author invitations:", err)
+	}
+	unread, err := db.UnreadNotifications(user.UUID)
+	if err != nil {
+		log.Println("Failed to count notifications:", err)
+	}
+	sort.SliceStable(categories, func(i, j int) bool {
+		return categories[i].PostCount > categories[j].PostCount
+	})
+	if len(categories) > PopularCategoriesLimit {
+		categories = categories[:PopularCategoriesLimit]
 	}
 
 	// Render home page
-	InitTemplate(w, "templates/home.html", map[string]string{"UUID": uuid})
+	InitTemplate(w, "templates/home.html", map[string]interface{}{
+		"UUID":        user.UUID,
+		"Theme":       theme,
+		"Maintenance": upcoming,
+		"Posts":       posts,
+		"Categories":  categories,
+		"Invitations": invites,
+		"Unread":      unread,
+	})
 }
 
 func (db *DataBase) Guest() (*User, error) {
@@ -152,6 +277,10 @@ func (db *DataBase) Guest() (*User, error) {
 	if err != nil {
 		return nil, err
 	}
+	avatarKey, err := NewAvatarKey()
+	if err != nil {
+		return nil, err
+	}
 
 	user := User{
 		UUID:          uuid,
@@ -159,7 +288,9 @@ func (db *DataBase) Guest() (*User, error) {
 		Username:      "guest_" + uuid[:8],
 		Email:         "",
 		Password:      "",
-		Lastseen:      time.Now(),
+		Lastseen:      Now(),
+		Role:          RoleUser,
+		AvatarKey:     avatarKey,
 	}
 
 	if err := db.SafeWriter("users", user); err != nil {
@@ -214,6 +345,10 @@ func (db *DataBase) Register(w http.ResponseWriter, username, email, password st
 	if err != nil {
 		return nil, err
 	}
+	avatarKey, err := NewAvatarKey()
+	if err != nil {
+		return nil, err
+	}
 
 	hash, err := HashPassword(password)
 	if err != nil {
@@ -242,7 +377,9 @@ func (db *DataBase) Register(w http.ResponseWriter, username, email, password st
 		Username:      username,
 		Email:         email,
 		Password:      password,
-		Lastseen:      time.Now(),
+		Lastseen:      Now(),
+		Role:          RoleUser,
+		AvatarKey:     avatarKey,
 	}
 
 	// Insert safely using SafeWriter
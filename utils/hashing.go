@@ -1,14 +1,51 @@
 package utils
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
 
 const DefaultCost = 10
 
+// A password hash faster than HashTooFast is cheap to brute force; one
+// slower than HashTooSlow lets a burst of logins tie up the server
+const (
+	HashTooFast = 50 * time.Millisecond
+	HashTooSlow = time.Second
+)
+
 func HashPassword(password string) (string, error) {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), DefaultCost)
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), BcryptCost)
 	if err != nil {
 		return "", err
 	}
 	return string(hashedPassword), nil
 }
 
+// CheckPasswordHashing validates BcryptCost and times one hash with it,
+// logging a warning if this machine hashes too quickly or too slowly.
+// Existing hashes keep the cost they were made with.
+func CheckPasswordHashing() error {
+	if BcryptCost < bcrypt.MinCost || BcryptCost > bcrypt.MaxCost {
+		return fmt.Errorf("FORUM_BCRYPT_COST must be between %d and %d, got %d", bcrypt.MinCost, bcrypt.MaxCost, BcryptCost)
+	}
+
+	start := time.Now()
+	if _, err := HashPassword("startup self-check"); err != nil {
+		return err
+	}
+	took := time.Since(start).Round(time.Millisecond)
+
+	switch {
+	case took < HashTooFast:
+		log.Printf("Warning: a password hash at bcrypt cost %d takes %v, which is fast enough to brute force; raise FORUM_BCRYPT_COST", BcryptCost, took)
+	case took > HashTooSlow:
+		log.Printf("Warning: a password hash at bcrypt cost %d takes %v, so a burst of logins can overload the server; lower FORUM_BCRYPT_COST", BcryptCost, took)
+	default:
+		log.Printf("Password hashing: bcrypt cost %d takes %v", BcryptCost, took)
+	}
+	return nil
+}
@@ -0,0 +1,322 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"html/template"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// codeLanguage describes enough of a language's syntax to colour it:
+// comments, strings, numbers and its reserved words
+type codeLanguage struct {
+	keywords     map[string]bool
+	literals     map[string]bool
+	lineComments []string
+	blockComment [2]string
+	quotes       string
+	// foldCase matches keywords in any case, for SQL
+	foldCase bool
+}
+
+func words(s string) map[string]bool {
+	set := make(map[string]bool)
+	for _, w := range strings.Fields(s) {
+		set[w] = true
+	}
+	return set
+}
+
+var cLikeLiterals = words("true false null NULL nullptr")
+
+// codeLanguages are the languages fenced code can be highlighted as, by
+// their canonical name. codeLanguageAliases maps the other names fences use.
+var codeLanguages = map[string]*codeLanguage{
+	"go": {
+		keywords:     words("break case chan const continue default defer else fallthrough for func go goto if import interface map package range return select struct switch type var"),
+		literals:     words("true false nil iota"),
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "\"'`",
+	},
+	"python": {
+		keywords:     words("and as assert async await break class continue def del elif else except finally for from global if import in is lambda nonlocal not or pass raise return try while with yield"),
+		literals:     words("True False None self"),
+		lineComments: []string{"#"},
+		quotes:       "\"'",
+	},
+	"javascript": {
+		keywords:     words("async await break case catch class const continue debugger default delete do else export extends finally for from function if import in instanceof interface let new of return static super switch this throw try type typeof var void while yield"),
+		literals:     words("true false null undefined NaN"),
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "\"'`",
+	},
+	"java": {
+		keywords:     words("abstract boolean break byte case catch char class continue default do double else enum extends final finally float for if implements import instanceof int interface long new package private protected public return short static super switch synchronized this throw throws try void volatile while var"),
+		literals:     cLikeLiterals,
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "\"'",
+	},
+	"c": {
+		keywords:     words("auto bool break case char class const continue default delete do double else enum extern float for goto if include inline int long namespace new private protected public return short signed sizeof static struct switch template this typedef union unsigned using virtual void volatile while define ifdef ifndef endif"),
+		literals:     cLikeLiterals,
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "\"'",
+	},
+	"rust": {
+		keywords:     words("as async await break const continue crate dyn else enum extern fn for if impl in let loop match mod move mut pub ref return self Self static struct super trait type unsafe use where while"),
+		literals:     words("true false None Some Ok Err"),
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "\"",
+	},
+	"sql": {
+		keywords:     words("select from where and or not in is like join left right inner outer on group by order having limit offset insert into values update set delete create table index view drop alter add primary key foreign references unique default as distinct union all case when then else end exists begin commit rollback asc desc"),
+		literals:     words("null true false"),
+		lineComments: []string{"--"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "'\"",
+		foldCase:     true,
+	},
+	"bash": {
+		keywords:     words("if then else elif fi for while until do done case esac in function return export local echo cd exit set unset source sudo"),
+		literals:     words("true false"),
+		lineComments: []string{"#"},
+		quotes:       "\"'",
+	},
+	"json": {
+		literals: words("true false null"),
+		quotes:   "\"",
+	},
+	"css": {
+		keywords:     words("important media import keyframes from to"),
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "\"'",
+	},
+}
+
+var codeLanguageAliases = map[string]string{
+	"golang": "go", "py": "python", "python3": "python",
+	"js": "javascript", "jsx": "javascript", "ts": "javascript", "typescript": "javascript", "tsx": "javascript", "node": "javascript",
+	"kotlin": "java", "csharp": "java", "cs": "java",
+	"cpp": "c", "c++": "c", "h": "c", "hpp": "c",
+	"rs": "rust", "sqlite": "sql", "postgresql": "sql", "mysql": "sql",
+	"sh": "bash", "shell": "bash", "zsh": "bash", "console": "bash",
+	"scss": "css",
+}
+
+// codeLanguageNamed returns the canonical name of a fence's language, or ""
+// when it isn't one that can be highlighted
+func codeLanguageNamed(name string) string {
+	name = strings.ToLower(name)
+	if alias, ok := codeLanguageAliases[name]; ok {
+		return alias
+	}
+	if _, ok := codeLanguages[name]; ok {
+		return name
+	}
+	return ""
+}
+
+// languageHints are telltale patterns of each language, for fences that
+// don't say what they hold. The language with the most hints wins; code
+// with fewer than two is left plain rather than guessed at.
+var languageHints = map[string][]*regexp.Regexp{
+	"go":         regexps(`(?m)^package \w+`, `\bfunc (\(\w+ \*?\w+\) )?\w+\(`, `:=`, `\bfmt\.`, `\berr != nil\b`),
+	"python":     regexps(`(?m)^\s*def \w+\(.*\):\s*$`, `(?m)^\s*(from \w+ )?import \w+`, `(?m)^\s*(if|for|while|elif|else|try|except).*:\s*$`, `\bself\.`, `\bprint\(`),
+	"javascript": regexps(`\bfunction\b`, `\b(const|let) \w+ =`, `=>`, `\bconsole\.log\(`, `===`),
+	"java":       regexps(`\bpublic (static )?(class|void|int|String)\b`, `\bSystem\.out\.`, `\bnew \w+\(`, `(?m);\s*$`),
+	"c":          regexps(`(?m)^#include\b`, `\bint main\(`, `\bprintf\(`, `\bstd::`, `(?m);\s*$`),
+	"rust":       regexps(`\bfn \w+\(`, `\blet mut\b`, `\bprintln!\(`, `\bimpl\b`, `->`),
+	"sql":        regexps(`(?i)\bselect\b.+\bfrom\b`, `(?i)\b(insert into|update \w+ set|delete from|create table)\b`, `(?i)\bwhere\b`, `(?i)\b(join|group by|order by)\b`),
+	"bash":       regexps(`(?m)^#!/bin/(ba)?sh`, `(?m)^\$ `, `\$\{?\w+\}?`, `(?m)^\s*(sudo|apt|npm|go|git|cd|ls|echo) `, `\bfi\b|\bdone\b`),
+	"json":       regexps(`^\s*[\[{]`, `"\w+"\s*:`, `[\]}]\s*$`),
+}
+
+func regexps(patterns ...string) []*regexp.Regexp {
+	res := make([]*regexp.Regexp, len(patterns))
+	for i, p := range patterns {
+		res[i] = regexp.MustCompile(p)
+	}
+	return res
+}
+
+// detectCodeLanguage guesses the language of unlabelled code, or returns ""
+func detectCodeLanguage(code string) string {
+	best, bestScore := "", 1
+	for name, hints := range languageHints {
+		score := 0
+		for _, h := range hints {
+			if h.MatchString(code) {
+				score++
+			}
+		}
+		if score > bestScore || (score == bestScore && score > 1 && name < best) {
+			best, bestScore = name, score
+		}
+	}
+	return best
+}
+
+// highlightCacheSize bounds the cache; it is emptied when it fills up
+const highlightCacheSize = 2000
+
+// highlightCache holds highlighted code by a hash of its language and
+// source. A revision of a post or comment never changes, so its code is
+// highlighted once and then served from here until the cache turns over.
+var highlightCache struct {
+	sync.Mutex
+	entries map[[sha256.Size]byte]highlighted
+}
+
+type highlighted struct {
+	html     string
+	language string
+}
+
+// highlightCode renders fenced code as HTML with its tokens wrapped in
+// spans for the stylesheet to colour. lang is what the fence says, or ""
+// to detect it. It returns the canonical language used, "" when the code
+// was left plain.
+func highlightCode(lang, code string) (string, string) {
+	key := sha256.Sum256([]byte(lang + "\x00" + code))
+	highlightCache.Lock()
+	entry, ok := highlightCache.entries[key]
+	highlightCache.Unlock()
+	if ok {
+		return entry.html, entry.language
+	}
+
+	name := codeLanguageNamed(lang)
+	if lang == "" {
+		name = detectCodeLanguage(code)
+	}
+	entry = highlighted{template.HTMLEscapeString(code), name}
+	if name != "" {
+		entry.html = codeLanguages[name].highlight(code)
+	}
+
+	highlightCache.Lock()
+	if highlightCache.entries == nil || len(highlightCache.entries) >= highlightCacheSize {
+		highlightCache.entries = make(map[[sha256.Size]byte]highlighted)
+	}
+	highlightCache.entries[key] = entry
+	highlightCache.Unlock()
+	return entry.html, entry.language
+}
+
+// Token classes, named briefly since every token of a code block carries one
+const (
+	tokenComment = "hl-c"
+	tokenString  = "hl-s"
+	tokenNumber  = "hl-n"
+	tokenKeyword = "hl-k"
+	tokenLiteral = "hl-l"
+)
+
+// highlight escapes code and wraps its comments, strings, numbers, keywords
+// and literals in spans. Anything it doesn't recognise is left as text, so
+// unusual code is never mangled, only less colourful.
+func (l *codeLanguage) highlight(code string) string {
+	var b strings.Builder
+	span := func(class, text string) {
+		b.WriteString(`<span class="` + class + `">` + template.HTMLEscapeString(text) + `</span>`)
+	}
+
+	for i := 0; i < len(code); {
+		rest := code[i:]
+		if open := l.blockComment[0]; open != "" && strings.HasPrefix(rest, open) {
+			end := strings.Index(rest[len(open):], l.blockComment[1])
+			n := len(rest)
+			if end >= 0 {
+				n = len(open) + end + len(l.blockComment[1])
+			}
+			span(tokenComment, rest[:n])
+			i += n
+			continue
+		}
+		if l.startsLineComment(code, i) {
+			n := strings.IndexByte(rest, '\n')
+			if n < 0 {
+				n = len(rest)
+			}
+			span(tokenComment, rest[:n])
+			i += n
+			continue
+		}
+
+		c := code[i]
+		switch {
+		case strings.IndexByte(l.quotes, c) >= 0:
+			n := scanString(rest)
+			span(tokenString, rest[:n])
+			i += n
+
+		case c >= '0' && c <= '9' && (i == 0 || !isWordByte(code[i-1])):
+			n := 1
+			for n < len(rest) && (isWordByte(rest[n]) || rest[n] == '.') {
+				n++
+			}
+			span(tokenNumber, rest[:n])
+			i += n
+
+		case isWordByte(c):
+			n := 1
+			for n < len(rest) && isWordByte(rest[n]) {
+				n++
+			}
+			word := rest[:n]
+			lookup := word
+			if l.foldCase {
+				lookup = strings.ToLower(word)
+			}
+			switch {
+			case l.keywords[lookup]:
+				span(tokenKeyword, word)
+			case l.literals[lookup]:
+				span(tokenLiteral, word)
+			default:
+				b.WriteString(template.HTMLEscapeString(word))
+			}
+			i += n
+
+		default:
+			b.WriteString(template.HTMLEscapeString(code[i : i+1]))
+			i++
+		}
+	}
+	return b.String()
+}
+
+// startsLineComment reports whether a line comment starts at code[i]. A
+// "#" only starts one after a space, so "$#" and URL fragments don't.
+func (l *codeLanguage) startsLineComment(code string, i int) bool {
+	for _, prefix := range l.lineComments {
+		if strings.HasPrefix(code[i:], prefix) {
+			return prefix != "#" || i == 0 || code[i-1] == ' ' || code[i-1] == '\t' || code[i-1] == '\n'
+		}
+	}
+	return false
+}
+
+// scanString returns the length of the string literal s starts with.
+// Backquoted strings may span lines; others end at the line's end when
+// they aren't closed.
+func scanString(s string) int {
+	quote := s[0]
+	for n := 1; n < len(s); n++ {
+		switch {
+		case s[n] == '\\' && quote != '`':
+			n++
+		case s[n] == quote:
+			return n + 1
+		case s[n] == '\n' && quote != '`':
+			return n
+		}
+	}
+	return len(s)
+}
@@ -0,0 +1,47 @@
+package utils
+
+import "database/sql"
+
+// execer is implemented by both *sql.DB and *sql.Tx so helpers can run
+// either on their own or as part of a caller's transaction
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// recordPostHistory appends an entry to a post's history
+func recordPostHistory(ex execer, postID int, userUUID, action, details string) error {
+	_, err := ex.Exec(
+		"INSERT INTO post_history (post_id, user_uuid, action, details, created_at) VALUES (?, ?, ?, ?, ?)",
+		postID, userUUID, action, details, Timestamp(),
+	)
+	return err
+}
+
+// ListPostHistory returns a post's history, newest first
+func (db *DataBase) ListPostHistory(postID int) ([]PostHistoryEntry, error) {
+	rows, err := db.Conn.Query(
+		`SELECT h.id, u.username, h.action, h.details, h.created_at
+		FROM post_history h JOIN users u ON u.uuid = h.user_uuid
+		WHERE h.post_id = ?
+		ORDER BY h.id DESC`,
+		postID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []PostHistoryEntry
+	for rows.Next() {
+		var (
+			e         PostHistoryEntry
+			createdAt string
+		)
+		if err := rows.Scan(&e.ID, &e.Actor, &e.Action, &e.Details, &createdAt); err != nil {
+			return nil, err
+		}
+		e.CreatedAt, _ = ParseTimestamp(createdAt)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,595 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ImportMaxUploadBytes caps the size of an uploaded export file
+const ImportMaxUploadBytes = 64 << 20
+
+// ImportAttachmentMaxBytes caps the size of a single downloaded attachment
+const ImportAttachmentMaxBytes = 10 << 20
+
+// ImportCacheDir is where attachments downloaded during an import are kept
+const ImportCacheDir = "cache/imports"
+
+// importedFilePattern matches the file names ImportedFileHandler will serve
+var importedFilePattern = regexp.MustCompile(`^[0-9a-f]{32}\.(png|jpg|gif|webp)$`)
+
+// importLinkPattern finds absolute and site-relative links in imported content
+var importLinkPattern = regexp.MustCompile(`(https?://|/)[^\s()<>"'\[\]]+`)
+
+// importImageTypes maps the attachment types kept by an import to their extension
+var importImageTypes = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// Importer parses another forum's data export into an ImportBundle
+type Importer interface {
+	// Name identifies the format in forms and reports
+	Name() string
+	Parse(data []byte) (*ImportBundle, error)
+	// IsAttachment reports whether a link in imported content points at a
+	// file hosted by the source that should be downloaded. base is the
+	// source site's URL, or nil when the admin didn't give one.
+	IsAttachment(link, base *url.URL) bool
+}
+
+// Importers lists the supported export formats
+var Importers = []Importer{discourseImporter{}, redditImporter{}}
+
+// findImporter returns the importer with the given name, or nil
+func findImporter(name string) Importer {
+	for _, imp := range Importers {
+		if imp.Name() == name {
+			return imp
+		}
+	}
+	return nil
+}
+
+// ImportBundle is an export mapped onto the forum's model. External IDs are
+// the source's own and are only used to link records and detect re-imports.
+type ImportBundle struct {
+	Users  []ImportUser
+	Topics []ImportTopic
+	Votes  []ImportVote
+	// Notes describe data in the export that has no place in the forum
+	Notes []string
+}
+
+// ImportUser is an account in an export
+type ImportUser struct {
+	ExternalID string
+	Username   string
+	Email      string
+	CreatedAt  time.Time
+}
+
+// ImportTopic becomes a post, and its replies comments on it
+type ImportTopic struct {
+	ExternalID string
+	AuthorID   string
+	Title      string
+	Content    string
+	Category   string
+	CreatedAt  time.Time
+	Replies    []ImportReply
+}
+
+// ImportReply is a reply to a topic
+type ImportReply struct {
+	ExternalID string
+	AuthorID   string
+	Content    string
+	CreatedAt  time.Time
+}
+
+// ImportVote is a user's vote on a topic
+type ImportVote struct {
+	TopicID string
+	UserID  string
+	Up      bool
+}
+
+// ImportMapping records where an external record ended up
+type ImportMapping struct {
+	Kind       string `json:"kind"`
+	ExternalID string `json:"external_id"`
+	LocalID    string `json:"local_id"`
+	Note       string `json:"note,omitempty"`
+}
+
+// ImportReport summarises an import run
+type ImportReport struct {
+	Format             string          `json:"format"`
+	Source             string          `json:"source"`
+	Users              int             `json:"users"`
+	Categories         int             `json:"categories"`
+	Topics             int             `json:"topics"`
+	Replies            int             `json:"replies"`
+	Votes              int             `json:"votes"`
+	AlreadyImported    int             `json:"already_imported"`
+	Attachments        int             `json:"attachments"`
+	AttachmentFailures int             `json:"attachment_failures"`
+	Mappings           []ImportMapping `json:"mappings"`
+	Notes              []string        `json:"notes"`
+}
+
+func (rep *ImportReport) mapped(kind, externalID, localID, note string) {
+	rep.Mappings = append(rep.Mappings, ImportMapping{kind, externalID, localID, note})
+}
+
+func (rep *ImportReport) note(format string, args ...interface{}) {
+	rep.Notes = append(rep.Notes, fmt.Sprintf(format, args...))
+}
+
+// importMappings loads what earlier runs imported from source, keyed by
+// kind and external ID
+func (db *DataBase) importMappings(source string) (map[string]string, error) {
+	rows, err := db.Conn.Query("SELECT kind, external_id, local_id FROM import_mappings WHERE source = ?", source)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mappings := make(map[string]string)
+	for rows.Next() {
+		var kind, externalID, localID string
+		if err := rows.Scan(&kind, &externalID, &localID); err != nil {
+			return nil, err
+		}
+		mappings[kind+":"+externalID] = localID
+	}
+	return mappings, rows.Err()
+}
+
+// importClient downloads attachments for imports. Exports come from other
+// sites and their users, so like linkPreviewClient it only reaches public
+// hosts and follows few redirects.
+var importClient = &http.Client{
+	Timeout: 20 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 5 * time.Second, Control: dialPublic}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+	CheckRedirect: checkWebRedirect,
+}
+
+// attachmentFetcher downloads attachments linked from imported content
+type attachmentFetcher struct {
+	importer Importer
+	base     *url.URL
+	client   *http.Client
+	fetched  map[string]string
+	report   *ImportReport
+}
+
+// rewrite downloads the attachments linked from content and points the links
+// at the local copies. Links that fail to download are left as they are.
+func (f *attachmentFetcher) rewrite(content string) string {
+	return importLinkPattern.ReplaceAllStringFunc(content, func(link string) string {
+		u, err := url.Parse(link)
+		if err != nil {
+			return link
+		}
+		if f.base != nil {
+			u = f.base.ResolveReference(u)
+		}
+		if !u.IsAbs() || !f.importer.IsAttachment(u, f.base) {
+			return link
+		}
+
+		if local, ok := f.fetched[u.String()]; ok {
+			return local
+		}
+		local, err := f.download(u.String())
+		if err != nil {
+			f.report.AttachmentFailures++
+			f.report.note("Attachment %s was not downloaded: %v", u, err)
+			local = link
+		} else {
+			f.report.Attachments++
+		}
+		f.fetched[u.String()] = local
+		return local
+	})
+}
+
+// download saves one image to ImportCacheDir, named by its content hash
+func (f *attachmentFetcher) download(link string) (string, error) {
+	resp, err := f.client.Get(link)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New(resp.Status)
+	}
+
+	mediaType, _, _ := strings.Cut(resp.Header.Get("Content-Type"), ";")
+	ext, ok := importImageTypes[strings.TrimSpace(mediaType)]
+	if !ok {
+		return "", errors.New("not a supported image type")
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, ImportAttachmentMaxBytes+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > ImportAttachmentMaxBytes {
+		return "", errors.New("file is too large")
+	}
+
+	sum := sha256.Sum256(data)
+	name := hex.EncodeToString(sum[:16]) + ext
+	if err := os.MkdirAll(ImportCacheDir, 0o755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(ImportCacheDir, name), data, 0o644); err != nil {
+		return "", err
+	}
+	return "/imported/" + name, nil
+}
+
+// importUsername returns a free username for an imported account, suffixing
+// the source format when the name is taken
+func importUsername(tx *sql.Tx, name, format string) (string, error) {
+	base := strings.Join(strings.Fields(name), "_")
+	if base == "" {
+		base = "imported"
+	}
+	candidate := base
+	for i := 1; ; i++ {
+		var exists bool
+		err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)", candidate).Scan(&exists)
+		if err != nil || !exists {
+			return candidate, err
+		}
+		candidate = base + "_" + format
+		if i > 1 {
+			candidate += strconv.Itoa(i)
+		}
+	}
+}
+
+// importCategory returns the ID of the category with the given name,
+// creating it if needed
+func importCategory(tx *sql.Tx, name string, rep *ImportReport) (int, error) {
+	var id int
+	err := tx.QueryRow("SELECT id FROM categories WHERE name = ? COLLATE NOCASE", name).Scan(&id)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return id, err
+	}
+	res, err := tx.Exec(
+		"INSERT INTO categories (name, position) VALUES (?, (SELECT COALESCE(MAX(position), 0) + 1 FROM categories))",
+		name,
+	)
+	if err != nil {
+		return 0, err
+	}
+	id64, err := res.LastInsertId()
+	rep.Categories++
+	rep.mapped("category", name, strconv.FormatInt(id64, 10), "created")
+	return int(id64), err
+}
+
+// RunImport imports an export in the given format. Records already imported
+// from the same source are skipped, so an import can safely be re-run.
+// Attachments are resolved against baseURL when it is set.
+func (db *DataBase) RunImport(imp Importer, source string, data []byte, baseURL, actorUUID string) (*ImportReport, error) {
+	bundle, err := imp.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	rep := &ImportReport{Format: imp.Name(), Source: source, Notes: bundle.Notes}
+
+	existing, err := db.importMappings(source)
+	if err != nil {
+		return nil, err
+	}
+
+	// Download attachments before taking the write lock
+	fetcher := &attachmentFetcher{
+		importer: imp,
+		client:   importClient,
+		fetched:  make(map[string]string),
+		report:   rep,
+	}
+	if baseURL != "" {
+		if fetcher.base, err = url.Parse(baseURL); err != nil {
+			return nil, fmt.Errorf("invalid base URL: %w", err)
+		}
+	}
+	for i := range bundle.Topics {
+		t := &bundle.Topics[i]
+		if _, done := existing["topic:"+t.ExternalID]; !done {
+			t.Content = fetcher.rewrite(t.Content)
+		}
+		for j := range t.Replies {
+			if _, done := existing["reply:"+t.Replies[j].ExternalID]; !done {
+				t.Replies[j].Content = fetcher.rewrite(t.Replies[j].Content)
+			}
+		}
+	}
+
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	record := func(kind, externalID, localID string) error {
+		existing[kind+":"+externalID] = localID
+		_, err := tx.Exec(
+			"INSERT INTO import_mappings (source, kind, external_id, local_id) VALUES (?, ?, ?, ?)",
+			source, kind, externalID, localID,
+		)
+		return err
+	}
+
+	for _, u := range bundle.Users {
+		if _, done := existing["user:"+u.ExternalID]; done {
+			rep.AlreadyImported++
+			continue
+		}
+
+		// Accounts with a known email are linked to the existing user
+		var uuid string
+		if u.Email != "" {
+			err := tx.QueryRow("SELECT uuid FROM users WHERE email = ? AND notregistered = 0", u.Email).Scan(&uuid)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return nil, err
+			}
+		}
+		if uuid != "" {
+			rep.mapped("user", u.ExternalID, uuid, "linked to existing account by email")
+		} else {
+			if uuid, err = GenerateUserID(); err != nil {
+				return nil, err
+			}
+			username, err := importUsername(tx, u.Username, imp.Name())
+			if err != nil {
+				return nil, err
+			}
+			avatarKey, err := NewAvatarKey()
+			if err != nil {
+				return nil, err
+			}
+			created := u.CreatedAt
+			if created.IsZero() {
+				created = Now()
+			}
+			// Imported accounts have no password; they sign in by magic link
+			_, err = tx.Exec(
+				`INSERT INTO users (uuid, username, email, password, notregistered, lastseen, loggedin, role, avatarkey)
+				VALUES (?, ?, ?, '', 0, ?, 0, ?, ?)`,
+				uuid, username, u.Email, FormatTimestamp(created), RoleUser, avatarKey,
+			)
+			if err != nil {
+				return nil, err
+			}
+			rep.Users++
+			note := ""
+			if username != u.Username {
+				note = "renamed to " + username
+			}
+			rep.mapped("user", u.ExternalID, uuid, note)
+		}
+		if err := record("user", u.ExternalID, uuid); err != nil {
+			return nil, err
+		}
+	}
+
+	categories := make(map[string]int)
+	for _, t := range bundle.Topics {
+		if _, done := existing["topic:"+t.ExternalID]; done {
+			rep.AlreadyImported++
+		} else {
+			author, ok := existing["user:"+t.AuthorID]
+			if !ok {
+				rep.note("Topic %s skipped: unknown author %q", t.ExternalID, t.AuthorID)
+				continue
+			}
+
+			res, err := tx.Exec(
+				"INSERT INTO posts (title, content, author_uuid, created_at) VALUES (?, ?, ?, ?)",
+				t.Title, t.Content, author, FormatTimestamp(t.CreatedAt),
+			)
+			if err != nil {
+				return nil, err
+			}
+			postID, err := res.LastInsertId()
+			if err != nil {
+				return nil, err
+			}
+
+			if t.Category != "" {
+				catID, ok := categories[t.Category]
+				if !ok {
+					if catID, err = importCategory(tx, t.Category, rep); err != nil {
+						return nil, err
+					}
+					categories[t.Category] = catID
+				}
+				if _, err := tx.Exec("INSERT INTO post_categories (post_id, category_id) VALUES (?, ?)", postID, catID); err != nil {
+					return nil, err
+				}
+			}
+			if err := recordPostHistory(tx, int(postID), actorUUID, "imported", "from "+source); err != nil {
+				return nil, err
+			}
+
+			rep.Topics++
+			rep.mapped("topic", t.ExternalID, strconv.FormatInt(postID, 10), "")
+			if err := record("topic", t.ExternalID, strconv.FormatInt(postID, 10)); err != nil {
+				return nil, err
+			}
+		}
+		postID := existing["topic:"+t.ExternalID]
+
+		for _, reply := range t.Replies {
+			if _, done := existing["reply:"+reply.ExternalID]; done {
+				rep.AlreadyImported++
+				continue
+			}
+			author, ok := existing["user:"+reply.AuthorID]
+			if !ok {
+				rep.note("Reply %s skipped: unknown author %q", reply.ExternalID, reply.AuthorID)
+				continue
+			}
+			res, err := tx.Exec(
+				"INSERT INTO comments (content, comment_author_uuid, post_id, created_at) VALUES (?, ?, ?, ?)",
+				reply.Content, author, postID, FormatTimestamp(reply.CreatedAt),
+			)
+			if err != nil {
+				return nil, err
+			}
+			commentID, err := res.LastInsertId()
+			if err != nil {
+				return nil, err
+			}
+			rep.Replies++
+			rep.mapped("reply", reply.ExternalID, strconv.FormatInt(commentID, 10), "")
+			if err := record("reply", reply.ExternalID, strconv.FormatInt(commentID, 10)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, v := range bundle.Votes {
+		key := v.TopicID + "/" + v.UserID
+		if _, done := existing["vote:"+key]; done {
+			rep.AlreadyImported++
+			continue
+		}
+		postID, okPost := existing["topic:"+v.TopicID]
+		user, okUser := existing["user:"+v.UserID]
+		if !okPost || !okUser {
+			rep.note("Vote by %q on topic %s skipped: topic or user not imported", v.UserID, v.TopicID)
+			continue
+		}
+
+		// A vote already cast on the forum takes precedence
+		var cast bool
+		err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM interactions WHERE user_uuid = ? AND post_id = ?)", user, postID).Scan(&cast)
+		if err != nil {
+			return nil, err
+		}
+		if !cast {
+			_, err := tx.Exec(
+				"INSERT INTO interactions (user_uuid, post_id, liked, disliked, created_at) VALUES (?, ?, ?, ?, ?)",
+				user, postID, v.Up, !v.Up, Timestamp(),
+			)
+			if err != nil {
+				return nil, err
+			}
+			rep.Votes++
+		}
+		if err := record("vote", key, postID); err != nil {
+			return nil, err
+		}
+	}
+
+	return rep, tx.Commit()
+}
+
+// AdminImportHandler handles GET and POST /admin/import
+func AdminImportHandler(w http.ResponseWriter, r *http.Request) {
+	admin, ok := RequireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	data := map[string]interface{}{"Importers": Importers}
+
+	if r.Method == http.MethodPost {
+		r.Body = http.MaxBytesReader(w, r.Body, ImportMaxUploadBytes)
+		if err := r.ParseMultipartForm(8 << 20); err != nil {
+			RenderError(w, "Upload failed: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		imp := findImporter(r.FormValue("importer"))
+		if imp == nil {
+			RenderError(w, "Unknown export format", http.StatusBadRequest)
+			return
+		}
+		file, _, err := r.FormFile("export")
+		if err != nil {
+			RenderError(w, "Choose an export file to import", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		content, err := io.ReadAll(file)
+		if err != nil {
+			RenderError(w, "Upload failed", http.StatusBadRequest)
+			return
+		}
+
+		// The source keys the ID mappings, so re-running an import of the
+		// same site skips what is already here
+		source := strings.TrimSpace(r.FormValue("source"))
+		if source == "" {
+			source = imp.Name()
+		}
+
+		report, err := db.RunImport(imp, source, content, strings.TrimSpace(r.FormValue("base_url")), admin.UUID)
+		if err != nil {
+			RenderError(w, "Import failed: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if WantsJSON(r) {
+			WriteJSON(w, http.StatusOK, report)
+			return
+		}
+		data["Report"] = report
+	} else if r.Method != http.MethodGet {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	InitTemplate(w, "templates/admin_import.html", data)
+}
+
+// ImportedFileHandler handles GET /imported/{file}
+func ImportedFileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	file := r.PathValue("file")
+	if !importedFilePattern.MatchString(file) {
+		RenderError(w, "File not found", http.StatusNotFound)
+		return
+	}
+	path := filepath.Join(ImportCacheDir, file)
+	if _, err := os.Stat(path); err != nil {
+		RenderError(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	// Files are named by their content, so they never change
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeFile(w, r, path)
+}
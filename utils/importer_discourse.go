@@ -0,0 +1,135 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// discourseImporter reads a Discourse export in JSON, with the users,
+// categories, topics (each with its posts) and likes as the admin API
+// returns them
+type discourseImporter struct{}
+
+type discourseExport struct {
+	Users []struct {
+		ID        int64     `json:"id"`
+		Username  string    `json:"username"`
+		Email     string    `json:"email"`
+		CreatedAt time.Time `json:"created_at"`
+	} `json:"users"`
+	Categories []struct {
+		ID   int64  `json:"id"`
+		Name string `json:"name"`
+	} `json:"categories"`
+	Topics []struct {
+		ID         int64     `json:"id"`
+		Title      string    `json:"title"`
+		CategoryID int64     `json:"category_id"`
+		CreatedAt  time.Time `json:"created_at"`
+		Posts      []struct {
+			ID         int64     `json:"id"`
+			PostNumber int       `json:"post_number"`
+			UserID     int64     `json:"user_id"`
+			Raw        string    `json:"raw"`
+			Cooked     string    `json:"cooked"`
+			CreatedAt  time.Time `json:"created_at"`
+			DeletedAt  string    `json:"deleted_at"`
+		} `json:"posts"`
+	} `json:"topics"`
+	Likes []struct {
+		PostID int64 `json:"post_id"`
+		UserID int64 `json:"user_id"`
+	} `json:"likes"`
+}
+
+func (discourseImporter) Name() string { return "discourse" }
+
+// IsAttachment matches files in the site's uploads directory. Only the
+// site itself is trusted, so nothing is downloaded without its URL.
+func (discourseImporter) IsAttachment(link, base *url.URL) bool {
+	return base != nil && strings.EqualFold(link.Host, base.Host) && strings.Contains(link.Path, "/uploads/")
+}
+
+func (discourseImporter) Parse(data []byte) (*ImportBundle, error) {
+	var export discourseExport
+	if err := json.Unmarshal(data, &export); err != nil {
+		return nil, fmt.Errorf("not a Discourse export: %w", err)
+	}
+	id := func(n int64) string { return strconv.FormatInt(n, 10) }
+
+	bundle := &ImportBundle{}
+	for _, u := range export.Users {
+		bundle.Users = append(bundle.Users, ImportUser{
+			ExternalID: id(u.ID),
+			Username:   u.Username,
+			Email:      u.Email,
+			CreatedAt:  u.CreatedAt,
+		})
+	}
+
+	categories := make(map[int64]string)
+	for _, c := range export.Categories {
+		categories[c.ID] = c.Name
+	}
+
+	// Likes are on posts; only likes on a topic's first post become votes
+	firstPosts := make(map[int64]int64)
+	deleted := 0
+	for _, t := range export.Topics {
+		topic := ImportTopic{
+			ExternalID: id(t.ID),
+			Title:      t.Title,
+			Category:   categories[t.CategoryID],
+			CreatedAt:  t.CreatedAt,
+		}
+		for _, p := range t.Posts {
+			if p.DeletedAt != "" {
+				deleted++
+				continue
+			}
+			content := p.Raw
+			if content == "" {
+				content = PlainText(p.Cooked)
+			}
+			if p.PostNumber == 1 {
+				topic.AuthorID = id(p.UserID)
+				topic.Content = content
+				firstPosts[p.ID] = t.ID
+				continue
+			}
+			topic.Replies = append(topic.Replies, ImportReply{
+				ExternalID: id(p.ID),
+				AuthorID:   id(p.UserID),
+				Content:    content,
+				CreatedAt:  p.CreatedAt,
+			})
+		}
+		if topic.AuthorID == "" {
+			bundle.Notes = append(bundle.Notes, "Topic "+topic.ExternalID+" skipped: its first post is missing or deleted")
+			continue
+		}
+		bundle.Topics = append(bundle.Topics, topic)
+	}
+
+	replyLikes := 0
+	for _, l := range export.Likes {
+		topicID, ok := firstPosts[l.PostID]
+		if !ok {
+			replyLikes++
+			continue
+		}
+		bundle.Votes = append(bundle.Votes, ImportVote{TopicID: id(topicID), UserID: id(l.UserID), Up: true})
+	}
+
+	if deleted > 0 {
+		bundle.Notes = append(bundle.Notes, fmt.Sprintf("%d deleted posts were left out", deleted))
+	}
+	if replyLikes > 0 {
+		bundle.Notes = append(bundle.Notes, fmt.Sprintf("%d likes on replies were left out; comments can't be liked", replyLikes))
+	}
+	return bundle, nil
+}
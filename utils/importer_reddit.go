@@ -0,0 +1,150 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/url"
+	"time"
+)
+
+// redditDeletedAuthor is how Reddit shows posts whose author deleted their account
+const redditDeletedAuthor = "[deleted]"
+
+// redditImporter reads Reddit threads in the JSON form Reddit serves when
+// .json is appended to a thread URL. A file may hold one thread or an array
+// of them. Reddit accounts are identified by username alone.
+type redditImporter struct{}
+
+// redditThing is a Reddit API object: a listing, a post (t3) or a comment (t1)
+type redditThing struct {
+	Kind string `json:"kind"`
+	Data struct {
+		Children   json.RawMessage `json:"children"`
+		Count      int             `json:"count"`
+		ID         string          `json:"id"`
+		Author     string          `json:"author"`
+		Title      string          `json:"title"`
+		Selftext   string          `json:"selftext"`
+		URL        string          `json:"url"`
+		Subreddit  string          `json:"subreddit"`
+		Body       string          `json:"body"`
+		CreatedUTC float64         `json:"created_utc"`
+		Replies    json.RawMessage `json:"replies"`
+	} `json:"data"`
+}
+
+// children decodes a listing's children. A "more" stub lists bare IDs
+// instead, for which this returns nothing.
+func (t redditThing) children() []redditThing {
+	var children []redditThing
+	json.Unmarshal(t.Data.Children, &children)
+	return children
+}
+
+func (redditImporter) Name() string { return "reddit" }
+
+// IsAttachment matches images hosted by Reddit and Imgur
+func (redditImporter) IsAttachment(link, _ *url.URL) bool {
+	switch link.Hostname() {
+	case "i.redd.it", "preview.redd.it", "i.imgur.com":
+		return true
+	}
+	return false
+}
+
+func (redditImporter) Parse(data []byte) (*ImportBundle, error) {
+	var threads [][]redditThing
+	if err := json.Unmarshal(data, &threads); err != nil {
+		var thread []redditThing
+		if err := json.Unmarshal(data, &thread); err != nil {
+			return nil, fmt.Errorf("not a Reddit thread export: %w", err)
+		}
+		threads = [][]redditThing{thread}
+	}
+
+	p := &redditParser{bundle: &ImportBundle{}, seen: make(map[string]bool)}
+	for _, thread := range threads {
+		if len(thread) == 0 {
+			return nil, fmt.Errorf("not a Reddit thread export: missing post listing")
+		}
+		posts := thread[0].children()
+		if len(posts) == 0 || posts[0].Kind != "t3" {
+			return nil, fmt.Errorf("not a Reddit thread export: missing post listing")
+		}
+		post := posts[0].Data
+
+		content := post.Selftext
+		if content == "" {
+			content = post.URL
+		}
+		topic := ImportTopic{
+			ExternalID: post.ID,
+			AuthorID:   p.user(post.Author),
+			Title:      html.UnescapeString(post.Title),
+			Content:    html.UnescapeString(content),
+			Category:   post.Subreddit,
+			CreatedAt:  redditTime(post.CreatedUTC),
+		}
+		if len(thread) > 1 {
+			p.comments(&topic, thread[1].children())
+		}
+		p.bundle.Topics = append(p.bundle.Topics, topic)
+	}
+
+	p.bundle.Notes = append(p.bundle.Notes, "Reddit exports only carry vote totals, so no votes were imported")
+	if p.collapsed > 0 {
+		p.bundle.Notes = append(p.bundle.Notes, fmt.Sprintf("%d collapsed comments weren't in the export", p.collapsed))
+	}
+	return p.bundle, nil
+}
+
+// redditParser collects users and comments while walking a thread
+type redditParser struct {
+	bundle    *ImportBundle
+	seen      map[string]bool
+	collapsed int
+}
+
+// user adds an author the first time they appear and returns their ID
+func (p *redditParser) user(name string) string {
+	if !p.seen[name] {
+		p.seen[name] = true
+		username := name
+		if name == redditDeletedAuthor {
+			username = "deleted"
+		}
+		p.bundle.Users = append(p.bundle.Users, ImportUser{ExternalID: name, Username: username})
+	}
+	return name
+}
+
+// comments flattens a comment tree onto a topic, parents before replies
+func (p *redditParser) comments(topic *ImportTopic, things []redditThing) {
+	for _, c := range things {
+		if c.Kind == "more" {
+			p.collapsed += c.Data.Count
+			continue
+		}
+		if c.Kind != "t1" {
+			continue
+		}
+		topic.Replies = append(topic.Replies, ImportReply{
+			ExternalID: c.Data.ID,
+			AuthorID:   p.user(c.Data.Author),
+			Content:    html.UnescapeString(c.Data.Body),
+			CreatedAt:  redditTime(c.Data.CreatedUTC),
+		})
+
+		// replies is "" when a comment has none
+		var replies redditThing
+		if json.Unmarshal(c.Data.Replies, &replies) == nil {
+			p.comments(topic, replies.children())
+		}
+	}
+}
+
+// redditTime converts Reddit's fractional Unix seconds
+func redditTime(sec float64) time.Time {
+	return time.Unix(int64(sec), 0).UTC()
+}
@@ -0,0 +1,215 @@
+package utils
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+// InactivityMailData is passed to the inactivity warning email template
+type InactivityMailData struct {
+	Recipient string
+	LastSeen  string
+	// LockOn and AnonymizeOn are empty when that stage is turned off
+	LockOn      string
+	AnonymizeOn string
+	LoginLink   string
+}
+
+// dormantAccount is a registered account that hasn't been used for a while
+type dormantAccount struct {
+	UUID, Username, Email string
+	LastSeen              time.Time
+}
+
+// inactivityCutoff returns the moment before which accounts are inactive
+// for the given number of months, and false when the stage is turned off
+func inactivityCutoff(months int) (time.Time, bool) {
+	if months <= 0 {
+		return time.Time{}, false
+	}
+	return Now().AddDate(0, -months, 0), true
+}
+
+// listDormantAccounts returns registered, not yet anonymized accounts last
+// seen before cutoff that also match the extra condition
+func (db *DataBase) listDormantAccounts(cutoff time.Time, cond string) ([]dormantAccount, error) {
+	rows, err := db.Conn.Query(
+		`SELECT uuid, username, email, lastseen FROM users
+		WHERE notregistered = 0 AND anonymized_at = '' AND lastseen < ? AND `+cond,
+		FormatTimestamp(cutoff),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []dormantAccount
+	for rows.Next() {
+		var (
+			a        dormantAccount
+			lastseen string
+		)
+		if err := rows.Scan(&a.UUID, &a.Username, &a.Email, &lastseen); err != nil {
+			return nil, err
+		}
+		a.LastSeen, _ = ParseTimestamp(lastseen)
+		list = append(list, a)
+	}
+	return list, rows.Err()
+}
+
+// IsLockedForInactivity reports whether the account was locked for going
+// unused and needs a new password before it can log in again
+func (db *DataBase) IsLockedForInactivity(uuid string) (bool, error) {
+	var locked bool
+	err := db.Conn.QueryRow("SELECT dormant_locked_at != '' FROM users WHERE uuid = ?", uuid).Scan(&locked)
+	return locked, err
+}
+
+// unlockDormantAccount sets a new password on an account locked for
+// inactivity, which unlocks it
+func unlockDormantAccount(ex execer, uuid, passwordHash string) error {
+	_, err := ex.Exec(
+		"UPDATE users SET password = ?, dormant_locked_at = '' WHERE uuid = ?", passwordHash, uuid,
+	)
+	return err
+}
+
+// anonymizeAccount strips an account of everything that identifies its
+// owner. Its posts and comments stay, under a placeholder name.
+func (db *DataBase) anonymizeAccount(uuid string) error {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := Timestamp()
+	_, err = tx.Exec(
+		`UPDATE users SET username = 'former-user-' || substr(uuid, 1, 8), email = uuid || '@anonymized.invalid',
+			password = '', loggedin = 0, anonymized_at = ?, dormant_locked_at = ?
+		WHERE uuid = ?`,
+		now, now, uuid,
+	)
+	if err != nil {
+		return err
+	}
+	for _, stmt := range []string{
+		"DELETE FROM user_preferences WHERE user_uuid = ?",
+		"DELETE FROM login_tokens WHERE user_uuid = ?",
+		"DELETE FROM mod_digests WHERE user_uuid = ?",
+		"DELETE FROM notification_digests WHERE user_uuid = ?",
+		"DELETE FROM notification_actors WHERE notification_id IN (SELECT id FROM notifications WHERE user_uuid = ?)",
+		"DELETE FROM notifications WHERE user_uuid = ?",
+		"DELETE FROM bookmarks WHERE user_uuid = ?",
+	} {
+		if _, err := tx.Exec(stmt, uuid); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ProcessInactiveAccounts walks dormant accounts through the lifecycle set
+// by InactivityWarnMonths, InactivityLockMonths and InactivityAnonymizeMonths:
+// their owner is emailed a warning, then the account is locked until its
+// password is reset, then it is anonymized. Using the account again starts
+// over. Each stage is skipped while its setting is 0.
+func ProcessInactiveAccounts() error {
+	var errs []error
+
+	if cutoff, ok := inactivityCutoff(InactivityAnonymizeMonths); ok {
+		accounts, err := db.listDormantAccounts(cutoff, "1")
+		if err != nil {
+			return err
+		}
+		for _, a := range accounts {
+			if err := db.anonymizeAccount(a.UUID); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			log.Printf("Anonymized account %s after inactivity", a.Username)
+		}
+	}
+
+	if cutoff, ok := inactivityCutoff(InactivityLockMonths); ok {
+		accounts, err := db.listDormantAccounts(cutoff, "dormant_locked_at = ''")
+		if err != nil {
+			return err
+		}
+		for _, a := range accounts {
+			db.Write.Lock()
+			_, err := db.Conn.Exec(
+				"UPDATE users SET dormant_locked_at = ?, loggedin = 0 WHERE uuid = ?", Timestamp(), a.UUID,
+			)
+			db.Write.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	// Accounts are warned once per stretch of inactivity
+	if cutoff, ok := inactivityCutoff(InactivityWarnMonths); ok {
+		accounts, err := db.listDormantAccounts(cutoff, "dormant_locked_at = '' AND dormant_warned_at < lastseen")
+		if err != nil {
+			return err
+		}
+		for _, a := range accounts {
+			if err := db.warnDormantAccount(a); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// warnDormantAccount emails the owner of a dormant account what will
+// happen to it, and records that they were warned
+func (db *DataBase) warnDormantAccount(a dormantAccount) error {
+	data := InactivityMailData{
+		Recipient: a.Username,
+		LastSeen:  a.LastSeen.Format("Jan 2, 2006"),
+		LoginLink: SiteURL + "/login",
+	}
+	if InactivityLockMonths > 0 {
+		data.LockOn = a.LastSeen.AddDate(0, InactivityLockMonths, 0).Format("Jan 2, 2006")
+	}
+	if InactivityAnonymizeMonths > 0 {
+		data.AnonymizeOn = a.LastSeen.AddDate(0, InactivityAnonymizeMonths, 0).Format("Jan 2, 2006")
+	}
+	if err := SendTemplateMail(a.Email, "Your forum account is inactive", "inactivity_warning", data); err != nil {
+		return err
+	}
+
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	_, err := db.Conn.Exec("UPDATE users SET dormant_warned_at = ? WHERE uuid = ?", Timestamp(), a.UUID)
+	return err
+}
+
+// errLockedForInactivity is returned by logins to accounts locked by
+// ProcessInactiveAccounts
+var errLockedForInactivity = errors.New("this account was locked after a long time without use; log in with an emailed link at /login/magic to choose a new password")
+
+// loginTokenLocked reports whether the account a login token belongs to is
+// locked for inactivity, without spending the token
+func (db *DataBase) loginTokenLocked(token string) (bool, error) {
+	var locked bool
+	err := db.Conn.QueryRow(
+		`SELECT u.dormant_locked_at != '' FROM login_tokens t JOIN users u ON u.uuid = t.user_uuid
+		WHERE t.token_hash = ? AND t.used_at = '' AND t.expires_at > ?`,
+		hashLoginToken(token), Timestamp(),
+	).Scan(&locked)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return locked, err
+}
@@ -0,0 +1,264 @@
+package utils
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// PostExcerptLength is how much of a post's text a listing shows
+const PostExcerptLength = 200
+
+// Post listing sort modes
+const (
+	SortNew      = "new"
+	SortTop      = "top"
+	SortComments = "comments"
+	SortHot      = "hot"
+)
+
+// SortMode is a way of ordering a post listing
+type SortMode struct {
+	Key   string
+	Label string
+}
+
+// SortModes lists the orderings offered on listings; the first is the default
+var SortModes = []SortMode{
+	{SortNew, "New"},
+	{SortHot, "Hot"},
+	{SortTop, "Top"},
+	{SortComments, "Most commented"},
+}
+
+// postOrderings maps each sort mode to its ORDER BY clause. The hot score
+// is the net likes plus one, divided by the square of the post's age in
+// hours plus two, so new posts start near the top and fall as they age
+// unless people keep reacting to them. @now is the current time.
+var postOrderings = map[string]string{
+	SortNew:      "p.created_at DESC, p.id DESC",
+	SortTop:      "COALESCE(r.likes - r.dislikes, 0) DESC, p.created_at DESC, p.id DESC",
+	SortComments: "COALESCE(c.comments, 0) DESC, p.created_at DESC, p.id DESC",
+	SortHot: `(1.0 + COALESCE(r.likes - r.dislikes, 0)) /
+		((MAX(julianday(@now) - julianday(p.created_at), 0) * 24 + 2) * (MAX(julianday(@now) - julianday(p.created_at), 0) * 24 + 2)) DESC,
+		p.created_at DESC, p.id DESC`,
+}
+
+// Post listing filters. Both need a registered user.
+const (
+	FilterMine       = "mine"
+	FilterLiked      = "liked"
+	FilterBookmarked = "bookmarked"
+)
+
+// FilterMode is a way of narrowing a post listing
+type FilterMode struct {
+	Key   string
+	Label string
+}
+
+// FilterModes lists the filters offered to registered users
+var FilterModes = []FilterMode{
+	{FilterMine, "My posts"},
+	{FilterLiked, "Liked posts"},
+	{FilterBookmarked, "Bookmarks"},
+}
+
+// postFilters maps each filter to its extra WHERE condition; @user is the
+// viewer's UUID
+var postFilters = map[string]string{
+	FilterMine:       "p.author_uuid = @user",
+	FilterLiked:      "EXISTS (SELECT 1 FROM interactions i WHERE i.post_id = p.id AND i.user_uuid = @user AND i.liked = 1)",
+	FilterBookmarked: "EXISTS (SELECT 1 FROM bookmarks b WHERE b.post_id = p.id AND b.user_uuid = @user)",
+}
+
+// categoryDescendants selects @category and every category below it. UNION
+// rather than UNION ALL stops the recursion if the parent links loop.
+const categoryDescendants = `(WITH RECURSIVE tree(id) AS (
+		SELECT @category
+		UNION SELECT c.id FROM categories c JOIN tree t ON c.parent_id = t.id
+	) SELECT id FROM tree)`
+
+// PostQuery selects and orders the posts of a listing
+type PostQuery struct {
+	Sort string
+	// Filter is empty for every post, or one of postFilters applied to
+	// UserUUID
+	Filter   string
+	UserUUID string
+	// CategoryID limits the listing to one category when it isn't 0
+	CategoryID int
+	// IncludeDescendants widens CategoryID to its subcategories, at any depth
+	IncludeDescendants bool
+	// Since limits the listing to posts created after it when it isn't zero
+	Since time.Time
+}
+
+// FilterFromRequest reads the ?filter= parameter. Guests and unknown
+// filters get the unfiltered listing.
+func FilterFromRequest(r *http.Request, user *User) string {
+	filter := r.URL.Query().Get("filter")
+	if _, ok := postFilters[filter]; !ok || user == nil || user.NotRegistered {
+		return ""
+	}
+	return filter
+}
+
+// SortFromRequest reads the ?sort= parameter, defaulting to the first of
+// SortModes when it is missing or unknown
+func SortFromRequest(r *http.Request) string {
+	sort := r.URL.Query().Get("sort")
+	if _, ok := postOrderings[sort]; !ok {
+		return SortModes[0].Key
+	}
+	return sort
+}
+
+// PostListData is one page of a post listing
+type PostListData struct {
+	Posts  []Post
+	Sort   string
+	Sorts  []SortMode
+	Filter string
+	// Filters is empty for guests
+	Filters    []FilterMode
+	Page       int
+	TotalPages int
+	Total      int
+	PrevPage   int
+	NextPage   int
+}
+
+// Summary returns the start of the post's text for listings
+func (p *Post) Summary() string {
+	return Excerpt(p.Content, PostExcerptLength)
+}
+
+// Description is the start of the post's rendered text, for link previews
+// and feeds where Markdown syntax would show through
+func (p *Post) Description() string {
+	return HTMLExcerpt(string(RenderMarkdown(p.Content)), PostExcerptLength)
+}
+
+// ListPosts returns one page of the published posts q selects, and the
+// total number of them. Comments, likes and dislikes are counted in the
+// same query.
+func (db *DataBase) ListPosts(q PostQuery, limit, offset int) ([]Post, int, error) {
+	order, ok := postOrderings[q.Sort]
+	if !ok {
+		return nil, 0, fmt.Errorf("unknown sort mode %q", q.Sort)
+	}
+	where := "p.deleted_at = '' AND p.status = @status"
+	if q.Filter != "" {
+		cond, ok := postFilters[q.Filter]
+		if !ok {
+			return nil, 0, fmt.Errorf("unknown filter %q", q.Filter)
+		}
+		where += " AND " + cond
+	}
+	if q.CategoryID != 0 && q.IncludeDescendants {
+		where += " AND EXISTS (SELECT 1 FROM post_categories pc WHERE pc.post_id = p.id AND pc.category_id IN " + categoryDescendants + ")"
+	} else if q.CategoryID != 0 {
+		where += " AND EXISTS (SELECT 1 FROM post_categories pc WHERE pc.post_id = p.id AND pc.category_id = @category)"
+	}
+	if !q.Since.IsZero() {
+		where += " AND p.created_at > @since"
+	}
+	if q.Filter == "" {
+		// Pinned posts stay on top whatever the sort
+		order = "pinned DESC, " + order
+	}
+	if q.CategoryID != 0 {
+		// Announcements stay on top of their category whatever the sort
+		order = "announced DESC, " + order
+	}
+	args := []interface{}{
+		sql.Named("now", Timestamp()),
+		sql.Named("status", PostPublished),
+		sql.Named("user", q.UserUUID),
+		sql.Named("category", q.CategoryID),
+		sql.Named("since", FormatTimestamp(q.Since)),
+		sql.Named("limit", limit),
+		sql.Named("offset", offset),
+	}
+
+	var total int
+	if err := db.Conn.QueryRow("SELECT COUNT(*) FROM posts p WHERE "+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.Conn.Query(
+		`SELECT p.id, p.title, p.content, p.created_at, u.username, `+coAuthorCredits+`, p.views, p.nsfw, p.spoiler,
+			COALESCE(c.comments, 0), COALESCE(r.likes, 0), COALESCE(r.dislikes, 0),
+			EXISTS (SELECT 1 FROM category_announcements a WHERE a.post_id = p.id AND a.category_id = @category) AS announced,
+			EXISTS (SELECT 1 FROM post_pins pp WHERE pp.post_id = p.id AND pp.category_id IN (0, @category)) AS pinned
+		FROM posts p JOIN users u ON u.uuid = p.author_uuid
+		LEFT JOIN (
+			SELECT post_id, SUM(liked) AS likes, SUM(disliked) AS dislikes
+			FROM interactions GROUP BY post_id
+		) r ON r.post_id = p.id
+		LEFT JOIN (
+			SELECT post_id, COUNT(*) AS comments FROM comments GROUP BY post_id
+		) c ON c.post_id = p.id
+		WHERE `+where+`
+		ORDER BY `+order+`
+		LIMIT @limit OFFSET @offset`,
+		args...,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var posts []Post
+	for rows.Next() {
+		var (
+			p                  Post
+			createdAt, credits string
+		)
+		if err := rows.Scan(&p.ID, &p.Title, &p.Content, &createdAt, &p.Author.Username, &credits, &p.Views, &p.NSFW, &p.Spoiler,
+			&p.CommentCount, &p.LikeCount, &p.DislikeCount, &p.Announcement, &p.Pinned); err != nil {
+			return nil, 0, err
+		}
+		p.CreatedAt, _ = ParseTimestamp(createdAt)
+		p.CoAuthors = splitCredits(credits)
+		posts = append(posts, p)
+	}
+	return posts, total, rows.Err()
+}
+
+// LoadPostPage loads the given 1-based page of the post listing for the
+// viewer, with times shown in their timezone
+func (db *DataBase) LoadPostPage(q PostQuery, page int, viewer *User) (*PostListData, error) {
+	posts, total, err := db.ListPosts(q, PostsPerPage, (page-1)*PostsPerPage)
+	if err != nil {
+		return nil, err
+	}
+	loc := db.GetLocationPreference(viewer.UUID)
+	reveal, _ := db.GetBoolPreference(viewer.UUID, PrefShowFlagged)
+	for i := range posts {
+		posts[i].CreatedAt = posts[i].CreatedAt.In(loc)
+		posts[i].Revealed = reveal
+	}
+
+	data := &PostListData{
+		Posts:      posts,
+		Sort:       q.Sort,
+		Sorts:      SortModes,
+		Filter:     q.Filter,
+		Page:       page,
+		Total:      total,
+		TotalPages: (total + PostsPerPage - 1) / PostsPerPage,
+	}
+	if !viewer.NotRegistered {
+		data.Filters = FilterModes
+	}
+	if page > 1 {
+		data.PrevPage = page - 1
+	}
+	if page < data.TotalPages {
+		data.NextPage = page + 1
+	}
+	return data, nil
+}
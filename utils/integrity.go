@@ -0,0 +1,355 @@
+package utils
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// integrityCheck finds one kind of row that points at something that no
+// longer exists. Foreign keys only catch these while PRAGMA foreign_keys is
+// on for the connection doing the write, which isn't the case for every
+// connection in the pool, and older databases predate some of them.
+type integrityCheck struct {
+	Name  string
+	Table string
+	// Where selects the broken rows of Table
+	Where string
+	// Repair fixes them. Checks without one are only reported, because
+	// fixing them would throw away content someone wrote.
+	Repair string
+}
+
+var integrityChecks = []integrityCheck{
+	{
+		Name:  "posts by missing users",
+		Table: "posts",
+		Where: "author_uuid NOT IN (SELECT uuid FROM users)",
+	},
+	{
+		Name:   "comments on missing posts",
+		Table:  "comments",
+		Where:  "post_id NOT IN (SELECT id FROM posts)",
+		Repair: "DELETE FROM comments WHERE post_id NOT IN (SELECT id FROM posts)",
+	},
+	{
+		Name:  "comments by missing users",
+		Table: "comments",
+		Where: "comment_author_uuid NOT IN (SELECT uuid FROM users)",
+	},
+	{
+		Name:   "likes on missing posts",
+		Table:  "interactions",
+		Where:  "post_id NOT IN (SELECT id FROM posts)",
+		Repair: "DELETE FROM interactions WHERE post_id NOT IN (SELECT id FROM posts)",
+	},
+	{
+		Name:   "likes by missing users",
+		Table:  "interactions",
+		Where:  "user_uuid NOT IN (SELECT uuid FROM users)",
+		Repair: "DELETE FROM interactions WHERE user_uuid NOT IN (SELECT uuid FROM users)",
+	},
+	{
+		Name:  "comment likes on missing comments or by missing users",
+		Table: "comment_interactions",
+		Where: "comment_id NOT IN (SELECT id FROM comments) OR user_uuid NOT IN (SELECT uuid FROM users)",
+		Repair: `DELETE FROM comment_interactions
+			WHERE comment_id NOT IN (SELECT id FROM comments) OR user_uuid NOT IN (SELECT uuid FROM users)`,
+	},
+	{
+		Name:   "post categories pointing at missing posts",
+		Table:  "post_categories",
+		Where:  "post_id NOT IN (SELECT id FROM posts)",
+		Repair: "DELETE FROM post_categories WHERE post_id NOT IN (SELECT id FROM posts)",
+	},
+	{
+		Name:   "post categories pointing at missing categories",
+		Table:  "post_categories",
+		Where:  "category_id NOT IN (SELECT id FROM categories)",
+		Repair: "DELETE FROM post_categories WHERE category_id NOT IN (SELECT id FROM categories)",
+	},
+	{
+		Name:   "subcategories of missing categories",
+		Table:  "categories",
+		Where:  "parent_id != 0 AND parent_id NOT IN (SELECT id FROM categories)",
+		Repair: "UPDATE categories SET parent_id = 0 WHERE parent_id != 0 AND parent_id NOT IN (SELECT id FROM categories)",
+	},
+	{
+		Name:  "moderators of missing categories or by missing users",
+		Table: "category_moderators",
+		Where: "category_id NOT IN (SELECT id FROM categories) OR user_uuid NOT IN (SELECT uuid FROM users)",
+		Repair: `DELETE FROM category_moderators
+			WHERE category_id NOT IN (SELECT id FROM categories) OR user_uuid NOT IN (SELECT uuid FROM users)`,
+	},
+	{
+		Name:  "announcements of missing posts or categories",
+		Table: "category_announcements",
+		Where: "post_id NOT IN (SELECT id FROM posts) OR category_id NOT IN (SELECT id FROM categories)",
+		Repair: `DELETE FROM category_announcements
+			WHERE post_id NOT IN (SELECT id FROM posts) OR category_id NOT IN (SELECT id FROM categories)`,
+	},
+	{
+		Name:  "pins of missing posts or categories",
+		Table: "post_pins",
+		Where: "post_id NOT IN (SELECT id FROM posts) OR (category_id != 0 AND category_id NOT IN (SELECT id FROM categories))",
+		Repair: `DELETE FROM post_pins
+			WHERE post_id NOT IN (SELECT id FROM posts) OR (category_id != 0 AND category_id NOT IN (SELECT id FROM categories))`,
+	},
+	{
+		Name:  "moved notices of missing posts or categories",
+		Table: "moved_posts",
+		Where: `post_id NOT IN (SELECT id FROM posts) OR category_id NOT IN (SELECT id FROM categories)
+			OR to_category_id NOT IN (SELECT id FROM categories)`,
+		Repair: `DELETE FROM moved_posts WHERE post_id NOT IN (SELECT id FROM posts)
+			OR category_id NOT IN (SELECT id FROM categories) OR to_category_id NOT IN (SELECT id FROM categories)`,
+	},
+	{
+		Name:  "merges of missing posts",
+		Table: "post_merges",
+		Where: "source_id NOT IN (SELECT id FROM posts) OR target_id NOT IN (SELECT id FROM posts)",
+	},
+	{
+		Name:   "items of missing merges",
+		Table:  "post_merge_items",
+		Where:  "merge_id NOT IN (SELECT id FROM post_merges)",
+		Repair: "DELETE FROM post_merge_items WHERE merge_id NOT IN (SELECT id FROM post_merges)",
+	},
+	{
+		Name:   "post templates of missing categories",
+		Table:  "category_templates",
+		Where:  "category_id NOT IN (SELECT id FROM categories)",
+		Repair: "DELETE FROM category_templates WHERE category_id NOT IN (SELECT id FROM categories)",
+	},
+	{
+		Name:  "co-authors of missing posts or users",
+		Table: "post_coauthors",
+		Where: "post_id NOT IN (SELECT id FROM posts) OR user_uuid NOT IN (SELECT uuid FROM users)",
+		Repair: `DELETE FROM post_coauthors
+			WHERE post_id NOT IN (SELECT id FROM posts) OR user_uuid NOT IN (SELECT uuid FROM users)`,
+	},
+	{
+		Name:  "reactions to missing posts or comments, or by missing users",
+		Table: "reactions",
+		Where: "post_id NOT IN (SELECT id FROM posts) OR (comment_id != 0 AND comment_id NOT IN (SELECT id FROM comments)) OR user_uuid NOT IN (SELECT uuid FROM users)",
+		Repair: `DELETE FROM reactions
+			WHERE post_id NOT IN (SELECT id FROM posts) OR (comment_id != 0 AND comment_id NOT IN (SELECT id FROM comments)) OR user_uuid NOT IN (SELECT uuid FROM users)`,
+	},
+	{
+		Name:  "mentions in missing posts or comments, or of missing users",
+		Table: "mentions",
+		Where: "post_id NOT IN (SELECT id FROM posts) OR (comment_id != 0 AND comment_id NOT IN (SELECT id FROM comments)) OR user_uuid NOT IN (SELECT uuid FROM users)",
+		Repair: `DELETE FROM mentions
+			WHERE post_id NOT IN (SELECT id FROM posts) OR (comment_id != 0 AND comment_id NOT IN (SELECT id FROM comments)) OR user_uuid NOT IN (SELECT uuid FROM users)`,
+	},
+	{
+		Name:  "notifications about missing posts or comments, or of missing users",
+		Table: "notifications",
+		Where: "(post_id IS NOT NULL AND post_id NOT IN (SELECT id FROM posts)) OR (comment_id != 0 AND comment_id NOT IN (SELECT id FROM comments)) OR user_uuid NOT IN (SELECT uuid FROM users)",
+		Repair: `DELETE FROM notifications
+			WHERE (post_id IS NOT NULL AND post_id NOT IN (SELECT id FROM posts)) OR (comment_id != 0 AND comment_id NOT IN (SELECT id FROM comments)) OR user_uuid NOT IN (SELECT uuid FROM users)`,
+	},
+	{
+		Name:   "actors of missing notifications",
+		Table:  "notification_actors",
+		Where:  "notification_id NOT IN (SELECT id FROM notifications)",
+		Repair: "DELETE FROM notification_actors WHERE notification_id NOT IN (SELECT id FROM notifications)",
+	},
+	{
+		Name:  "comment drafts on missing posts or by missing users",
+		Table: "comment_drafts",
+		Where: "post_id NOT IN (SELECT id FROM posts) OR user_uuid NOT IN (SELECT uuid FROM users)",
+		Repair: `DELETE FROM comment_drafts
+			WHERE post_id NOT IN (SELECT id FROM posts) OR user_uuid NOT IN (SELECT uuid FROM users)`,
+	},
+	{
+		Name:  "subscriptions to missing posts or of missing users",
+		Table: "post_subscriptions",
+		Where: "post_id NOT IN (SELECT id FROM posts) OR user_uuid NOT IN (SELECT uuid FROM users)",
+		Repair: `DELETE FROM post_subscriptions
+			WHERE post_id NOT IN (SELECT id FROM posts) OR user_uuid NOT IN (SELECT uuid FROM users)`,
+	},
+	{
+		Name:  "revisions of missing posts",
+		Table: "post_revisions",
+		Where: "post_id NOT IN (SELECT id FROM posts)",
+	},
+	{
+		Name:   "bookmarks of missing posts or by missing users",
+		Table:  "bookmarks",
+		Where:  "post_id NOT IN (SELECT id FROM posts) OR user_uuid NOT IN (SELECT uuid FROM users)",
+		Repair: "DELETE FROM bookmarks WHERE post_id NOT IN (SELECT id FROM posts) OR user_uuid NOT IN (SELECT uuid FROM users)",
+	},
+	{
+		Name:   "polls of missing posts",
+		Table:  "polls",
+		Where:  "post_id NOT IN (SELECT id FROM posts)",
+		Repair: "DELETE FROM polls WHERE post_id NOT IN (SELECT id FROM posts)",
+	},
+	{
+		Name:   "poll options of missing polls",
+		Table:  "poll_options",
+		Where:  "post_id NOT IN (SELECT post_id FROM polls)",
+		Repair: "DELETE FROM poll_options WHERE post_id NOT IN (SELECT post_id FROM polls)",
+	},
+	{
+		Name:   "poll votes for missing options or by missing users",
+		Table:  "poll_votes",
+		Where:  "option_id NOT IN (SELECT id FROM poll_options) OR user_uuid NOT IN (SELECT uuid FROM users)",
+		Repair: "DELETE FROM poll_votes WHERE option_id NOT IN (SELECT id FROM poll_options) OR user_uuid NOT IN (SELECT uuid FROM users)",
+	},
+	{
+		Name:  "reports of missing posts",
+		Table: "reports",
+		Where: "post_id NOT IN (SELECT id FROM posts)",
+	},
+	{
+		Name:   "accepted answers that aren't comments on their post",
+		Table:  "posts",
+		Where:  "accepted_comment_id != 0 AND accepted_comment_id NOT IN (SELECT id FROM comments WHERE post_id = posts.id)",
+		Repair: "UPDATE posts SET accepted_comment_id = 0 WHERE accepted_comment_id != 0 AND accepted_comment_id NOT IN (SELECT id FROM comments WHERE post_id = posts.id)",
+	},
+	{
+		Name:  "reports of missing comments",
+		Table: "reports",
+		Where: "comment_id != 0 AND comment_id NOT IN (SELECT id FROM comments)",
+	},
+	{
+		Name:   "translations of missing posts",
+		Table:  "post_translations",
+		Where:  "post_id NOT IN (SELECT id FROM posts)",
+		Repair: "DELETE FROM post_translations WHERE post_id NOT IN (SELECT id FROM posts)",
+	},
+	{
+		Name:   "summaries of missing posts",
+		Table:  "post_summaries",
+		Where:  "post_id NOT IN (SELECT id FROM posts)",
+		Repair: "DELETE FROM post_summaries WHERE post_id NOT IN (SELECT id FROM posts)",
+	},
+	{
+		Name:   "link clicks on missing posts",
+		Table:  "link_clicks",
+		Where:  "post_id NOT IN (SELECT id FROM posts)",
+		Repair: "DELETE FROM link_clicks WHERE post_id NOT IN (SELECT id FROM posts)",
+	},
+	{
+		// The files stay on disk, so these are left for an admin to look at
+		Name:  "images of missing posts",
+		Table: "post_images",
+		Where: "post_id NOT IN (SELECT id FROM posts)",
+	},
+	{
+		Name:  "attachments of missing posts",
+		Table: "post_attachments",
+		Where: "post_id NOT IN (SELECT id FROM posts)",
+	},
+}
+
+// IntegrityIssue is what one check found
+type IntegrityIssue struct {
+	Check    string
+	Rows     int
+	Repaired bool
+}
+
+func (i IntegrityIssue) String() string {
+	if i.Repaired {
+		return fmt.Sprintf("%s: %d (repaired)", i.Check, i.Rows)
+	}
+	return fmt.Sprintf("%s: %d", i.Check, i.Rows)
+}
+
+// CheckIntegrity runs every integrity check and returns those that found
+// something. With repair, issues that have a repair are fixed in one
+// transaction.
+func (db *DataBase) CheckIntegrity(repair bool) ([]IntegrityIssue, error) {
+	var issues []IntegrityIssue
+	for _, c := range integrityChecks {
+		var n int
+		if err := db.Conn.QueryRow("SELECT COUNT(*) FROM " + c.Table + " WHERE " + c.Where).Scan(&n); err != nil {
+			return nil, fmt.Errorf("%s: %w", c.Name, err)
+		}
+		if n > 0 {
+			issues = append(issues, IntegrityIssue{Check: c.Name, Rows: n})
+		}
+	}
+	if !repair || len(issues) == 0 {
+		return issues, nil
+	}
+
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	for i := range issues {
+		for _, c := range integrityChecks {
+			if c.Name != issues[i].Check || c.Repair == "" {
+				continue
+			}
+			if _, err := tx.Exec(c.Repair); err != nil {
+				return nil, fmt.Errorf("repairing %s: %w", c.Name, err)
+			}
+			issues[i].Repaired = true
+		}
+	}
+	return issues, tx.Commit()
+}
+
+// SweepIntegrity is the integrity job. It repairs what it can when
+// IntegrityRepair is set and reports everything it found through
+// ReportError.
+func SweepIntegrity() error {
+	issues, err := db.CheckIntegrity(IntegrityRepair)
+	if err != nil {
+		return err
+	}
+	if len(issues) == 0 {
+		return nil
+	}
+	lines := make([]string, len(issues))
+	for i, issue := range issues {
+		lines[i] = issue.String()
+	}
+	ReportError(Diagnostics{
+		Title: "Data integrity issues found",
+		Error: strings.Join(lines, "\n"),
+	})
+	return nil
+}
+
+// IntegrityCommand runs the checks from the command line:
+//
+//	forum integrity [-repair]
+//
+// It prints what it found and returns 1 when unrepaired issues remain.
+func IntegrityCommand(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("integrity", flag.ContinueOnError)
+	fs.SetOutput(out)
+	repair := fs.Bool("repair", false, "fix the issues that can be fixed safely")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	issues, err := db.CheckIntegrity(*repair)
+	if err != nil {
+		fmt.Fprintln(out, "Integrity check failed:", err)
+		return 1
+	}
+	if len(issues) == 0 {
+		fmt.Fprintln(out, "No integrity issues found")
+		return 0
+	}
+	status := 0
+	for _, issue := range issues {
+		fmt.Fprintln(out, issue)
+		if !issue.Repaired {
+			status = 1
+		}
+	}
+	return status
+}
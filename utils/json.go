@@ -0,0 +1,26 @@
+package utils
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// WriteJSON encodes data as the JSON response body with the given status
+func WriteJSON(w http.ResponseWriter, statusCode int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Println("JSON encode error:", err)
+	}
+}
+
+// WantsJSON reports whether the client asked for a JSON response,
+// either with ?format=json or through the Accept header.
+func WantsJSON(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "json" {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
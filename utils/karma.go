@@ -0,0 +1,20 @@
+package utils
+
+// userKarma scores what others made of a user's contributions: a point for
+// each like of their posts and comments, and AcceptedAnswerKarma for each
+// of their answers accepted by someone else. Liking or accepting oneself
+// and posts in the trash don't count.
+const userKarma = `SELECT
+	(SELECT COUNT(*) FROM interactions i JOIN posts p ON p.id = i.post_id
+		WHERE p.author_uuid = ?1 AND i.liked AND i.user_uuid != ?1 AND p.deleted_at = '')
+	+ (SELECT COUNT(*) FROM comment_interactions ci JOIN comments c ON c.id = ci.comment_id
+		WHERE c.comment_author_uuid = ?1 AND ci.liked AND ci.user_uuid != ?1)
+	+ ?2 * (SELECT COUNT(*) FROM posts p JOIN comments c ON c.id = p.accepted_comment_id AND c.post_id = p.id
+		WHERE c.comment_author_uuid = ?1 AND p.author_uuid != ?1 AND p.deleted_at = '')`
+
+// UserKarma returns a user's karma; see userKarma
+func (db *DataBase) UserKarma(uuid string) (int, error) {
+	var karma int
+	err := db.Conn.QueryRow(userKarma, uuid, AcceptedAnswerKarma).Scan(&karma)
+	return karma, err
+}
@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// LengthLimit bounds the length of a piece of user text, in characters
+type LengthLimit struct {
+	// Name is how validation errors refer to the text
+	Name string
+	Min  int
+	// Max is 0 when there is no upper bound
+	Max int
+}
+
+// envLengthLimit reads a limit from <prefix>_MIN_LENGTH and
+// <prefix>_MAX_LENGTH, falling back to the given bounds. The minimum is
+// kept at 1 or more and the maximum, unless 0, at the minimum or more.
+func envLengthLimit(name, prefix string, defMin, defMax int) LengthLimit {
+	l := LengthLimit{
+		Name: name,
+		Min:  max(envInt(prefix+"_MIN_LENGTH", defMin), 1),
+		Max:  max(envInt(prefix+"_MAX_LENGTH", defMax), 0),
+	}
+	if l.Max != 0 && l.Max < l.Min {
+		l.Max = l.Min
+	}
+	return l
+}
+
+// Check returns an error describing how s breaks the limit, if it does
+func (l LengthLimit) Check(s string) error {
+	n := utf8.RuneCountInString(s)
+	switch {
+	case n == 0:
+		return fmt.Errorf("%s can't be empty", l.Name)
+	case n < l.Min:
+		return fmt.Errorf("%s must be at least %d characters", l.Name, l.Min)
+	case l.Max != 0 && n > l.Max:
+		return fmt.Errorf("%s can be at most %d characters, not %d", l.Name, l.Max, n)
+	}
+	return nil
+}
+
+// CheckMax is Check without the minimum, for text that may be unfinished
+func (l LengthLimit) CheckMax(s string) error {
+	if l.Max != 0 && utf8.RuneCountInString(s) > l.Max {
+		return l.Check(s)
+	}
+	return nil
+}
@@ -0,0 +1,385 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// MaxLinkPreviews caps the preview cards shown under a post
+const MaxLinkPreviews = 3
+
+// LinkPreviewTTL is how long a fetched preview is used before the page is
+// fetched again, and LinkPreviewRetention how long previews nobody asked
+// for are kept
+const (
+	LinkPreviewTTL       = 24 * time.Hour
+	LinkPreviewRetention = 30 * 24 * time.Hour
+)
+
+// Limits on what a preview fetch reads. Pages are only read far enough to
+// find their metadata.
+const (
+	linkPreviewPageBytes  = 512 << 10
+	linkPreviewImageBytes = 2 << 20
+	linkPreviewBatch      = 10
+)
+
+// Link preview statuses. Pending previews are waiting for the fetch job.
+const (
+	PreviewPending = "pending"
+	PreviewReady   = "ready"
+	PreviewFailed  = "failed"
+)
+
+// LinkPreview describes the page behind a bare URL in a post
+type LinkPreview struct {
+	ID          int
+	URL         string
+	Title       string
+	Description string
+	// Image is the page's own image URL; readers get it through
+	// LinkPreviewImageHandler so the site can't track them
+	Image string
+}
+
+// Host is the site the link points to
+func (p LinkPreview) Host() string {
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(u.Hostname(), "www.")
+}
+
+// Token identifies the URL in the post's /out links
+func (p LinkPreview) Token() string {
+	return linkToken(p.URL)
+}
+
+// bareLinkPattern matches the links RenderMarkdown makes of bare URLs,
+// whose text is the URL itself
+var bareLinkPattern = regexp.MustCompile(`<a href="(https?://[^"]*)" rel="nofollow ugc noopener">([^<]*)</a>`)
+
+// bareURLs returns the distinct bare URLs of a post body, in order, up to
+// limit. Links written as [text](url), URLs in code and videos that play
+// in place don't count.
+func bareURLs(src string, limit int) []string {
+	var urls []string
+	seen := make(map[string]bool)
+	for _, m := range bareLinkPattern.FindAllStringSubmatch(embedVideos(string(RenderMarkdown(src))), -1) {
+		if m[1] != m[2] || seen[m[1]] {
+			continue
+		}
+		seen[m[1]] = true
+		urls = append(urls, html.UnescapeString(m[1]))
+		if len(urls) == limit {
+			break
+		}
+	}
+	return urls
+}
+
+// PostLinkPreviews returns the ready previews of a post's bare URLs, and
+// asks the fetch job for the ones it doesn't have yet or that went stale
+func (db *DataBase) PostLinkPreviews(post *Post) ([]LinkPreview, error) {
+	if !LinkPreviews {
+		return nil, nil
+	}
+	urls := bareURLs(post.Content, MaxLinkPreviews)
+	if len(urls) == 0 {
+		return nil, nil
+	}
+
+	db.Write.Lock()
+	now := Timestamp()
+	for _, u := range urls {
+		if _, err := db.Conn.Exec(
+			`INSERT INTO link_previews (url, status, requested_at) VALUES (?, ?, ?)
+			ON CONFLICT(url) DO UPDATE SET requested_at = excluded.requested_at`,
+			u, PreviewPending, now,
+		); err != nil {
+			db.Write.Unlock()
+			return nil, err
+		}
+	}
+	db.Write.Unlock()
+
+	var previews []LinkPreview
+	for _, u := range urls {
+		var p LinkPreview
+		err := db.Conn.QueryRow(
+			"SELECT id, url, title, description, image FROM link_previews WHERE url = ? AND status = ?",
+			u, PreviewReady,
+		).Scan(&p.ID, &p.URL, &p.Title, &p.Description, &p.Image)
+		if err == nil {
+			previews = append(previews, p)
+		}
+	}
+	return previews, nil
+}
+
+// errPrivateAddress is returned when a fetch would reach a host that
+// isn't on the public internet
+var errPrivateAddress = errors.New("refusing to connect to a non-public address")
+
+// publicIP reports whether ip is routable on the public internet
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	// Carrier-grade NAT space isn't covered by IsPrivate
+	if ip4 := ip.To4(); ip4 != nil && ip4[0] == 100 && ip4[1]&0xc0 == 64 {
+		return false
+	}
+	return true
+}
+
+// dialPublic refuses connections to anything but public addresses on the
+// web ports. It runs on the address actually dialed, after DNS, so a name
+// can't be made to resolve somewhere internal between checks.
+func dialPublic(network, address string, _ syscall.RawConn) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+		return errPrivateAddress
+	}
+	if port != "80" && port != "443" {
+		return errPrivateAddress
+	}
+	return nil
+}
+
+// linkPreviewClient fetches pages and images for link previews. Posters
+// choose the URLs, so it only reaches public hosts, ignores proxy settings
+// and gives up quickly.
+var linkPreviewClient = &http.Client{
+	Timeout: 8 * time.Second,
+	Transport: &http.Transport{
+		DialContext:            (&net.Dialer{Timeout: 3 * time.Second, Control: dialPublic}).DialContext,
+		TLSHandshakeTimeout:    3 * time.Second,
+		ResponseHeaderTimeout:  5 * time.Second,
+		MaxResponseHeaderBytes: 64 << 10,
+	},
+	CheckRedirect: checkWebRedirect,
+}
+
+// checkWebRedirect follows at most a few redirects, and only to web URLs
+func checkWebRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 3 {
+		return errors.New("too many redirects")
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return errors.New("redirected off the web")
+	}
+	return nil
+}
+
+// previewGet requests a URL for a preview with the given Accept header
+func previewGet(ctx context.Context, rawURL, accept string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return nil, errors.New("not a web address")
+	}
+	req.Header.Set("Accept", accept)
+	req.Header.Set("User-Agent", "ForumHub link preview")
+	resp, err := linkPreviewClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return resp, nil
+}
+
+var (
+	htmlMetaTag   = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+	htmlAttribute = regexp.MustCompile(`(?is)([a-z][a-z0-9:_-]*)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+	htmlTitleTag  = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+)
+
+// parsePreview reads a page's Open Graph tags, falling back to its title
+// and description. base resolves a relative image URL.
+func parsePreview(page string, base *url.URL) LinkPreview {
+	meta := make(map[string]string)
+	for _, tag := range htmlMetaTag.FindAllString(page, -1) {
+		attrs := make(map[string]string)
+		for _, m := range htmlAttribute.FindAllStringSubmatch(tag, -1) {
+			attrs[strings.ToLower(m[1])] = m[2] + m[3] + m[4]
+		}
+		key := attrs["property"]
+		if key == "" {
+			key = attrs["name"]
+		}
+		key = strings.ToLower(key)
+		if _, ok := meta[key]; key != "" && !ok {
+			meta[key] = html.UnescapeString(attrs["content"])
+		}
+	}
+	first := func(keys ...string) string {
+		for _, k := range keys {
+			if v := strings.TrimSpace(meta[k]); v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+
+	var p LinkPreview
+	p.Title = first("og:title", "twitter:title")
+	if m := htmlTitleTag.FindStringSubmatch(page); p.Title == "" && m != nil {
+		p.Title = html.UnescapeString(m[1])
+	}
+	p.Title = Excerpt(p.Title, 200)
+	p.Description = Excerpt(first("og:description", "description", "twitter:description"), 300)
+	if image := first("og:image", "og:image:url", "twitter:image"); image != "" {
+		if u, err := base.Parse(image); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			p.Image = u.String()
+		}
+	}
+	return p
+}
+
+// fetchLinkPreview fetches the page behind a URL and reads its preview
+func fetchLinkPreview(rawURL string) (LinkPreview, error) {
+	resp, err := previewGet(context.Background(), rawURL, "text/html")
+	if err != nil {
+		return LinkPreview{}, err
+	}
+	defer resp.Body.Close()
+	if !strings.Contains(resp.Header.Get("Content-Type"), "text/html") {
+		return LinkPreview{}, errors.New("not an HTML page")
+	}
+	page, err := io.ReadAll(io.LimitReader(resp.Body, linkPreviewPageBytes))
+	if err != nil {
+		return LinkPreview{}, err
+	}
+	p := parsePreview(string(page), resp.Request.URL)
+	if p.Title == "" {
+		return p, errors.New("the page has no title")
+	}
+	return p, nil
+}
+
+// FetchLinkPreviews fetches the previews the post pages asked for: new
+// ones, and stale ones that were asked for again. Previews nobody asked
+// for in LinkPreviewRetention are dropped.
+func FetchLinkPreviews() error {
+	if !LinkPreviews {
+		return nil
+	}
+	stale := FormatTimestamp(Now().Add(-LinkPreviewTTL))
+	rows, err := db.Conn.Query(
+		`SELECT url FROM link_previews
+		WHERE status = ? OR (fetched_at < ? AND requested_at > fetched_at)
+		ORDER BY requested_at DESC LIMIT ?`,
+		PreviewPending, stale, linkPreviewBatch,
+	)
+	if err != nil {
+		return err
+	}
+	var urls []string
+	for rows.Next() {
+		var u string
+		if err := rows.Scan(&u); err != nil {
+			rows.Close()
+			return err
+		}
+		urls = append(urls, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, u := range urls {
+		p, err := fetchLinkPreview(u)
+		status := PreviewReady
+		if err != nil {
+			log.Printf("Link preview of %s failed: %v", u, err)
+			status = PreviewFailed
+		}
+		db.Write.Lock()
+		_, err = db.Conn.Exec(
+			`UPDATE link_previews SET status = ?, title = ?, description = ?, image = ?, fetched_at = ?
+			WHERE url = ?`,
+			status, p.Title, p.Description, p.Image, Timestamp(), u,
+		)
+		db.Write.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	db.Write.Lock()
+	defer db.Write.Unlock()
+	_, err = db.Conn.Exec(
+		"DELETE FROM link_previews WHERE requested_at < ?",
+		FormatTimestamp(Now().Add(-LinkPreviewRetention)),
+	)
+	return err
+}
+
+// LinkPreviewImageHandler handles GET /link-preview/{id}/image. Preview
+// images are passed through the forum so their sites don't see who reads
+// the post. Only images of known previews are served, and never SVG,
+// which could carry script onto this origin.
+func LinkPreviewImageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	var image string
+	err = db.Conn.QueryRow(
+		"SELECT image FROM link_previews WHERE id = ? AND status = ? AND image != ''", id, PreviewReady,
+	).Scan(&image)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	resp, err := previewGet(r.Context(), image, "image/*")
+	if err != nil {
+		http.Error(w, "Image unavailable", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	contentType := resp.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "image/") || strings.Contains(contentType, "svg") {
+		http.Error(w, "Image unavailable", http.StatusBadGateway)
+		return
+	}
+	if resp.ContentLength > linkPreviewImageBytes {
+		http.Error(w, "Image too large", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	io.Copy(w, io.LimitReader(resp.Body, linkPreviewImageBytes))
+}
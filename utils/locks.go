@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// CanLockPost reports whether a user may lock a post to new comments:
+// those who can manage it, and moderators of any of its categories
+func (db *DataBase) CanLockPost(user *User, post *Post) bool {
+	if CanManagePost(user, post) {
+		return true
+	}
+	for _, c := range post.Categories {
+		if db.CanModerateCategory(user, c.ID) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetPostLocked locks a post to new comments, or unlocks it, and records
+// it in the post's history. Unlocking an archived post takes it out of the
+// archive too.
+func (db *DataBase) SetPostLocked(postID int, locked bool, actorUUID string) error {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query, action := "UPDATE posts SET locked_at = ? WHERE id = ? AND locked_at = ''", "locked"
+	args := []interface{}{Timestamp(), postID}
+	if !locked {
+		query, action = "UPDATE posts SET locked_at = '', archived_at = '' WHERE id = ? AND locked_at != ''", "unlocked"
+		args = []interface{}{postID}
+	}
+	res, err := tx.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("post is already " + action)
+	}
+	if err := recordPostHistory(tx, postID, actorUUID, action, ""); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// LockPostHandler handles POST /post/lock
+// The form sends id and lock=1 to lock the post or 0 to unlock it.
+func LockPostHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		RenderError(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	post, err := db.GetPost(id)
+	if err != nil || post.IsDeleted() || post.IsDraft() || post.IsMerged() {
+		RenderError(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	if !db.CanLockPost(user, post) {
+		RenderError(w, "You can't lock this post", http.StatusForbidden)
+		return
+	}
+
+	if err := db.SetPostLocked(post.ID, r.FormValue("lock") == "1", user.UUID); err != nil {
+		RenderError(w, "Failed to update post: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/post/"+strconv.Itoa(post.ID), http.StatusSeeOther)
+}
@@ -26,12 +26,13 @@ func (db *DataBase) Login(w http.ResponseWriter, r *http.Request, username, emai
 
 	// 2. Query the user by username or email
 	row := db.Conn.QueryRow(
-		"SELECT uuid, username, email, password, notregistered, loggedin FROM users WHERE username = ? OR email = ?",
+		"SELECT uuid, username, email, password, notregistered, loggedin, suspendeduntil, dormant_locked_at FROM users WHERE username = ? OR email = ?",
 		username, email,
 	)
 
 	// Scan the result into the User struct
-	errScan := row.Scan(&user.UUID, &user.Username, &user.Email, &user.Password, &user.NotRegistered, &user.LoggedIn)
+	var suspended, dormantLocked string
+	errScan := row.Scan(&user.UUID, &user.Username, &user.Email, &user.Password, &user.NotRegistered, &user.LoggedIn, &suspended, &dormantLocked)
 	if errScan != nil {
 		if errScan == sql.ErrNoRows {
 			return User{}, errors.New("user not found")
@@ -50,7 +51,18 @@ func (db *DataBase) Login(w http.ResponseWriter, r *http.Request, username, emai
 		return User{}, errors.New("invalid password")
 	}
 
-	// 5. Refresh session & mark user as logged in
+	// 5. Refuse suspended accounts
+	user.SuspendedUntil, _ = ParseTimestamp(suspended)
+	if user.IsSuspended() {
+		return User{}, errors.New("this account is suspended " + SuspensionText(user.SuspendedUntil) + "; you can appeal at /appeal")
+	}
+
+	// 6. Accounts locked for inactivity need a new password first
+	if dormantLocked != "" {
+		return User{}, errLockedForInactivity
+	}
+
+	// 7. Refresh session & mark user as logged in
 	if err := db.RefreshSession(user.UUID); err != nil {
 		return User{}, err
 	}
@@ -0,0 +1,192 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MagicLinkTTL is how long an emailed login link stays valid
+const MagicLinkTTL = 15 * time.Minute
+
+// hashLoginToken returns the form a login token is stored in. Only the hash
+// is kept so a leaked database can't be used to log in.
+func hashLoginToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateLoginToken issues a single-use login token for the registered user
+// with the given email. It returns the user's email along with the token.
+func (db *DataBase) CreateLoginToken(email string) (string, string, error) {
+	var uuid string
+	err := db.Conn.QueryRow(
+		"SELECT uuid, email FROM users WHERE email = ? AND notregistered = 0", email,
+	).Scan(&uuid, &email)
+	if err != nil {
+		return "", "", err
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	token := hex.EncodeToString(raw)
+
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	_, err = db.Conn.Exec(
+		"INSERT INTO login_tokens (token_hash, user_uuid, expires_at) VALUES (?, ?, ?)",
+		hashLoginToken(token), uuid, FormatTimestamp(Now().Add(MagicLinkTTL)),
+	)
+	if err != nil {
+		return "", "", err
+	}
+	return email, token, nil
+}
+
+// ConsumeLoginToken spends a login token and logs its user in. The token is
+// marked used even if the login is then refused, so it can never be replayed.
+// Accounts locked for inactivity are unlocked with newPasswordHash, and
+// refused without one.
+func (db *DataBase) ConsumeLoginToken(token, newPasswordHash string) (*User, error) {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	var uuid string
+	err := db.Conn.QueryRow(
+		`UPDATE login_tokens SET used_at = ?
+		WHERE token_hash = ? AND used_at = '' AND expires_at > ?
+		RETURNING user_uuid`,
+		Timestamp(), hashLoginToken(token), Timestamp(),
+	).Scan(&uuid)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errors.New("this login link is invalid, expired or already used")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := db.GetUserByUUID(uuid)
+	if err != nil {
+		return nil, err
+	}
+	// Same rules as password logins
+	if user.LoggedIn {
+		return nil, errors.New("this user is already logged in from another session")
+	}
+	if user.IsSuspended() {
+		return nil, errors.New("this account is suspended " + SuspensionText(user.SuspendedUntil) + "; you can appeal at /appeal")
+	}
+	locked, err := db.IsLockedForInactivity(user.UUID)
+	if err != nil {
+		return nil, err
+	}
+	if locked {
+		if newPasswordHash == "" {
+			return nil, errLockedForInactivity
+		}
+		if err := unlockDormantAccount(db.Conn, user.UUID, newPasswordHash); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := db.RefreshSession(user.UUID); err != nil {
+		return nil, err
+	}
+	if _, err := db.Conn.Exec("UPDATE users SET loggedin = 1 WHERE uuid = ?", user.UUID); err != nil {
+		return nil, err
+	}
+	user.LoggedIn = true
+	return user, nil
+}
+
+// PurgeLoginTokens deletes login tokens that can no longer be used
+func PurgeLoginTokens() error {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	_, err := db.Conn.Exec("DELETE FROM login_tokens WHERE expires_at <= ? OR used_at != ''", Timestamp())
+	return err
+}
+
+// MagicLinkHandler handles GET and POST /login/magic.
+// POST emails a login link to the given address.
+func MagicLinkHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		InitTemplate(w, "templates/magic_link.html", map[string]interface{}{"Sent": false, "Minutes": int(MagicLinkTTL.Minutes())})
+
+	case http.MethodPost:
+		email, token, err := db.CreateLoginToken(strings.TrimSpace(r.FormValue("email")))
+		if err == nil {
+			// Never from the request's Host, which whoever asks for the link
+			// controls and could point at their own server
+			link := SiteURL + "/login/magic/" + token
+			body := "Use this link to log in to ForumHub. It works once and expires in " +
+				strconv.Itoa(int(MagicLinkTTL.Minutes())) + " minutes.\n\n" + link + "\n\nIf you didn't ask for it, you can ignore this email."
+			if err := SendMail(email, "Your ForumHub login link", body); err != nil {
+				log.Println("Failed to send login link:", err)
+			}
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			log.Println("Failed to create login token:", err)
+		}
+
+		// Answer the same either way so the form can't be used to probe for accounts
+		InitTemplate(w, "templates/magic_link.html", map[string]interface{}{"Sent": true, "Minutes": int(MagicLinkTTL.Minutes())})
+
+	default:
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// MagicLoginHandler handles GET and POST /login/magic/{token}.
+// GET only asks for confirmation so link previewers can't spend the token.
+// Accounts locked for inactivity are also asked for a new password.
+func MagicLoginHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.PathValue("token")
+	locked, err := db.loginTokenLocked(token)
+	if err != nil {
+		RenderError(w, "Failed to check login link", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		InitTemplate(w, "templates/magic_login.html", map[string]interface{}{"Token": token, "Locked": locked})
+
+	case http.MethodPost:
+		// Check the new password before the token is spent
+		var hash string
+		if locked {
+			password := r.FormValue("password")
+			if password == "" || password != r.FormValue("confirm_password") {
+				RenderError(w, "Enter the same new password twice", http.StatusBadRequest)
+				return
+			}
+			if hash, err = HashPassword(password); err != nil {
+				RenderError(w, "Failed to set password", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		user, err := db.ConsumeLoginToken(token, hash)
+		if err != nil {
+			RenderError(w, "login failed: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		SetUserCookie(w, user.UUID)
+		http.Redirect(w, r, "/home", http.StatusSeeOther)
+
+	default:
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
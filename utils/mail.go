@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"log"
+
+	"forum/internal/mail"
+)
+
+// MailTemplateDir holds the bodies of outgoing emails: a text/template
+// <name>.txt for each, and optionally an html/template <name>.html
+const MailTemplateDir = "templates/email"
+
+// mailer delivers outgoing email. It writes messages to the server log
+// until SetupMail picks the backend the configuration asks for.
+var mailer mail.Sender = mail.LogSender{}
+
+// SetupMail sets up outgoing email from MailConfigFile and the environment
+func SetupMail() error {
+	config, err := mail.LoadConfig(MailConfigFile)
+	if err != nil {
+		return err
+	}
+	sender, err := mail.New(config)
+	if err != nil {
+		return err
+	}
+	mailer = sender
+	switch sender.(type) {
+	case *mail.SMTPSender:
+		log.Printf("Mail: sending through %s:%d as %s", config.Host, config.Port, config.From)
+	case mail.LogSender:
+		log.Println("Mail: writing outgoing email to the log")
+	case mail.NopSender:
+		log.Println("Mail: outgoing email is turned off")
+	}
+	return nil
+}
+
+// SendMail delivers a plain text email
+func SendMail(to, subject, body string) error {
+	return mailer.Send(mail.Message{To: to, Subject: subject, Text: body})
+}
+
+// SendTemplateMail renders templates/email/<name>.txt with data, and
+// <name>.html when there is one, and sends it. Text templates aren't
+// escaped, so user content passed to them must go through PlainText or
+// Excerpt first.
+func SendTemplateMail(to, subject, name string, data interface{}) error {
+	text, html, err := mail.Templates{Dir: MailTemplateDir}.Render(name, data)
+	if err != nil {
+		return err
+	}
+	return mailer.Send(mail.Message{To: to, Subject: subject, Text: text, HTML: html})
+}
@@ -0,0 +1,214 @@
+package utils
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaintenanceAnnounceBefore is how long before a window the banner appears
+const MaintenanceAnnounceBefore = 24 * time.Hour
+
+// datetimeLocalLayout is the format of <input type="datetime-local"> values
+const datetimeLocalLayout = "2006-01-02T15:04"
+
+// maintenance holds the window currently in effect; nil while the site is up.
+// It is refreshed by the maintenance job rather than queried per request.
+var maintenance struct {
+	sync.RWMutex
+	active *MaintenanceWindow
+}
+
+// ActiveMaintenance returns the maintenance window in effect, if any
+func ActiveMaintenance() *MaintenanceWindow {
+	maintenance.RLock()
+	defer maintenance.RUnlock()
+	return maintenance.active
+}
+
+// scanMaintenanceWindows reads rows of id, starts_at, ends_at, message
+func scanMaintenanceWindows(rows *sql.Rows) ([]MaintenanceWindow, error) {
+	defer rows.Close()
+
+	var windows []MaintenanceWindow
+	for rows.Next() {
+		var (
+			m                MaintenanceWindow
+			startsAt, endsAt string
+		)
+		if err := rows.Scan(&m.ID, &startsAt, &endsAt, &m.Message); err != nil {
+			return nil, err
+		}
+		m.StartsAt, _ = ParseTimestamp(startsAt)
+		m.EndsAt, _ = ParseTimestamp(endsAt)
+		windows = append(windows, m)
+	}
+	return windows, rows.Err()
+}
+
+// ListMaintenanceWindows returns windows that haven't ended yet, soonest first
+func (db *DataBase) ListMaintenanceWindows() ([]MaintenanceWindow, error) {
+	rows, err := db.Conn.Query(
+		`SELECT id, starts_at, ends_at, message FROM maintenance_windows
+		WHERE ends_at > ? ORDER BY starts_at`,
+		Timestamp(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanMaintenanceWindows(rows)
+}
+
+// findMaintenanceWindow returns the first window that hasn't ended and starts before the given time
+func (db *DataBase) findMaintenanceWindow(startsBefore time.Time) (*MaintenanceWindow, error) {
+	rows, err := db.Conn.Query(
+		`SELECT id, starts_at, ends_at, message FROM maintenance_windows
+		WHERE ends_at > ? AND starts_at <= ?
+		ORDER BY starts_at LIMIT 1`,
+		Timestamp(), FormatTimestamp(startsBefore),
+	)
+	if err != nil {
+		return nil, err
+	}
+	windows, err := scanMaintenanceWindows(rows)
+	if err != nil || len(windows) == 0 {
+		return nil, err
+	}
+	return &windows[0], nil
+}
+
+// UpcomingMaintenance returns the next window due within MaintenanceAnnounceBefore
+func (db *DataBase) UpcomingMaintenance() (*MaintenanceWindow, error) {
+	return db.findMaintenanceWindow(Now().Add(MaintenanceAnnounceBefore))
+}
+
+// ScheduleMaintenance stores a new maintenance window
+func (db *DataBase) ScheduleMaintenance(start, end time.Time, message, createdBy string) error {
+	if !end.After(start) {
+		return errors.New("the window must end after it starts")
+	}
+	if !end.After(Now()) {
+		return errors.New("the window is already over")
+	}
+
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	_, err := db.Conn.Exec(
+		"INSERT INTO maintenance_windows (starts_at, ends_at, message, created_by) VALUES (?, ?, ?, ?)",
+		FormatTimestamp(start), FormatTimestamp(end), message, createdBy,
+	)
+	return err
+}
+
+// CancelMaintenance deletes a maintenance window
+func (db *DataBase) CancelMaintenance(id int) error {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	_, err := db.Conn.Exec("DELETE FROM maintenance_windows WHERE id = ?", id)
+	return err
+}
+
+// SyncMaintenanceMode switches maintenance mode on or off to match the
+// schedule. It runs as a scheduler job and after every schedule change.
+func SyncMaintenanceMode() error {
+	active, err := db.findMaintenanceWindow(Now())
+	if err != nil {
+		return err
+	}
+
+	maintenance.Lock()
+	maintenance.active = active
+	maintenance.Unlock()
+	return nil
+}
+
+// MaintenanceGate answers 503 to everyone but admins while maintenance is on.
+// Static files and login/logout stay reachable so admins can still sign in.
+func MaintenanceGate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		active := ActiveMaintenance()
+		if active == nil || strings.HasPrefix(r.URL.Path, "/static/") ||
+			r.URL.Path == "/login" || r.URL.Path == "/logout" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if uuid, err := GetUserFromCookie(r); err == nil {
+			if user, err := db.GetUserByUUID(uuid); err == nil && user.IsAdmin() {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		w.Header().Set("Retry-After", strconv.Itoa(int(active.EndsAt.Sub(Now()).Seconds())+1))
+		RenderError(w, "Down for maintenance until "+active.EndsAt.Format("Jan 2, 2006 15:04 MST")+". "+active.Message,
+			http.StatusServiceUnavailable)
+	})
+}
+
+// MaintenanceHandler handles GET and POST /admin/maintenance.
+// POST schedules a window, or cancels one when action=cancel.
+func MaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	admin, ok := RequireAdmin(w, r)
+	if !ok {
+		return
+	}
+	loc := db.GetLocationPreference(admin.UUID)
+
+	switch r.Method {
+	case http.MethodGet:
+		windows, err := db.ListMaintenanceWindows()
+		if err != nil {
+			RenderError(w, "Failed to load maintenance windows", http.StatusInternalServerError)
+			return
+		}
+		for i := range windows {
+			windows[i].StartsAt = windows[i].StartsAt.In(loc)
+			windows[i].EndsAt = windows[i].EndsAt.In(loc)
+		}
+		InitTemplate(w, "templates/admin_maintenance.html", map[string]interface{}{
+			"Windows":  windows,
+			"Active":   ActiveMaintenance(),
+			"Timezone": loc.String(),
+		})
+
+	case http.MethodPost:
+		var err error
+		if r.FormValue("action") == "cancel" {
+			id, convErr := strconv.Atoi(r.FormValue("id"))
+			if convErr != nil {
+				RenderError(w, "Invalid window", http.StatusBadRequest)
+				return
+			}
+			err = db.CancelMaintenance(id)
+		} else {
+			start, err1 := time.ParseInLocation(datetimeLocalLayout, r.FormValue("starts_at"), loc)
+			end, err2 := time.ParseInLocation(datetimeLocalLayout, r.FormValue("ends_at"), loc)
+			if err1 != nil || err2 != nil {
+				RenderError(w, "Invalid start or end time", http.StatusBadRequest)
+				return
+			}
+			err = db.ScheduleMaintenance(start, end, strings.TrimSpace(r.FormValue("message")), admin.UUID)
+		}
+		if err != nil {
+			RenderError(w, "Failed to update schedule: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Apply the change now instead of waiting for the next job run
+		if err := SyncMaintenanceMode(); err != nil {
+			RenderError(w, "Failed to update maintenance mode", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/admin/maintenance", http.StatusSeeOther)
+
+	default:
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
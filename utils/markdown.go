@@ -0,0 +1,295 @@
+package utils
+
+import (
+	"html/template"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// markdownMaxDepth limits how deeply quotes and lists may nest
+const markdownMaxDepth = 8
+
+var (
+	mdHeading     = regexp.MustCompile(`^(#{1,6})[ \t]+(.*?)[ \t#]*$`)
+	mdRule        = regexp.MustCompile(`^ {0,3}(-[ \t]*-[ \t]*-[- \t]*|\*[ \t]*\*[ \t]*\*[* \t]*|_[ \t]*_[ \t]*_[_ \t]*)$`)
+	mdFence       = regexp.MustCompile("^ {0,3}(```+|~~~+)[ \t]*([A-Za-z0-9_+-]*)")
+	mdBullet      = regexp.MustCompile(`^ {0,3}[-*+][ \t]+`)
+	mdOrdered     = regexp.MustCompile(`^ {0,3}[0-9]{1,9}[.)][ \t]+`)
+	mdQuote       = regexp.MustCompile(`^ {0,3}> ?`)
+	mdAutolink    = regexp.MustCompile(`^https?://[^\s<>"']*[^\s<>"'.,;:!?)\]]`)
+	mdLinkPattern = regexp.MustCompile(`^(!?)\[([^\[\]]*)\]\(\s*([^\s()]*)\s*\)`)
+)
+
+// markdownRenderer renders Markdown with or without its optional features
+type markdownRenderer struct {
+	headings bool
+	images   bool
+}
+
+var (
+	fullMarkdown = markdownRenderer{headings: true, images: true}
+	// commentMarkdown keeps comments from outweighing the post they are
+	// on: headings stay text and images become links to them
+	commentMarkdown = markdownRenderer{}
+)
+
+// RenderMarkdown renders user-written Markdown as HTML. It is the sanitizer
+// as well: raw HTML in the source is escaped, only a fixed set of tags is
+// ever produced, and links are limited to safe schemes. Images are only
+// shown from this site so posts can't embed tracking pixels.
+func RenderMarkdown(src string) template.HTML {
+	return fullMarkdown.render(src)
+}
+
+// RenderCommentMarkdown renders a comment like RenderMarkdown, without
+// headings and images
+func RenderCommentMarkdown(src string) template.HTML {
+	return commentMarkdown.render(src)
+}
+
+func (md markdownRenderer) render(src string) template.HTML {
+	src = strings.ReplaceAll(src, "\r\n", "\n")
+	lines := strings.Split(strings.Map(func(r rune) rune {
+		if r == '\r' || r == 0 {
+			return -1
+		}
+		return r
+	}, src), "\n")
+
+	var b strings.Builder
+	md.renderBlocks(&b, lines, 0)
+	return template.HTML(b.String())
+}
+
+// renderBlocks renders a run of lines as block elements
+func (md markdownRenderer) renderBlocks(b *strings.Builder, lines []string, depth int) {
+	var para []string
+	flush := func() {
+		if len(para) > 0 {
+			b.WriteString("<p>")
+			for i, l := range para {
+				if i > 0 {
+					b.WriteString("<br>\n")
+				}
+				b.WriteString(md.renderInline(strings.TrimSpace(l)))
+			}
+			b.WriteString("</p>\n")
+			para = nil
+		}
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		nested := depth < markdownMaxDepth
+
+		switch {
+		case strings.TrimSpace(line) == "":
+			flush()
+
+		case mdFence.MatchString(line):
+			flush()
+			m := mdFence.FindStringSubmatch(line)
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), m[1]); i++ {
+				code = append(code, lines[i])
+			}
+			highlighted, lang := highlightCode(m[2], strings.Join(code, "\n"))
+			if lang == "" {
+				lang = m[2]
+			}
+			b.WriteString("<pre><code")
+			if lang != "" {
+				b.WriteString(` class="language-` + lang + `"`)
+			}
+			b.WriteString(">" + highlighted + "</code></pre>\n")
+
+		case md.headings && mdHeading.MatchString(line):
+			flush()
+			m := mdHeading.FindStringSubmatch(line)
+			level := string(rune('0' + len(m[1])))
+			b.WriteString("<h" + level + ">" + md.renderInline(m[2]) + "</h" + level + ">\n")
+
+		case mdRule.MatchString(line):
+			flush()
+			b.WriteString("<hr>\n")
+
+		case nested && mdQuote.MatchString(line):
+			flush()
+			var quoted []string
+			for ; i < len(lines) && mdQuote.MatchString(lines[i]); i++ {
+				quoted = append(quoted, mdQuote.ReplaceAllString(lines[i], ""))
+			}
+			i--
+			b.WriteString("<blockquote>\n")
+			md.renderBlocks(b, quoted, depth+1)
+			b.WriteString("</blockquote>\n")
+
+		case nested && (mdBullet.MatchString(line) || mdOrdered.MatchString(line)):
+			flush()
+			marker, tag := mdBullet, "ul"
+			if mdOrdered.MatchString(line) {
+				marker, tag = mdOrdered, "ol"
+			}
+			b.WriteString("<" + tag + ">\n")
+			for i < len(lines) && marker.MatchString(lines[i]) {
+				item := []string{marker.ReplaceAllString(lines[i], "")}
+				// Indented lines continue the item, and may hold a nested list
+				for i++; i < len(lines) && (strings.HasPrefix(lines[i], "  ") || strings.HasPrefix(lines[i], "\t")); i++ {
+					item = append(item, strings.TrimPrefix(strings.TrimPrefix(lines[i], "\t"), "  "))
+				}
+				b.WriteString("<li>" + md.renderListItem(item, depth+1) + "</li>\n")
+			}
+			i--
+			b.WriteString("</" + tag + ">\n")
+
+		default:
+			para = append(para, line)
+		}
+	}
+	flush()
+}
+
+// renderListItem renders the lines of one list item. Unless the item has
+// blank lines in it, its leading paragraph is unwrapped so lists stay compact.
+func (md markdownRenderer) renderListItem(lines []string, depth int) string {
+	var b strings.Builder
+	md.renderBlocks(&b, lines, depth)
+	html := strings.TrimSuffix(b.String(), "\n")
+	for _, l := range lines {
+		if strings.TrimSpace(l) == "" {
+			return html
+		}
+	}
+	if end := strings.Index(html, "</p>"); strings.HasPrefix(html, "<p>") && end >= 0 {
+		return html[len("<p>"):end] + html[end+len("</p>"):]
+	}
+	return html
+}
+
+// renderInline renders code spans, emphasis, links and images in a line of
+// text, escaping everything else
+func (md markdownRenderer) renderInline(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		rest := s[i:]
+
+		switch {
+		case rest[0] == '\\' && len(rest) > 1 && strings.ContainsRune("\\`*_[]()#!>-+.", rune(rest[1])):
+			b.WriteString(template.HTMLEscapeString(rest[1:2]))
+			i += 2
+			continue
+
+		case rest[0] == '`':
+			ticks := len(rest) - len(strings.TrimLeft(rest, "`"))
+			if end := strings.Index(rest[ticks:], rest[:ticks]); end >= 0 {
+				code := strings.TrimSpace(rest[ticks : ticks+end])
+				b.WriteString("<code>" + template.HTMLEscapeString(code) + "</code>")
+				i += 2*ticks + end
+				continue
+			}
+			b.WriteString(rest[:ticks])
+			i += ticks
+			continue
+
+		case rest[0] == '[' || strings.HasPrefix(rest, "!["):
+			if m := mdLinkPattern.FindStringSubmatch(rest); m != nil {
+				b.WriteString(md.renderLink(m[1] == "!", m[2], m[3]))
+				i += len(m[0])
+				continue
+			}
+
+		case rest[0] == '*' || rest[0] == '_':
+			if html, n := md.renderEmphasis(s, i); n > 0 {
+				b.WriteString(html)
+				i += n
+				continue
+			}
+
+		case rest[0] == 'h' && (i == 0 || !isWordByte(s[i-1])):
+			if m := mdAutolink.FindString(rest); m != "" {
+				b.WriteString(md.renderLink(false, m, m))
+				i += len(m)
+				continue
+			}
+		}
+
+		b.WriteString(template.HTMLEscapeString(rest[:1]))
+		i++
+	}
+	return b.String()
+}
+
+// renderEmphasis renders **strong** or *em* starting at s[i], returning the
+// HTML and the number of bytes consumed, or 0 if the delimiter isn't closed
+func (md markdownRenderer) renderEmphasis(s string, i int) (string, int) {
+	c := s[i]
+	// Underscores inside words, as in snake_case, are literal
+	if c == '_' && i > 0 && isWordByte(s[i-1]) {
+		return "", 0
+	}
+
+	delim, tag := string(c), "em"
+	if strings.HasPrefix(s[i:], delim+delim) {
+		delim, tag = delim+delim, "strong"
+	}
+	start := i + len(delim)
+	if start >= len(s) || s[start] == ' ' {
+		return "", 0
+	}
+	end := strings.Index(s[start:], delim)
+	if end <= 0 || s[start+end-1] == ' ' {
+		return "", 0
+	}
+	after := start + end + len(delim)
+	if c == '_' && after < len(s) && isWordByte(s[after]) {
+		return "", 0
+	}
+	return "<" + tag + ">" + md.renderInline(s[start:start+end]) + "</" + tag + ">", after - i
+}
+
+// renderLink renders a link or image, falling back to plain text when the
+// URL isn't safe
+func (md markdownRenderer) renderLink(image bool, text, href string) string {
+	u, ok := safeURL(href)
+	if !ok {
+		return template.HTMLEscapeString(text)
+	}
+	if image && md.images && strings.HasPrefix(u, "/") && !strings.HasPrefix(u, "//") {
+		return `<img src="` + template.HTMLEscapeString(u) + `" alt="` + template.HTMLEscapeString(text) + `" loading="lazy">`
+	}
+	// Link text that is itself a URL is kept literal so links don't nest
+	var label string
+	if strings.Contains(text, "://") {
+		label = template.HTMLEscapeString(text)
+	} else {
+		label = md.renderInline(text)
+	}
+	if label == "" {
+		label = template.HTMLEscapeString(u)
+	}
+	return `<a href="` + template.HTMLEscapeString(u) + `" rel="nofollow ugc noopener">` + label + `</a>`
+}
+
+// safeURL allows http, https and mailto links and paths on this site
+func safeURL(raw string) (string, bool) {
+	u, err := url.Parse(raw)
+	if err != nil || raw == "" {
+		return "", false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https", "mailto":
+		return u.String(), true
+	case "":
+		// Scheme-relative links would point off-site
+		if u.Host != "" || strings.HasPrefix(raw, "//") {
+			return "", false
+		}
+		return u.String(), true
+	}
+	return "", false
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
@@ -0,0 +1,253 @@
+package utils
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"forum/internal/notify"
+)
+
+// MentionSuggestionLimit caps the number of autocomplete suggestions
+const MentionSuggestionLimit = 10
+
+// MaxMentions caps the users recorded as mentioned by one post or comment,
+// so a list of names can't be used to ping half the forum
+const MaxMentions = 20
+
+// mentionPattern matches an @mention with what precedes it. A mention can't
+// follow a word character or a slash, so email addresses and paths aren't
+// taken for one, and a name doesn't end in punctuation ending a sentence.
+var mentionPattern = regexp.MustCompile(`(^|[^\w@/])@(\w(?:[\w.-]*\w)?)`)
+
+// renderedTagPattern matches a tag in rendered HTML, with its name and
+// whether it closes an element
+var renderedTagPattern = regexp.MustCompile(`<(/?)([a-z0-9]+)[^>]*>`)
+
+// mapMentionText applies fn to the text of rendered Markdown where a mention
+// may be, that is outside code and links
+func mapMentionText(rendered string, fn func(text string) string) string {
+	var (
+		b    strings.Builder
+		skip int
+		last int
+	)
+	for _, m := range renderedTagPattern.FindAllStringSubmatchIndex(rendered, -1) {
+		text := rendered[last:m[0]]
+		if skip == 0 {
+			text = fn(text)
+		}
+		b.WriteString(text)
+		b.WriteString(rendered[m[0]:m[1]])
+		last = m[1]
+
+		switch rendered[m[4]:m[5]] {
+		case "a", "code", "pre":
+			if m[3] > m[2] {
+				skip = max(skip-1, 0)
+			} else {
+				skip++
+			}
+		}
+	}
+	text := rendered[last:]
+	if skip == 0 {
+		text = fn(text)
+	}
+	b.WriteString(text)
+	return b.String()
+}
+
+// mentionedNames returns the distinct names mentioned in rendered Markdown,
+// in the order they first appear
+func mentionedNames(rendered string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	mapMentionText(rendered, func(text string) string {
+		for _, m := range mentionPattern.FindAllStringSubmatch(text, -1) {
+			if !seen[m[2]] {
+				seen[m[2]] = true
+				names = append(names, m[2])
+			}
+		}
+		return text
+	})
+	return names
+}
+
+// registeredUsernames returns which of names belong to registered users
+func (db *DataBase) registeredUsernames(names []string) (map[string]bool, error) {
+	known := make(map[string]bool)
+	if len(names) == 0 {
+		return known, nil
+	}
+	args := make([]any, len(names))
+	for i, n := range names {
+		args[i] = n
+	}
+	rows, err := db.Conn.Query(
+		"SELECT username FROM users WHERE notregistered = 0 AND username IN ("+
+			strings.TrimSuffix(strings.Repeat("?, ", len(names)), ", ")+")",
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		known[name] = true
+	}
+	return known, rows.Err()
+}
+
+// linkMentions links the @mentions of registered users in rendered Markdown
+// to their profiles. Names that aren't users are left as typed, and so is
+// everything when the users can't be looked up.
+func linkMentions(rendered string) string {
+	names := mentionedNames(rendered)
+	if len(names) == 0 {
+		return rendered
+	}
+	known, err := db.registeredUsernames(names)
+	if err != nil || len(known) == 0 {
+		return rendered
+	}
+	return mapMentionText(rendered, func(text string) string {
+		return mentionPattern.ReplaceAllStringFunc(text, func(match string) string {
+			m := mentionPattern.FindStringSubmatch(match)
+			if !known[m[2]] {
+				return match
+			}
+			return m[1] + `<a href="/user/` + url.PathEscape(m[2]) + `" class="mention">@` + m[2] + `</a>`
+		})
+	})
+}
+
+// recordMentions stores who a post, or with commentID one of its comments,
+// mentions, and notifies them. On edits, mentions that were
+// removed are dropped and those already recorded keep their date, so each
+// user is only ever mentioned, and notified, once by the same text. Authors
+// mentioning themselves aren't recorded.
+func recordMentions(tx *sql.Tx, postID, commentID int, authorUUID, content string) error {
+	names := mentionedNames(string(RenderMarkdown(content)))
+	if len(names) > MaxMentions {
+		names = names[:MaxMentions]
+	}
+
+	args := []any{postID, commentID}
+	for _, n := range names {
+		args = append(args, n)
+	}
+	if _, err := tx.Exec(
+		`DELETE FROM mentions WHERE post_id = ? AND comment_id = ?
+		AND user_uuid NOT IN (SELECT uuid FROM users WHERE username IN (''`+strings.Repeat(", ?", len(names))+`))`,
+		args...,
+	); err != nil {
+		return err
+	}
+
+	now := Now()
+	for _, name := range names {
+		var userUUID string
+		err := tx.QueryRow(
+			"SELECT uuid FROM users WHERE username = ? AND notregistered = 0 AND uuid != ?", name, authorUUID,
+		).Scan(&userUUID)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		res, err := tx.Exec(
+			`INSERT OR IGNORE INTO mentions (post_id, comment_id, user_uuid, author_uuid, created_at)
+			VALUES (?, ?, ?, ?, ?)`,
+			postID, commentID, userUUID, authorUUID, FormatTimestamp(now),
+		)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		event := notify.Event{Kind: notify.Mention, Recipient: userUUID, Actor: authorUUID, PostID: postID, CommentID: commentID, At: now}
+		if err := sendNotification(tx, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MentionSuggestion is one username offered by the mention autocomplete
+type MentionSuggestion struct {
+	Username    string `json:"username"`
+	Participant bool   `json:"participant"`
+}
+
+// SuggestMentions returns registered users whose username starts with prefix.
+// Participants of the post (its author and commenters) are listed first.
+// The requesting user is left out since mentioning yourself is pointless.
+func (db *DataBase) SuggestMentions(postID int, prefix, excludeUUID string, limit int) ([]MentionSuggestion, error) {
+	rows, err := db.Conn.Query(
+		`SELECT u.username,
+			u.uuid IN (
+				SELECT author_uuid FROM posts WHERE id = ?
+				UNION
+				SELECT comment_author_uuid FROM comments WHERE post_id = ?
+			) AS participant
+		FROM users u
+		WHERE u.notregistered = 0 AND u.uuid != ? AND u.username LIKE ? ESCAPE '\'
+		ORDER BY participant DESC, u.username COLLATE NOCASE
+		LIMIT ?`,
+		postID, postID, excludeUUID, escapeLike(prefix)+"%", limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	suggestions := []MentionSuggestion{}
+	for rows.Next() {
+		var s MentionSuggestion
+		if err := rows.Scan(&s.Username, &s.Participant); err != nil {
+			return nil, err
+		}
+		suggestions = append(suggestions, s)
+	}
+	return suggestions, rows.Err()
+}
+
+// MentionSuggestHandler handles GET /mentions/suggest?post=&q=
+// It always answers with JSON for the comment form's autocomplete.
+func MentionSuggestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		WriteJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		WriteJSON(w, http.StatusUnauthorized, map[string]string{"error": "login required"})
+		return
+	}
+
+	// Without a thread there are simply no participants to rank first
+	postID, _ := strconv.Atoi(r.URL.Query().Get("post"))
+	prefix := strings.TrimPrefix(strings.TrimSpace(r.URL.Query().Get("q")), "@")
+
+	suggestions, err := db.SuggestMentions(postID, prefix, user.UUID, MentionSuggestionLimit)
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, map[string]string{"error": "lookup failed"})
+		return
+	}
+
+	WriteJSON(w, http.StatusOK, suggestions)
+}
@@ -0,0 +1,296 @@
+package utils
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// MergeUndoWindow is how long after a merge it can still be undone
+const MergeUndoWindow = 24 * time.Hour
+
+// Kinds of post_merge_items, the rows a merge moved to the target
+const (
+	mergedComment     = "comment"
+	mergedInteraction = "interaction"
+)
+
+// PostMerge is a post that was merged into another
+type PostMerge struct {
+	ID          int
+	SourceID    int
+	SourceTitle string
+	TargetID    int
+	MergedBy    string
+	CreatedAt   time.Time
+}
+
+// UndoableUntil is when the merge can no longer be undone
+func (m PostMerge) UndoableUntil() time.Time {
+	return m.CreatedAt.Add(MergeUndoWindow)
+}
+
+// CanUndo reports whether the merge is still within its undo window
+func (m PostMerge) CanUndo() bool {
+	return Now().Before(m.UndoableUntil())
+}
+
+// mergeablePost checks that a post can take part in a merge: published and
+// neither in the trash nor merged itself
+func mergeablePost(tx *sql.Tx, id int) error {
+	var status, deletedAt string
+	err := tx.QueryRow("SELECT status, deleted_at FROM posts WHERE id = ?", id).Scan(&status, &deletedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errors.New("post #" + strconv.Itoa(id) + " not found")
+	}
+	if err != nil {
+		return err
+	}
+	if status != PostPublished || deletedAt != "" {
+		return errors.New("post #" + strconv.Itoa(id) + " can't be merged")
+	}
+	return nil
+}
+
+// MergePost merges a duplicate post into another: its comments, and the
+// reactions of users who hadn't reacted to the target, move to the target,
+// and the source is left as a stub redirecting there. What was moved is
+// recorded so UndoMerge can put it back.
+func (db *DataBase) MergePost(sourceID, targetID int, actorUUID string) error {
+	if sourceID == targetID {
+		return errors.New("a post can't be merged into itself")
+	}
+
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := mergeablePost(tx, sourceID); err != nil {
+		return err
+	}
+	if err := mergeablePost(tx, targetID); err != nil {
+		return err
+	}
+
+	res, err := tx.Exec(
+		"INSERT INTO post_merges (source_id, target_id, merged_by, created_at) VALUES (?, ?, ?, ?)",
+		sourceID, targetID, actorUUID, Timestamp(),
+	)
+	if err != nil {
+		return err
+	}
+	mergeID, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	// The target keeps its own reactions; users who reacted to both posts
+	// keep their reaction to the source, where an undo finds it again
+	steps := []struct {
+		query string
+		args  []interface{}
+	}{
+		{
+			`INSERT INTO post_merge_items (merge_id, kind, item_id)
+			SELECT ?, ?, id FROM comments WHERE post_id = ?`,
+			[]interface{}{mergeID, mergedComment, sourceID},
+		},
+		{
+			`INSERT INTO post_merge_items (merge_id, kind, item_id)
+			SELECT ?, ?, id FROM interactions WHERE post_id = ?
+			AND user_uuid NOT IN (SELECT user_uuid FROM interactions WHERE post_id = ?)`,
+			[]interface{}{mergeID, mergedInteraction, sourceID, targetID},
+		},
+		{
+			"UPDATE comments SET post_id = ? WHERE id IN (SELECT item_id FROM post_merge_items WHERE merge_id = ? AND kind = ?)",
+			[]interface{}{targetID, mergeID, mergedComment},
+		},
+		{
+			"UPDATE interactions SET post_id = ? WHERE id IN (SELECT item_id FROM post_merge_items WHERE merge_id = ? AND kind = ?)",
+			[]interface{}{targetID, mergeID, mergedInteraction},
+		},
+		{
+			"UPDATE posts SET status = ? WHERE id = ?",
+			[]interface{}{PostMerged, sourceID},
+		},
+	}
+	for _, step := range steps {
+		if _, err := tx.Exec(step.query, step.args...); err != nil {
+			return err
+		}
+	}
+
+	if err := recordPostHistory(tx, sourceID, actorUUID, "merged", "into post #"+strconv.Itoa(targetID)); err != nil {
+		return err
+	}
+	if err := recordPostHistory(tx, targetID, actorUUID, "merged in", "post #"+strconv.Itoa(sourceID)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UndoMerge reverses a merge within MergeUndoWindow: the moved comments and
+// reactions go back to the source, which is published again. It returns the
+// source's id.
+func (db *DataBase) UndoMerge(mergeID int, actorUUID string) (int, error) {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var (
+		sourceID, targetID  int
+		createdAt, undoneAt string
+	)
+	err = tx.QueryRow(
+		"SELECT source_id, target_id, created_at, undone_at FROM post_merges WHERE id = ?", mergeID,
+	).Scan(&sourceID, &targetID, &createdAt, &undoneAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, errors.New("merge not found")
+	}
+	if err != nil {
+		return 0, err
+	}
+	if undoneAt != "" {
+		return 0, errors.New("the merge was already undone")
+	}
+	merged, _ := ParseTimestamp(createdAt)
+	if !(PostMerge{CreatedAt: merged}).CanUndo() {
+		return 0, errors.New("the merge can no longer be undone")
+	}
+
+	res, err := tx.Exec("UPDATE posts SET status = ? WHERE id = ? AND status = ?", PostPublished, sourceID, PostMerged)
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return 0, errors.New("the merged post has changed since")
+	}
+	if _, err := tx.Exec(
+		"UPDATE comments SET post_id = ? WHERE id IN (SELECT item_id FROM post_merge_items WHERE merge_id = ? AND kind = ?)",
+		sourceID, mergeID, mergedComment,
+	); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(
+		"UPDATE interactions SET post_id = ? WHERE id IN (SELECT item_id FROM post_merge_items WHERE merge_id = ? AND kind = ?)",
+		sourceID, mergeID, mergedInteraction,
+	); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("UPDATE post_merges SET undone_at = ? WHERE id = ?", Timestamp(), mergeID); err != nil {
+		return 0, err
+	}
+
+	if err := recordPostHistory(tx, sourceID, actorUUID, "unmerged", "from post #"+strconv.Itoa(targetID)); err != nil {
+		return 0, err
+	}
+	if err := recordPostHistory(tx, targetID, actorUUID, "unmerged", "post #"+strconv.Itoa(sourceID)); err != nil {
+		return 0, err
+	}
+	return sourceID, tx.Commit()
+}
+
+// MergedInto returns the post a merged post now redirects to
+func (db *DataBase) MergedInto(postID int) (int, error) {
+	var targetID int
+	err := db.Conn.QueryRow(
+		"SELECT target_id FROM post_merges WHERE source_id = ? AND undone_at = '' ORDER BY id DESC LIMIT 1", postID,
+	).Scan(&targetID)
+	return targetID, err
+}
+
+// ListMergesInto returns the posts merged into a post that haven't been
+// undone, newest first
+func (db *DataBase) ListMergesInto(postID int) ([]PostMerge, error) {
+	rows, err := db.Conn.Query(
+		`SELECT m.id, m.source_id, p.title, m.target_id, COALESCE(u.username, ''), m.created_at
+		FROM post_merges m
+		JOIN posts p ON p.id = m.source_id
+		LEFT JOIN users u ON u.uuid = m.merged_by
+		WHERE m.target_id = ? AND m.undone_at = ''
+		ORDER BY m.id DESC`,
+		postID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var merges []PostMerge
+	for rows.Next() {
+		var (
+			m         PostMerge
+			createdAt string
+		)
+		if err := rows.Scan(&m.ID, &m.SourceID, &m.SourceTitle, &m.TargetID, &m.MergedBy, &createdAt); err != nil {
+			return nil, err
+		}
+		m.CreatedAt, _ = ParseTimestamp(createdAt)
+		merges = append(merges, m)
+	}
+	return merges, rows.Err()
+}
+
+// MergePostHandler handles POST /post/merge
+func MergePostHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	staff, ok := RequireStaff(w, r)
+	if !ok {
+		return
+	}
+
+	sourceID, err1 := strconv.Atoi(r.FormValue("source_id"))
+	targetID, err2 := strconv.Atoi(r.FormValue("target_id"))
+	if err1 != nil || err2 != nil {
+		RenderError(w, "Invalid posts", http.StatusBadRequest)
+		return
+	}
+
+	if err := db.MergePost(sourceID, targetID, staff.UUID); err != nil {
+		RenderError(w, "Merge failed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/post/"+strconv.Itoa(targetID)+"#merges", http.StatusSeeOther)
+}
+
+// UndoMergeHandler handles POST /post/merge/undo
+func UndoMergeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	staff, ok := RequireStaff(w, r)
+	if !ok {
+		return
+	}
+
+	mergeID, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		RenderError(w, "Invalid merge", http.StatusBadRequest)
+		return
+	}
+
+	sourceID, err := db.UndoMerge(mergeID, staff.UUID)
+	if err != nil {
+		RenderError(w, "Undo failed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/post/"+strconv.Itoa(sourceID), http.StatusSeeOther)
+}
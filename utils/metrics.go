@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// MetricsHandler handles GET /metrics in the Prometheus text format.
+// Scrapers authenticate with MetricsToken; otherwise an admin session is
+// required.
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token, hasToken := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	switch {
+	case hasToken && MetricsToken != "":
+		if subtle.ConstantTimeCompare([]byte(token), []byte(MetricsToken)) != 1 {
+			http.Error(w, "Invalid metrics token", http.StatusUnauthorized)
+			return
+		}
+	default:
+		if _, ok := RequireAdmin(w, r); !ok {
+			return
+		}
+	}
+
+	stats, err := LatestStorageStats()
+	if err != nil {
+		log.Println("Failed to collect storage stats:", err)
+		http.Error(w, "Failed to collect metrics", http.StatusInternalServerError)
+		return
+	}
+
+	var b strings.Builder
+	gauge := func(name, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	}
+	gauge("forum_db_size_bytes", "Size of the SQLite database file and its write-ahead log.")
+	fmt.Fprintf(&b, "forum_db_size_bytes %d\n", stats.FileBytes)
+	gauge("forum_db_size_limit_bytes", "Soft quota on the database size, 0 when unset.")
+	fmt.Fprintf(&b, "forum_db_size_limit_bytes %d\n", stats.SizeLimit())
+	gauge("forum_db_rows", "Rows per database table.")
+	for _, t := range stats.Tables {
+		fmt.Fprintf(&b, "forum_db_rows{table=%q} %d\n", t.Name, t.Rows)
+	}
+	gauge("forum_db_row_limit", "Soft quota on the total number of rows, 0 when unset.")
+	fmt.Fprintf(&b, "forum_db_row_limit %d\n", DBRowLimit)
+	gauge("forum_db_stats_timestamp_seconds", "When the storage figures were collected.")
+	fmt.Fprintf(&b, "forum_db_stats_timestamp_seconds %d\n", stats.CheckedAt.Unix())
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,157 @@
+package utils
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// AdminUserData is passed to the admin user-detail template
+type AdminUserData struct {
+	User       *User
+	Online     bool
+	Notes      []UserNote
+	Warnings   []Warning
+	Points     int
+	Suspension string
+	Severities []string
+	Snippets   []ReplySnippet
+	CanWarn    bool
+}
+
+// AddUserNote attaches a staff note to a user account
+func (db *DataBase) AddUserNote(userUUID, authorUUID, note string) error {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	_, err := db.Conn.Exec(
+		"INSERT INTO user_notes (user_uuid, author_uuid, note, created_at) VALUES (?, ?, ?, ?)",
+		userUUID, authorUUID, note, Timestamp(),
+	)
+	return err
+}
+
+// ListUserNotes returns the staff notes on a user, newest first
+func (db *DataBase) ListUserNotes(userUUID string) ([]UserNote, error) {
+	rows, err := db.Conn.Query(
+		`SELECT n.id, u.username, n.note, n.created_at
+		FROM user_notes n JOIN users u ON u.uuid = n.author_uuid
+		WHERE n.user_uuid = ?
+		ORDER BY n.id DESC`,
+		userUUID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notes []UserNote
+	for rows.Next() {
+		var (
+			n         UserNote
+			createdAt string
+		)
+		if err := rows.Scan(&n.ID, &n.Author, &n.Note, &createdAt); err != nil {
+			return nil, err
+		}
+		n.CreatedAt, _ = ParseTimestamp(createdAt)
+		notes = append(notes, n)
+	}
+	return notes, rows.Err()
+}
+
+// AdminUserHandler handles GET /admin/users/{username}
+func AdminUserHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	staff, ok := RequireStaff(w, r)
+	if !ok {
+		return
+	}
+
+	user, err := db.GetUserByUsername(r.PathValue("username"))
+	if err != nil {
+		RenderError(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	notes, err := db.ListUserNotes(user.UUID)
+	if err != nil {
+		RenderError(w, "Failed to load notes", http.StatusInternalServerError)
+		return
+	}
+	loc := db.GetLocationPreference(staff.UUID)
+	for i := range notes {
+		notes[i].CreatedAt = notes[i].CreatedAt.In(loc)
+	}
+	user.Lastseen = user.Lastseen.In(loc)
+
+	warnings, err := db.ListWarnings(user.UUID)
+	if err != nil {
+		RenderError(w, "Failed to load warnings", http.StatusInternalServerError)
+		return
+	}
+	for i := range warnings {
+		warnings[i].CreatedAt = warnings[i].CreatedAt.In(loc)
+	}
+	points, err := db.WarningPoints(user.UUID)
+	if err != nil {
+		RenderError(w, "Failed to load warnings", http.StatusInternalServerError)
+		return
+	}
+
+	snippets, err := db.ListSnippets()
+	if err != nil {
+		RenderError(w, "Failed to load warnings", http.StatusInternalServerError)
+		return
+	}
+
+	data := AdminUserData{
+		User:       user,
+		Online:     IsOnline(user),
+		Notes:      notes,
+		Warnings:   warnings,
+		Points:     points,
+		Severities: WarningSeverities,
+		Snippets:   snippets,
+		CanWarn:    CanWarn(staff, user),
+	}
+	if user.IsSuspended() {
+		data.Suspension = SuspensionText(user.SuspendedUntil.In(loc))
+	}
+
+	InitTemplate(w, "templates/admin_user.html", data)
+}
+
+// AddUserNoteHandler handles POST /admin/users/{username}/notes
+func AddUserNoteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	staff, ok := RequireStaff(w, r)
+	if !ok {
+		return
+	}
+
+	user, err := db.GetUserByUsername(r.PathValue("username"))
+	if err != nil {
+		RenderError(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	note := strings.TrimSpace(r.FormValue("note"))
+	if note == "" {
+		RenderError(w, "Note can't be empty", http.StatusBadRequest)
+		return
+	}
+
+	if err := db.AddUserNote(user.UUID, staff.UUID, note); err != nil {
+		RenderError(w, "Failed to save note", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/users/"+url.PathEscape(user.Username), http.StatusSeeOther)
+}
@@ -0,0 +1,69 @@
+package utils
+
+import "time"
+
+// MovedNoticeDays is how long a category lists a post that was moved out
+// of it
+const MovedNoticeDays = 7
+
+// MovedNotice points readers of a category to where a post went
+type MovedNotice struct {
+	PostID int
+	Title  string
+	// ToID and ToName are the category the post was moved to
+	ToID    int
+	ToName  string
+	MovedAt time.Time
+}
+
+// ListMovedNotices returns the recent notices left in a category, newest
+// first. Posts that were deleted since, or moved back, aren't listed.
+func (db *DataBase) ListMovedNotices(categoryID int) ([]MovedNotice, error) {
+	since := FormatTimestamp(Now().AddDate(0, 0, -MovedNoticeDays))
+	rows, err := db.Conn.Query(
+		`SELECT m.post_id, p.title, m.to_category_id, c.name, m.created_at
+		FROM moved_posts m
+		JOIN posts p ON p.id = m.post_id
+		JOIN categories c ON c.id = m.to_category_id
+		WHERE m.category_id = ? AND m.created_at >= ? AND p.deleted_at = '' AND p.status = ?
+		ORDER BY m.created_at DESC`,
+		categoryID, since, PostPublished,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notices []MovedNotice
+	for rows.Next() {
+		var (
+			n       MovedNotice
+			movedAt string
+		)
+		if err := rows.Scan(&n.PostID, &n.Title, &n.ToID, &n.ToName, &movedAt); err != nil {
+			return nil, err
+		}
+		n.MovedAt, _ = ParseTimestamp(movedAt)
+		notices = append(notices, n)
+	}
+	return notices, rows.Err()
+}
+
+// CanMovePost reports whether a user may move a post out of a category:
+// its author and staff can move it out of any, category moderators out of
+// the ones they moderate
+func (db *DataBase) CanMovePost(user *User, post *Post, fromID int) bool {
+	return CanManagePost(user, post) || db.CanModerateCategory(user, fromID)
+}
+
+// ListMoveSources returns the categories of a post the user may move it
+// out of
+func (db *DataBase) ListMoveSources(user *User, post *Post) []Category {
+	var sources []Category
+	for _, c := range post.Categories {
+		if db.CanMovePost(user, post, c.ID) {
+			sources = append(sources, c)
+		}
+	}
+	return sources
+}
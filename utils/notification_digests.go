@@ -0,0 +1,181 @@
+package utils
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"forum/internal/notify"
+)
+
+// Limits on what one notification digest lists
+const (
+	DigestNotificationLimit = 20
+	DigestTopPostLimit      = 5
+)
+
+// DigestPost is one of the top posts in a notification digest
+type DigestPost struct {
+	Title    string
+	Likes    int
+	Comments int
+	Link     string
+}
+
+// NotificationDigestMailData is passed to the notification digest email
+// template. Unread counts every unread notification, which can be more
+// than Notifications lists.
+type NotificationDigestMailData struct {
+	Recipient     string
+	Unread        int
+	Notifications []NotificationMailItem
+	TopPosts      []DigestPost
+	Frequency     string
+	Link          string
+	SettingsLink  string
+}
+
+// notificationDigestRecipient is a user who asked for a notification
+// digest, and how often
+type notificationDigestRecipient struct {
+	digestRecipient
+	Frequency string
+}
+
+// listNotificationDigestRecipients returns the users who asked for a
+// notification digest and when they were last sent one
+func (db *DataBase) listNotificationDigestRecipients() ([]notificationDigestRecipient, error) {
+	rows, err := db.Conn.Query(
+		`SELECT u.uuid, u.username, u.email, p.value, COALESCE(d.sent_at, '')
+		FROM users u
+		JOIN user_preferences p ON p.user_uuid = u.uuid AND p.key = ?
+		LEFT JOIN notification_digests d ON d.user_uuid = u.uuid
+		WHERE p.value != ? AND u.notregistered = 0 AND u.email != ''`,
+		PrefNotificationDigest, DigestOff,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []notificationDigestRecipient
+	for rows.Next() {
+		var (
+			d      notificationDigestRecipient
+			sentAt string
+		)
+		if err := rows.Scan(&d.UUID, &d.Username, &d.Email, &d.Frequency, &sentAt); err != nil {
+			return nil, err
+		}
+		d.LastSent, _ = ParseTimestamp(sentAt)
+		list = append(list, d)
+	}
+	return list, rows.Err()
+}
+
+// markNotificationDigestSent records that a user was just sent their
+// digest, and that the notifications in it were emailed, so the next
+// digest and the notification-mail job leave them out
+func (db *DataBase) markNotificationDigestSent(uuid string, ids []int) error {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := notify.MarkMailed(tx, ids, Now()); err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		`INSERT INTO notification_digests (user_uuid, sent_at) VALUES (?, ?)
+		ON CONFLICT(user_uuid) DO UPDATE SET sent_at = excluded.sent_at`,
+		uuid, Timestamp(),
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SendNotificationDigests emails each user whose digest is due their unread
+// notifications that weren't emailed yet, and the top posts since their
+// last digest. Nothing is sent when there is neither, so the next digest
+// goes out as soon as there is something to tell.
+func SendNotificationDigests() error {
+	recipients, err := db.listNotificationDigestRecipients()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, d := range recipients {
+		interval, ok := digestIntervals[d.Frequency]
+		if !ok || Now().Sub(d.LastSent) < interval {
+			continue
+		}
+		if err := sendNotificationDigest(d, interval); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		log.Printf("Failed to send %d of %d notification digests", len(errs), len(recipients))
+	}
+	return errors.Join(errs...)
+}
+
+// sendNotificationDigest compiles and sends one user's digest
+func sendNotificationDigest(d notificationDigestRecipient, interval time.Duration) error {
+	pending, err := notify.UnreadUnmailed(db.Conn, d.UUID, DigestNotificationLimit)
+	if err != nil {
+		return err
+	}
+	// Top posts are those since the last digest, so none comes up twice
+	since := d.LastSent
+	if since.IsZero() {
+		since = Now().Add(-interval)
+	}
+	posts, _, err := db.ListPosts(PostQuery{Sort: SortTop, Since: since}, DigestTopPostLimit, 0)
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 && len(posts) == 0 {
+		return nil
+	}
+
+	data := NotificationDigestMailData{
+		Recipient:    d.Username,
+		Frequency:    d.Frequency,
+		Link:         SiteURL + "/notifications",
+		SettingsLink: SiteURL + "/settings/notifications",
+	}
+	if _, data.Unread, err = notify.Count(db.Conn, d.UUID); err != nil {
+		return err
+	}
+	ids := make([]int, len(pending))
+	for i, n := range pending {
+		ids[i] = n.ID
+		data.Notifications = append(data.Notifications, NotificationMailItem{
+			Message:   n.Message(),
+			PostTitle: Excerpt(n.PostTitle, ReplyExcerptLength),
+			Excerpt:   notificationExcerpt(n),
+			Link:      SiteURL + n.Link(),
+		})
+	}
+	for _, p := range posts {
+		data.TopPosts = append(data.TopPosts, DigestPost{
+			Title:    Excerpt(p.Title, ReplyExcerptLength),
+			Likes:    p.LikeCount,
+			Comments: p.CommentCount,
+			Link:     SiteURL + "/post/" + strconv.Itoa(p.ID),
+		})
+	}
+
+	if err := SendTemplateMail(d.Email, "Your "+d.Frequency+" forum digest", "notification_digest", data); err != nil {
+		return err
+	}
+	return db.markNotificationDigestSent(d.UUID, ids)
+}
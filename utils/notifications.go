@@ -0,0 +1,393 @@
+package utils
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"forum/internal/notify"
+)
+
+// NotificationsPerPage is how many notifications the notifications page
+// shows at a time
+const NotificationsPerPage = 30
+
+// NotificationExcerptLength caps the context shown with a notification
+const NotificationExcerptLength = 160
+
+// NotificationsData is passed to the notifications template
+type NotificationsData struct {
+	Notifications []notify.Notification
+	Unread        int
+	Total         int
+	Page          int
+	TotalPages    int
+	PrevPage      int
+	NextPage      int
+}
+
+// UnreadNotifications returns how many unread notifications a user has
+func (db *DataBase) UnreadNotifications(userUUID string) (int, error) {
+	_, unread, err := notify.Count(db.Conn, userUUID)
+	return unread, err
+}
+
+// MarkNotificationRead marks one of a user's notifications as read, or
+// all of them when id is 0, or with read false marks it unread again
+func (db *DataBase) MarkNotificationRead(userUUID string, id int, read bool) error {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	if !read {
+		return notify.MarkUnread(db.Conn, userUUID, id)
+	}
+	return notify.MarkRead(db.Conn, userUUID, id, Now())
+}
+
+// sendNotification records an event through tx on the channel its
+// recipient picked for its kind in their preferences
+func sendNotification(tx *sql.Tx, e notify.Event) error {
+	if e.Recipient == "" || e.Recipient == e.Actor {
+		return nil
+	}
+	channel, err := db.GetPreference(e.Recipient, e.Kind.PreferenceKey())
+	if err != nil {
+		return err
+	}
+	return notify.Send(tx, e, notify.Channel(channel))
+}
+
+// notificationExcerpt returns the plain text context shown with a
+// notification
+func notificationExcerpt(n notify.Notification) string {
+	rendered := RenderMarkdown(n.Text)
+	if n.CommentID != 0 {
+		rendered = RenderCommentMarkdown(n.Text)
+	}
+	return HTMLExcerpt(string(rendered), NotificationExcerptLength)
+}
+
+// notifyComment tells everyone watching a post about a new comment on it,
+// through tx: the post's author as a comment on their post, others as a
+// comment on a post they watch. The author of the comment replied to is
+// told about the reply instead, watching or not. Nobody is told twice, or
+// about their own comments.
+func notifyComment(tx *sql.Tx, post *Post, parentID, commentID int, authorUUID string) error {
+	event := notify.Event{
+		Actor:     authorUUID,
+		PostID:    post.ID,
+		CommentID: commentID,
+		At:        Now(),
+	}
+	var replied string
+	if parentID != 0 {
+		if err := tx.QueryRow("SELECT comment_author_uuid FROM comments WHERE id = ?", parentID).Scan(&replied); err != nil {
+			return err
+		}
+		reply := event
+		reply.Kind, reply.Recipient = notify.Reply, replied
+		if err := sendNotification(tx, reply); err != nil {
+			return err
+		}
+	}
+
+	watchers, err := db.listWatchers(post, authorUUID)
+	if err != nil {
+		return err
+	}
+	for _, uuid := range watchers {
+		if uuid == replied {
+			continue
+		}
+		e := event
+		e.Kind, e.Recipient = notify.Watch, uuid
+		if uuid == post.Author.UUID {
+			e.Kind = notify.Comment
+		}
+		if err := sendNotification(tx, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NotificationsHandler handles GET /notifications, the current user's
+// notifications, newest first with the unread ones marked
+func NotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if user.NotRegistered {
+		RenderError(w, "Register to get notifications", http.StatusForbidden)
+		return
+	}
+
+	data := NotificationsData{}
+	if data.Total, data.Unread, err = notify.Count(db.Conn, user.UUID); err != nil {
+		RenderError(w, "Failed to load notifications", http.StatusInternalServerError)
+		return
+	}
+	data.TotalPages = (data.Total + NotificationsPerPage - 1) / NotificationsPerPage
+	data.Page = max(min(PageFromRequest(r), data.TotalPages), 1)
+	if data.Page > 1 {
+		data.PrevPage = data.Page - 1
+	}
+	if data.Page < data.TotalPages {
+		data.NextPage = data.Page + 1
+	}
+	data.Notifications, err = notify.List(db.Conn, user.UUID, NotificationsPerPage, (data.Page-1)*NotificationsPerPage)
+	if err != nil {
+		RenderError(w, "Failed to load notifications", http.StatusInternalServerError)
+		return
+	}
+
+	loc := db.GetLocationPreference(user.UUID)
+	for i := range data.Notifications {
+		n := &data.Notifications[i]
+		n.CreatedAt = n.CreatedAt.In(loc)
+		n.Text = notificationExcerpt(*n)
+	}
+	InitTemplate(w, "templates/notifications.html", data)
+}
+
+// UnreadNotificationsHandler handles GET /notifications/unread, which
+// pages poll for the unread count to keep the badge in the header current.
+// Polling checks the session without refreshing it, so an open tab doesn't
+// keep its user logged in or shown as online.
+func UnreadNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		WriteJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	uuid, err := GetUserFromCookie(r)
+	if err != nil || uuid == "" || db.CheckSession(w, uuid) != nil {
+		WriteJSON(w, http.StatusUnauthorized, map[string]string{"error": "not logged in"})
+		return
+	}
+
+	unread, err := db.UnreadNotifications(uuid)
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to count notifications"})
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	WriteJSON(w, http.StatusOK, map[string]int{"unread": unread})
+}
+
+// OpenNotificationHandler handles GET /notifications/{id}, which marks the
+// notification read and goes on to what it is about
+func OpenNotificationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		RenderError(w, "Notification not found", http.StatusNotFound)
+		return
+	}
+	n, err := notify.Get(db.Conn, user.UUID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		RenderError(w, "Notification not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		RenderError(w, "Failed to load notification", http.StatusInternalServerError)
+		return
+	}
+	if !n.Read {
+		if err := db.MarkNotificationRead(user.UUID, n.ID, true); err != nil {
+			RenderError(w, "Failed to update notification", http.StatusInternalServerError)
+			return
+		}
+	}
+	http.Redirect(w, r, n.Link(), http.StatusSeeOther)
+}
+
+// MarkNotificationsHandler handles POST /notifications/read. The form
+// sends the id of a notification, or 0 for all of them, and read=0 to mark
+// one unread instead.
+func MarkNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	read := r.FormValue("read") != "0"
+	if !read && id == 0 {
+		RenderError(w, "Pick a notification to mark unread", http.StatusBadRequest)
+		return
+	}
+	if err := db.MarkNotificationRead(user.UUID, id, read); err != nil {
+		RenderError(w, "Failed to update notifications", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/notifications", http.StatusSeeOther)
+}
+
+// NotificationSetting is one kind of notification on the settings page,
+// with the channel the user picked for it
+type NotificationSetting struct {
+	Kind    notify.Kind
+	Channel notify.Channel
+}
+
+// NotificationSettingsHandler handles GET and POST /settings/notifications,
+// where users pick how they hear about each kind of notification and how
+// often they get a digest. The form sends each kind's preference key with
+// its channel, and notification_digest.
+func NotificationSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if user.NotRegistered {
+		RenderError(w, "Guests have no settings", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		prefs, err := db.GetPreferences(user.UUID)
+		if err != nil {
+			RenderError(w, "Failed to load settings", http.StatusInternalServerError)
+			return
+		}
+		settings := make([]NotificationSetting, len(notify.Kinds))
+		for i, kind := range notify.Kinds {
+			settings[i] = NotificationSetting{kind, notify.Channel(prefs[kind.PreferenceKey()])}
+		}
+		InitTemplate(w, "templates/notification_settings.html", map[string]interface{}{
+			"Settings":          settings,
+			"Channels":          notify.Channels,
+			"Digest":            prefs[PrefNotificationDigest],
+			"DigestFrequencies": DigestFrequencies,
+		})
+
+	case http.MethodPost:
+		values := map[string]string{PrefNotificationDigest: r.FormValue(PrefNotificationDigest)}
+		for _, kind := range notify.Kinds {
+			values[kind.PreferenceKey()] = r.FormValue(kind.PreferenceKey())
+		}
+		// Validate everything before storing anything
+		for key, value := range values {
+			if err := validatePreference(key, value); err != nil {
+				RenderError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		for key, value := range values {
+			if err := db.SetPreference(user.UUID, key, value); err != nil {
+				RenderError(w, "Failed to save settings", http.StatusInternalServerError)
+				return
+			}
+		}
+		http.Redirect(w, r, "/settings/notifications", http.StatusSeeOther)
+
+	default:
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// NotificationMailBatch caps the notifications emailed in one run
+const NotificationMailBatch = 500
+
+// NotificationMailItem is one notification in a notification email
+type NotificationMailItem struct {
+	Message   string
+	PostTitle string
+	Excerpt   string
+	Link      string
+}
+
+// NotificationMailData is passed to the notifications email template
+type NotificationMailData struct {
+	Recipient    string
+	Items        []NotificationMailItem
+	SettingsLink string
+}
+
+// SendNotificationMail emails notifications of the kinds their recipients
+// get by email, one email per recipient with everything that came in since
+// the last run. Notifications read in the meantime are left out, since
+// they have already been seen.
+func SendNotificationMail() error {
+	pending, err := notify.Unmailed(db.Conn, NotificationMailBatch)
+	if err != nil || len(pending) == 0 {
+		return err
+	}
+
+	var errs []error
+	for start := 0; start < len(pending); {
+		end := start + 1
+		for end < len(pending) && pending[end].Recipient == pending[start].Recipient {
+			end++
+		}
+		if err := mailNotifications(pending[start:end]); err != nil {
+			errs = append(errs, err)
+		}
+		start = end
+	}
+	if len(errs) > 0 {
+		log.Printf("Failed to email notifications to %d recipients", len(errs))
+	}
+	return errors.Join(errs...)
+}
+
+// mailNotifications emails one recipient their unread notifications among
+// list and marks all of list mailed
+func mailNotifications(list []notify.Notification) error {
+	user, err := db.GetUserByUUID(list[0].Recipient)
+	if err != nil {
+		return err
+	}
+
+	data := NotificationMailData{Recipient: user.Username, SettingsLink: SiteURL + "/settings/notifications"}
+	ids := make([]int, len(list))
+	for i, n := range list {
+		ids[i] = n.ID
+		if n.Read {
+			continue
+		}
+		data.Items = append(data.Items, NotificationMailItem{
+			Message:   n.Message(),
+			PostTitle: Excerpt(n.PostTitle, ReplyExcerptLength),
+			Excerpt:   notificationExcerpt(n),
+			Link:      SiteURL + n.Link(),
+		})
+	}
+	if len(data.Items) > 0 && user.Email != "" {
+		subject := data.Items[0].Message
+		if len(data.Items) > 1 {
+			subject = strconv.Itoa(len(data.Items)) + " new notifications"
+		}
+		if err := SendTemplateMail(user.Email, subject, "notifications", data); err != nil {
+			return err
+		}
+	}
+
+	db.Write.Lock()
+	defer db.Write.Unlock()
+	return notify.MarkMailed(db.Conn, ids, Now())
+}
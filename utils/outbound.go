@@ -0,0 +1,153 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"html"
+	"html/template"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+// outboundLinkPattern matches the external links RenderMarkdown produces.
+// It relies on RenderMarkdown being the only producer of these tags, with
+// their href already escaped.
+var outboundLinkPattern = regexp.MustCompile(`<a href="(https?://[^"]*)" rel="nofollow ugc noopener">`)
+
+// OutboundLink is an external link in a post or its comments, with how
+// often it was followed
+type OutboundLink struct {
+	URL    string
+	Clicks int
+}
+
+// linkToken identifies an external URL in /out links without spelling it
+// out in the address
+func linkToken(rawURL string) string {
+	sum := sha256.Sum256([]byte(rawURL))
+	return hex.EncodeToString(sum[:8])
+}
+
+// RenderPostMarkdown renders Markdown like RenderMarkdown, sending external
+// links through /out so clicks are counted for the post and the post's
+// address isn't leaked to the destination as referrer. Video links on a
+// line of their own become players; see embedVideos. @mentions of users
+// link to their profiles.
+func RenderPostMarkdown(postID int, src string) template.HTML {
+	return finishPostHTML(postID, RenderMarkdown(src))
+}
+
+// RenderPostCommentMarkdown renders a comment on a post like RenderPostMarkdown,
+// with the reduced feature set of RenderCommentMarkdown
+func RenderPostCommentMarkdown(postID int, src string) template.HTML {
+	return finishPostHTML(postID, RenderCommentMarkdown(src))
+}
+
+// finishPostHTML links mentions, embeds videos and routes external links
+// through /out in Markdown rendered for a post
+func finishPostHTML(postID int, rendered template.HTML) template.HTML {
+	linked := outboundLinkPattern.ReplaceAllStringFunc(embedVideos(linkMentions(string(rendered))), func(tag string) string {
+		escaped := outboundLinkPattern.FindStringSubmatch(tag)[1]
+		out := "/out/" + strconv.Itoa(postID) + "/" + linkToken(html.UnescapeString(escaped))
+		return `<a href="` + out + `" title="` + escaped + `" rel="nofollow ugc noopener noreferrer">`
+	})
+	return template.HTML(linked)
+}
+
+// postOutboundURLs returns every external URL in a post and its comments,
+// as rendered
+func (db *DataBase) postOutboundURLs(post *Post) ([]string, error) {
+	comments, err := db.ListComments(post.ID)
+	if err != nil {
+		return nil, err
+	}
+	sources := []string{post.Content}
+	for _, c := range comments {
+		sources = append(sources, c.Content)
+	}
+
+	var urls []string
+	for _, src := range sources {
+		for _, m := range outboundLinkPattern.FindAllStringSubmatch(string(RenderMarkdown(src)), -1) {
+			urls = append(urls, html.UnescapeString(m[1]))
+		}
+	}
+	return urls, nil
+}
+
+// RecordLinkClick counts a click on an external link in a post
+func (db *DataBase) RecordLinkClick(postID int, rawURL string) error {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	_, err := db.Conn.Exec(
+		`INSERT INTO link_clicks (post_id, url, clicks, last_clicked_at) VALUES (?, ?, 1, ?)
+		ON CONFLICT(post_id, url) DO UPDATE SET clicks = clicks + 1, last_clicked_at = excluded.last_clicked_at`,
+		postID, rawURL, Timestamp(),
+	)
+	return err
+}
+
+// ListLinkClicks returns the clicked external links of a post, most
+// clicked first
+func (db *DataBase) ListLinkClicks(postID int) ([]OutboundLink, error) {
+	rows, err := db.Conn.Query(
+		"SELECT url, clicks FROM link_clicks WHERE post_id = ? ORDER BY clicks DESC, url", postID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var links []OutboundLink
+	for rows.Next() {
+		var l OutboundLink
+		if err := rows.Scan(&l.URL, &l.Clicks); err != nil {
+			return nil, err
+		}
+		links = append(links, l)
+	}
+	return links, rows.Err()
+}
+
+// OutboundHandler handles GET /out/{post}/{token}, counting the click and
+// redirecting to the external link. Only links that are actually in the
+// post or its comments are followed, so this is no open redirect.
+func OutboundHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	postID, err := strconv.Atoi(r.PathValue("post"))
+	if err != nil {
+		RenderError(w, "Link not found", http.StatusNotFound)
+		return
+	}
+	post, err := db.GetPost(postID)
+	if err != nil || post.IsDeleted() || post.IsDraft() || post.IsMerged() {
+		RenderError(w, "Link not found", http.StatusNotFound)
+		return
+	}
+	urls, err := db.postOutboundURLs(post)
+	if err != nil {
+		RenderError(w, "Failed to load link", http.StatusInternalServerError)
+		return
+	}
+
+	token := r.PathValue("token")
+	for _, u := range urls {
+		if linkToken(u) != token {
+			continue
+		}
+		if err := db.RecordLinkClick(post.ID, u); err != nil {
+			log.Printf("Failed to count click on post %d: %v", post.ID, err)
+		}
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		http.Redirect(w, r, u, http.StatusFound)
+		return
+	}
+	RenderError(w, "Link not found", http.StatusNotFound)
+}
@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"html"
+	"html/template"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// WordsPerMinute is the reading speed reading times are estimated at
+const WordsPerMinute = 200
+
+// A post is long-form from LongFormWords words. Long-form posts show their
+// reading time, and a table of contents once they have TOCMinHeadings
+// headings.
+const (
+	LongFormWords  = 400
+	TOCMinHeadings = 3
+)
+
+// OutlineEntry is one heading of a post
+type OutlineEntry struct {
+	Text string
+	// ID is the heading's anchor in the rendered post
+	ID string
+	// Depth is the heading's level below the post's top heading level
+	Depth int
+}
+
+// PostOutline is a post's rendered body with what's needed to find one's
+// way around it
+type PostOutline struct {
+	Body     template.HTML
+	Words    int
+	Headings []OutlineEntry
+}
+
+// LongForm reports whether the post is long enough to show its outline
+func (o PostOutline) LongForm() bool {
+	return o.Words >= LongFormWords
+}
+
+// ReadingMinutes estimates how long the post takes to read, at least a
+// minute
+func (o PostOutline) ReadingMinutes() int {
+	return max(1, (o.Words+WordsPerMinute-1)/WordsPerMinute)
+}
+
+// TOC returns the table of contents, or nil when the post is too short or
+// has too few headings to need one
+func (o PostOutline) TOC() []OutlineEntry {
+	if !o.LongForm() || len(o.Headings) < TOCMinHeadings {
+		return nil
+	}
+	return o.Headings
+}
+
+// renderedHeading matches a heading as RenderMarkdown writes it
+var renderedHeading = regexp.MustCompile(`(?s)<h([1-6])>(.*?)</h[1-6]>`)
+
+// OutlinePost renders a post's body like RenderPostMarkdown, giving its
+// headings anchors, and counts its words. Working from the rendered HTML
+// keeps the outline in step with what readers see, headings in quotes
+// included.
+func OutlinePost(postID int, src string) PostOutline {
+	var (
+		o      PostOutline
+		levels []int
+		used   = make(map[string]int)
+	)
+	body := renderedHeading.ReplaceAllStringFunc(string(RenderPostMarkdown(postID, src)), func(tag string) string {
+		m := renderedHeading.FindStringSubmatch(tag)
+		text := html.UnescapeString(strings.Join(strings.Fields(PlainText(m[2])), " "))
+		id := headingID(text, used)
+		level, _ := strconv.Atoi(m[1])
+		o.Headings = append(o.Headings, OutlineEntry{Text: text, ID: id})
+		levels = append(levels, level)
+		return "<h" + m[1] + ` id="` + id + `">` + m[2] + "</h" + m[1] + ">"
+	})
+	if len(levels) > 0 {
+		top := levels[0]
+		for _, l := range levels {
+			top = min(top, l)
+		}
+		for i := range o.Headings {
+			o.Headings[i].Depth = levels[i] - top
+		}
+	}
+	o.Body = template.HTML(body)
+	o.Words = len(strings.Fields(html.UnescapeString(PlainText(body))))
+	return o
+}
+
+// headingID makes an anchor from a heading's text. Anchors are prefixed so
+// they can't clash with the page's own ids, and numbered when a post
+// repeats a heading.
+func headingID(text string, used map[string]int) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(text) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	slug := strings.TrimSuffix("section-"+b.String(), "-")
+	used[slug]++
+	if n := used[slug]; n > 1 {
+		slug += "-" + strconv.Itoa(n)
+	}
+	return slug
+}
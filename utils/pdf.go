@@ -0,0 +1,170 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Page layout of generated PDFs: A4 in points, set in Courier, whose
+// glyphs are all 0.6 em wide so lines can be wrapped exactly without
+// embedding font metrics
+const (
+	pdfPageWidth  = 595
+	pdfPageHeight = 842
+	pdfMargin     = 56
+	pdfCharWidth  = 0.6
+)
+
+// pdfStyle is a font size with its line height
+type pdfStyle struct {
+	font    string
+	size    float64
+	leading float64
+}
+
+var (
+	pdfBody    = pdfStyle{"F1", 10, 13}
+	pdfBold    = pdfStyle{"F2", 10, 13}
+	pdfHeading = pdfStyle{"F2", 14, 20}
+	pdfSmall   = pdfStyle{"F1", 8, 11}
+)
+
+type pdfLine struct {
+	style pdfStyle
+	text  string
+	y     float64
+}
+
+// pdfDocument lays out plain text on pages. Text is limited to Latin-1,
+// which the standard fonts cover; other characters print as "?".
+type pdfDocument struct {
+	pages [][]pdfLine
+	y     float64
+}
+
+func newPDFDocument() *pdfDocument {
+	d := &pdfDocument{}
+	d.newPage()
+	return d
+}
+
+func (d *pdfDocument) newPage() {
+	d.pages = append(d.pages, nil)
+	d.y = pdfPageHeight - pdfMargin
+}
+
+// Text adds a paragraph, wrapping it to the page width. Line breaks in
+// the text are kept.
+func (d *pdfDocument) Text(style pdfStyle, text string) {
+	width := int((pdfPageWidth - 2*pdfMargin) / (style.size * pdfCharWidth))
+	for _, para := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		for _, line := range wrapText(strings.ReplaceAll(para, "\t", "    "), width) {
+			if d.y-style.leading < pdfMargin {
+				d.newPage()
+			}
+			d.y -= style.leading
+			page := &d.pages[len(d.pages)-1]
+			*page = append(*page, pdfLine{style, line, d.y})
+		}
+	}
+}
+
+// Gap adds vertical space, unless at the top of a page
+func (d *pdfDocument) Gap(points float64) {
+	if d.y < pdfPageHeight-pdfMargin {
+		d.y -= points
+	}
+}
+
+// wrapText breaks text into lines of at most width runes at spaces,
+// cutting words that are longer than a line. An empty text is one empty
+// line.
+func wrapText(text string, width int) []string {
+	var (
+		lines []string
+		line  []rune
+	)
+	for _, word := range strings.Split(strings.TrimRightFunc(text, unicode.IsSpace), " ") {
+		w := []rune(word)
+		if len(line) > 0 && len(line)+1+len(w) > width {
+			lines = append(lines, string(line))
+			line = nil
+		}
+		for len(w) > width {
+			lines = append(lines, string(w[:width]))
+			w = w[width:]
+		}
+		if len(line) > 0 {
+			line = append(line, ' ')
+		}
+		line = append(line, w...)
+	}
+	return append(lines, string(line))
+}
+
+// pdfString encodes text as a PDF literal string in Latin-1
+func pdfString(text string) string {
+	var b strings.Builder
+	b.WriteByte('(')
+	for _, r := range text {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20 || (r >= 0x7f && r < 0xa0):
+			continue
+		case r > 0xff:
+			b.WriteByte('?')
+		default:
+			b.WriteByte(byte(r))
+		}
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+// Bytes writes the document out as a PDF file
+func (d *pdfDocument) Bytes(title string) []byte {
+	var (
+		buf     bytes.Buffer
+		offsets []int
+	)
+	object := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	// Objects 1 to 4 are fixed; each page then takes a page object and
+	// its content stream
+	var kids []string
+	for i := range d.pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", 6+2*i))
+	}
+	buf.WriteString("%PDF-1.4\n")
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Courier-Bold /Encoding /WinAnsiEncoding >>")
+	object(fmt.Sprintf("<< /Title %s /Producer (ForumHub) >>", pdfString(title)))
+	for i, lines := range d.pages {
+		var content strings.Builder
+		for _, l := range lines {
+			fmt.Fprintf(&content, "BT /%s %g Tf %d %g Td %s Tj ET\n", l.style.font, l.style.size, pdfMargin, l.y, pdfString(l.text))
+		}
+		object(fmt.Sprintf(
+			"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, 7+2*i,
+		))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()))
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R /Info 5 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return buf.Bytes()
+}
@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// collapseReplies drops the replies nested CommentCollapseDepth or more
+// deep from a page of comments in thread order, counting them in
+// HiddenReplies of the reply they are under. The thread holding comment
+// open, if it is on the page, is left whole.
+func collapseReplies(comments []Comment, open int) []Comment {
+	if CommentCollapseDepth == 0 {
+		return comments
+	}
+
+	openRoot, root := 0, 0
+	for _, c := range comments {
+		if c.threadDepth == 0 {
+			root = c.ID
+		}
+		if c.ID == open {
+			openRoot = root
+			break
+		}
+	}
+
+	shown := comments[:0]
+	for _, c := range comments {
+		if c.threadDepth == 0 {
+			root = c.ID
+		}
+		// The reply above a collapsed one is shown, since it is shallower
+		if c.threadDepth >= CommentCollapseDepth && root != openRoot {
+			shown[len(shown)-1].HiddenReplies++
+			continue
+		}
+		shown = append(shown, c)
+	}
+	return shown
+}
+
+// CommentPermalinkHandler handles GET /comment/{id}, the stable link to a
+// comment. It redirects to the page of its post the comment is on, which
+// follows the comment when its post is merged into another.
+func CommentPermalinkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		RenderError(w, "Comment not found", http.StatusNotFound)
+		return
+	}
+	comment, err := db.GetComment(id)
+	if err != nil {
+		RenderError(w, "Comment not found", http.StatusNotFound)
+		return
+	}
+	post, err := db.GetPost(comment.Post.ID)
+	if err != nil || post.IsDeleted() || post.IsDraft() || post.IsMerged() {
+		RenderError(w, "Comment not found", http.StatusNotFound)
+		return
+	}
+	http.Redirect(w, r, CommentLink("", post.ID, comment.ID), http.StatusSeeOther)
+}
@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// GlobalPin is the category_id of a pin that keeps a post atop the front
+// page, and atop each of its categories
+const GlobalPin = 0
+
+// PinOption is a place the viewer may pin a post, and whether it already
+// is pinned there. Category is empty for GlobalPin.
+type PinOption struct {
+	Category Category
+	Pinned   bool
+}
+
+// IsPinnedIn reports whether the post is pinned in the category, or
+// globally for GlobalPin
+func (db *DataBase) IsPinnedIn(postID, categoryID int) (bool, error) {
+	var pinned bool
+	err := db.Conn.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM post_pins WHERE category_id = ? AND post_id = ?)",
+		categoryID, postID,
+	).Scan(&pinned)
+	return pinned, err
+}
+
+// ListPinOptions returns where the user may pin the post: globally for
+// staff, and in each of its categories they moderate
+func (db *DataBase) ListPinOptions(user *User, post *Post) ([]PinOption, error) {
+	var options []PinOption
+	if user.IsStaff() {
+		pinned, err := db.IsPinnedIn(post.ID, GlobalPin)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, PinOption{Pinned: pinned})
+	}
+	for _, c := range post.Categories {
+		if !db.CanModerateCategory(user, c.ID) {
+			continue
+		}
+		pinned, err := db.IsPinnedIn(post.ID, c.ID)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, PinOption{Category: c, Pinned: pinned})
+	}
+	return options, nil
+}
+
+// SetPin pins a post in one of its categories, or globally for GlobalPin,
+// or unpins it, and records it in the post's history
+func (db *DataBase) SetPin(post *Post, categoryID int, pin bool, actorUUID string) error {
+	where := "everywhere"
+	if categoryID != GlobalPin {
+		where = ""
+		for _, c := range post.Categories {
+			if c.ID == categoryID {
+				where = "in " + c.Name
+			}
+		}
+		if where == "" {
+			return errors.New("the post isn't in that category")
+		}
+	}
+
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	action := "pinned"
+	if pin {
+		_, err = tx.Exec(
+			`INSERT OR IGNORE INTO post_pins (category_id, post_id, pinned_by, created_at)
+			VALUES (?, ?, ?, ?)`,
+			categoryID, post.ID, actorUUID, Timestamp(),
+		)
+	} else {
+		action = "unpinned"
+		_, err = tx.Exec("DELETE FROM post_pins WHERE category_id = ? AND post_id = ?", categoryID, post.ID)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := recordPostHistory(tx, post.ID, actorUUID, action, where); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// PinPostHandler handles POST /post/pin
+// The form sends post_id, category_id (0 for a global pin) and pin=1 to
+// pin the post or 0 to unpin it. Global pins are for staff, category pins
+// for the category's moderators.
+func PinPostHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	postID, err1 := strconv.Atoi(r.FormValue("post_id"))
+	categoryID, err2 := strconv.Atoi(r.FormValue("category_id"))
+	if err1 != nil || err2 != nil {
+		RenderError(w, "Invalid post or category", http.StatusBadRequest)
+		return
+	}
+	post, err := db.GetPost(postID)
+	if err != nil || post.IsDeleted() || post.IsDraft() || post.IsMerged() {
+		RenderError(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	if categoryID == GlobalPin && !user.IsStaff() {
+		RenderError(w, "Only staff can pin posts everywhere", http.StatusForbidden)
+		return
+	}
+	if categoryID != GlobalPin && !db.CanModerateCategory(user, categoryID) {
+		RenderError(w, "Only moderators of this category can pin posts in it", http.StatusForbidden)
+		return
+	}
+
+	if err := db.SetPin(post, categoryID, r.FormValue("pin") == "1", user.UUID); err != nil {
+		RenderError(w, "Failed to update pin: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/post/"+strconv.Itoa(post.ID), http.StatusSeeOther)
+}
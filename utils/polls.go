@@ -0,0 +1,331 @@
+package utils
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bounds on the number of options a poll offers
+const (
+	MinPollOptions = 2
+	MaxPollOptions = 10
+)
+
+// PollOptionLength caps the length of one option, in runes
+const PollOptionLength = 200
+
+// PollInput is a poll as submitted with the post form
+type PollInput struct {
+	Question string
+	Options  []string
+	Multiple bool
+	// ClosesAt is zero for a poll that stays open
+	ClosesAt time.Time
+}
+
+// OptionsText is the options one per line, for redisplaying the form
+func (p PollInput) OptionsText() string {
+	return strings.Join(p.Options, "\n")
+}
+
+// Poll is a post's poll with its results, as seen by one viewer
+type Poll struct {
+	PostID   int
+	Question string
+	Multiple bool
+	ClosesAt time.Time
+	Options  []PollOption
+	// Voters counts people, not votes; with multiple choice they differ
+	Voters int
+	// Voted is whether the viewer has voted
+	Voted bool
+}
+
+// PollOption is one answer of a poll
+type PollOption struct {
+	ID    int
+	Label string
+	Votes int
+	// Percent is the share of voters who picked the option
+	Percent int
+	// Chosen is whether the viewer picked it
+	Chosen bool
+}
+
+// Closed reports whether the poll no longer takes votes
+func (p *Poll) Closed() bool {
+	return !p.ClosesAt.IsZero() && !Now().Before(p.ClosesAt)
+}
+
+// readPollForm reads the poll fields of a post form. It returns nil when
+// they were left empty.
+func readPollForm(r *http.Request, loc *time.Location) (*PollInput, error) {
+	poll := &PollInput{
+		Question: strings.TrimSpace(r.FormValue("poll_question")),
+		Multiple: r.FormValue("poll_multiple") == "on",
+	}
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(r.FormValue("poll_options"), "\n") {
+		option := strings.TrimSpace(line)
+		if option == "" || seen[strings.ToLower(option)] {
+			continue
+		}
+		seen[strings.ToLower(option)] = true
+		poll.Options = append(poll.Options, option)
+	}
+	closes := strings.TrimSpace(r.FormValue("poll_closes"))
+
+	if poll.Question == "" && len(poll.Options) == 0 {
+		return nil, nil
+	}
+	if poll.Question == "" {
+		return poll, errors.New("the poll needs a question")
+	}
+	if len(poll.Options) < MinPollOptions || len(poll.Options) > MaxPollOptions {
+		return poll, fmt.Errorf("a poll needs %d to %d different options", MinPollOptions, MaxPollOptions)
+	}
+	for _, option := range poll.Options {
+		if len([]rune(option)) > PollOptionLength {
+			return poll, fmt.Errorf("poll options are limited to %d characters", PollOptionLength)
+		}
+	}
+	if closes != "" {
+		t, err := time.ParseInLocation(datetimeLocalLayout, closes, loc)
+		if err != nil {
+			return poll, errors.New("invalid poll closing time")
+		}
+		if !t.After(Now()) {
+			return poll, errors.New("the poll must close in the future")
+		}
+		poll.ClosesAt = t
+	}
+	return poll, nil
+}
+
+// savePoll attaches a poll to a post. A nil poll is a no-op.
+func savePoll(ex execer, postID int, poll *PollInput) error {
+	if poll == nil {
+		return nil
+	}
+	closesAt := ""
+	if !poll.ClosesAt.IsZero() {
+		closesAt = FormatTimestamp(poll.ClosesAt)
+	}
+	if _, err := ex.Exec(
+		"INSERT INTO polls (post_id, question, multiple, closes_at, created_at) VALUES (?, ?, ?, ?, ?)",
+		postID, poll.Question, poll.Multiple, closesAt, Timestamp(),
+	); err != nil {
+		return err
+	}
+	for i, option := range poll.Options {
+		if _, err := ex.Exec(
+			"INSERT INTO poll_options (post_id, position, label) VALUES (?, ?, ?)",
+			postID, i, option,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddPoll attaches a poll to a post that doesn't have one yet
+func (db *DataBase) AddPoll(postID int, poll *PollInput) error {
+	if poll == nil {
+		return nil
+	}
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	err = tx.QueryRow("SELECT 1 FROM polls WHERE post_id = ?", postID).Scan(&exists)
+	if err == nil {
+		return errors.New("the post already has a poll")
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if err := savePoll(tx, postID, poll); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// HasPoll reports whether a post has a poll
+func (db *DataBase) HasPoll(postID int) (bool, error) {
+	var exists int
+	err := db.Conn.QueryRow("SELECT 1 FROM polls WHERE post_id = ?", postID).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// GetPoll returns a post's poll with its results and the viewer's votes,
+// or nil if the post has none
+func (db *DataBase) GetPoll(postID int, viewerUUID string) (*Poll, error) {
+	var (
+		poll     = Poll{PostID: postID}
+		closesAt string
+	)
+	err := db.Conn.QueryRow(
+		"SELECT question, multiple, closes_at FROM polls WHERE post_id = ?", postID,
+	).Scan(&poll.Question, &poll.Multiple, &closesAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	poll.ClosesAt, _ = ParseTimestamp(closesAt)
+
+	rows, err := db.Conn.Query(
+		`SELECT o.id, o.label,
+			(SELECT COUNT(*) FROM poll_votes v WHERE v.option_id = o.id),
+			EXISTS (SELECT 1 FROM poll_votes v WHERE v.option_id = o.id AND v.user_uuid = ?)
+		FROM poll_options o
+		WHERE o.post_id = ?
+		ORDER BY o.position`,
+		viewerUUID, postID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var o PollOption
+		if err := rows.Scan(&o.ID, &o.Label, &o.Votes, &o.Chosen); err != nil {
+			return nil, err
+		}
+		if o.Chosen {
+			poll.Voted = true
+		}
+		poll.Options = append(poll.Options, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := db.Conn.QueryRow(
+		"SELECT COUNT(DISTINCT user_uuid) FROM poll_votes WHERE post_id = ?", postID,
+	).Scan(&poll.Voters); err != nil {
+		return nil, err
+	}
+	if poll.Voters > 0 {
+		for i := range poll.Options {
+			poll.Options[i].Percent = poll.Options[i].Votes * 100 / poll.Voters
+		}
+	}
+	return &poll, nil
+}
+
+// CastVote records a user's choices in a poll, replacing any earlier vote.
+// Votes can be changed until the poll closes.
+func (db *DataBase) CastVote(postID int, userUUID string, optionIDs []int) error {
+	if len(optionIDs) == 0 {
+		return errors.New("pick an option to vote")
+	}
+
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var (
+		multiple bool
+		closesAt string
+	)
+	err = tx.QueryRow("SELECT multiple, closes_at FROM polls WHERE post_id = ?", postID).Scan(&multiple, &closesAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errors.New("the post has no poll")
+	}
+	if err != nil {
+		return err
+	}
+	if closes, err := ParseTimestamp(closesAt); err == nil && !Now().Before(closes) {
+		return errors.New("the poll is closed")
+	}
+
+	chosen := make(map[int]bool)
+	for _, id := range optionIDs {
+		chosen[id] = true
+	}
+	if len(chosen) > 1 && !multiple {
+		return errors.New("this poll takes a single choice")
+	}
+
+	if _, err := tx.Exec("DELETE FROM poll_votes WHERE post_id = ? AND user_uuid = ?", postID, userUUID); err != nil {
+		return err
+	}
+	now := Timestamp()
+	for id := range chosen {
+		res, err := tx.Exec(
+			`INSERT INTO poll_votes (post_id, option_id, user_uuid, created_at)
+			SELECT post_id, id, ?, ? FROM poll_options WHERE id = ? AND post_id = ?`,
+			userUUID, now, id, postID,
+		)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return errors.New("unknown poll option")
+		}
+	}
+	return tx.Commit()
+}
+
+// VoteHandler handles POST /post/{id}/vote
+func VoteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if user.NotRegistered {
+		RenderError(w, "Please register to vote", http.StatusForbidden)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		RenderError(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	post, err := db.GetPost(id)
+	if err != nil || post.IsDeleted() || post.IsDraft() || post.IsMerged() {
+		RenderError(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	if post.IsArchived() {
+		RenderError(w, "This thread is archived", http.StatusForbidden)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		RenderError(w, "Invalid vote", http.StatusBadRequest)
+		return
+	}
+	if err := db.CastVote(id, user.UUID, formIDs(r, "option")); err != nil {
+		RenderError(w, "Vote not counted: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, "/post/"+strconv.Itoa(id)+"#poll", http.StatusSeeOther)
+}
@@ -0,0 +1,121 @@
+package utils
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// postExportTimeLayout is how exports date the post and its comments
+const postExportTimeLayout = "Jan 2, 2006 15:04 MST"
+
+// postByline credits a post's author and co-authors
+func postByline(post *Post) string {
+	byline := "By " + post.Author.Username
+	if len(post.CoAuthors) > 0 {
+		byline += " with " + strings.Join(post.CoAuthors, ", ")
+	}
+	return byline
+}
+
+// postCategoryNames lists a post's categories by name
+func postCategoryNames(post *Post) string {
+	names := make([]string, len(post.Categories))
+	for i, c := range post.Categories {
+		names[i] = c.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+// PostMarkdown writes a post and its comments as a Markdown document.
+// Bodies are already Markdown, so they're copied as they are.
+func PostMarkdown(post *Post, comments []Comment, link string, loc *time.Location) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", post.Title)
+	fmt.Fprintf(&b, "*%s, %s*", postByline(post), post.CreatedAt.In(loc).Format(postExportTimeLayout))
+	if names := postCategoryNames(post); names != "" {
+		fmt.Fprintf(&b, "  \n*Categories: %s*", names)
+	}
+	fmt.Fprintf(&b, "  \n<%s>\n\n%s\n", link, post.Content)
+
+	if len(comments) > 0 {
+		fmt.Fprintf(&b, "\n---\n\n## Comments (%d)\n", len(comments))
+		for _, c := range comments {
+			fmt.Fprintf(&b, "\n### %s, %s\n\n%s\n", c.Author.Username, c.CreatedAt.In(loc).Format(postExportTimeLayout), c.Content)
+		}
+	}
+	return b.String()
+}
+
+// PostPDF lays out a post and its comments as a PDF. Bodies are printed as
+// their Markdown source, which reads well as plain text.
+func PostPDF(post *Post, comments []Comment, link string, loc *time.Location) []byte {
+	d := newPDFDocument()
+	d.Text(pdfHeading, post.Title)
+	d.Text(pdfSmall, postByline(post)+", "+post.CreatedAt.In(loc).Format(postExportTimeLayout))
+	if names := postCategoryNames(post); names != "" {
+		d.Text(pdfSmall, "Categories: "+names)
+	}
+	d.Text(pdfSmall, link)
+	d.Gap(10)
+	d.Text(pdfBody, post.Content)
+
+	if len(comments) > 0 {
+		d.Gap(16)
+		d.Text(pdfHeading, fmt.Sprintf("Comments (%d)", len(comments)))
+		for _, c := range comments {
+			d.Gap(10)
+			d.Text(pdfBold, c.Author.Username+", "+c.CreatedAt.In(loc).Format(postExportTimeLayout))
+			d.Text(pdfBody, c.Content)
+		}
+	}
+	return d.Bytes(post.Title)
+}
+
+// ExportPostHandler handles GET /post/{id}/export?format=md|pdf, a
+// download of the post and its comments for archiving
+func ExportPostHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		RenderError(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	post, err := db.GetPost(id)
+	if err != nil || post.IsDeleted() || post.IsDraft() || post.IsMerged() {
+		RenderError(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	comments, err := db.ListComments(id)
+	if err != nil {
+		RenderError(w, "Failed to export post", http.StatusInternalServerError)
+		return
+	}
+
+	link := SiteURL + "/post/" + strconv.Itoa(id)
+	loc := db.GetLocationPreference(user.UUID)
+	filename := "post-" + strconv.Itoa(id)
+	switch r.URL.Query().Get("format") {
+	case "", "md":
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.md"`)
+		w.Write([]byte(PostMarkdown(post, comments, link, loc)))
+	case "pdf":
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.pdf"`)
+		w.Write(PostPDF(post, comments, link, loc))
+	default:
+		RenderError(w, "Unknown export format", http.StatusBadRequest)
+	}
+}
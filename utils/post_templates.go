@@ -0,0 +1,199 @@
+package utils
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// PostTemplate is the body a category's new posts start from. Required
+// names the template's sections a post must fill in before publishing.
+type PostTemplate struct {
+	CategoryID   int
+	CategoryName string
+	Body         string
+	Required     []string
+}
+
+// RequiredText is Required one per line, for the admin form
+func (t PostTemplate) RequiredText() string {
+	return strings.Join(t.Required, "\n")
+}
+
+// markdownHeading matches a Markdown ATX heading, capturing its text
+var markdownHeading = regexp.MustCompile(`^#{1,6}\s+(.*?)\s*#*\s*$`)
+
+// splitSections maps each heading of a Markdown text, lowercased, to the
+// trimmed text under it up to the next heading
+func splitSections(text string) map[string]string {
+	sections := make(map[string]string)
+	heading := ""
+	var body []string
+	flush := func() {
+		if heading != "" {
+			sections[heading] = strings.TrimSpace(strings.Join(body, "\n"))
+		}
+	}
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		if m := markdownHeading.FindStringSubmatch(line); m != nil {
+			flush()
+			heading, body = strings.ToLower(m[1]), nil
+			continue
+		}
+		body = append(body, line)
+	}
+	flush()
+	return sections
+}
+
+// MissingSections returns the required sections body leaves out, leaves
+// empty or leaves as the template had them
+func (t PostTemplate) MissingSections(body string) []string {
+	given, placeholder := splitSections(body), splitSections(t.Body)
+	var missing []string
+	for _, name := range t.Required {
+		key := strings.ToLower(name)
+		if text := given[key]; text == "" || text == placeholder[key] {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+// GetPostTemplate returns a category's post template, or nil if it has none
+func (db *DataBase) GetPostTemplate(categoryID int) (*PostTemplate, error) {
+	templates, err := db.listPostTemplates("t.category_id = ?", categoryID)
+	if err != nil || len(templates) == 0 {
+		return nil, err
+	}
+	return &templates[0], nil
+}
+
+// ListPostTemplates returns every category's post template, keyed by
+// category ID
+func (db *DataBase) ListPostTemplates() (map[int]PostTemplate, error) {
+	templates, err := db.listPostTemplates("1 = 1")
+	if err != nil {
+		return nil, err
+	}
+	byCategory := make(map[int]PostTemplate, len(templates))
+	for _, t := range templates {
+		byCategory[t.CategoryID] = t
+	}
+	return byCategory, nil
+}
+
+// listPostTemplates returns the templates matching where
+func (db *DataBase) listPostTemplates(where string, args ...interface{}) ([]PostTemplate, error) {
+	rows, err := db.Conn.Query(
+		`SELECT t.category_id, c.name, t.body, t.required
+		FROM category_templates t JOIN categories c ON c.id = t.category_id
+		WHERE `+where+`
+		ORDER BY c.position, c.name COLLATE NOCASE`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var templates []PostTemplate
+	for rows.Next() {
+		var (
+			t        PostTemplate
+			required string
+		)
+		if err := rows.Scan(&t.CategoryID, &t.CategoryName, &t.Body, &required); err != nil {
+			return nil, err
+		}
+		if required != "" {
+			t.Required = strings.Split(required, "\n")
+		}
+		templates = append(templates, t)
+	}
+	return templates, rows.Err()
+}
+
+// SetPostTemplate replaces a category's post template. An empty body
+// removes it. Every required section must be a heading of the template.
+func (db *DataBase) SetPostTemplate(categoryID int, body string, required []string) error {
+	if _, err := db.GetCategory(categoryID); err != nil {
+		return err
+	}
+
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	if body == "" {
+		_, err := db.Conn.Exec("DELETE FROM category_templates WHERE category_id = ?", categoryID)
+		return err
+	}
+	// Posts start from the template, so it has to fit in one
+	if err := BodyLength.CheckMax(body); err != nil {
+		return err
+	}
+	sections := splitSections(body)
+	for _, name := range required {
+		if _, ok := sections[strings.ToLower(name)]; !ok {
+			return fmt.Errorf("the template has no %q section", name)
+		}
+	}
+
+	_, err := db.Conn.Exec(
+		`INSERT INTO category_templates (category_id, body, required) VALUES (?, ?, ?)
+		ON CONFLICT(category_id) DO UPDATE SET body = excluded.body, required = excluded.required`,
+		categoryID, body, strings.Join(required, "\n"),
+	)
+	return err
+}
+
+// checkPostTemplates returns an error naming the first required section
+// body leaves unfilled, among the templates of the given categories
+func (db *DataBase) checkPostTemplates(categoryIDs []int, body string) error {
+	for _, id := range categoryIDs {
+		t, err := db.GetPostTemplate(id)
+		if err != nil {
+			return err
+		}
+		if t == nil {
+			continue
+		}
+		if missing := t.MissingSections(body); len(missing) > 0 {
+			return fmt.Errorf("fill in the %q section, which posts in %s need", missing[0], t.CategoryName)
+		}
+	}
+	return nil
+}
+
+// SavePostTemplateHandler handles POST /admin/categories/template. The
+// required field lists the required section headings one per line.
+func SavePostTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := RequireAdmin(w, r); !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		RenderError(w, "Invalid category", http.StatusBadRequest)
+		return
+	}
+	var required []string
+	for _, line := range strings.Split(r.FormValue("required"), "\n") {
+		if name := strings.TrimSpace(line); name != "" {
+			required = append(required, name)
+		}
+	}
+
+	if err := db.SetPostTemplate(id, strings.TrimSpace(r.FormValue("body")), required); err != nil {
+		RenderError(w, "Failed to save template: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/categories", http.StatusSeeOther)
+}
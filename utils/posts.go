@@ -0,0 +1,1127 @@
+package utils
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PostPageData is passed to the post template
+type PostPageData struct {
+	Post       *Post
+	Comments   *CommentPage
+	History    []PostHistoryEntry
+	CanManage  bool
+	CanComment bool
+	CanLock    bool
+	// CanBookmark is false for guests, who can't keep bookmarks
+	CanBookmark bool
+	Bookmarked  bool
+	// Watching is whether the viewer is emailed about new comments; it is
+	// only loaded for those who can bookmark
+	Watching bool
+	// CanReact is whether the viewer can like and dislike comments and
+	// react to the post and comments with emoji
+	CanReact bool
+	// EmojiReactions are the emoji reactions to the post itself
+	EmojiReactions []ReactionCount
+	// CanAccept is set for the author of a question. AcceptedAnswer is
+	// shown above the comments, whichever page they are on.
+	CanAccept      bool
+	AcceptedAnswer *Comment
+	// Bookmarks counts who bookmarked the post, for those who can manage it
+	Bookmarks int
+	// CanReport is false for guests and the post's author. ReportReasons is
+	// set for everyone who can report, the post or its comments.
+	CanReport     bool
+	ReportReasons []ReportReason
+	// ViewerUUID tells the viewer's own comments apart, which they can't
+	// report
+	ViewerUUID string
+	// Snippets are only loaded for staff
+	Snippets []ReplySnippet
+	// Announcements lists the post's categories the viewer moderates
+	Announcements []AnnouncementOption
+	// MoveFrom lists the categories the viewer may move the post out of
+	MoveFrom []Category
+	// CanEdit adds co-authors to those who can manage the post.
+	// CoAuthors, invitations included, is loaded for those who can manage it.
+	CanEdit   bool
+	CoAuthors []CoAuthor
+	// CanMerge is set for staff; Merges lists the posts merged into this one
+	CanMerge bool
+	Merges   []PostMerge
+	// Pins lists where the viewer may pin the post
+	Pins []PinOption
+	// Breadcrumbs is the path down to the post's first category
+	Breadcrumbs []Category
+	Categories  []Category
+	Images      []PostImage
+	// Languages is empty when no translation service is configured
+	Languages        []TranslationLanguage
+	Translation      *PostTranslation
+	TranslationError string
+	// Summary is nil unless the thread is long enough to have been summarized
+	Summary *ThreadSummary
+	// LinkClicks is only loaded for those who can manage the post
+	LinkClicks []OutboundLink
+	Related    []SimilarPost
+	// Outline is the rendered body with its reading time and headings
+	Outline PostOutline
+	// LinkPreviews has cards for the post's bare URLs that were fetched
+	LinkPreviews []LinkPreview
+	// CommentForm is what was submitted when a comment is turned away
+	CommentForm   CommentForm
+	CommentLength LengthLimit
+	// Poll is nil unless the post has one; CanVote is false once it closes
+	Poll    *Poll
+	CanVote bool
+	// BaseURL makes the share metadata's links absolute
+	BaseURL string
+}
+
+// CommentForm holds a rejected comment, redisplayed with the reason
+type CommentForm struct {
+	Content string
+	Error   string
+	// ParentID is the comment a turned-away reply was answering
+	ParentID int
+}
+
+// PostFormData is passed to the post form template. Post.ID is zero when
+// a new post is being written.
+type PostFormData struct {
+	Post       *Post
+	Categories []Category
+	Selected   map[int]bool
+	Images     []PostImage
+	MaxImages  int
+	// TitleLength and BodyLength are shown as hints on the form
+	TitleLength LengthLimit
+	BodyLength  LengthLimit
+	// Poll holds the poll fields as submitted; HasPoll hides them once the
+	// post has a poll, which can't be changed afterwards
+	Poll           *PollInput
+	HasPoll        bool
+	MaxPollOptions int
+	// Error explains why a submitted form was turned away
+	Error string
+}
+
+// GetPost loads a post with its author and categories.
+// Deleted posts are returned too; check IsDeleted before showing them.
+func (db *DataBase) GetPost(id int) (*Post, error) {
+	var (
+		p                                                    Post
+		createdAt, editedAt, deletedAt, lockedAt, archivedAt string
+		credits                                              string
+	)
+	err := db.Conn.QueryRow(
+		`SELECT p.id, p.title, p.content, u.uuid, u.username, p.created_at, p.edited_at, p.deleted_at, p.status, p.views, p.locked_at,
+			p.archived_at, p.accepted_comment_id, p.nsfw, p.spoiler, `+coAuthorCredits+`
+		FROM posts p JOIN users u ON u.uuid = p.author_uuid
+		WHERE p.id = ?`,
+		id,
+	).Scan(&p.ID, &p.Title, &p.Content, &p.Author.UUID, &p.Author.Username, &createdAt, &editedAt, &deletedAt, &p.Status, &p.Views, &lockedAt,
+		&archivedAt, &p.AcceptedCommentID, &p.NSFW, &p.Spoiler, &credits)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errors.New("post not found")
+		}
+		return nil, err
+	}
+	p.CreatedAt, _ = ParseTimestamp(createdAt)
+	p.EditedAt, _ = ParseTimestamp(editedAt)
+	p.DeletedAt, _ = ParseTimestamp(deletedAt)
+	p.LockedAt, _ = ParseTimestamp(lockedAt)
+	p.ArchivedAt, _ = ParseTimestamp(archivedAt)
+	p.CoAuthors = splitCredits(credits)
+
+	p.Categories, err = db.ListPostCategories(id)
+	if err != nil {
+		return nil, err
+	}
+	p.Attachments, err = db.ListPostAttachments(id)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// ListPostCategories returns the categories a post belongs to
+func (db *DataBase) ListPostCategories(postID int) ([]Category, error) {
+	rows, err := db.Conn.Query(
+		`SELECT c.id, c.name, c.description, c.archived, c.qa, c.parent_id
+		FROM post_categories pc JOIN categories c ON c.id = pc.category_id
+		WHERE pc.post_id = ?
+		ORDER BY c.name COLLATE NOCASE`,
+		postID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var categories []Category
+	for rows.Next() {
+		var c Category
+		if err := rows.Scan(&c.ID, &c.Name, &c.Description, &c.Archived, &c.QA, &c.ParentID); err != nil {
+			return nil, err
+		}
+		categories = append(categories, c)
+	}
+	return categories, rows.Err()
+}
+
+// CanManagePost reports whether a user may change a post:
+// its author and staff can, everyone else can't. Drafts are private to
+// their author.
+func CanManagePost(user *User, post *Post) bool {
+	if post.IsDraft() {
+		return user.UUID == post.Author.UUID
+	}
+	return user.UUID == post.Author.UUID || user.IsStaff()
+}
+
+// MovePost moves a post out of one category and into another,
+// recording the move in the post's history. With leaveNotice the source
+// category lists where the post went for MovedNoticeDays.
+func (db *DataBase) MovePost(postID, fromID, toID int, actorUUID string, leaveNotice bool) error {
+	if fromID == toID {
+		return errors.New("post is already in that category")
+	}
+	from, err := db.GetCategory(fromID)
+	if err != nil {
+		return err
+	}
+	to, err := db.GetCategory(toID)
+	if err != nil {
+		return err
+	}
+	if to.Archived {
+		return errors.New("cannot move a post into an archived category")
+	}
+
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM post_categories WHERE post_id = ? AND category_id = ?", postID, fromID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("post is not in the source category")
+	}
+
+	for _, stmt := range []string{
+		"DELETE FROM category_announcements WHERE post_id = ? AND category_id = ?",
+		"DELETE FROM post_pins WHERE post_id = ? AND category_id = ?",
+	} {
+		if _, err := tx.Exec(stmt, postID, fromID); err != nil {
+			return err
+		}
+	}
+
+	// The post may already be in the target too; then the move just drops the source
+	if _, err := tx.Exec("INSERT OR IGNORE INTO post_categories (post_id, category_id) VALUES (?, ?)", postID, toID); err != nil {
+		return err
+	}
+
+	// A notice left when the post was moved out of the target is stale now
+	if _, err := tx.Exec("DELETE FROM moved_posts WHERE post_id = ? AND category_id = ?", postID, toID); err != nil {
+		return err
+	}
+	details := "from " + from.Name + " to " + to.Name
+	if leaveNotice {
+		if _, err := tx.Exec(
+			`INSERT OR REPLACE INTO moved_posts (category_id, post_id, to_category_id, moved_by, created_at)
+			VALUES (?, ?, ?, ?, ?)`,
+			fromID, postID, toID, actorUUID, Timestamp(),
+		); err != nil {
+			return err
+		}
+		details += ", leaving a notice"
+	}
+	if err := recordPostHistory(tx, postID, actorUUID, "moved", details); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// checkPostCategories returns an error unless every category exists and,
+// unless the post is already in it, isn't archived
+func (db *DataBase) checkPostCategories(categoryIDs []int, current map[int]bool) (map[int]bool, error) {
+	wanted := make(map[int]bool, len(categoryIDs))
+	for _, id := range categoryIDs {
+		if wanted[id] {
+			continue
+		}
+		c, err := db.GetCategory(id)
+		if err != nil {
+			return nil, err
+		}
+		if c.Archived && !current[id] {
+			return nil, errors.New("cannot add a post to an archived category")
+		}
+		wanted[id] = true
+	}
+	return wanted, nil
+}
+
+// CreatePost stores a new post with its categories, images, attachments and
+// poll, if any, and returns its ID. status is PostPublished or PostDraft.
+func (db *DataBase) CreatePost(authorUUID, title, content, status string, flags ContentFlags, categoryIDs []int, images []ImageUpload, files []FileUpload, poll *PollInput) (int, error) {
+	wanted, err := db.checkPostCategories(categoryIDs, nil)
+	if err != nil {
+		return 0, err
+	}
+	if len(images) > MaxImagesPerPost {
+		return 0, fmt.Errorf("a post can have at most %d images", MaxImagesPerPost)
+	}
+
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		"INSERT INTO posts (title, content, author_uuid, created_at, status, nsfw, spoiler) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		title, content, authorUUID, Timestamp(), status, flags.NSFW, flags.Spoiler,
+	)
+	if err != nil {
+		return 0, err
+	}
+	id64, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	postID := int(id64)
+
+	for id := range wanted {
+		if _, err := tx.Exec("INSERT INTO post_categories (post_id, category_id) VALUES (?, ?)", postID, id); err != nil {
+			return 0, err
+		}
+	}
+	if err := savePostImages(tx, postID, images, authorUUID); err != nil {
+		return 0, err
+	}
+	if err := savePostAttachments(tx, postID, files, authorUUID); err != nil {
+		return 0, err
+	}
+	if err := savePoll(tx, postID, poll); err != nil {
+		return 0, err
+	}
+	if err := recordMentions(tx, postID, 0, authorUUID, content); err != nil {
+		return 0, err
+	}
+	return postID, tx.Commit()
+}
+
+// UpdatePost replaces a post's title, content, content flags and categories,
+// stamps it as edited and records what changed in its history. Archived categories can
+// be kept but not newly added. Drafts are saved without either, since no one
+// else has seen them yet.
+func (db *DataBase) UpdatePost(post *Post, title, content string, flags ContentFlags, categoryIDs []int, actorUUID string) error {
+	current := make(map[int]bool, len(post.Categories))
+	for _, c := range post.Categories {
+		current[c.ID] = true
+	}
+
+	wanted, err := db.checkPostCategories(categoryIDs, current)
+	if err != nil {
+		return err
+	}
+
+	var changed []string
+	if title != post.Title {
+		changed = append(changed, "title")
+	}
+	if content != post.Content {
+		changed = append(changed, "body")
+	}
+	if flags != post.ContentFlags {
+		changed = append(changed, "content warnings")
+	}
+	categoriesChanged := len(wanted) != len(current)
+	for id := range wanted {
+		if !current[id] {
+			categoriesChanged = true
+		}
+	}
+	if categoriesChanged {
+		changed = append(changed, "categories")
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	editedAt := Timestamp()
+	if post.IsDraft() {
+		editedAt = ""
+	}
+	// Revisions are taken before the update so the first one can keep the
+	// original version
+	if !post.IsDraft() && (title != post.Title || content != post.Content) {
+		if err := recordPostRevision(tx, post.ID, actorUUID, title, content); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(
+		"UPDATE posts SET title = ?, content = ?, nsfw = ?, spoiler = ?, edited_at = ? WHERE id = ?",
+		title, content, flags.NSFW, flags.Spoiler, editedAt, post.ID,
+	); err != nil {
+		return err
+	}
+	if content != post.Content {
+		if err := recordMentions(tx, post.ID, 0, post.Author.UUID, content); err != nil {
+			return err
+		}
+	}
+
+	if categoriesChanged {
+		if _, err := tx.Exec("DELETE FROM post_categories WHERE post_id = ?", post.ID); err != nil {
+			return err
+		}
+		for id := range wanted {
+			if _, err := tx.Exec("INSERT INTO post_categories (post_id, category_id) VALUES (?, ?)", post.ID, id); err != nil {
+				return err
+			}
+		}
+		// A post is only announced in categories it still belongs to
+		if _, err := tx.Exec(
+			`DELETE FROM category_announcements WHERE post_id = ?
+			AND category_id NOT IN (SELECT category_id FROM post_categories WHERE post_id = ?)`,
+			post.ID, post.ID,
+		); err != nil {
+			return err
+		}
+	}
+
+	if !post.IsDraft() {
+		if err := recordPostHistory(tx, post.ID, actorUUID, "edited", strings.Join(changed, ", ")); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// PublishPost publishes a draft. It is dated from publication rather than
+// from when the draft was started.
+func (db *DataBase) PublishPost(postID int, actorUUID string) error {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		"UPDATE posts SET status = ?, created_at = ? WHERE id = ? AND status = ?",
+		PostPublished, Timestamp(), postID, PostDraft,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("post is already published")
+	}
+	if err := recordPostHistory(tx, postID, actorUUID, "published", ""); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ListDrafts returns a user's unpublished posts, most recently started first
+func (db *DataBase) ListDrafts(uuid string) ([]Post, error) {
+	rows, err := db.Conn.Query(
+		"SELECT id, title FROM posts WHERE author_uuid = ? AND status = ? AND deleted_at = '' ORDER BY id DESC",
+		uuid, PostDraft,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var posts []Post
+	for rows.Next() {
+		p := Post{Status: PostDraft}
+		if err := rows.Scan(&p.ID, &p.Title); err != nil {
+			return nil, err
+		}
+		posts = append(posts, p)
+	}
+	return posts, rows.Err()
+}
+
+// servePostShare answers visitors without a session, such as the crawlers
+// that unfurl shared links: they get the post's title and excerpt in the
+// share metadata and a way in, but not the discussion itself
+func servePostShare(w http.ResponseWriter, r *http.Request, id int) {
+	post, err := db.GetPost(id)
+	if err == nil && post.IsMerged() {
+		if target, err := db.MergedInto(id); err == nil {
+			http.Redirect(w, r, "/post/"+strconv.Itoa(target), http.StatusFound)
+			return
+		}
+	}
+	if err != nil || post.IsDeleted() || post.IsDraft() || post.IsMerged() {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	images, err := db.ListPostImages(id)
+	if err != nil {
+		log.Println("Failed to load post images:", err)
+	}
+	InitTemplate(w, "templates/post_share.html", PostPageData{Post: post, Images: images, BaseURL: SiteURL})
+}
+
+// PostHandler handles GET /post/{id}. With ?fragment=comments only the
+// comment list is rendered.
+func PostHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		RenderError(w, "Post not found", http.StatusNotFound)
+		return
+	}
+
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		servePostShare(w, r, id)
+		return
+	}
+
+	post, err := db.GetPost(id)
+	if err != nil {
+		RenderError(w, "Post not found", http.StatusNotFound)
+		return
+	}
+
+	// Deleted posts leave a tombstone; their author and staff can restore them
+	if post.IsDeleted() {
+		InitTemplate(w, "templates/post_deleted.html", map[string]interface{}{
+			"ID":         post.ID,
+			"CanRestore": CanManagePost(user, post),
+			"DeletedAt":  post.DeletedAt.In(db.GetLocationPreference(user.UUID)),
+		})
+		return
+	}
+
+	// Drafts are edited, not viewed, and only by their author
+	if post.IsDraft() {
+		if post.Author.UUID != user.UUID {
+			RenderError(w, "Post not found", http.StatusNotFound)
+			return
+		}
+		http.Redirect(w, r, "/post/edit?id="+strconv.Itoa(post.ID), http.StatusSeeOther)
+		return
+	}
+
+	// Merged posts send readers on to the post they were merged into
+	if post.IsMerged() {
+		target, err := db.MergedInto(post.ID)
+		if err != nil {
+			RenderError(w, "Post not found", http.StatusNotFound)
+			return
+		}
+		http.Redirect(w, r, "/post/"+strconv.Itoa(target), http.StatusFound)
+		return
+	}
+
+	renderPostPage(w, r, user, post, CommentForm{}, http.StatusOK)
+}
+
+// renderPostPage shows a published post to user. A non-200 status is used
+// to redisplay a comment that was turned away, with form holding it.
+func renderPostPage(w http.ResponseWriter, r *http.Request, user *User, post *Post, form CommentForm, status int) {
+	id := post.ID
+	data := PostPageData{
+		Post:          post,
+		CanManage:     CanManagePost(user, post),
+		CanEdit:       CanEditPost(user, post) && !post.IsArchived(),
+		CanComment:    !user.NotRegistered && !post.IsLocked(),
+		CanLock:       db.CanLockPost(user, post),
+		CommentForm:   form,
+		CommentLength: CommentLength,
+		Outline:       OutlinePost(post.ID, post.Content),
+		BaseURL:       SiteURL,
+		ViewerUUID:    user.UUID,
+	}
+	var err error
+	if !user.NotRegistered {
+		data.CanReport = user.UUID != post.Author.UUID
+		data.ReportReasons = ReportReasons
+	}
+	if data.CanComment && form.Content == "" {
+		if data.CommentForm.Content, err = db.GetCommentDraft(id, user.UUID); err != nil {
+			RenderError(w, "Failed to load post", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	page, sort := PageFromRequest(r), CommentSortFromRequest(r)
+	commentID, err := strconv.Atoi(r.URL.Query().Get("comment"))
+	if err == nil {
+		if page, err = db.CommentPageOf(id, commentID, sort); err != nil {
+			RenderError(w, "Failed to load post", http.StatusInternalServerError)
+			return
+		}
+	}
+	if data.Comments, err = db.LoadCommentPage(id, page, sort); err != nil {
+		RenderError(w, "Failed to load post", http.StatusInternalServerError)
+		return
+	}
+	// Deep replies are collapsed, except in the thread of a linked comment
+	data.Comments.Comments = collapseReplies(data.Comments.Comments, commentID)
+	comments := data.Comments.Comments
+	data.CanAccept = post.IsQuestion() && user.UUID == post.Author.UUID && !post.IsArchived()
+	if post.AcceptedCommentID != 0 {
+		answer, err := db.GetComment(post.AcceptedCommentID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			RenderError(w, "Failed to load post", http.StatusInternalServerError)
+			return
+		}
+		// A merge that was undone can leave the answer on another post
+		if answer != nil && answer.Post.ID == id && (!answer.IsHidden() || db.CanSeeHiddenComment(user, post, answer)) {
+			data.AcceptedAnswer = answer
+		}
+		for i := range comments {
+			comments[i].Accepted = comments[i].ID == post.AcceptedCommentID
+		}
+	}
+	emoji, err := db.PostReactions(id, user.UUID)
+	if err != nil {
+		RenderError(w, "Failed to load post", http.StatusInternalServerError)
+		return
+	}
+	data.EmojiReactions = reactionsOrEmpty(emoji[0])
+	for i := range comments {
+		// Hidden comments keep their place for everyone else, like deleted ones
+		if comments[i].IsHidden() && !data.CanLock && comments[i].Author.UUID != user.UUID {
+			comments[i].Content = ""
+		}
+		comments[i].EmojiReactions = reactionsOrEmpty(emoji[comments[i].ID])
+		comments[i].CanEdit = CanEditComment(user, &comments[i]) && !post.IsArchived()
+	}
+	if data.CanReact = !user.NotRegistered && !post.IsArchived(); data.CanReact {
+		reactions, err := db.CommentReactions(id, user.UUID)
+		if err != nil {
+			RenderError(w, "Failed to load post", http.StatusInternalServerError)
+			return
+		}
+		for i := range comments {
+			comments[i].Reaction = reactions[comments[i].ID]
+		}
+	}
+	if data.Images, err = db.ListPostImages(id); err != nil {
+		RenderError(w, "Failed to load post", http.StatusInternalServerError)
+		return
+	}
+	if data.History, err = db.ListPostHistory(id); err != nil {
+		RenderError(w, "Failed to load post", http.StatusInternalServerError)
+		return
+	}
+	if data.Summary, err = db.GetThreadSummary(id); err != nil {
+		RenderError(w, "Failed to load post", http.StatusInternalServerError)
+		return
+	}
+	if data.Poll, err = db.GetPoll(id, user.UUID); err != nil {
+		RenderError(w, "Failed to load post", http.StatusInternalServerError)
+		return
+	}
+	if data.Poll != nil {
+		data.CanVote = !user.NotRegistered && !data.Poll.Closed() && !post.IsArchived()
+	}
+	if len(post.Categories) > 0 {
+		if data.Breadcrumbs, err = db.CategoryPath(post.Categories[0].ID); err != nil {
+			RenderError(w, "Failed to load post", http.StatusInternalServerError)
+			return
+		}
+	}
+	loc := db.GetLocationPreference(user.UUID)
+	post.EditedAt = post.EditedAt.In(loc)
+	if data.Poll != nil {
+		data.Poll.ClosesAt = data.Poll.ClosesAt.In(loc)
+	}
+	for i := range comments {
+		comments[i].CreatedAt = comments[i].CreatedAt.In(loc)
+	}
+	// ?fragment=comments returns just a page of comments, for refreshing
+	// them or loading more in place
+	if r.URL.Query().Get("fragment") == "comments" {
+		RenderPartial(w, "comment_list", map[string]interface{}{
+			"Comments": comments, "CanReply": data.CanComment, "CanReact": data.CanReact, "CanAccept": data.CanAccept,
+			"ReportReasons": data.ReportReasons, "Viewer": data.ViewerUUID, "Sort": data.Comments.Sort, "CanHide": data.CanLock,
+		})
+		return
+	}
+	if status == http.StatusOK {
+		RecordPostView(post.ID, user.UUID)
+	}
+	if data.LinkPreviews, err = db.PostLinkPreviews(post); err != nil {
+		// Previews are extras; the post reads fine without them
+		log.Printf("Failed to load link previews of post %d: %v", id, err)
+	}
+	if data.CanManage {
+		if data.LinkClicks, err = db.ListLinkClicks(post.ID); err != nil {
+			RenderError(w, "Failed to load post", http.StatusInternalServerError)
+			return
+		}
+	}
+	for i := range data.History {
+		data.History[i].CreatedAt = data.History[i].CreatedAt.In(loc)
+	}
+	if TranslationEnabled() {
+		data.Languages = TranslationLanguages
+		if lang := r.URL.Query().Get("translate"); lang != "" {
+			// A failed translation shouldn't keep readers from the original
+			if data.Translation, err = db.TranslatePost(post, lang); err != nil {
+				log.Printf("Failed to translate post %d: %v", id, err)
+				data.TranslationError = "Translation failed, showing the original."
+			}
+		}
+	}
+	if data.Announcements, err = db.ListAnnouncementOptions(user, post); err != nil {
+		RenderError(w, "Failed to load post", http.StatusInternalServerError)
+		return
+	}
+	if data.Pins, err = db.ListPinOptions(user, post); err != nil {
+		RenderError(w, "Failed to load post", http.StatusInternalServerError)
+		return
+	}
+	if data.CanBookmark = !user.NotRegistered; data.CanBookmark {
+		if data.Bookmarked, err = db.IsBookmarked(user.UUID, post.ID); err != nil {
+			RenderError(w, "Failed to load post", http.StatusInternalServerError)
+			return
+		}
+		if data.Watching, err = db.IsWatching(post, user.UUID); err != nil {
+			RenderError(w, "Failed to load post", http.StatusInternalServerError)
+			return
+		}
+	}
+	if data.CanManage {
+		if data.Bookmarks, err = db.CountBookmarks(post.ID); err != nil {
+			RenderError(w, "Failed to load post", http.StatusInternalServerError)
+			return
+		}
+		if data.CoAuthors, err = db.ListCoAuthors(post.ID); err != nil {
+			RenderError(w, "Failed to load post", http.StatusInternalServerError)
+			return
+		}
+	}
+	// Related posts are a nicety; the page is shown without them on error
+	if data.Related, err = db.RelatedPosts(post, RelatedPostsLimit); err != nil {
+		log.Printf("Failed to find posts related to %d: %v", post.ID, err)
+	}
+	if user.IsStaff() {
+		if data.Snippets, err = db.ListSnippets(); err != nil {
+			RenderError(w, "Failed to load post", http.StatusInternalServerError)
+			return
+		}
+	}
+	if data.CanMerge = user.IsStaff(); data.CanMerge {
+		if data.Merges, err = db.ListMergesInto(post.ID); err != nil {
+			RenderError(w, "Failed to load post", http.StatusInternalServerError)
+			return
+		}
+		for i := range data.Merges {
+			data.Merges[i].CreatedAt = data.Merges[i].CreatedAt.In(loc)
+		}
+	}
+	if data.MoveFrom = db.ListMoveSources(user, post); len(data.MoveFrom) > 0 {
+		// Only active categories are offered as move targets
+		if data.Categories, err = db.ListCategories(false); err != nil {
+			RenderError(w, "Failed to load post", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if status != http.StatusOK {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+	}
+	InitTemplate(w, "templates/post.html", data)
+}
+
+// MovePostHandler handles POST /post/move
+func MovePostHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	postID, err := strconv.Atoi(r.FormValue("post_id"))
+	if err != nil {
+		RenderError(w, "Invalid post", http.StatusBadRequest)
+		return
+	}
+	post, err := db.GetPost(postID)
+	if err != nil {
+		RenderError(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	if post.IsDeleted() {
+		RenderError(w, "Restore the post before moving it", http.StatusBadRequest)
+		return
+	}
+
+	from, err1 := strconv.Atoi(r.FormValue("from"))
+	to, err2 := strconv.Atoi(r.FormValue("to"))
+	if err1 != nil || err2 != nil {
+		RenderError(w, "Invalid categories", http.StatusBadRequest)
+		return
+	}
+	if !db.CanMovePost(user, post, from) {
+		RenderError(w, "You can't move this post", http.StatusForbidden)
+		return
+	}
+
+	if err := db.MovePost(postID, from, to, user.UUID, r.FormValue("notice") == "on"); err != nil {
+		RenderError(w, "Move failed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/post/"+strconv.Itoa(postID), http.StatusSeeOther)
+}
+
+// maxPostFormBytes bounds a post form submission, uploads included
+const maxPostFormBytes = MaxImagesPerPost*MaxImageBytes + MaxPostAttachmentBytes + 1<<20
+
+// postSubmission holds what a post form carries besides the title and body
+type postSubmission struct {
+	// draft is set when the author saves rather than publishes
+	draft       bool
+	categoryIDs []int
+	images      []ImageUpload
+	files       []FileUpload
+	// poll is nil when no poll was filled in
+	poll *PollInput
+}
+
+// renderPostForm shows the post form. Categories offered are the active ones
+// plus any archived ones already selected. A non-200 status is used to
+// redisplay a submission that was turned away.
+func renderPostForm(w http.ResponseWriter, data PostFormData, status int) {
+	all, err := db.ListCategories(true)
+	if err != nil {
+		RenderError(w, "Failed to load categories", http.StatusInternalServerError)
+		return
+	}
+	for _, c := range all {
+		if !c.Archived || data.Selected[c.ID] {
+			data.Categories = append(data.Categories, c)
+		}
+	}
+	data.MaxImages = MaxImagesPerPost
+	data.TitleLength, data.BodyLength = TitleLength, BodyLength
+	data.MaxPollOptions = MaxPollOptions
+
+	if status != http.StatusOK {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+	}
+	InitTemplate(w, "templates/post_edit.html", data)
+}
+
+// readPostForm reads a submitted post form into data, returning the rest of
+// the submission or an error to show on the form. loc is the author's
+// timezone, which the poll closing time is given in.
+func readPostForm(w http.ResponseWriter, r *http.Request, data *PostFormData, loc *time.Location) (*postSubmission, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxPostFormBytes)
+	if err := r.ParseMultipartForm(8 << 20); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		return nil, errors.New("the upload is too large")
+	}
+
+	data.Post.Title = strings.TrimSpace(r.FormValue("title"))
+	data.Post.Content = strings.TrimSpace(r.FormValue("content"))
+	data.Post.NSFW = r.FormValue("nsfw") == "on"
+	data.Post.Spoiler = r.FormValue("spoiler") == "on"
+
+	data.Selected = make(map[int]bool)
+	sub := &postSubmission{draft: r.FormValue("action") == "draft"}
+	for _, v := range r.Form["categories"] {
+		cid, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, errors.New("invalid category")
+		}
+		sub.categoryIDs = append(sub.categoryIDs, cid)
+		data.Selected[cid] = true
+	}
+
+	// Drafts may be unfinished, but need a title to find them by
+	if err := TitleLength.Check(data.Post.Title); err != nil {
+		return nil, err
+	}
+	if sub.draft {
+		if err := BodyLength.CheckMax(data.Post.Content); err != nil {
+			return nil, err
+		}
+	} else if err := BodyLength.Check(data.Post.Content); err != nil {
+		return nil, err
+	}
+	// Posts are held to their categories' templates when published, not
+	// when edited later, so templates added since don't block edits
+	if !sub.draft && (data.Post.ID == 0 || data.Post.IsDraft()) {
+		if err := db.checkPostTemplates(sub.categoryIDs, data.Post.Content); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if sub.images, err = ReadImageUploads(r, "images"); err != nil {
+		return nil, err
+	}
+	if sub.files, err = ReadFileUploads(r, "attachments"); err != nil {
+		return nil, err
+	}
+	if !data.HasPoll {
+		sub.poll, err = readPollForm(r, loc)
+		data.Poll = sub.poll
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sub, nil
+}
+
+// formIDs reads the integer values submitted for a form field, skipping
+// any that aren't numbers
+func formIDs(r *http.Request, field string) []int {
+	var ids []int
+	for _, v := range r.Form[field] {
+		if id, err := strconv.Atoi(v); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// NewPostHandler handles GET and POST /post/new
+func NewPostHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if user.NotRegistered {
+		RenderError(w, "Guests can't post; register to start a discussion", http.StatusForbidden)
+		return
+	}
+
+	data := PostFormData{Post: &Post{}, Selected: make(map[int]bool)}
+
+	switch r.Method {
+	case http.MethodGet:
+		// Opened from a category, the form starts from its post template
+		if id, err := strconv.Atoi(r.URL.Query().Get("category")); err == nil {
+			data.Selected[id] = true
+			t, err := db.GetPostTemplate(id)
+			if err != nil {
+				RenderError(w, "Failed to load the post template", http.StatusInternalServerError)
+				return
+			}
+			if t != nil {
+				data.Post.Content = t.Body
+			}
+		}
+		renderPostForm(w, data, http.StatusOK)
+
+	case http.MethodPost:
+		sub, err := readPostForm(w, r, &data, db.GetLocationPreference(user.UUID))
+		if err != nil {
+			data.Error = "Couldn't save the post: " + err.Error()
+			renderPostForm(w, data, http.StatusBadRequest)
+			return
+		}
+
+		status := PostPublished
+		if sub.draft {
+			status = PostDraft
+		}
+		id, err := db.CreatePost(user.UUID, data.Post.Title, data.Post.Content, status, data.Post.ContentFlags, sub.categoryIDs, sub.images, sub.files, sub.poll)
+		if err != nil {
+			data.Error = "Couldn't save the post: " + err.Error()
+			renderPostForm(w, data, http.StatusBadRequest)
+			return
+		}
+		if sub.draft {
+			http.Redirect(w, r, "/drafts", http.StatusSeeOther)
+			return
+		}
+		http.Redirect(w, r, "/post/"+strconv.Itoa(id), http.StatusSeeOther)
+
+	default:
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// EditPostHandler handles GET and POST /post/edit?id=
+func EditPostHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		RenderError(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	post, err := db.GetPost(id)
+	if err != nil {
+		RenderError(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	if !CanEditPost(user, post) {
+		if post.IsDraft() {
+			RenderError(w, "Post not found", http.StatusNotFound)
+			return
+		}
+		RenderError(w, "You can't edit this post", http.StatusForbidden)
+		return
+	}
+	if post.IsDeleted() {
+		RenderError(w, "Restore the post before editing it", http.StatusBadRequest)
+		return
+	}
+	if post.IsMerged() {
+		RenderError(w, "Undo the merge before editing the post", http.StatusBadRequest)
+		return
+	}
+	if post.IsArchived() {
+		RenderError(w, "Archived posts are read-only; a moderator can unlock it", http.StatusBadRequest)
+		return
+	}
+
+	data := PostFormData{Selected: make(map[int]bool)}
+	for _, c := range post.Categories {
+		data.Selected[c.ID] = true
+	}
+	if data.Images, err = db.ListPostImages(post.ID); err != nil {
+		RenderError(w, "Failed to load post", http.StatusInternalServerError)
+		return
+	}
+	if data.HasPoll, err = db.HasPoll(post.ID); err != nil {
+		RenderError(w, "Failed to load post", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		data.Post = post
+		renderPostForm(w, data, http.StatusOK)
+
+	case http.MethodPost:
+		// Edit a copy so a rejected form shows what was submitted
+		edited := *post
+		data.Post = &edited
+		sub, err := readPostForm(w, r, &data, db.GetLocationPreference(user.UUID))
+		if err != nil {
+			data.Error = "Couldn't save the post: " + err.Error()
+			renderPostForm(w, data, http.StatusBadRequest)
+			return
+		}
+
+		removeImages := formIDs(r, "remove_images")
+		if len(data.Images)-len(removeImages)+len(sub.images) > MaxImagesPerPost {
+			data.Error = fmt.Sprintf("Couldn't save the post: it can have at most %d images", MaxImagesPerPost)
+			renderPostForm(w, data, http.StatusBadRequest)
+			return
+		}
+
+		if err := db.UpdatePost(post, edited.Title, edited.Content, edited.ContentFlags, sub.categoryIDs, user.UUID); err != nil {
+			data.Error = "Couldn't save the post: " + err.Error()
+			renderPostForm(w, data, http.StatusBadRequest)
+			return
+		}
+		if err := db.UpdatePostImages(post.ID, sub.images, removeImages, user.UUID); err != nil {
+			data.Error = "Your changes were saved, but the images weren't: " + err.Error()
+			renderPostForm(w, data, http.StatusBadRequest)
+			return
+		}
+		if err := db.UpdatePostAttachments(post.ID, sub.files, formIDs(r, "remove_attachments"), user.UUID); err != nil {
+			data.Error = "Your changes were saved, but the attachments weren't: " + err.Error()
+			renderPostForm(w, data, http.StatusBadRequest)
+			return
+		}
+		if err := db.AddPoll(post.ID, sub.poll); err != nil {
+			data.Error = "Your changes were saved, but the poll wasn't: " + err.Error()
+			renderPostForm(w, data, http.StatusBadRequest)
+			return
+		}
+		if post.IsDraft() {
+			if sub.draft {
+				http.Redirect(w, r, "/drafts", http.StatusSeeOther)
+				return
+			}
+			if err := db.PublishPost(post.ID, user.UUID); err != nil {
+				data.Error = "Your draft was saved, but not published: " + err.Error()
+				renderPostForm(w, data, http.StatusBadRequest)
+				return
+			}
+		}
+		http.Redirect(w, r, "/post/"+strconv.Itoa(post.ID), http.StatusSeeOther)
+
+	default:
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// DraftsHandler handles GET /drafts
+func DraftsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	drafts, err := db.ListDrafts(user.UUID)
+	if err != nil {
+		RenderError(w, "Failed to load drafts", http.StatusInternalServerError)
+		return
+	}
+	InitTemplate(w, "templates/drafts.html", map[string]interface{}{"Drafts": drafts})
+}
@@ -0,0 +1,289 @@
+package utils
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"forum/internal/notify"
+)
+
+// Preference keys stored in user_preferences
+const (
+	PrefTheme              = "theme"
+	PrefTimezone           = "timezone"
+	PrefShowGravatar       = "show_gravatar"
+	PrefShowActivity       = "show_activity"
+	PrefShowOnline         = "show_online"
+	PrefShowLiked          = "show_liked"
+	PrefModDigest          = "mod_digest"
+	PrefShowFlagged        = "show_flagged"
+	PrefWatchOwnPosts      = "watch_own_posts"
+	PrefWatchCommented     = "watch_commented"
+	PrefNotificationDigest = "notification_digest"
+)
+
+// Themes a user can pick on the settings page
+var Themes = []string{"system", "light", "dark"}
+
+// preferenceDefaults holds the value of every known key for users who never set it.
+// A key must be listed here to be stored at all.
+var preferenceDefaults = map[string]string{
+	PrefTheme:              "system",
+	PrefTimezone:           "UTC",
+	PrefShowGravatar:       "true",
+	PrefShowActivity:       "true",
+	PrefShowOnline:         "true",
+	PrefShowLiked:          "true",
+	PrefModDigest:          DigestDaily,
+	PrefShowFlagged:        "false",
+	PrefWatchOwnPosts:      "true",
+	PrefWatchCommented:     "true",
+	PrefNotificationDigest: DigestOff,
+
+	// How each kind of notification is delivered, see notify.Channel
+	notify.Comment.PreferenceKey(): string(notify.InApp),
+	notify.Reply.PreferenceKey():   string(notify.InApp),
+	notify.Watch.PreferenceKey():   string(notify.Email),
+	notify.Like.PreferenceKey():    string(notify.InApp),
+	notify.Mention.PreferenceKey(): string(notify.InApp),
+}
+
+// preferenceMigrations carry choices stored under preferences that were
+// replaced over to the ones replacing them. Users who stored From with
+// FromValue get To set to ToValue, unless they already set To, and From
+// is dropped for everyone.
+var preferenceMigrations = []struct {
+	From, FromValue string
+	To, ToValue     string
+}{
+	// Watched threads were emailed unless email notifications were off
+	{"email_notifications", "false", notify.Watch.PreferenceKey(), string(notify.InApp)},
+	// Mentions could only be turned off altogether
+	{"allow_mentions", "false", notify.Mention.PreferenceKey(), string(notify.Off)},
+}
+
+// MigratePreferences applies preferenceMigrations
+func (db *DataBase) MigratePreferences() error {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, m := range preferenceMigrations {
+		_, err := tx.Exec(
+			`INSERT OR IGNORE INTO user_preferences (user_uuid, key, value)
+			SELECT user_uuid, ?, ? FROM user_preferences WHERE key = ? AND value = ?`,
+			m.To, m.ToValue, m.From, m.FromValue,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to migrate preference %s: %w", m.From, err)
+		}
+		if _, err := tx.Exec("DELETE FROM user_preferences WHERE key = ?", m.From); err != nil {
+			return fmt.Errorf("failed to migrate preference %s: %w", m.From, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// validatePreference checks a value before it is stored
+func validatePreference(key, value string) error {
+	def, known := preferenceDefaults[key]
+	if !known {
+		return fmt.Errorf("unknown preference %q", key)
+	}
+
+	switch key {
+	case PrefTheme:
+		for _, t := range Themes {
+			if value == t {
+				return nil
+			}
+		}
+		return fmt.Errorf("unknown theme %q", value)
+	case PrefModDigest, PrefNotificationDigest:
+		for _, f := range DigestFrequencies {
+			if value == f {
+				return nil
+			}
+		}
+		return fmt.Errorf("unknown digest frequency %q", value)
+	case PrefTimezone:
+		if _, err := time.LoadLocation(value); err != nil {
+			return fmt.Errorf("unknown timezone %q", value)
+		}
+		return nil
+	case notify.Comment.PreferenceKey(), notify.Reply.PreferenceKey(), notify.Watch.PreferenceKey(),
+		notify.Like.PreferenceKey(), notify.Mention.PreferenceKey():
+		if !slices.Contains(notify.Channels, notify.Channel(value)) {
+			return fmt.Errorf("unknown notification channel %q", value)
+		}
+		return nil
+	}
+
+	// Boolean preferences are recognised by their default
+	if def == "true" || def == "false" {
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("%s must be true or false", key)
+		}
+	}
+	return nil
+}
+
+// GetPreference returns a user's value for key, or the key's default
+func (db *DataBase) GetPreference(uuid, key string) (string, error) {
+	def, known := preferenceDefaults[key]
+	if !known {
+		return "", fmt.Errorf("unknown preference %q", key)
+	}
+
+	var value string
+	err := db.Conn.QueryRow(
+		"SELECT value FROM user_preferences WHERE user_uuid = ? AND key = ?", uuid, key,
+	).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return def, nil
+	}
+	if err != nil {
+		return def, err
+	}
+	return value, nil
+}
+
+// GetBoolPreference returns a boolean preference
+func (db *DataBase) GetBoolPreference(uuid, key string) (bool, error) {
+	value, err := db.GetPreference(uuid, key)
+	if err != nil {
+		return false, err
+	}
+	return strconv.ParseBool(value)
+}
+
+// GetLocationPreference returns the user's timezone, falling back to UTC
+func (db *DataBase) GetLocationPreference(uuid string) *time.Location {
+	value, err := db.GetPreference(uuid, PrefTimezone)
+	if err != nil {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(value)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// GetPreferences returns every known preference for a user, defaults included
+func (db *DataBase) GetPreferences(uuid string) (map[string]string, error) {
+	prefs := make(map[string]string, len(preferenceDefaults))
+	for k, v := range preferenceDefaults {
+		prefs[k] = v
+	}
+
+	rows, err := db.Conn.Query("SELECT key, value FROM user_preferences WHERE user_uuid = ?", uuid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		// Ignore keys that are no longer known
+		if _, known := preferenceDefaults[key]; known {
+			prefs[key] = value
+		}
+	}
+	return prefs, rows.Err()
+}
+
+// SetPreference validates and stores a preference
+func (db *DataBase) SetPreference(uuid, key, value string) error {
+	if err := validatePreference(key, value); err != nil {
+		return err
+	}
+
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	_, err := db.Conn.Exec(
+		`INSERT INTO user_preferences (user_uuid, key, value) VALUES (?, ?, ?)
+		ON CONFLICT(user_uuid, key) DO UPDATE SET value = excluded.value`,
+		uuid, key, value,
+	)
+	return err
+}
+
+// SetBoolPreference stores a boolean preference
+func (db *DataBase) SetBoolPreference(uuid, key string, value bool) error {
+	return db.SetPreference(uuid, key, strconv.FormatBool(value))
+}
+
+// SettingsHandler handles GET and POST /settings
+func SettingsHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if user.NotRegistered {
+		RenderError(w, "Guests have no settings", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		prefs, err := db.GetPreferences(user.UUID)
+		if err != nil {
+			RenderError(w, "Failed to load settings", http.StatusInternalServerError)
+			return
+		}
+		data := map[string]interface{}{
+			"Prefs":  prefs,
+			"Themes": Themes,
+		}
+		// Only staff are sent the moderation digest
+		if user.IsStaff() {
+			data["DigestFrequencies"] = DigestFrequencies
+		}
+		InitTemplate(w, "templates/settings.html", data)
+
+	case http.MethodPost:
+		values := map[string]string{
+			PrefTheme:          r.FormValue("theme"),
+			PrefTimezone:       r.FormValue("timezone"),
+			PrefShowFlagged:    strconv.FormatBool(r.FormValue("show_flagged") == "on"),
+			PrefWatchOwnPosts:  strconv.FormatBool(r.FormValue("watch_own_posts") == "on"),
+			PrefWatchCommented: strconv.FormatBool(r.FormValue("watch_commented") == "on"),
+		}
+		if user.IsStaff() {
+			values[PrefModDigest] = r.FormValue("mod_digest")
+		}
+		// Validate everything before storing anything
+		for key, value := range values {
+			if err := validatePreference(key, value); err != nil {
+				RenderError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		for key, value := range values {
+			if err := db.SetPreference(user.UUID, key, value); err != nil {
+				RenderError(w, "Failed to save settings", http.StatusInternalServerError)
+				return
+			}
+		}
+		http.Redirect(w, r, "/settings", http.StatusSeeOther)
+
+	default:
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,34 @@
+package utils
+
+import "net/http"
+
+// maxPreviewBytes bounds the Markdown sent to PreviewHandler
+const maxPreviewBytes = 1 << 20
+
+// PreviewHandler handles POST /post/preview. It renders the content field
+// exactly as a saved post would be, or a comment when kind is "comment",
+// and returns the HTML fragment, for the preview on post and comment forms.
+func PreviewHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, err := CurrentUser(w, r); err != nil {
+		RenderError(w, "Log in to preview posts", http.StatusUnauthorized)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxPreviewBytes)
+	if err := r.ParseForm(); err != nil {
+		RenderError(w, "Preview is too long", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	render := RenderMarkdown
+	if r.PostFormValue("kind") == "comment" {
+		render = RenderCommentMarkdown
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(render(r.PostFormValue("content"))))
+}
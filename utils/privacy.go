@@ -0,0 +1,87 @@
+package utils
+
+import "net/http"
+
+// DefaultPrivacySettings is what the owner and staff see: everything
+var DefaultPrivacySettings = PrivacySettings{
+	ShowGravatar: true,
+	ShowActivity: true,
+	ShowOnline:   true,
+	ShowLiked:    true,
+}
+
+// privacyFields maps each privacy setting to its preference key
+func privacyFields(s *PrivacySettings) map[string]*bool {
+	return map[string]*bool{
+		PrefShowGravatar: &s.ShowGravatar,
+		PrefShowActivity: &s.ShowActivity,
+		PrefShowOnline:   &s.ShowOnline,
+		PrefShowLiked:    &s.ShowLiked,
+	}
+}
+
+// GetPrivacySettings loads a user's privacy settings from their preferences
+func (db *DataBase) GetPrivacySettings(uuid string) (PrivacySettings, error) {
+	var s PrivacySettings
+	for key, field := range privacyFields(&s) {
+		value, err := db.GetBoolPreference(uuid, key)
+		if err != nil {
+			return DefaultPrivacySettings, err
+		}
+		*field = value
+	}
+	return s, nil
+}
+
+// SavePrivacySettings stores a user's privacy settings as preferences
+func (db *DataBase) SavePrivacySettings(uuid string, s PrivacySettings) error {
+	for key, field := range privacyFields(&s) {
+		if err := db.SetBoolPreference(uuid, key, *field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PrivacySettingsHandler handles GET and POST /settings/privacy
+func PrivacySettingsHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if user.NotRegistered {
+		RenderError(w, "Guests have no profile settings", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		settings, err := db.GetPrivacySettings(user.UUID)
+		if err != nil {
+			RenderError(w, "Failed to load settings", http.StatusInternalServerError)
+			return
+		}
+		InitTemplate(w, "templates/privacy.html", map[string]interface{}{
+			"Username": user.Username,
+			"Settings": settings,
+		})
+
+	case http.MethodPost:
+		// Unchecked checkboxes are not submitted at all
+		settings := PrivacySettings{
+			ShowGravatar: r.FormValue("show_gravatar") == "on",
+			ShowActivity: r.FormValue("show_activity") == "on",
+			ShowOnline:   r.FormValue("show_online") == "on",
+			ShowLiked:    r.FormValue("show_liked") == "on",
+		}
+		if err := db.SavePrivacySettings(user.UUID, settings); err != nil {
+			RenderError(w, "Failed to save settings", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/settings/privacy", http.StatusSeeOther)
+
+	default:
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,187 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// OnlineWindow is how recently a user must have been seen to show as online
+const OnlineWindow = 5 * time.Minute
+
+// ProfileActivityLimit caps the posts/comments/likes listed on a profile
+const ProfileActivityLimit = 10
+
+// ProfileData is passed to the profile template.
+// Fields hidden by the user's privacy settings are left empty.
+type ProfileData struct {
+	Username     string
+	IsOwner      bool
+	ViewerIsMod  bool
+	Avatar       string
+	ShowOnline   bool
+	Online       bool
+	ShowActivity bool
+	Posts        []Post
+	Comments     []Comment
+	ShowLiked    bool
+	LikedPosts   []Post
+	// HasFeed is whether the user's posts are published as a feed, which
+	// follows their own setting whoever is looking
+	HasFeed bool
+	Karma   int
+}
+
+// GravatarURL returns the gravatar image URL for an email address
+func GravatarURL(email string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return "https://www.gravatar.com/avatar/" + hex.EncodeToString(sum[:]) + "?d=identicon"
+}
+
+// IsOnline reports whether a logged-in user was seen within OnlineWindow
+func IsOnline(u *User) bool {
+	return u.LoggedIn && Now().Sub(u.Lastseen) < OnlineWindow
+}
+
+// ListUserPosts returns the most recent posts written by a user
+func (db *DataBase) ListUserPosts(uuid string, limit int) ([]Post, error) {
+	rows, err := db.Conn.Query(
+		"SELECT id, title FROM posts WHERE author_uuid = ? AND deleted_at = '' AND status = 'published' ORDER BY id DESC LIMIT ?",
+		uuid, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var posts []Post
+	for rows.Next() {
+		var p Post
+		if err := rows.Scan(&p.ID, &p.Title); err != nil {
+			return nil, err
+		}
+		posts = append(posts, p)
+	}
+	return posts, rows.Err()
+}
+
+// ListUserComments returns the most recent comments written by a user,
+// along with the title of the post they belong to
+func (db *DataBase) ListUserComments(uuid string, limit int) ([]Comment, error) {
+	rows, err := db.Conn.Query(
+		`SELECT c.id, c.content, p.id, p.title
+		FROM comments c JOIN posts p ON p.id = c.post_id
+		WHERE c.comment_author_uuid = ? AND c.deleted_at = '' AND c.hidden_at = '' AND p.deleted_at = '' AND p.status = 'published'
+		ORDER BY c.id DESC LIMIT ?`,
+		uuid, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var comments []Comment
+	for rows.Next() {
+		var c Comment
+		if err := rows.Scan(&c.ID, &c.Content, &c.Post.ID, &c.Post.Title); err != nil {
+			return nil, err
+		}
+		comments = append(comments, c)
+	}
+	return comments, rows.Err()
+}
+
+// ListLikedPosts returns the most recent posts a user liked
+func (db *DataBase) ListLikedPosts(uuid string, limit int) ([]Post, error) {
+	rows, err := db.Conn.Query(
+		`SELECT p.id, p.title
+		FROM interactions i JOIN posts p ON p.id = i.post_id
+		WHERE i.user_uuid = ? AND i.liked = 1 AND p.deleted_at = '' AND p.status = 'published'
+		ORDER BY i.id DESC LIMIT ?`,
+		uuid, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var posts []Post
+	for rows.Next() {
+		var p Post
+		if err := rows.Scan(&p.ID, &p.Title); err != nil {
+			return nil, err
+		}
+		posts = append(posts, p)
+	}
+	return posts, rows.Err()
+}
+
+// ProfileHandler handles GET /user/{username}
+// The owner and staff always see the full profile; everyone else only sees
+// what the profile's privacy settings allow.
+func ProfileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	viewer, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	user, err := db.GetUserByUsername(r.PathValue("username"))
+	if err != nil {
+		RenderError(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	settings, err := db.GetPrivacySettings(user.UUID)
+	if err != nil {
+		RenderError(w, "Failed to load profile", http.StatusInternalServerError)
+		return
+	}
+
+	data := ProfileData{
+		Username:    user.Username,
+		IsOwner:     viewer.UUID == user.UUID,
+		ViewerIsMod: viewer.IsStaff(),
+		HasFeed:     settings.ShowActivity,
+	}
+	if data.IsOwner || data.ViewerIsMod {
+		settings = DefaultPrivacySettings
+	}
+
+	if data.Karma, err = db.UserKarma(user.UUID); err != nil {
+		RenderError(w, "Failed to load profile", http.StatusInternalServerError)
+		return
+	}
+	data.Avatar = AvatarURL(user.AvatarKey, user.Email, settings.ShowGravatar)
+	if settings.ShowOnline {
+		data.ShowOnline = true
+		data.Online = IsOnline(user)
+	}
+	if settings.ShowActivity {
+		data.ShowActivity = true
+		if data.Posts, err = db.ListUserPosts(user.UUID, ProfileActivityLimit); err != nil {
+			RenderError(w, "Failed to load profile", http.StatusInternalServerError)
+			return
+		}
+		if data.Comments, err = db.ListUserComments(user.UUID, ProfileActivityLimit); err != nil {
+			RenderError(w, "Failed to load profile", http.StatusInternalServerError)
+			return
+		}
+	}
+	if settings.ShowLiked {
+		data.ShowLiked = true
+		if data.LikedPosts, err = db.ListLikedPosts(user.UUID, ProfileActivityLimit); err != nil {
+			RenderError(w, "Failed to load profile", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	InitTemplate(w, "templates/profile.html", data)
+}
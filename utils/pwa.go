@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// SiteName is the name the forum is installed under on a device
+const SiteName = "ForumHub"
+
+// ThemeColor colours the browser UI around the installed app
+const ThemeColor = "#6366f1"
+
+// manifestIcon describes one icon in the web app manifest
+type manifestIcon struct {
+	Src     string `json:"src"`
+	Sizes   string `json:"sizes"`
+	Type    string `json:"type"`
+	Purpose string `json:"purpose,omitempty"`
+}
+
+// webManifest is the web app manifest that makes the forum installable
+var webManifest = map[string]interface{}{
+	"name":             SiteName + " Community",
+	"short_name":       SiteName,
+	"start_url":        "/home",
+	"scope":            "/",
+	"display":          "standalone",
+	"background_color": "#f8fafc",
+	"theme_color":      ThemeColor,
+	"icons": []manifestIcon{
+		{"/static/icons/icon-192.png", "192x192", "image/png", "any maskable"},
+		{"/static/icons/icon-512.png", "512x512", "image/png", "any maskable"},
+		{"/static/icons/icon.svg", "any", "image/svg+xml", ""},
+	},
+}
+
+// ManifestHandler handles GET /manifest.webmanifest
+func ManifestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := json.Marshal(webManifest)
+	if err != nil {
+		RenderError(w, "Failed to build manifest", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/manifest+json")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(body)
+}
+
+// ServiceWorkerHandler handles GET /sw.js. The worker is served from the
+// root rather than /static/ so its scope covers the whole site, and is
+// never cached so updates reach browsers straight away.
+func ServiceWorkerHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeFile(w, r, "static/sw.js")
+}
+
+// OfflineHandler handles GET /offline, the page the service worker shows
+// when the network is unavailable. It needs no session so it can be cached.
+func OfflineHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	InitTemplate(w, "templates/offline.html", nil)
+}
@@ -0,0 +1,150 @@
+package utils
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+// ReactionCount is how many reacted to a post or comment with one emoji,
+// and whether the viewer is among them
+type ReactionCount struct {
+	Emoji string
+	Count int
+	Mine  bool
+}
+
+// ToggleReaction adds a user's emoji reaction to a post, or with commentID
+// to one of its comments, or takes it back if they had already reacted
+// with it. It reports whether the reaction is now there.
+func (db *DataBase) ToggleReaction(postID, commentID int, userUUID, emoji string) (bool, error) {
+	if !slices.Contains(ReactionEmojis, emoji) {
+		return false, errors.New("unknown reaction")
+	}
+
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	res, err := db.Conn.Exec(
+		"DELETE FROM reactions WHERE post_id = ? AND comment_id = ? AND user_uuid = ? AND emoji = ?",
+		postID, commentID, userUUID, emoji,
+	)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return false, nil
+	}
+	_, err = db.Conn.Exec(
+		"INSERT INTO reactions (post_id, comment_id, user_uuid, emoji, created_at) VALUES (?, ?, ?, ?, ?)",
+		postID, commentID, userUUID, emoji, Timestamp(),
+	)
+	return err == nil, err
+}
+
+// PostReactions returns the emoji reactions to a post and its comments, by
+// comment ID with 0 for the post itself. Each list has every emoji in
+// ReactionEmojis, in that order, whether anyone used it or not; emojis
+// since dropped from the set aren't counted.
+func (db *DataBase) PostReactions(postID int, viewerUUID string) (map[int][]ReactionCount, error) {
+	rows, err := db.Conn.Query(
+		`SELECT comment_id, emoji, COUNT(*), MAX(user_uuid = ?)
+		FROM reactions WHERE post_id = ?
+		GROUP BY comment_id, emoji`,
+		viewerUUID, postID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reactions := make(map[int][]ReactionCount)
+	for rows.Next() {
+		var (
+			commentID int
+			rc        ReactionCount
+		)
+		if err := rows.Scan(&commentID, &rc.Emoji, &rc.Count, &rc.Mine); err != nil {
+			return nil, err
+		}
+		i := slices.Index(ReactionEmojis, rc.Emoji)
+		if i < 0 {
+			continue
+		}
+		if reactions[commentID] == nil {
+			reactions[commentID] = emptyReactions()
+		}
+		reactions[commentID][i] = rc
+	}
+	return reactions, rows.Err()
+}
+
+// emptyReactions lists every emoji in ReactionEmojis with no one reacting
+func emptyReactions() []ReactionCount {
+	counts := make([]ReactionCount, len(ReactionEmojis))
+	for i, emoji := range ReactionEmojis {
+		counts[i].Emoji = emoji
+	}
+	return counts
+}
+
+// reactionsOrEmpty returns counts, or emptyReactions when nobody reacted
+func reactionsOrEmpty(counts []ReactionCount) []ReactionCount {
+	if counts == nil {
+		return emptyReactions()
+	}
+	return counts
+}
+
+// ReactHandler handles POST /post/{id}/react. The form sends the emoji and
+// comment_id, which is 0 or missing to react to the post itself.
+func ReactHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if user.NotRegistered {
+		RenderError(w, "Register to react to posts and comments", http.StatusForbidden)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		RenderError(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	post, err := db.GetPost(id)
+	if err != nil || post.IsDeleted() || post.IsDraft() || post.IsMerged() {
+		RenderError(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	if post.IsArchived() {
+		RenderError(w, "This thread is archived", http.StatusForbidden)
+		return
+	}
+
+	commentID, _ := strconv.Atoi(r.FormValue("comment_id"))
+	if commentID != 0 {
+		comment, err := db.GetComment(commentID)
+		if err != nil || comment.Post.ID != post.ID {
+			RenderError(w, "Comment not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	if _, err := db.ToggleReaction(post.ID, commentID, user.UUID, r.FormValue("emoji")); err != nil {
+		RenderError(w, "Failed to save reaction: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if commentID != 0 {
+		http.Redirect(w, r, CommentLink("", post.ID, commentID), http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/post/"+strconv.Itoa(post.ID), http.StatusSeeOther)
+}
@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Reactor is someone who liked or disliked a post or comment
+type Reactor struct {
+	Username string    `json:"username"`
+	At       time.Time `json:"at"`
+}
+
+// ReactorList is who liked and disliked a post or comment, most recent
+// first. Those who keep their likes private are only counted.
+type ReactorList struct {
+	Likes           []Reactor `json:"likes"`
+	Dislikes        []Reactor `json:"dislikes"`
+	PrivateLikes    int       `json:"private_likes"`
+	PrivateDislikes int       `json:"private_dislikes"`
+}
+
+// LikeCount counts everyone who liked, private or not
+func (l *ReactorList) LikeCount() int {
+	return len(l.Likes) + l.PrivateLikes
+}
+
+// DislikeCount counts everyone who disliked, private or not
+func (l *ReactorList) DislikeCount() int {
+	return len(l.Dislikes) + l.PrivateDislikes
+}
+
+// ListReactors returns who liked and disliked a post, or with commentID
+// one of its comments. Users who turned off showing what they liked are
+// counted in the Private fields unless showPrivate is set.
+func (db *DataBase) ListReactors(postID, commentID int, showPrivate bool) (*ReactorList, error) {
+	table, where, id := "interactions", "i.post_id = ?", postID
+	if commentID != 0 {
+		table, where, id = "comment_interactions", "i.comment_id = ?", commentID
+	}
+	rows, err := db.Conn.Query(
+		`SELECT u.username, i.liked, i.created_at,
+			COALESCE((SELECT value FROM user_preferences p WHERE p.user_uuid = i.user_uuid AND p.key = ?), ?)
+		FROM `+table+` i JOIN users u ON u.uuid = i.user_uuid
+		WHERE `+where+` AND (i.liked OR i.disliked)
+		ORDER BY i.created_at DESC, u.username`,
+		PrefShowLiked, preferenceDefaults[PrefShowLiked], id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := &ReactorList{}
+	for rows.Next() {
+		var (
+			r                  Reactor
+			liked              bool
+			createdAt, visible string
+		)
+		if err := rows.Scan(&r.Username, &liked, &createdAt, &visible); err != nil {
+			return nil, err
+		}
+		r.At, _ = ParseTimestamp(createdAt)
+		public, _ := strconv.ParseBool(visible)
+		switch {
+		case !public && !showPrivate && liked:
+			list.PrivateLikes++
+		case !public && !showPrivate:
+			list.PrivateDislikes++
+		case liked:
+			list.Likes = append(list.Likes, r)
+		default:
+			list.Dislikes = append(list.Dislikes, r)
+		}
+	}
+	return list, rows.Err()
+}
+
+// ReactorsHandler handles GET /post/{id}/reactors, listing who liked and
+// disliked the post, or with ?comment_id= one of its comments. Only the
+// author of what was reacted to and moderators of the post can look, and
+// only staff see those who keep their likes private. Send Accept:
+// application/json or ?format=json for the list as JSON.
+func ReactorsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		RenderError(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	post, err := db.GetPost(id)
+	if err != nil || post.IsDeleted() || post.IsDraft() || post.IsMerged() {
+		RenderError(w, "Post not found", http.StatusNotFound)
+		return
+	}
+
+	author := post.Author.UUID
+	var comment *Comment
+	if commentID, _ := strconv.Atoi(r.URL.Query().Get("comment_id")); commentID != 0 {
+		comment, err = db.GetComment(commentID)
+		if err != nil || comment.Post.ID != post.ID || comment.IsDeleted() {
+			RenderError(w, "Comment not found", http.StatusNotFound)
+			return
+		}
+		author = comment.Author.UUID
+	}
+	if (user.NotRegistered || user.UUID != author) && !db.CanLockPost(user, post) {
+		RenderError(w, "Only the author and moderators can see who reacted", http.StatusForbidden)
+		return
+	}
+
+	commentID := 0
+	if comment != nil {
+		commentID = comment.ID
+	}
+	reactors, err := db.ListReactors(post.ID, commentID, user.IsStaff())
+	if err != nil {
+		RenderError(w, "Failed to load reactions", http.StatusInternalServerError)
+		return
+	}
+	if WantsJSON(r) {
+		WriteJSON(w, http.StatusOK, reactors)
+		return
+	}
+
+	loc := db.GetLocationPreference(user.UUID)
+	for _, list := range [][]Reactor{reactors.Likes, reactors.Dislikes} {
+		for i := range list {
+			list[i].At = list[i].At.In(loc)
+		}
+	}
+	InitTemplate(w, "templates/reactors.html", map[string]interface{}{
+		"Post":     post,
+		"Comment":  comment,
+		"Reactors": reactors,
+	})
+}
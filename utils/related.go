@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RelatedPostsLimit is how many related posts a post page shows
+const RelatedPostsLimit = 5
+
+// RelatedPostsTTL is how long a post's related posts are cached
+const RelatedPostsTTL = 10 * time.Minute
+
+// relatedCacheSize bounds the cache; it is emptied when it fills up
+const relatedCacheSize = 1000
+
+// relatedCache holds recently computed related posts by post ID
+var relatedCache struct {
+	sync.Mutex
+	entries map[int]relatedEntry
+}
+
+type relatedEntry struct {
+	posts   []SimilarPost
+	expires time.Time
+}
+
+// RelatedPosts returns published posts related to post, most related
+// first. Each category the two share counts twice as much as each word of
+// the title they share. Results are cached for RelatedPostsTTL.
+func (db *DataBase) RelatedPosts(post *Post, limit int) ([]SimilarPost, error) {
+	relatedCache.Lock()
+	entry, ok := relatedCache.entries[post.ID]
+	relatedCache.Unlock()
+	if ok && Now().Before(entry.expires) {
+		return entry.posts, nil
+	}
+
+	posts, err := db.findRelatedPosts(post, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	relatedCache.Lock()
+	if relatedCache.entries == nil || len(relatedCache.entries) >= relatedCacheSize {
+		relatedCache.entries = make(map[int]relatedEntry)
+	}
+	relatedCache.entries[post.ID] = relatedEntry{posts, Now().Add(RelatedPostsTTL)}
+	relatedCache.Unlock()
+	return posts, nil
+}
+
+func (db *DataBase) findRelatedPosts(post *Post, limit int) ([]SimilarPost, error) {
+	var (
+		score []string
+		args  []interface{}
+	)
+	if len(post.Categories) > 0 {
+		marks := make([]string, len(post.Categories))
+		for i, c := range post.Categories {
+			marks[i] = "?"
+			args = append(args, c.ID)
+		}
+		score = append(score, "2 * (SELECT COUNT(*) FROM post_categories pc WHERE pc.post_id = p.id AND pc.category_id IN ("+strings.Join(marks, ", ")+"))")
+	}
+	for _, t := range searchTerms(post.Title, 10) {
+		score = append(score, "(instr(lower(p.title), ?) > 0)")
+		args = append(args, t)
+	}
+	if len(score) == 0 {
+		return []SimilarPost{}, nil
+	}
+
+	rows, err := db.Conn.Query(
+		`SELECT id, title, username, comments FROM (
+			SELECT p.id, p.title, u.username, p.created_at,
+				(SELECT COUNT(*) FROM comments c WHERE c.post_id = p.id) AS comments,
+				`+strings.Join(score, " + ")+` AS score
+			FROM posts p JOIN users u ON u.uuid = p.author_uuid
+			WHERE p.id != ? AND p.deleted_at = '' AND p.status = ?
+		) WHERE score > 0
+		ORDER BY score DESC, created_at DESC, id DESC
+		LIMIT ?`,
+		append(args, post.ID, PostPublished, limit)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	posts := []SimilarPost{}
+	for rows.Next() {
+		var p SimilarPost
+		if err := rows.Scan(&p.ID, &p.Title, &p.Author, &p.Comments); err != nil {
+			return nil, err
+		}
+		p.URL = "/post/" + strconv.Itoa(p.ID)
+		posts = append(posts, p)
+	}
+	return posts, rows.Err()
+}
@@ -0,0 +1,413 @@
+package utils
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Report statuses. Open reports wait in the queue; a moderator either acts
+// on them or dismisses them.
+const (
+	ReportOpen      = "open"
+	ReportResolved  = "resolved"
+	ReportDismissed = "dismissed"
+)
+
+// ReportDetailsLimit caps the free text a reporter can add, in runes
+const ReportDetailsLimit = 1000
+
+// ResolvedReportsLimit caps the recent decisions listed under the queue
+const ResolvedReportsLimit = 20
+
+// ReportExcerptLength is how much of a reported comment the queue quotes,
+// in runes
+const ReportExcerptLength = 300
+
+// ErrAlreadyReported is returned when the reporter already has an open
+// report on the post or comment
+var ErrAlreadyReported = errors.New("you have already reported this")
+
+// ReportReason is one of the reasons offered on the report form
+type ReportReason struct {
+	Key   string
+	Label string
+}
+
+// ReportReasons lists why a post or comment can be reported
+var ReportReasons = []ReportReason{
+	{"spam", "Spam or advertising"},
+	{"harassment", "Harassment or abuse"},
+	{"inappropriate", "Inappropriate content"},
+	{"off-topic", "Off-topic"},
+	{"other", "Something else"},
+}
+
+// reportReasonLabel returns the label of a reason key, or "" if it's unknown
+func reportReasonLabel(key string) string {
+	for _, reason := range ReportReasons {
+		if reason.Key == key {
+			return reason.Label
+		}
+	}
+	return ""
+}
+
+// Report is one user's report of a post or of one of its comments
+type Report struct {
+	ID        int
+	PostID    int
+	PostTitle string
+	// CommentID is 0 when the post itself is reported. CommentAuthor and
+	// CommentExcerpt give moderators the gist of a reported comment.
+	CommentID      int
+	CommentAuthor  string
+	CommentExcerpt string
+	Reporter       string
+	Reason         string
+	Details        string
+	Status         string
+	ResolvedBy     string
+	Resolution     string
+	CreatedAt      time.Time
+	ResolvedAt     time.Time
+}
+
+// ReasonLabel describes the report's reason
+func (r Report) ReasonLabel() string {
+	if label := reportReasonLabel(r.Reason); label != "" {
+		return label
+	}
+	return r.Reason
+}
+
+// ReportedPost groups the open reports of one post, or of one of its
+// comments when CommentID is set, for the queue
+type ReportedPost struct {
+	PostID         int
+	Title          string
+	CommentID      int
+	CommentAuthor  string
+	CommentExcerpt string
+	Reports        []Report
+}
+
+// ReportPost files a report of a post, or with commentID of one of its
+// comments. A reporter can only have one open report per post or comment;
+// reporting again returns ErrAlreadyReported.
+func (db *DataBase) ReportPost(postID, commentID int, reporterUUID, reason, details string) error {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	var exists int
+	err := db.Conn.QueryRow(
+		"SELECT 1 FROM reports WHERE post_id = ? AND comment_id = ? AND reporter_uuid = ? AND status = ?",
+		postID, commentID, reporterUUID, ReportOpen,
+	).Scan(&exists)
+	if err == nil {
+		return ErrAlreadyReported
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	_, err = db.Conn.Exec(
+		"INSERT INTO reports (post_id, comment_id, reporter_uuid, reason, details, status, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		postID, commentID, reporterUUID, reason, details, ReportOpen, Timestamp(),
+	)
+	return err
+}
+
+// listReports returns the reports matching where, in the given order
+func (db *DataBase) listReports(where, order string, args ...interface{}) ([]Report, error) {
+	rows, err := db.Conn.Query(
+		`SELECT r.id, r.post_id, p.title, r.comment_id, COALESCE(cu.username, ''), COALESCE(c.content, ''),
+			COALESCE(u.username, ''), r.reason, r.details, r.status,
+			COALESCE(m.username, ''), r.resolution, r.created_at, r.resolved_at
+		FROM reports r
+		JOIN posts p ON p.id = r.post_id
+		LEFT JOIN comments c ON c.id = r.comment_id
+		LEFT JOIN users cu ON cu.uuid = c.comment_author_uuid
+		LEFT JOIN users u ON u.uuid = r.reporter_uuid
+		LEFT JOIN users m ON m.uuid = r.resolved_by
+		WHERE `+where+`
+		ORDER BY `+order,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reports []Report
+	for rows.Next() {
+		var (
+			rep                   Report
+			createdAt, resolvedAt string
+		)
+		if err := rows.Scan(&rep.ID, &rep.PostID, &rep.PostTitle, &rep.CommentID, &rep.CommentAuthor, &rep.CommentExcerpt,
+			&rep.Reporter, &rep.Reason, &rep.Details,
+			&rep.Status, &rep.ResolvedBy, &rep.Resolution, &createdAt, &resolvedAt); err != nil {
+			return nil, err
+		}
+		rep.CommentExcerpt = HTMLExcerpt(string(RenderCommentMarkdown(rep.CommentExcerpt)), ReportExcerptLength)
+		rep.CreatedAt, _ = ParseTimestamp(createdAt)
+		rep.ResolvedAt, _ = ParseTimestamp(resolvedAt)
+		reports = append(reports, rep)
+	}
+	return reports, rows.Err()
+}
+
+// ListReportedPosts returns the open reports grouped by post or comment.
+// What was reported first comes first, so the queue is worked in order.
+func (db *DataBase) ListReportedPosts() ([]ReportedPost, error) {
+	reports, err := db.listReports(
+		"r.status = ?",
+		`(SELECT MIN(o.id) FROM reports o
+			WHERE o.post_id = r.post_id AND o.comment_id = r.comment_id AND o.status = r.status), r.id`,
+		ReportOpen,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var posts []ReportedPost
+	for _, rep := range reports {
+		if n := len(posts); n == 0 || posts[n-1].PostID != rep.PostID || posts[n-1].CommentID != rep.CommentID {
+			posts = append(posts, ReportedPost{
+				PostID:         rep.PostID,
+				Title:          rep.PostTitle,
+				CommentID:      rep.CommentID,
+				CommentAuthor:  rep.CommentAuthor,
+				CommentExcerpt: rep.CommentExcerpt,
+			})
+		}
+		last := &posts[len(posts)-1]
+		last.Reports = append(last.Reports, rep)
+	}
+	return posts, nil
+}
+
+// ListClosedReports returns the most recently resolved or dismissed reports
+func (db *DataBase) ListClosedReports(limit int) ([]Report, error) {
+	return db.listReports("r.status != ?", "r.resolved_at DESC, r.id DESC LIMIT ?", ReportOpen, limit)
+}
+
+// CloseReports resolves or dismisses every open report of a post, or with
+// commentID of one of its comments, at once
+func (db *DataBase) CloseReports(postID, commentID int, staffUUID, status, resolution string) error {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	res, err := db.Conn.Exec(
+		`UPDATE reports SET status = ?, resolved_by = ?, resolution = ?, resolved_at = ?
+		WHERE post_id = ? AND comment_id = ? AND status = ?`,
+		status, staffUUID, resolution, Timestamp(), postID, commentID, ReportOpen,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("no open reports for this")
+	}
+	return nil
+}
+
+// ReportPostHandler handles POST /post/{id}/report. The reporter gets a
+// confirmation page, which also says so when they had already reported it.
+func ReportPostHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if user.NotRegistered {
+		RenderError(w, "Please register to report posts", http.StatusForbidden)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		RenderError(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	post, err := db.GetPost(id)
+	if err != nil || post.IsDeleted() || post.IsDraft() || post.IsMerged() {
+		RenderError(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	if post.Author.UUID == user.UUID {
+		RenderError(w, "You can't report your own post", http.StatusBadRequest)
+		return
+	}
+
+	fileReport(w, r, user, post, nil)
+}
+
+// ReportCommentHandler handles POST /comment/{id}/report, like
+// ReportPostHandler for a comment
+func ReportCommentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if user.NotRegistered {
+		RenderError(w, "Please register to report comments", http.StatusForbidden)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		RenderError(w, "Comment not found", http.StatusNotFound)
+		return
+	}
+	comment, err := db.GetComment(id)
+	if err != nil {
+		RenderError(w, "Comment not found", http.StatusNotFound)
+		return
+	}
+	post, err := db.GetPost(comment.Post.ID)
+	if err != nil || post.IsDeleted() || post.IsDraft() || post.IsMerged() {
+		RenderError(w, "Comment not found", http.StatusNotFound)
+		return
+	}
+	if comment.Author.UUID == user.UUID {
+		RenderError(w, "You can't report your own comment", http.StatusBadRequest)
+		return
+	}
+
+	fileReport(w, r, user, post, comment)
+}
+
+// fileReport reads the report form for a post, or for comment when it
+// isn't nil, files the report and shows the reporter the confirmation
+func fileReport(w http.ResponseWriter, r *http.Request, user *User, post *Post, comment *Comment) {
+	reason := r.FormValue("reason")
+	if reportReasonLabel(reason) == "" {
+		RenderError(w, "Please pick a reason for the report", http.StatusBadRequest)
+		return
+	}
+	details := strings.TrimSpace(r.FormValue("details"))
+	if len([]rune(details)) > ReportDetailsLimit {
+		RenderError(w, "Report details are limited to "+strconv.Itoa(ReportDetailsLimit)+" characters", http.StatusBadRequest)
+		return
+	}
+
+	commentID := 0
+	if comment != nil {
+		commentID = comment.ID
+	}
+	duplicate := false
+	if err := db.ReportPost(post.ID, commentID, user.UUID, reason, details); err != nil {
+		if !errors.Is(err, ErrAlreadyReported) {
+			RenderError(w, "Failed to send the report", http.StatusInternalServerError)
+			return
+		}
+		duplicate = true
+	}
+
+	InitTemplate(w, "templates/report.html", map[string]interface{}{
+		"Post":      post,
+		"Comment":   comment,
+		"Duplicate": duplicate,
+	})
+}
+
+// AdminReportsHandler handles GET /admin/reports
+func AdminReportsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	staff, ok := RequireStaff(w, r)
+	if !ok {
+		return
+	}
+
+	open, err := db.ListReportedPosts()
+	if err != nil {
+		RenderError(w, "Failed to load reports", http.StatusInternalServerError)
+		return
+	}
+	closed, err := db.ListClosedReports(ResolvedReportsLimit)
+	if err != nil {
+		RenderError(w, "Failed to load reports", http.StatusInternalServerError)
+		return
+	}
+
+	loc := db.GetLocationPreference(staff.UUID)
+	for i := range open {
+		for j := range open[i].Reports {
+			open[i].Reports[j].CreatedAt = open[i].Reports[j].CreatedAt.In(loc)
+		}
+	}
+	for i := range closed {
+		closed[i].ResolvedAt = closed[i].ResolvedAt.In(loc)
+	}
+
+	snippets, err := db.ListSnippets()
+	if err != nil {
+		RenderError(w, "Failed to load reports", http.StatusInternalServerError)
+		return
+	}
+
+	InitTemplate(w, "templates/admin_reports.html", map[string]interface{}{
+		"Open":     open,
+		"Closed":   closed,
+		"Snippets": snippets,
+	})
+}
+
+// CloseReportsHandler handles POST /admin/reports/close
+func CloseReportsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	staff, ok := RequireStaff(w, r)
+	if !ok {
+		return
+	}
+
+	postID, err := strconv.Atoi(r.FormValue("post_id"))
+	if err != nil {
+		RenderError(w, "Invalid post", http.StatusBadRequest)
+		return
+	}
+	// comment_id is set when closing the reports of a comment
+	commentID, _ := strconv.Atoi(r.FormValue("comment_id"))
+	post, err := db.GetPost(postID)
+	if err != nil {
+		RenderError(w, "Post not found", http.StatusNotFound)
+		return
+	}
+
+	status := ReportDismissed
+	if r.FormValue("decision") == ReportResolved {
+		status = ReportResolved
+	}
+	resolution, err := withSnippet(r, strings.TrimSpace(r.FormValue("resolution")), post.Author.Username, staff.Username, post.Title)
+	if err != nil {
+		RenderError(w, "Failed to close reports: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := db.CloseReports(postID, commentID, staff.UUID, status, resolution); err != nil {
+		RenderError(w, "Failed to close reports: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/reports", http.StatusSeeOther)
+}
@@ -0,0 +1,213 @@
+package utils
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxDiffCells caps the size of the table diffLines fills in. Longer texts
+// are shown as wholly replaced rather than diffed.
+const maxDiffCells = 4_000_000
+
+// PostRevision is the title and body of a post as saved by one edit
+type PostRevision struct {
+	ID        int
+	Title     string
+	Content   string
+	Editor    string
+	CreatedAt time.Time
+}
+
+// Diff line kinds
+const (
+	DiffSame    = "same"
+	DiffAdded   = "added"
+	DiffRemoved = "removed"
+)
+
+// DiffLine is one line of a diff between two revisions
+type DiffLine struct {
+	Kind string
+	Text string
+}
+
+// RevisionsPageData is passed to the revisions template. Selected is the
+// revision being compared with Previous, which is nil for the original.
+type RevisionsPageData struct {
+	Post      *Post
+	Revisions []PostRevision
+	Selected  *PostRevision
+	Previous  *PostRevision
+	Diff      []DiffLine
+}
+
+// recordPostRevision stores the post's title and body as saved by an edit.
+// The first edit also stores the version it replaced, as the original.
+func recordPostRevision(ex execer, postID int, editorUUID, title, content string) error {
+	if _, err := ex.Exec(
+		`INSERT INTO post_revisions (post_id, title, content, editor_uuid, created_at)
+		SELECT id, title, content, author_uuid, created_at FROM posts
+		WHERE id = ? AND NOT EXISTS (SELECT 1 FROM post_revisions WHERE post_id = ?)`,
+		postID, postID,
+	); err != nil {
+		return err
+	}
+	_, err := ex.Exec(
+		"INSERT INTO post_revisions (post_id, title, content, editor_uuid, created_at) VALUES (?, ?, ?, ?, ?)",
+		postID, title, content, editorUUID, Timestamp(),
+	)
+	return err
+}
+
+// ListPostRevisions returns a post's revisions, oldest first
+func (db *DataBase) ListPostRevisions(postID int) ([]PostRevision, error) {
+	rows, err := db.Conn.Query(
+		`SELECT r.id, r.title, r.content, u.username, r.created_at
+		FROM post_revisions r JOIN users u ON u.uuid = r.editor_uuid
+		WHERE r.post_id = ?
+		ORDER BY r.id`,
+		postID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []PostRevision
+	for rows.Next() {
+		var (
+			rev       PostRevision
+			createdAt string
+		)
+		if err := rows.Scan(&rev.ID, &rev.Title, &rev.Content, &rev.Editor, &createdAt); err != nil {
+			return nil, err
+		}
+		rev.CreatedAt, _ = ParseTimestamp(createdAt)
+		revisions = append(revisions, rev)
+	}
+	return revisions, rows.Err()
+}
+
+// diffLines compares two texts line by line through their longest common
+// subsequence
+func diffLines(before, after string) []DiffLine {
+	a := strings.Split(strings.ReplaceAll(before, "\r\n", "\n"), "\n")
+	b := strings.Split(strings.ReplaceAll(after, "\r\n", "\n"), "\n")
+
+	var diff []DiffLine
+	if (len(a)+1)*(len(b)+1) > maxDiffCells {
+		for _, line := range a {
+			diff = append(diff, DiffLine{DiffRemoved, line})
+		}
+		for _, line := range b {
+			diff = append(diff, DiffLine{DiffAdded, line})
+		}
+		return diff
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			diff = append(diff, DiffLine{DiffSame, a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			diff = append(diff, DiffLine{DiffRemoved, a[i]})
+			i++
+		default:
+			diff = append(diff, DiffLine{DiffAdded, b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		diff = append(diff, DiffLine{DiffRemoved, a[i]})
+	}
+	for ; j < len(b); j++ {
+		diff = append(diff, DiffLine{DiffAdded, b[j]})
+	}
+	return diff
+}
+
+// PostRevisionsHandler handles GET /post/{id}/revisions?rev=
+// It lists the post's revisions and shows how the selected one, by default
+// the latest, differs from the one before it.
+func PostRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		RenderError(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	post, err := db.GetPost(id)
+	if err != nil || post.IsDeleted() || post.IsDraft() || post.IsMerged() {
+		RenderError(w, "Post not found", http.StatusNotFound)
+		return
+	}
+
+	revisions, err := db.ListPostRevisions(post.ID)
+	if err != nil {
+		RenderError(w, "Failed to load revisions", http.StatusInternalServerError)
+		return
+	}
+	loc := db.GetLocationPreference(user.UUID)
+	for i := range revisions {
+		revisions[i].CreatedAt = revisions[i].CreatedAt.In(loc)
+	}
+
+	data := RevisionsPageData{Post: post, Revisions: revisions}
+	if len(revisions) > 0 {
+		selected := len(revisions) - 1
+		if rev := r.URL.Query().Get("rev"); rev != "" {
+			revID, _ := strconv.Atoi(rev)
+			selected = -1
+			for i := range revisions {
+				if revisions[i].ID == revID {
+					selected = i
+				}
+			}
+			if selected < 0 {
+				RenderError(w, "Revision not found", http.StatusNotFound)
+				return
+			}
+		}
+
+		// The original is compared with itself, so it is shown unmarked
+		data.Selected = &revisions[selected]
+		before := data.Selected.Content
+		if selected > 0 {
+			data.Previous = &revisions[selected-1]
+			before = data.Previous.Content
+		}
+		data.Diff = diffLines(before, data.Selected.Content)
+	}
+
+	InitTemplate(w, "templates/revisions.html", data)
+}
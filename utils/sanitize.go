@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// htmlTagPattern matches anything that looks like an HTML tag or comment
+var htmlTagPattern = regexp.MustCompile(`(?s)<!--.*?-->|<[^>]*>`)
+
+// PlainText reduces user content to safe plain text for places that don't
+// escape it, such as email bodies: tags and control characters are removed
+func PlainText(s string) string {
+	s = htmlTagPattern.ReplaceAllString(s, "")
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\n' && r != '\t' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// Excerpt returns the plain text of s on one line, cut to at most n runes
+func Excerpt(s string, n int) string {
+	s = strings.Join(strings.Fields(PlainText(s)), " ")
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return strings.TrimSpace(string(runes[:n])) + "…"
+}
+
+// HTMLExcerpt is Excerpt for rendered HTML, with entities decoded back to
+// text. The result is unescaped, so it must only go where it gets escaped
+// again, such as templates and XML.
+func HTMLExcerpt(s string, n int) string {
+	return html.UnescapeString(Excerpt(s, n))
+}
@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"log"
+	"time"
+)
+
+// job is a task the scheduler runs periodically
+type job struct {
+	Name     string
+	Interval time.Duration
+	Run      func() error
+}
+
+// jobs lists every background job started by StartScheduler
+var jobs = []job{
+	{"maintenance", 30 * time.Second, SyncMaintenanceMode},
+	{"login-tokens", time.Hour, PurgeLoginTokens},
+	{"data-exports", time.Minute, ProcessDataExports},
+	{"federation", time.Minute, PublishFederatedPosts},
+	{"storage", 10 * time.Minute, CheckStorage},
+	{"summaries", 15 * time.Minute, SummarizeThreads},
+	{"integrity", 24 * time.Hour, SweepIntegrity},
+	{"views", 30 * time.Second, FlushPostViews},
+	{"mod-digests", time.Hour, SendModerationDigests},
+	{"inactive-accounts", 24 * time.Hour, ProcessInactiveAccounts},
+	{"link-previews", time.Minute, FetchLinkPreviews},
+	{"archive", time.Hour, ArchiveStalePosts},
+	{"comment-drafts", time.Hour, PurgeCommentDrafts},
+	{"notification-mail", 5 * time.Minute, SendNotificationMail},
+	{"notification-digests", time.Hour, SendNotificationDigests},
+}
+
+// StartScheduler runs every registered job in its own goroutine.
+// Each job runs once immediately and then on its interval. In test mode
+// nothing runs on its own; see RunJobHandler.
+func StartScheduler() {
+	if TestMode {
+		return
+	}
+	for _, j := range jobs {
+		go runJob(j)
+	}
+}
+
+func runJob(j job) {
+	run := func() {
+		if err := j.Run(); err != nil {
+			log.Printf("Job %s failed: %v", j.Name, err)
+		}
+	}
+
+	run()
+	ticker := time.NewTicker(j.Interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		run()
+	}
+}
@@ -0,0 +1,511 @@
+package utils
+
+import (
+	"database/sql"
+	"fmt"
+	"html"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// SearchPageSize is the number of results per search page
+const SearchPageSize = 20
+
+// SearchSnippetLength is roughly how many characters of context a search
+// result shows around the match
+const SearchSnippetLength = 200
+
+// SimilarPostsLimit is how many existing posts are suggested while a new
+// post's title is typed
+const SimilarPostsLimit = 5
+
+// Search result types; the empty type finds posts and comments alike
+const (
+	SearchPosts    = "posts"
+	SearchComments = "comments"
+)
+
+// SearchTypes lists the result types the search page filters by
+var SearchTypes = []SortMode{
+	{"", "All"},
+	{SearchPosts, "Posts"},
+	{SearchComments, "Comments"},
+}
+
+// searchTypeFilters maps each result type to the matches it keeps
+var searchTypeFilters = map[string]string{
+	"":             "1",
+	SearchPosts:    "comment_id = 0",
+	SearchComments: "comment_id != 0",
+}
+
+// searchIndexed reports whether the full-text indexes are in use.
+// It needs SQLite built with FTS5, which go-sqlite3 only does with the
+// sqlite_fts5 build tag; without it searches fall back to LIKE.
+var searchIndexed bool
+
+// searchIndex is one full-text index and the statements that create it
+type searchIndex struct {
+	Name   string
+	Schema []string
+}
+
+// searchIndexes are the full-text indexes over post titles and bodies and
+// over comments. They read their content from posts and comments, and the
+// triggers keep them in step.
+var searchIndexes = []searchIndex{
+	{"posts_fts", []string{
+		`CREATE VIRTUAL TABLE IF NOT EXISTS posts_fts USING fts5(
+			title, content, content='posts', content_rowid='id', tokenize='porter unicode61'
+		)`,
+		`CREATE TRIGGER IF NOT EXISTS posts_fts_insert AFTER INSERT ON posts BEGIN
+			INSERT INTO posts_fts (rowid, title, content) VALUES (new.id, new.title, new.content);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS posts_fts_delete AFTER DELETE ON posts BEGIN
+			INSERT INTO posts_fts (posts_fts, rowid, title, content) VALUES ('delete', old.id, old.title, old.content);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS posts_fts_update AFTER UPDATE OF title, content ON posts BEGIN
+			INSERT INTO posts_fts (posts_fts, rowid, title, content) VALUES ('delete', old.id, old.title, old.content);
+			INSERT INTO posts_fts (rowid, title, content) VALUES (new.id, new.title, new.content);
+		END`,
+	}},
+	{"comments_fts", []string{
+		`CREATE VIRTUAL TABLE IF NOT EXISTS comments_fts USING fts5(
+			content, content='comments', content_rowid='id', tokenize='porter unicode61'
+		)`,
+		`CREATE TRIGGER IF NOT EXISTS comments_fts_insert AFTER INSERT ON comments BEGIN
+			INSERT INTO comments_fts (rowid, content) VALUES (new.id, new.content);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS comments_fts_delete AFTER DELETE ON comments BEGIN
+			INSERT INTO comments_fts (comments_fts, rowid, content) VALUES ('delete', old.id, old.content);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS comments_fts_update AFTER UPDATE OF content ON comments BEGIN
+			INSERT INTO comments_fts (comments_fts, rowid, content) VALUES ('delete', old.id, old.content);
+			INSERT INTO comments_fts (rowid, content) VALUES (new.id, new.content);
+		END`,
+	}},
+}
+
+// SetupSearchIndex creates the full-text indexes when SQLite supports FTS5,
+// filling each from existing rows the first time
+func (db *DataBase) SetupSearchIndex() error {
+	var fts5 bool
+	if err := db.Conn.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&fts5); err != nil {
+		return err
+	}
+	if !fts5 {
+		log.Println("SQLite was built without FTS5, search falls back to LIKE; build with -tags sqlite_fts5 to enable it")
+		return nil
+	}
+
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	for _, index := range searchIndexes {
+		var exists int
+		err := db.Conn.QueryRow("SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?", index.Name).Scan(&exists)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		for _, stmt := range index.Schema {
+			if _, err := db.Conn.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		if exists == 0 {
+			if _, err := db.Conn.Exec(fmt.Sprintf("INSERT INTO %[1]s (%[1]s) VALUES ('rebuild')", index.Name)); err != nil {
+				return err
+			}
+		}
+	}
+	searchIndexed = true
+	return nil
+}
+
+// searchStopWords are left out of similarity queries since nearly every
+// title contains some of them
+var searchStopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "can": true, "do": true,
+	"for": true, "how": true, "i": true, "in": true, "is": true, "it": true,
+	"my": true, "of": true, "on": true, "or": true, "the": true, "to": true,
+	"what": true, "why": true, "with": true,
+}
+
+// searchTerms splits text into lowercase words, dropping stop words and
+// duplicates. At most max words are returned.
+func searchTerms(text string, max int) []string {
+	seen := make(map[string]bool)
+	var terms []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if searchStopWords[word] || seen[word] {
+			continue
+		}
+		seen[word] = true
+		terms = append(terms, word)
+		if len(terms) == max {
+			break
+		}
+	}
+	return terms
+}
+
+// SimilarPost is an existing post suggested for a title being typed
+type SimilarPost struct {
+	ID       int    `json:"id"`
+	Title    string `json:"title"`
+	URL      string `json:"url"`
+	Author   string `json:"author"`
+	Comments int    `json:"comments"`
+}
+
+// SimilarPosts returns published posts whose titles share words with title,
+// best matches first
+func (db *DataBase) SimilarPosts(title string, limit int) ([]SimilarPost, error) {
+	terms := searchTerms(title, 10)
+	if len(terms) == 0 {
+		return []SimilarPost{}, nil
+	}
+
+	var (
+		query string
+		args  []interface{}
+	)
+	if searchIndexed {
+		quoted := make([]string, len(terms))
+		for i, t := range terms {
+			quoted[i] = `"` + t + `"`
+		}
+		query = `SELECT p.id, p.title, u.username, (SELECT COUNT(*) FROM comments c WHERE c.post_id = p.id)
+			FROM posts_fts f JOIN posts p ON p.id = f.rowid JOIN users u ON u.uuid = p.author_uuid
+			WHERE posts_fts MATCH ? AND p.deleted_at = '' AND p.status = ?
+			ORDER BY bm25(posts_fts), p.id DESC
+			LIMIT ?`
+		args = []interface{}{"title : (" + strings.Join(quoted, " OR ") + ")", PostPublished, limit}
+	} else {
+		// Rank by how many of the words each title contains
+		score := make([]string, len(terms))
+		for i, t := range terms {
+			score[i] = "(instr(lower(p.title), ?) > 0)"
+			args = append(args, t)
+		}
+		query = `SELECT p.id, p.title, u.username, (SELECT COUNT(*) FROM comments c WHERE c.post_id = p.id)
+			FROM posts p JOIN users u ON u.uuid = p.author_uuid
+			WHERE p.deleted_at = '' AND p.status = ? AND (` + strings.Join(score, " + ") + `) > 0
+			ORDER BY ` + strings.Join(score, " + ") + ` DESC, p.id DESC
+			LIMIT ?`
+		args = append(append(append([]interface{}{PostPublished}, args...), args...), limit)
+	}
+
+	rows, err := db.Conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	posts := []SimilarPost{}
+	for rows.Next() {
+		var p SimilarPost
+		if err := rows.Scan(&p.ID, &p.Title, &p.Author, &p.Comments); err != nil {
+			return nil, err
+		}
+		p.URL = "/post/" + strconv.Itoa(p.ID)
+		posts = append(posts, p)
+	}
+	return posts, rows.Err()
+}
+
+// SimilarPostsHandler handles GET /post/similar?title=, returning JSON
+// suggestions of existing discussions while a new post's title is typed
+func SimilarPostsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		WriteJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	if _, err := CurrentUser(w, r); err != nil {
+		WriteJSON(w, http.StatusUnauthorized, map[string]string{"error": "not logged in"})
+		return
+	}
+
+	posts, err := db.SimilarPosts(r.URL.Query().Get("title"), SimilarPostsLimit)
+	if err != nil {
+		log.Printf("Failed to find similar posts: %v", err)
+		WriteJSON(w, http.StatusInternalServerError, map[string]string{"error": "search failed"})
+		return
+	}
+	WriteJSON(w, http.StatusOK, map[string]interface{}{"posts": posts})
+}
+
+// Matches are marked with these control characters in titles and snippets
+// until highlightMatches turns them into <mark> tags; being control
+// characters they can't appear in the escaped text itself
+const (
+	matchOpen  = "\x01"
+	matchClose = "\x02"
+)
+
+// highlightMatches escapes text and wraps its marked matches in <mark>
+func highlightMatches(text string) template.HTML {
+	text = html.EscapeString(strings.ReplaceAll(strings.ReplaceAll(text, "\n", " "), "\r", ""))
+	return template.HTML(strings.NewReplacer(matchOpen, "<mark>", matchClose, "</mark>").Replace(text))
+}
+
+// markTerms marks every occurrence of terms in text, for results found
+// without the full-text index
+func markTerms(text string, terms []string) string {
+	lower := strings.ToLower(text)
+	if len(lower) != len(text) {
+		// Lowercasing changed byte offsets; mark the lowercase text instead
+		text = lower
+	}
+	marked := make([]bool, len(text)+1)
+	ends := make([]bool, len(text)+1)
+	for _, t := range terms {
+		for i := 0; ; {
+			j := strings.Index(lower[i:], t)
+			if j < 0 {
+				break
+			}
+			marked[i+j], ends[i+j+len(t)] = true, true
+			i += j + len(t)
+		}
+	}
+
+	var b strings.Builder
+	for i := 0; i <= len(text); i++ {
+		if ends[i] {
+			b.WriteString(matchClose)
+		}
+		if marked[i] {
+			b.WriteString(matchOpen)
+		}
+		if i < len(text) {
+			b.WriteByte(text[i])
+		}
+	}
+	return b.String()
+}
+
+// termSnippet cuts the plain text of s to about n runes around the first
+// occurrence of any of terms
+func termSnippet(s string, terms []string, n int) string {
+	s = strings.Join(strings.Fields(PlainText(s)), " ")
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	lower := []rune(strings.ToLower(s))
+	first := -1
+	for _, t := range terms {
+		if i := strings.Index(string(lower), t); i >= 0 {
+			if pos := len([]rune(string(lower)[:i])); first < 0 || pos < first {
+				first = pos
+			}
+		}
+	}
+	start := max(first-n/4, 0)
+	end := min(start+n, len(runes))
+	snippet := strings.TrimSpace(string(runes[start:end]))
+	if start > 0 {
+		snippet = "…" + snippet
+	}
+	if end < len(runes) {
+		snippet += "…"
+	}
+	return snippet
+}
+
+// SearchResult is a post or comment matching a search
+type SearchResult struct {
+	PostID int
+	// CommentID is 0 when the post itself matched
+	CommentID int
+	Title     template.HTML
+	Snippet   template.HTML
+	Author    string
+	CreatedAt time.Time
+}
+
+// URL links to the matching post, or to the permalink of the matching
+// comment
+func (r SearchResult) URL() string {
+	if r.CommentID != 0 {
+		return "/comment/" + strconv.Itoa(r.CommentID)
+	}
+	return "/post/" + strconv.Itoa(r.PostID)
+}
+
+// SearchData is passed to the search template
+type SearchData struct {
+	Query string
+	// Type is one of the keys of SearchTypes
+	Type       string
+	Types      []SortMode
+	Results    []SearchResult
+	Page       int
+	TotalPages int
+	Total      int
+	PrevPage   int
+	NextPage   int
+	// Indexed is false when search falls back to LIKE and results come
+	// newest first rather than by relevance
+	Indexed bool
+}
+
+// indexedSearchQuery finds posts and comments through the full-text
+// indexes, ranking title matches above body matches
+const indexedSearchQuery = `WITH matches AS (
+		SELECT p.id AS post_id, 0 AS comment_id,
+			highlight(posts_fts, 0, @open, @close) AS title,
+			snippet(posts_fts, 1, @open, @close, '…', 32) AS snippet,
+			p.author_uuid AS author_uuid, p.created_at AS created_at,
+			bm25(posts_fts, 5.0, 1.0) AS rank
+		FROM posts_fts JOIN posts p ON p.id = posts_fts.rowid
+		WHERE posts_fts MATCH @query AND p.deleted_at = '' AND p.status = @status
+		UNION ALL
+		SELECT p.id, c.id, p.title, snippet(comments_fts, 0, @open, @close, '…', 32),
+			c.comment_author_uuid, c.created_at, bm25(comments_fts)
+		FROM comments_fts JOIN comments c ON c.id = comments_fts.rowid JOIN posts p ON p.id = c.post_id
+		WHERE comments_fts MATCH @query AND c.hidden_at = '' AND p.deleted_at = '' AND p.status = @status
+	)`
+
+// Search returns one page of the published posts and comments matching
+// every word of text, only posts or comments when kind is SearchPosts or
+// SearchComments, and the total number of matches
+func (db *DataBase) Search(text, kind string, limit, offset int) ([]SearchResult, int, error) {
+	filter, ok := searchTypeFilters[kind]
+	if !ok {
+		return nil, 0, fmt.Errorf("unknown result type %q", kind)
+	}
+	terms := searchTerms(text, 10)
+	if len(terms) == 0 {
+		return []SearchResult{}, 0, nil
+	}
+
+	var matches string
+	args := []interface{}{
+		sql.Named("status", PostPublished),
+		sql.Named("limit", limit),
+		sql.Named("offset", offset),
+	}
+	if searchIndexed {
+		quoted := make([]string, len(terms))
+		for i, t := range terms {
+			quoted[i] = `"` + t + `"`
+		}
+		matches = indexedSearchQuery
+		args = append(args,
+			sql.Named("query", strings.Join(quoted, " ")),
+			sql.Named("open", matchOpen),
+			sql.Named("close", matchClose),
+		)
+	} else {
+		var postConds, commentConds []string
+		for i, t := range terms {
+			name := "t" + strconv.Itoa(i)
+			postConds = append(postConds, "instr(lower(p.title || ' ' || p.content), @"+name+") > 0")
+			commentConds = append(commentConds, "instr(lower(c.content), @"+name+") > 0")
+			args = append(args, sql.Named(name, t))
+		}
+		matches = `WITH matches AS (
+			SELECT p.id AS post_id, 0 AS comment_id, p.title AS title, p.content AS snippet,
+				p.author_uuid AS author_uuid, p.created_at AS created_at, 0 AS rank
+			FROM posts p
+			WHERE p.deleted_at = '' AND p.status = @status AND ` + strings.Join(postConds, " AND ") + `
+			UNION ALL
+			SELECT p.id, c.id, p.title, c.content, c.comment_author_uuid, c.created_at, 0
+			FROM comments c JOIN posts p ON p.id = c.post_id
+			WHERE c.hidden_at = '' AND p.deleted_at = '' AND p.status = @status AND ` + strings.Join(commentConds, " AND ") + `
+		)`
+	}
+
+	var total int
+	if err := db.Conn.QueryRow(matches+" SELECT COUNT(*) FROM matches WHERE "+filter, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.Conn.Query(matches+`
+		SELECT m.post_id, m.comment_id, m.title, m.snippet, u.username, m.created_at
+		FROM matches m JOIN users u ON u.uuid = m.author_uuid
+		WHERE `+filter+`
+		ORDER BY m.rank, m.created_at DESC, m.post_id DESC, m.comment_id DESC
+		LIMIT @limit OFFSET @offset`, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	results := []SearchResult{}
+	for rows.Next() {
+		var (
+			r                         SearchResult
+			title, snippet, createdAt string
+		)
+		if err := rows.Scan(&r.PostID, &r.CommentID, &title, &snippet, &r.Author, &createdAt); err != nil {
+			return nil, 0, err
+		}
+		if !searchIndexed {
+			if r.CommentID == 0 {
+				title = markTerms(title, terms)
+			}
+			snippet = markTerms(termSnippet(snippet, terms, SearchSnippetLength), terms)
+		}
+		r.Title = highlightMatches(title)
+		r.Snippet = highlightMatches(snippet)
+		r.CreatedAt, _ = ParseTimestamp(createdAt)
+		results = append(results, r)
+	}
+	return results, total, rows.Err()
+}
+
+// SearchHandler handles GET /search?q=&type=&page=, full-text search over
+// posts and comments, or only one of them by type
+func SearchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	data := SearchData{
+		Query:   strings.TrimSpace(r.URL.Query().Get("q")),
+		Type:    r.URL.Query().Get("type"),
+		Types:   SearchTypes,
+		Page:    PageFromRequest(r),
+		Indexed: searchIndexed,
+	}
+	if _, ok := searchTypeFilters[data.Type]; !ok {
+		data.Type = ""
+	}
+	if data.Query != "" {
+		data.Results, data.Total, err = db.Search(data.Query, data.Type, SearchPageSize, (data.Page-1)*SearchPageSize)
+		if err != nil {
+			log.Printf("Search for %q failed: %v", data.Query, err)
+			RenderError(w, "Search failed", http.StatusInternalServerError)
+			return
+		}
+	}
+	loc := db.GetLocationPreference(user.UUID)
+	for i := range data.Results {
+		data.Results[i].CreatedAt = data.Results[i].CreatedAt.In(loc)
+	}
+
+	data.TotalPages = (data.Total + SearchPageSize - 1) / SearchPageSize
+	if data.Page > 1 {
+		data.PrevPage = data.Page - 1
+	}
+	if data.Page < data.TotalPages {
+		data.NextPage = data.Page + 1
+	}
+	InitTemplate(w, "templates/search.html", data)
+}
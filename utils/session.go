@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// GetUserByUUID loads a user by its UUID
+func (db *DataBase) GetUserByUUID(uuid string) (*User, error) {
+	var (
+		user      User
+		suspended string
+	)
+	err := db.Conn.QueryRow(
+		"SELECT uuid, username, email, notregistered, loggedin, role, suspendeduntil FROM users WHERE uuid = ?",
+		uuid,
+	).Scan(&user.UUID, &user.Username, &user.Email, &user.NotRegistered, &user.LoggedIn, &user.Role, &suspended)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errors.New("user not found")
+		}
+		return nil, err
+	}
+	user.SuspendedUntil, _ = ParseTimestamp(suspended)
+	return &user, nil
+}
+
+// CurrentUser resolves the session cookie to a user and refreshes the session.
+// It returns an error if there is no cookie or the session has expired.
+func CurrentUser(w http.ResponseWriter, r *http.Request) (*User, error) {
+	uuid, err := GetUserFromCookie(r)
+	if err != nil || uuid == "" {
+		return nil, errors.New("no session")
+	}
+
+	if err := db.CheckSession(w, uuid); err != nil {
+		return nil, err
+	}
+
+	if err := db.RefreshSession(uuid); err != nil {
+		log.Printf("Failed to refresh session for uuid %s: %v", uuid, err)
+	}
+
+	user, err := db.GetUserByUUID(uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	// Suspended accounts lose their session
+	if user.IsSuspended() {
+		ClearUserCookie(w)
+		return nil, errors.New("account suspended")
+	}
+	return user, nil
+}
+
+// RequireAdmin returns the current user if they are an admin.
+// Otherwise it writes the appropriate response and returns false.
+func RequireAdmin(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil, false
+	}
+	if !user.IsAdmin() {
+		RenderError(w, "Admins only", http.StatusForbidden)
+		return nil, false
+	}
+	return user, true
+}
+
+// RequireStaff returns the current user if they are a moderator or admin.
+// Otherwise it writes the appropriate response and returns false.
+func RequireStaff(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil, false
+	}
+	if !user.IsStaff() {
+		RenderError(w, "Staff only", http.StatusForbidden)
+		return nil, false
+	}
+	return user, true
+}
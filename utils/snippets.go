@@ -0,0 +1,169 @@
+package utils
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ReplySnippet is a canned response staff can insert into warnings,
+// appeal decisions and comments
+type ReplySnippet struct {
+	ID    int
+	Title string
+	Body  string
+}
+
+// SnippetVariables documents the placeholders a snippet may use
+var SnippetVariables = []string{"{username}", "{moderator}", "{post}"}
+
+// ListSnippets returns every reply snippet, by title
+func (db *DataBase) ListSnippets() ([]ReplySnippet, error) {
+	rows, err := db.Conn.Query("SELECT id, title, body FROM reply_snippets ORDER BY title COLLATE NOCASE, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var snippets []ReplySnippet
+	for rows.Next() {
+		var s ReplySnippet
+		if err := rows.Scan(&s.ID, &s.Title, &s.Body); err != nil {
+			return nil, err
+		}
+		snippets = append(snippets, s)
+	}
+	return snippets, rows.Err()
+}
+
+// GetSnippet loads one reply snippet
+func (db *DataBase) GetSnippet(id int) (*ReplySnippet, error) {
+	var s ReplySnippet
+	err := db.Conn.QueryRow("SELECT id, title, body FROM reply_snippets WHERE id = ?", id).Scan(&s.ID, &s.Title, &s.Body)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errors.New("snippet not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// SaveSnippet creates a snippet when id is 0 and updates it otherwise
+func (db *DataBase) SaveSnippet(id int, title, body, authorUUID string) error {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	if id == 0 {
+		_, err := db.Conn.Exec(
+			"INSERT INTO reply_snippets (title, body, author_uuid, updated_at) VALUES (?, ?, ?, ?)",
+			title, body, authorUUID, Timestamp(),
+		)
+		return err
+	}
+	res, err := db.Conn.Exec(
+		"UPDATE reply_snippets SET title = ?, body = ?, author_uuid = ?, updated_at = ? WHERE id = ?",
+		title, body, authorUUID, Timestamp(), id,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("snippet not found")
+	}
+	return nil
+}
+
+// DeleteSnippet removes a reply snippet
+func (db *DataBase) DeleteSnippet(id int) error {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	_, err := db.Conn.Exec("DELETE FROM reply_snippets WHERE id = ?", id)
+	return err
+}
+
+// ExpandSnippet fills in a snippet's placeholders. username is who the
+// reply is addressed to, moderator who is sending it and post the title
+// of the post it is about, if any. Unknown placeholders are left as typed.
+func ExpandSnippet(body, username, moderator, post string) string {
+	return strings.NewReplacer(
+		"{username}", username,
+		"{moderator}", moderator,
+		"{post}", post,
+	).Replace(body)
+}
+
+// withSnippet puts the snippet chosen in the form's "snippet" field in
+// front of the text the moderator typed. Text is returned unchanged when
+// no snippet was chosen.
+func withSnippet(r *http.Request, text, username, moderator, post string) (string, error) {
+	if r.FormValue("snippet") == "" {
+		return text, nil
+	}
+	id, err := strconv.Atoi(r.FormValue("snippet"))
+	if err != nil {
+		return "", errors.New("snippet not found")
+	}
+	snippet, err := db.GetSnippet(id)
+	if err != nil {
+		return "", err
+	}
+
+	expanded := ExpandSnippet(snippet.Body, username, moderator, post)
+	if text == "" {
+		return expanded, nil
+	}
+	return expanded + "\n\n" + text, nil
+}
+
+// SnippetsHandler handles GET and POST /admin/snippets. POST saves a
+// snippet, or deletes it when action=delete.
+func SnippetsHandler(w http.ResponseWriter, r *http.Request) {
+	staff, ok := RequireStaff(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		id, _ := strconv.Atoi(r.FormValue("id"))
+		if r.FormValue("action") == "delete" {
+			if err := db.DeleteSnippet(id); err != nil {
+				RenderError(w, "Failed to delete snippet", http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, "/admin/snippets", http.StatusSeeOther)
+			return
+		}
+
+		title := strings.TrimSpace(r.FormValue("title"))
+		body := strings.TrimSpace(r.FormValue("body"))
+		if title == "" || body == "" {
+			RenderError(w, "A snippet needs a title and text", http.StatusBadRequest)
+			return
+		}
+		if err := db.SaveSnippet(id, title, body, staff.UUID); err != nil {
+			RenderError(w, "Failed to save snippet: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, "/admin/snippets", http.StatusSeeOther)
+		return
+	default:
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	snippets, err := db.ListSnippets()
+	if err != nil {
+		RenderError(w, "Failed to load snippets", http.StatusInternalServerError)
+		return
+	}
+	InitTemplate(w, "templates/admin_snippets.html", map[string]interface{}{
+		"Snippets":  snippets,
+		"Variables": SnippetVariables,
+	})
+}
@@ -0,0 +1,170 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TableRows is the row count of one table
+type TableRows struct {
+	Name string
+	Rows int64
+}
+
+// StorageStats is a snapshot of how much the database holds
+type StorageStats struct {
+	CheckedAt time.Time
+	// FileBytes is the size of the database file and its write-ahead log
+	FileBytes int64
+	Tables    []TableRows
+	TotalRows int64
+}
+
+// SizeLimit returns the size quota in bytes, or 0 when there is none
+func (s *StorageStats) SizeLimit() int64 {
+	return int64(DBSizeLimitMB) << 20
+}
+
+// OverSize reports whether the database is past its size quota
+func (s *StorageStats) OverSize() bool {
+	return DBSizeLimitMB > 0 && s.FileBytes > s.SizeLimit()
+}
+
+// OverRows reports whether the database is past its row quota
+func (s *StorageStats) OverRows() bool {
+	return DBRowLimit > 0 && s.TotalRows > int64(DBRowLimit)
+}
+
+// SizeText formats the file size for display
+func (s *StorageStats) SizeText() string {
+	return formatBytes(s.FileBytes)
+}
+
+// SizeLimitText formats the size quota for display
+func (s *StorageStats) SizeLimitText() string {
+	return formatBytes(s.SizeLimit())
+}
+
+// RowLimit returns the row quota, or 0 when there is none
+func (s *StorageStats) RowLimit() int {
+	return DBRowLimit
+}
+
+// formatBytes formats n as B, KB, MB or GB
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+// CollectStorageStats measures the database file and counts the rows of
+// every table
+func (db *DataBase) CollectStorageStats() (*StorageStats, error) {
+	stats := &StorageStats{CheckedAt: Now()}
+	for _, path := range []string{db.Path, db.Path + "-wal"} {
+		info, err := os.Stat(path)
+		if err == nil {
+			stats.FileBytes += info.Size()
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	rows, err := db.Conn.Query(`SELECT name FROM sqlite_master
+		WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		t := TableRows{Name: name}
+		quoted := `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+		if err := db.Conn.QueryRow("SELECT COUNT(*) FROM " + quoted).Scan(&t.Rows); err != nil {
+			return nil, err
+		}
+		stats.Tables = append(stats.Tables, t)
+		stats.TotalRows += t.Rows
+	}
+	return stats, nil
+}
+
+// storage holds the latest snapshot taken by the storage job and whether
+// each quota was exceeded at that point, so alerts fire once per crossing
+var storage struct {
+	sync.Mutex
+	latest   *StorageStats
+	overSize bool
+	overRows bool
+}
+
+// CheckStorage takes a new snapshot of the database and raises an alert
+// through ReportError when it crosses a quota
+func CheckStorage() error {
+	stats, err := db.CollectStorageStats()
+	if err != nil {
+		return err
+	}
+
+	storage.Lock()
+	defer storage.Unlock()
+	storage.latest = stats
+
+	if over := stats.OverSize(); over != storage.overSize {
+		storage.overSize = over
+		if over {
+			ReportError(Diagnostics{
+				Title: "Database size quota exceeded",
+				Error: fmt.Sprintf("The database is %s, over its quota of %s", stats.SizeText(), stats.SizeLimitText()),
+			})
+		}
+	}
+	if over := stats.OverRows(); over != storage.overRows {
+		storage.overRows = over
+		if over {
+			ReportError(Diagnostics{
+				Title: "Database row quota exceeded",
+				Error: fmt.Sprintf("The database holds %d rows, over its quota of %d", stats.TotalRows, DBRowLimit),
+			})
+		}
+	}
+	return nil
+}
+
+// LatestStorageStats returns the storage job's latest snapshot, taking one
+// now if the job hasn't run yet
+func LatestStorageStats() (*StorageStats, error) {
+	storage.Lock()
+	latest := storage.latest
+	storage.Unlock()
+	if latest != nil {
+		return latest, nil
+	}
+	if err := CheckStorage(); err != nil {
+		return nil, err
+	}
+	storage.Lock()
+	defer storage.Unlock()
+	return storage.latest, nil
+}
@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// IsWatching reports whether a user is told about new comments on a post.
+// A choice made with the watch toggle wins; otherwise authors watch their
+// own posts unless their preferences say not to.
+func (db *DataBase) IsWatching(post *Post, userUUID string) (bool, error) {
+	var watching bool
+	err := db.Conn.QueryRow(
+		"SELECT watching FROM post_subscriptions WHERE post_id = ? AND user_uuid = ?", post.ID, userUUID,
+	).Scan(&watching)
+	if err == nil {
+		return watching, nil
+	}
+	if post.Author.UUID != userUUID {
+		return false, nil
+	}
+	return db.GetBoolPreference(userUUID, PrefWatchOwnPosts)
+}
+
+// SetWatching records a user's choice to watch a post or stop watching it.
+// Stopping is remembered so commenting again doesn't subscribe them anew.
+func (db *DataBase) SetWatching(postID int, userUUID string, watching bool) error {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	_, err := db.Conn.Exec(
+		`INSERT INTO post_subscriptions (post_id, user_uuid, watching, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(post_id, user_uuid) DO UPDATE SET watching = excluded.watching, created_at = excluded.created_at`,
+		postID, userUUID, watching, Timestamp(),
+	)
+	return err
+}
+
+// watchCommentedPost subscribes a commenter to the thread through ex, unless
+// they already made a choice for it. Authors watch their posts without
+// a subscription.
+func watchCommentedPost(ex execer, post *Post, userUUID string) error {
+	if post.Author.UUID == userUUID {
+		return nil
+	}
+	_, err := ex.Exec(
+		"INSERT OR IGNORE INTO post_subscriptions (post_id, user_uuid, watching, created_at) VALUES (?, ?, 1, ?)",
+		post.ID, userUUID, Timestamp(),
+	)
+	return err
+}
+
+// listWatchers returns the UUIDs of the registered users watching a post,
+// other than exceptUUID
+func (db *DataBase) listWatchers(post *Post, exceptUUID string) ([]string, error) {
+	rows, err := db.Conn.Query(
+		`SELECT u.uuid FROM users u
+		WHERE u.notregistered = 0 AND u.uuid != ? AND (
+			u.uuid IN (SELECT user_uuid FROM post_subscriptions WHERE post_id = ? AND watching = 1)
+			OR (u.uuid = ? AND NOT EXISTS (SELECT 1 FROM post_subscriptions WHERE post_id = ? AND user_uuid = u.uuid))
+		)`,
+		exceptUUID, post.ID, post.Author.UUID, post.ID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var watchers []string
+	for rows.Next() {
+		var uuid string
+		if err := rows.Scan(&uuid); err != nil {
+			return nil, err
+		}
+		watchers = append(watchers, uuid)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Authors without a subscription only watch if their preferences say so
+	kept := watchers[:0]
+	for _, uuid := range watchers {
+		if uuid == post.Author.UUID {
+			if watching, err := db.IsWatching(post, uuid); err != nil || !watching {
+				continue
+			}
+		}
+		kept = append(kept, uuid)
+	}
+	return kept, nil
+}
+
+// WatchPostHandler handles POST /post/{id}/watch. The form sends watch=1
+// to watch the post or 0 to stop.
+func WatchPostHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if user.NotRegistered {
+		RenderError(w, "Register to watch posts", http.StatusForbidden)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		RenderError(w, "Post not found", http.StatusNotFound)
+		return
+	}
+	post, err := db.GetPost(id)
+	if err != nil || post.IsDeleted() || post.IsDraft() || post.IsMerged() {
+		RenderError(w, "Post not found", http.StatusNotFound)
+		return
+	}
+
+	if err := db.SetWatching(post.ID, user.UUID, r.FormValue("watch") == "1"); err != nil {
+		RenderError(w, "Failed to update watching", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/post/"+strconv.Itoa(post.ID)+"#watch", http.StatusSeeOther)
+}
@@ -0,0 +1,222 @@
+package utils
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Summarizer writes a short summary of a discussion thread
+type Summarizer interface {
+	// Name labels summaries so readers know where they came from
+	Name() string
+	Summarize(title, thread string) (string, error)
+}
+
+// ErrSummaryUnavailable is returned when no summary service is configured
+var ErrSummaryUnavailable = errors.New("thread summaries are not available")
+
+// SummaryInputLimit caps how much of a thread, in characters, is sent to
+// the summarizer. Longer threads are cut off at the end.
+const SummaryInputLimit = 20000
+
+// SummaryBatchSize is how many threads one run of the summary job handles
+const SummaryBatchSize = 20
+
+// summarizer is the configured service; see SummarizeURL
+var summarizer = newSummarizer()
+
+func newSummarizer() Summarizer {
+	if SummarizeURL == "" {
+		return noopSummarizer{}
+	}
+	return &httpSummarizer{
+		url:    SummarizeURL,
+		key:    SummarizeKey,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// SummariesEnabled reports whether a summary service is configured
+func SummariesEnabled() bool {
+	_, noop := summarizer.(noopSummarizer)
+	return !noop
+}
+
+// noopSummarizer is used when no service is configured
+type noopSummarizer struct{}
+
+func (noopSummarizer) Name() string { return "" }
+
+func (noopSummarizer) Summarize(string, string) (string, error) {
+	return "", ErrSummaryUnavailable
+}
+
+// httpSummarizer posts {"title", "text"} as JSON to a summary service and
+// expects {"summary"} back, or {"error"} with a non-200 status
+type httpSummarizer struct {
+	url    string
+	key    string
+	client *http.Client
+}
+
+func (s *httpSummarizer) Name() string { return "summary service" }
+
+func (s *httpSummarizer) Summarize(title, thread string) (string, error) {
+	payload, err := json.Marshal(map[string]string{"title": title, "text": thread})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.key != "" {
+		req.Header.Set("Authorization", "Bearer "+s.key)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Summary string `json:"summary"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("summary service: %s (%d)", result.Error, resp.StatusCode)
+	}
+	return strings.TrimSpace(result.Summary), nil
+}
+
+// threadText flattens a post and its comments into the text handed to the
+// summarizer, one message per paragraph
+func threadText(post *Post, comments []Comment) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %s\n\n", post.Author.Username, PlainText(post.Content))
+	for _, c := range comments {
+		fmt.Fprintf(&b, "%s: %s\n\n", c.Author.Username, PlainText(c.Content))
+	}
+	text := []rune(b.String())
+	if len(text) > SummaryInputLimit {
+		text = text[:SummaryInputLimit]
+	}
+	return strings.TrimSpace(string(text))
+}
+
+// GetThreadSummary returns the cached summary of a post's thread, or nil
+// when there is none
+func (db *DataBase) GetThreadSummary(postID int) (*ThreadSummary, error) {
+	var (
+		s         ThreadSummary
+		createdAt string
+	)
+	err := db.Conn.QueryRow(
+		"SELECT summary, provider, comment_count, created_at FROM post_summaries WHERE post_id = ?", postID,
+	).Scan(&s.Summary, &s.Provider, &s.CommentCount, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.CreatedAt, _ = ParseTimestamp(createdAt)
+	return &s, nil
+}
+
+// SummarizeThread generates and caches a new summary of a post's thread
+func (db *DataBase) SummarizeThread(postID int) error {
+	if !SummariesEnabled() {
+		return ErrSummaryUnavailable
+	}
+	post, err := db.GetPost(postID)
+	if err != nil {
+		return err
+	}
+	comments, err := db.ListComments(postID)
+	if err != nil {
+		return err
+	}
+
+	summary, err := summarizer.Summarize(post.Title, threadText(post, comments))
+	if err != nil {
+		return err
+	}
+	if summary == "" {
+		return errors.New("summary service returned an empty summary")
+	}
+
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	_, err = db.Conn.Exec(
+		`INSERT INTO post_summaries (post_id, summary, provider, comment_count, created_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(post_id) DO UPDATE SET summary = excluded.summary, provider = excluded.provider,
+			comment_count = excluded.comment_count, created_at = excluded.created_at`,
+		postID, summary, summarizer.Name(), len(comments), Timestamp(),
+	)
+	return err
+}
+
+// threadsToSummarize returns published posts with at least
+// SummaryMinComments comments that have no summary yet, or have gained
+// SummaryRefreshComments comments since theirs was written
+func (db *DataBase) threadsToSummarize(limit int) ([]int, error) {
+	rows, err := db.Conn.Query(
+		`SELECT p.id
+		FROM posts p
+		JOIN comments c ON c.post_id = p.id
+		LEFT JOIN post_summaries s ON s.post_id = p.id
+		WHERE p.deleted_at = '' AND p.status = ?
+		GROUP BY p.id
+		HAVING COUNT(c.id) >= ? AND (MAX(s.post_id) IS NULL OR COUNT(c.id) - MAX(s.comment_count) >= ?)
+		ORDER BY COUNT(c.id) DESC
+		LIMIT ?`,
+		PostPublished, SummaryMinComments, SummaryRefreshComments, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// SummarizeThreads is the summary job: it summarizes long threads and
+// refreshes summaries that many comments have arrived since. It does
+// nothing while no summary service is configured.
+func SummarizeThreads() error {
+	if !SummariesEnabled() {
+		return nil
+	}
+	ids, err := db.threadsToSummarize(SummaryBatchSize)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := db.SummarizeThread(id); err != nil {
+			return fmt.Errorf("post %d: %w", id, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"net/http"
+	"time"
+)
+
+// TestClockHandler handles GET and POST /test/clock in test mode. POST moves
+// the clock, either to ?set= (RFC3339) or forward by ?advance= (a Go
+// duration such as 25h). Both return the clock's time.
+func TestClockHandler(w http.ResponseWriter, r *http.Request) {
+	tc, ok := clock.(*TestClock)
+	if !TestMode || !ok {
+		RenderError(w, "Page not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if set := r.FormValue("set"); set != "" {
+			t, err := time.Parse(time.RFC3339, set)
+			if err != nil {
+				WriteJSON(w, http.StatusBadRequest, map[string]string{"error": "set must be an RFC3339 time"})
+				return
+			}
+			tc.Set(t)
+		}
+		if advance := r.FormValue("advance"); advance != "" {
+			d, err := time.ParseDuration(advance)
+			if err != nil {
+				WriteJSON(w, http.StatusBadRequest, map[string]string{"error": "advance must be a duration"})
+				return
+			}
+			tc.Advance(d)
+		}
+	default:
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	WriteJSON(w, http.StatusOK, map[string]string{"now": FormatTimestamp(tc.Now())})
+}
+
+// RunJobHandler handles POST /test/jobs/{name} in test mode, running one
+// background job to completion
+func RunJobHandler(w http.ResponseWriter, r *http.Request) {
+	if !TestMode {
+		RenderError(w, "Page not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	for _, j := range jobs {
+		if j.Name != r.PathValue("name") {
+			continue
+		}
+		if err := j.Run(); err != nil {
+			WriteJSON(w, http.StatusInternalServerError, map[string]string{"job": j.Name, "error": err.Error()})
+			return
+		}
+		WriteJSON(w, http.StatusOK, map[string]string{"job": j.Name, "status": "ok"})
+		return
+	}
+	WriteJSON(w, http.StatusNotFound, map[string]string{"error": "unknown job"})
+}
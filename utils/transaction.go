@@ -0,0 +1,135 @@
+package utils
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrNoRequestTx is returned by RequestTx outside a Transactional handler
+var ErrNoRequestTx = errors.New("request has no transaction")
+
+type requestTxKey struct{}
+
+// requestTx is the transaction of one request. It is only opened when the
+// handler first asks for it, so everything the handler does before that,
+// like checking the session, runs outside it.
+type requestTx struct {
+	tx   *sql.Tx
+	done bool
+}
+
+// begin opens the transaction, taking the database's write lock until
+// finish is called
+func (t *requestTx) begin() (*sql.Tx, error) {
+	if t.done {
+		return nil, errors.New("request transaction already finished")
+	}
+	if t.tx == nil {
+		db.Write.Lock()
+		tx, err := db.Conn.Begin()
+		if err != nil {
+			db.Write.Unlock()
+			return nil, err
+		}
+		t.tx = tx
+	}
+	return t.tx, nil
+}
+
+// finish commits or rolls back the transaction, if one was opened, and
+// releases the write lock
+func (t *requestTx) finish(commit bool) error {
+	if t.done {
+		return nil
+	}
+	t.done = true
+	if t.tx == nil {
+		return nil
+	}
+	defer db.Write.Unlock()
+	if commit {
+		return t.tx.Commit()
+	}
+	return t.tx.Rollback()
+}
+
+// RequestTx returns the transaction of a request served by a Transactional
+// handler, opening it on first use. Once it is open the handler holds the
+// database's write lock, so it must make the rest of its writes through
+// the transaction rather than DataBase methods that take the lock.
+func RequestTx(r *http.Request) (*sql.Tx, error) {
+	t, ok := r.Context().Value(requestTxKey{}).(*requestTx)
+	if !ok {
+		return nil, ErrNoRequestTx
+	}
+	return t.begin()
+}
+
+// txResponseWriter settles the request transaction just before the status
+// line is sent: success commits and an error status rolls back. A failed
+// commit replaces the handler's response with a 500.
+type txResponseWriter struct {
+	http.ResponseWriter
+	tx          *requestTx
+	wroteHeader bool
+	failed      bool
+}
+
+func (w *txResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if err := w.tx.finish(status < http.StatusBadRequest); err != nil {
+		w.failed = true
+		ReportError(Diagnostics{Title: "Failed to commit request transaction", Error: err.Error()})
+		w.Header().Del("Location")
+		RenderError(w.ResponseWriter, "Failed to save your changes", http.StatusInternalServerError)
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *txResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.failed {
+		// The error page has already been written
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Transactional wraps a handler of mutating requests in one database
+// transaction, available through RequestTx. The transaction commits when
+// the handler responds with a success or redirect status, and rolls back
+// when it responds with an error or panics. GET and HEAD requests pass
+// through untouched.
+func Transactional(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next(w, r)
+			return
+		}
+
+		t := &requestTx{}
+		tw := &txResponseWriter{ResponseWriter: w, tx: t}
+		defer func() {
+			if rec := recover(); rec != nil {
+				if err := t.finish(false); err != nil {
+					rec = fmt.Sprintf("%v (and rolling back failed: %v)", rec, err)
+				}
+				panic(rec)
+			}
+		}()
+
+		next(tw, r.WithContext(context.WithValue(r.Context(), requestTxKey{}, t)))
+		if !tw.wroteHeader {
+			tw.WriteHeader(http.StatusOK)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package utils
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Translator machine-translates text into a target language
+type Translator interface {
+	// Name labels translations so readers know where they came from
+	Name() string
+	Translate(text, targetLang string) (string, error)
+}
+
+// ErrTranslationUnavailable is returned when no translation service is configured
+var ErrTranslationUnavailable = errors.New("translation is not available")
+
+// TranslationLanguage is a language readers can translate posts into
+type TranslationLanguage struct {
+	Code string
+	Name string
+}
+
+// TranslationLanguages lists the target languages offered on post pages
+var TranslationLanguages = []TranslationLanguage{
+	{"en", "English"},
+	{"ar", "Arabic"},
+	{"fr", "French"},
+	{"es", "Spanish"},
+	{"de", "German"},
+}
+
+// translator is the configured service; see TranslateURL
+var translator = newTranslator()
+
+func newTranslator() Translator {
+	if TranslateURL == "" {
+		return noopTranslator{}
+	}
+	return &libreTranslator{
+		url:    strings.TrimSuffix(TranslateURL, "/") + "/translate",
+		key:    TranslateKey,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// TranslationEnabled reports whether a translation service is configured
+func TranslationEnabled() bool {
+	_, noop := translator.(noopTranslator)
+	return !noop
+}
+
+// noopTranslator is used when no service is configured
+type noopTranslator struct{}
+
+func (noopTranslator) Name() string { return "" }
+
+func (noopTranslator) Translate(string, string) (string, error) {
+	return "", ErrTranslationUnavailable
+}
+
+// libreTranslator talks to a LibreTranslate-compatible HTTP API
+type libreTranslator struct {
+	url    string
+	key    string
+	client *http.Client
+}
+
+func (t *libreTranslator) Name() string { return "LibreTranslate" }
+
+func (t *libreTranslator) Translate(text, targetLang string) (string, error) {
+	payload, err := json.Marshal(map[string]string{
+		"q":       text,
+		"source":  "auto",
+		"target":  targetLang,
+		"format":  "text",
+		"api_key": t.key,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := t.client.Post(t.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		TranslatedText string `json:"translatedText"`
+		Error          string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("translation service: %s (%d)", result.Error, resp.StatusCode)
+	}
+	return result.TranslatedText, nil
+}
+
+// isTranslationLanguage reports whether lang is one of TranslationLanguages
+func isTranslationLanguage(lang string) bool {
+	for _, l := range TranslationLanguages {
+		if l.Code == lang {
+			return true
+		}
+	}
+	return false
+}
+
+// TranslatePost returns a post translated into lang. Translations are cached
+// and redone only when the post has been edited since.
+func (db *DataBase) TranslatePost(post *Post, lang string) (*PostTranslation, error) {
+	if !TranslationEnabled() {
+		return nil, ErrTranslationUnavailable
+	}
+	if !isTranslationLanguage(lang) {
+		return nil, errors.New("unsupported language")
+	}
+	version := FormatTimestamp(post.EditedAt)
+
+	tr := PostTranslation{Lang: lang}
+	err := db.Conn.QueryRow(
+		`SELECT title, content, provider FROM post_translations
+		WHERE post_id = ? AND lang = ? AND source_edited_at = ?`,
+		post.ID, lang, version,
+	).Scan(&tr.Title, &tr.Content, &tr.Provider)
+	if err == nil {
+		return &tr, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	if tr.Title, err = translator.Translate(post.Title, lang); err != nil {
+		return nil, err
+	}
+	if tr.Content, err = translator.Translate(post.Content, lang); err != nil {
+		return nil, err
+	}
+	tr.Provider = translator.Name()
+
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	_, err = db.Conn.Exec(
+		`INSERT INTO post_translations (post_id, lang, title, content, provider, source_edited_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(post_id, lang) DO UPDATE SET title = excluded.title, content = excluded.content,
+			provider = excluded.provider, source_edited_at = excluded.source_edited_at`,
+		post.ID, lang, tr.Title, tr.Content, tr.Provider, version,
+	)
+	return &tr, err
+}
@@ -0,0 +1,200 @@
+package utils
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// TrashedPost is a deleted post listed in the trash
+type TrashedPost struct {
+	ID        int
+	Title     string
+	Author    string
+	DeletedBy string
+	DeletedAt time.Time
+}
+
+// DeletePost moves a post to the trash. It stays in the database, hidden
+// from listings, until it is restored.
+func (db *DataBase) DeletePost(postID int, actorUUID string) error {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		"UPDATE posts SET deleted_at = ?, deleted_by = ? WHERE id = ? AND deleted_at = ''",
+		Timestamp(), actorUUID, postID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("post is already deleted")
+	}
+	if err := recordPostHistory(tx, postID, actorUUID, "deleted", ""); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RestorePost takes a post back out of the trash
+func (db *DataBase) RestorePost(postID int, actorUUID string) error {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		"UPDATE posts SET deleted_at = '', deleted_by = '' WHERE id = ? AND deleted_at != ''", postID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("post is not in the trash")
+	}
+	if err := recordPostHistory(tx, postID, actorUUID, "restored", ""); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ListTrash returns deleted posts, most recently deleted first. Staff see
+// every deleted post; other users only their own.
+func (db *DataBase) ListTrash(user *User) ([]TrashedPost, error) {
+	query := `SELECT p.id, p.title, a.username, COALESCE(d.username, ''), p.deleted_at
+		FROM posts p
+		JOIN users a ON a.uuid = p.author_uuid
+		LEFT JOIN users d ON d.uuid = p.deleted_by
+		WHERE p.deleted_at != ''`
+	args := []interface{}{}
+	if user.IsStaff() {
+		// Staff see every post but other people's drafts
+		query += " AND (p.status = ? OR p.author_uuid = ?)"
+		args = append(args, PostPublished, user.UUID)
+	} else {
+		query += " AND p.author_uuid = ?"
+		args = append(args, user.UUID)
+	}
+	query += " ORDER BY p.deleted_at DESC"
+
+	rows, err := db.Conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var posts []TrashedPost
+	for rows.Next() {
+		var (
+			p         TrashedPost
+			deletedAt string
+		)
+		if err := rows.Scan(&p.ID, &p.Title, &p.Author, &p.DeletedBy, &deletedAt); err != nil {
+			return nil, err
+		}
+		p.DeletedAt, _ = ParseTimestamp(deletedAt)
+		posts = append(posts, p)
+	}
+	return posts, rows.Err()
+}
+
+// managedPostFromForm loads the post named by the id form value and checks
+// the current user may manage it. It writes the response and returns false
+// if not.
+func managedPostFromForm(w http.ResponseWriter, r *http.Request) (*User, *Post, bool) {
+	if r.Method != http.MethodPost {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, nil, false
+	}
+
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil, nil, false
+	}
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		RenderError(w, "Invalid post", http.StatusBadRequest)
+		return nil, nil, false
+	}
+	post, err := db.GetPost(id)
+	if err != nil {
+		RenderError(w, "Post not found", http.StatusNotFound)
+		return nil, nil, false
+	}
+	if !CanManagePost(user, post) {
+		RenderError(w, "You can't change this post", http.StatusForbidden)
+		return nil, nil, false
+	}
+	return user, post, true
+}
+
+// DeletePostHandler handles POST /post/delete
+func DeletePostHandler(w http.ResponseWriter, r *http.Request) {
+	user, post, ok := managedPostFromForm(w, r)
+	if !ok {
+		return
+	}
+
+	if err := db.DeletePost(post.ID, user.UUID); err != nil {
+		RenderError(w, "Delete failed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, "/trash", http.StatusSeeOther)
+}
+
+// RestorePostHandler handles POST /post/restore
+func RestorePostHandler(w http.ResponseWriter, r *http.Request) {
+	user, post, ok := managedPostFromForm(w, r)
+	if !ok {
+		return
+	}
+
+	if err := db.RestorePost(post.ID, user.UUID); err != nil {
+		RenderError(w, "Restore failed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, "/post/"+strconv.Itoa(post.ID), http.StatusSeeOther)
+}
+
+// TrashHandler handles GET /trash
+func TrashHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	posts, err := db.ListTrash(user)
+	if err != nil {
+		RenderError(w, "Failed to load trash", http.StatusInternalServerError)
+		return
+	}
+	loc := db.GetLocationPreference(user.UUID)
+	for i := range posts {
+		posts[i].DeletedAt = posts[i].DeletedAt.In(loc)
+	}
+
+	InitTemplate(w, "templates/trash.html", map[string]interface{}{
+		"Posts":   posts,
+		"IsStaff": user.IsStaff(),
+	})
+}
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"database/sql"
+	"strings"
 	"sync"
 	"time"
 
@@ -10,9 +11,18 @@ import (
 
 const SessionTimeout = 1 * time.Hour
 
+// User roles
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
 type DataBase struct {
 	Conn  *sql.DB
 	Write sync.Mutex
+	// Path is the SQLite file the connection was opened on
+	Path string
 }
 
 type User struct {
@@ -24,23 +34,191 @@ type User struct {
 	UUID          string
 	Lastseen      time.Time
 	LoggedIn      bool
+	Role          string
+	// SuspendedUntil is zero when the account isn't suspended
+	SuspendedUntil time.Time
+	// AvatarKey names the user's identicon, see NewAvatarKey
+	AvatarKey string
+}
+
+// IsSuspended reports whether the account is currently suspended
+func (u *User) IsSuspended() bool {
+	return Now().Before(u.SuspendedUntil)
+}
+
+// IsStaff reports whether the user is a moderator or an admin
+func (u *User) IsStaff() bool {
+	return u.Role == RoleModerator || u.Role == RoleAdmin
+}
+
+// IsAdmin reports whether the user is an admin
+func (u *User) IsAdmin() bool {
+	return u.Role == RoleAdmin
 }
 
 type Post struct {
-	ID       int
-	Title    string
-	Content  string
-	Author   User
-	Comments []Comment
-	Likes    []Interaction
-	DisLikes []Interaction
+	ID         int
+	Title      string
+	Content    string
+	Author     User
+	Categories []Category
+	Comments   []Comment
+	Likes      []Interaction
+	DisLikes   []Interaction
+	// Attachments are loaded by GetPost
+	Attachments []Attachment
+	CreatedAt   time.Time
+	// EditedAt is zero until the post is edited
+	EditedAt time.Time
+	// DeletedAt is zero unless the post is in the trash
+	DeletedAt time.Time
+	// Status is PostPublished, PostDraft or PostMerged
+	Status string
+	// LockedAt is zero unless the post is locked to new comments
+	LockedAt time.Time
+	// ArchivedAt is zero unless the archive job locked the post for
+	// going quiet; see ArchiveStalePosts
+	ArchivedAt time.Time
+	// AcceptedCommentID is the accepted answer of a question, or 0
+	AcceptedCommentID int
+	// Announcement is set by ListPosts when the post is an announcement in
+	// the category being listed
+	Announcement bool
+	// Pinned is set by ListPosts when the post is pinned globally or in the
+	// category being listed
+	Pinned bool
+	// Views counts distinct sessions per day; see RecordPostView
+	Views int
+	// CommentCount, LikeCount and DislikeCount are counted by ListPosts
+	CommentCount int
+	LikeCount    int
+	DislikeCount int
+	// CoAuthors are the usernames of the co-authors who accepted
+	CoAuthors []string
+	ContentFlags
+	// Revealed is set by LoadPostPage when the viewer chose to always see
+	// flagged posts
+	Revealed bool
+}
+
+// Concealed reports whether listings should hide the post's text behind a
+// click-through
+func (p *Post) Concealed() bool {
+	return p.Flagged() && !p.Revealed
+}
+
+// ContentFlags are the content warnings an author can put on a post.
+// Listings hide flagged posts' text behind a click-through.
+type ContentFlags struct {
+	NSFW    bool
+	Spoiler bool
+}
+
+// Flagged reports whether any content warning is set
+func (f ContentFlags) Flagged() bool {
+	return f.NSFW || f.Spoiler
+}
+
+// Warning names the content warnings that are set
+func (f ContentFlags) Warning() string {
+	var names []string
+	if f.NSFW {
+		names = append(names, "NSFW")
+	}
+	if f.Spoiler {
+		names = append(names, "Spoiler")
+	}
+	return strings.Join(names, ", ")
+}
+
+// Post statuses. Drafts are only visible to their author. A merged post
+// was folded into another and redirects to it.
+const (
+	PostPublished = "published"
+	PostDraft     = "draft"
+	PostMerged    = "merged"
+)
+
+// IsDraft reports whether the post hasn't been published yet
+func (p *Post) IsDraft() bool {
+	return p.Status == PostDraft
+}
+
+// IsMerged reports whether the post was merged into another
+func (p *Post) IsMerged() bool {
+	return p.Status == PostMerged
+}
+
+// PostHistoryEntry records a change made to a post after publishing
+type PostHistoryEntry struct {
+	ID        int
+	Actor     string
+	Action    string
+	Details   string
+	CreatedAt time.Time
+}
+
+// IsDeleted reports whether the post is in the trash
+func (p *Post) IsDeleted() bool {
+	return !p.DeletedAt.IsZero()
+}
+
+// IsLocked reports whether the post is closed to new comments
+func (p *Post) IsLocked() bool {
+	return !p.LockedAt.IsZero()
+}
+
+// IsArchived reports whether the post was archived. Archived posts are
+// locked and read-only until a moderator unlocks them.
+func (p *Post) IsArchived() bool {
+	return !p.ArchivedAt.IsZero()
 }
 
 type Comment struct {
-	ID      int
-	Content string
-	Author  User
-	Post    Post
+	ID        int
+	Content   string
+	Author    User
+	Post      Post
+	CreatedAt time.Time
+	// EditedAt is zero unless the comment was edited. DeletedAt is zero
+	// unless it was deleted, which empties its content.
+	EditedAt  time.Time
+	DeletedAt time.Time
+	// HiddenAt is zero unless a moderator hid the comment; see
+	// SetCommentHidden
+	HiddenAt time.Time
+	// ParentID is the comment this one replies to, 0 for top-level comments
+	ParentID int
+	// Depth and ReplyTo are set by ListCommentTree. Depth is capped at
+	// CommentMaxDepth; deeper replies name who they reply to instead.
+	Depth   int
+	ReplyTo string
+	// threadDepth is Depth before the cap
+	threadDepth int
+	// HiddenReplies counts the replies collapsed under this one on post
+	// pages; see collapseReplies
+	HiddenReplies int
+	// Likes and Dislikes are counted by ListComments and ListCommentTree.
+	// Reaction is the viewer's own, set on post pages.
+	Likes    int
+	Dislikes int
+	Reaction string
+	// Accepted marks the accepted answer of a question, on post pages
+	Accepted bool
+	// EmojiReactions are set on post pages; see PostReactions
+	EmojiReactions []ReactionCount
+	// CanEdit is set on post pages; see CanEditComment
+	CanEdit bool
+}
+
+// IsDeleted reports whether the comment was deleted
+func (c Comment) IsDeleted() bool {
+	return !c.DeletedAt.IsZero()
+}
+
+// IsHidden reports whether a moderator hid the comment
+func (c Comment) IsHidden() bool {
+	return !c.HiddenAt.IsZero()
 }
 
 type Reply struct {
@@ -51,8 +229,18 @@ type Reply struct {
 }
 
 type Category struct {
-	ID   int
-	Name string
+	ID          int
+	Name        string
+	Description string
+	Archived    bool
+	// QA categories are for questions, whose authors can accept an answer
+	QA bool
+	// ParentID is 0 for top-level categories
+	ParentID int
+	// PostCount is only filled in by ListCategoryStats
+	PostCount int
+	// Children is only filled in by CategoryTree
+	Children []Category
 }
 
 type Interaction struct {
@@ -80,6 +268,84 @@ type SubForum struct {
 	Admins  []User
 }
 
+// PrivacySettings controls what other users can see on a profile
+type PrivacySettings struct {
+	ShowGravatar bool
+	ShowActivity bool
+	ShowOnline   bool
+	ShowLiked    bool
+}
+
+// UserNote is a private staff note attached to a user account
+type UserNote struct {
+	ID        int
+	Author    string
+	Note      string
+	CreatedAt time.Time
+}
+
+// Warning is a formal staff warning issued to a user
+type Warning struct {
+	ID        int
+	Issuer    string
+	Severity  string
+	Reason    string
+	CreatedAt time.Time
+}
+
+// WarningThreshold suspends an account once its warning points reach Points.
+// A SuspendDays of 0 suspends the account indefinitely.
+type WarningThreshold struct {
+	Points      int
+	SuspendDays int
+}
+
+// MaintenanceWindow is a scheduled period during which only admins can use the site
+type MaintenanceWindow struct {
+	ID       int
+	StartsAt time.Time
+	EndsAt   time.Time
+	Message  string
+}
+
+// BanAppeal is a suspended user's request to be reinstated
+type BanAppeal struct {
+	ID             int
+	Username       string
+	SuspendedUntil time.Time
+	Message        string
+	Status         string
+	DecidedBy      string
+	DecisionReason string
+	CreatedAt      time.Time
+	DecidedAt      time.Time
+}
+
+// DataExport is a user's request for an archive of their data
+type DataExport struct {
+	ID          int
+	Status      string
+	CreatedAt   time.Time
+	CompletedAt time.Time
+}
+
+// PostTranslation is a machine translation of a post
+type PostTranslation struct {
+	Lang     string
+	Title    string
+	Content  string
+	Provider string
+}
+
+// ThreadSummary is a generated summary of a post and its comments
+type ThreadSummary struct {
+	Summary  string
+	Provider string
+	// CommentCount is how many comments the thread had when summarized
+	CommentCount int
+	CreatedAt    time.Time
+}
+
 type HomeData struct {
 	UserLoggedIn bool
 	Username     string
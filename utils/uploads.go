@@ -0,0 +1,246 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // registers the GIF decoder for image.DecodeConfig
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+// UploadDir is where uploaded images are stored
+const UploadDir = "uploads"
+
+// Limits on images attached to posts
+const (
+	MaxImageBytes    = 5 << 20
+	MaxImageSide     = 8000
+	MaxImagesPerPost = 8
+)
+
+// uploadFilePattern matches the generated names UploadHandler will serve
+var uploadFilePattern = regexp.MustCompile(`^[0-9a-f]{32}\.(jpg|png|gif)$`)
+
+// uploadImageTypes maps accepted image types, as sniffed from the file
+// itself, to the extension they are stored with
+var uploadImageTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// PostImage is an image attached to a post
+type PostImage struct {
+	ID   int
+	File string
+}
+
+// URL is where the image is served from
+func (img PostImage) URL() string {
+	return "/uploads/" + img.File
+}
+
+// ImageUpload is an uploaded image that passed validation but isn't saved yet
+type ImageUpload struct {
+	Name string
+	data []byte
+	ext  string
+}
+
+// ReadImageUploads validates the images uploaded in a form field. The type
+// is taken from the file's content rather than its name, and the image
+// header must decode, so renamed or truncated files are turned away.
+func ReadImageUploads(r *http.Request, field string) ([]ImageUpload, error) {
+	if r.MultipartForm == nil {
+		return nil, nil
+	}
+
+	var uploads []ImageUpload
+	for _, fh := range r.MultipartForm.File[field] {
+		if fh.Size == 0 {
+			continue
+		}
+		if fh.Size > MaxImageBytes {
+			return nil, fmt.Errorf("%s is larger than %d MB", fh.Filename, MaxImageBytes>>20)
+		}
+		f, err := fh.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(io.LimitReader(f, MaxImageBytes+1))
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > MaxImageBytes {
+			return nil, fmt.Errorf("%s is larger than %d MB", fh.Filename, MaxImageBytes>>20)
+		}
+
+		ext, ok := uploadImageTypes[http.DetectContentType(data)]
+		if !ok {
+			return nil, fmt.Errorf("%s isn't a JPEG, PNG or GIF image", fh.Filename)
+		}
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s couldn't be read as an image", fh.Filename)
+		}
+		if cfg.Width > MaxImageSide || cfg.Height > MaxImageSide {
+			return nil, fmt.Errorf("%s is larger than %d pixels on a side", fh.Filename, MaxImageSide)
+		}
+		uploads = append(uploads, ImageUpload{Name: fh.Filename, data: data, ext: ext})
+	}
+	return uploads, nil
+}
+
+// ListPostImages returns a post's images in upload order
+func (db *DataBase) ListPostImages(postID int) ([]PostImage, error) {
+	rows, err := db.Conn.Query("SELECT id, file FROM post_images WHERE post_id = ? ORDER BY id", postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var images []PostImage
+	for rows.Next() {
+		var img PostImage
+		if err := rows.Scan(&img.ID, &img.File); err != nil {
+			return nil, err
+		}
+		images = append(images, img)
+	}
+	return images, rows.Err()
+}
+
+// savePostImages writes uploads to UploadDir under random names and
+// attaches them to a post as part of the caller's transaction. Files
+// already written are removed if anything fails.
+func savePostImages(ex execer, postID int, uploads []ImageUpload, uploaderUUID string) (err error) {
+	if len(uploads) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(UploadDir, 0o755); err != nil {
+		return err
+	}
+
+	var written []string
+	defer func() {
+		if err != nil {
+			for _, path := range written {
+				os.Remove(path)
+			}
+		}
+	}()
+
+	for _, up := range uploads {
+		raw := make([]byte, 16)
+		if _, err := rand.Read(raw); err != nil {
+			return err
+		}
+		file := hex.EncodeToString(raw) + up.ext
+		path := filepath.Join(UploadDir, file)
+		if err := os.WriteFile(path, up.data, 0o644); err != nil {
+			return err
+		}
+		written = append(written, path)
+
+		if _, err := ex.Exec(
+			"INSERT INTO post_images (post_id, file, uploader_uuid, created_at) VALUES (?, ?, ?, ?)",
+			postID, file, uploaderUUID, Timestamp(),
+		); err != nil {
+			return err
+		}
+	}
+	return recordPostHistory(ex, postID, uploaderUUID, "images added", strconv.Itoa(len(uploads)))
+}
+
+// UpdatePostImages adds uploads to a post and removes the images listed in
+// removeIDs, keeping the post within MaxImagesPerPost
+func (db *DataBase) UpdatePostImages(postID int, uploads []ImageUpload, removeIDs []int, actorUUID string) error {
+	if len(uploads) == 0 && len(removeIDs) == 0 {
+		return nil
+	}
+	current, err := db.ListPostImages(postID)
+	if err != nil {
+		return err
+	}
+
+	remove := make(map[int]bool, len(removeIDs))
+	for _, id := range removeIDs {
+		remove[id] = true
+	}
+	var removed []PostImage
+	for _, img := range current {
+		if remove[img.ID] {
+			removed = append(removed, img)
+		}
+	}
+	if len(current)-len(removed)+len(uploads) > MaxImagesPerPost {
+		return fmt.Errorf("a post can have at most %d images", MaxImagesPerPost)
+	}
+
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, img := range removed {
+		if _, err := tx.Exec("DELETE FROM post_images WHERE id = ? AND post_id = ?", img.ID, postID); err != nil {
+			return err
+		}
+	}
+	if len(removed) > 0 {
+		if err := recordPostHistory(tx, postID, actorUUID, "images removed", strconv.Itoa(len(removed))); err != nil {
+			return err
+		}
+	}
+	if err := savePostImages(tx, postID, uploads, actorUUID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// Files go only once the rows are gone for good
+	for _, img := range removed {
+		os.Remove(filepath.Join(UploadDir, img.File))
+	}
+	return nil
+}
+
+// UploadHandler handles GET /uploads/{file}
+func UploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	file := r.PathValue("file")
+	if !uploadFilePattern.MatchString(file) {
+		RenderError(w, "File not found", http.StatusNotFound)
+		return
+	}
+	path := filepath.Join(UploadDir, file)
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		RenderError(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	// Names are random and never reused, so the content never changes
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeFile(w, r, path)
+}
@@ -0,0 +1,161 @@
+package utils
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// UserSearchPageSize is the number of users returned per search page
+const UserSearchPageSize = 20
+
+// UserSearchResult is the public view of a user returned by the search endpoint
+type UserSearchResult struct {
+	Username string `json:"username"`
+	Avatar   string `json:"avatar"`
+}
+
+// UserSearchData is passed to the users template and encoded as JSON
+type UserSearchData struct {
+	Query      string             `json:"query"`
+	Page       int                `json:"page"`
+	TotalPages int                `json:"total_pages"`
+	Total      int                `json:"total"`
+	Users      []UserSearchResult `json:"users"`
+	PrevPage   int                `json:"-"`
+	NextPage   int                `json:"-"`
+}
+
+// escapeLike escapes the LIKE wildcards so user input is matched literally
+func escapeLike(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return r.Replace(s)
+}
+
+// PageFromRequest reads the 1-based ?page= parameter, defaulting to 1
+func PageFromRequest(r *http.Request) int {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		return 1
+	}
+	return page
+}
+
+// GetUserByUsername loads a registered user by username
+func (db *DataBase) GetUserByUsername(username string) (*User, error) {
+	var (
+		user      User
+		lastseen  string
+		suspended string
+	)
+	err := db.Conn.QueryRow(
+		"SELECT uuid, username, email, lastseen, loggedin, role, suspendeduntil, avatarkey FROM users WHERE username = ? AND notregistered = 0",
+		username,
+	).Scan(&user.UUID, &user.Username, &user.Email, &lastseen, &user.LoggedIn, &user.Role, &suspended, &user.AvatarKey)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errors.New("user not found")
+		}
+		return nil, err
+	}
+	user.Lastseen, _ = ParseTimestamp(lastseen)
+	user.SuspendedUntil, _ = ParseTimestamp(suspended)
+	return &user, nil
+}
+
+// SearchUsers finds registered users whose username starts with prefix.
+// It returns one page of results and the total number of matches.
+func (db *DataBase) SearchUsers(prefix string, limit, offset int) ([]UserSearchResult, int, error) {
+	pattern := escapeLike(prefix) + "%"
+
+	var total int
+	err := db.Conn.QueryRow(
+		`SELECT COUNT(*) FROM users WHERE notregistered = 0 AND username LIKE ? ESCAPE '\'`,
+		pattern,
+	).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.Conn.Query(
+		`SELECT u.avatarkey, u.username, u.email, COALESCE(p.value, 'true') = 'true'
+		FROM users u LEFT JOIN user_preferences p ON p.user_uuid = u.uuid AND p.key = '`+PrefShowGravatar+`'
+		WHERE u.notregistered = 0 AND u.username LIKE ? ESCAPE '\'
+		ORDER BY u.username COLLATE NOCASE
+		LIMIT ? OFFSET ?`,
+		pattern, limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	users := []UserSearchResult{}
+	for rows.Next() {
+		var (
+			u            UserSearchResult
+			key, email   string
+			showGravatar bool
+		)
+		if err := rows.Scan(&key, &u.Username, &email, &showGravatar); err != nil {
+			return nil, 0, err
+		}
+		// Respect the user's privacy settings in listings too
+		u.Avatar = AvatarURL(key, email, showGravatar)
+		users = append(users, u)
+	}
+	return users, total, rows.Err()
+}
+
+// UserSearchHandler handles GET /users/search?q=&page=
+// It renders HTML by default and JSON when requested.
+func UserSearchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, err := CurrentUser(w, r); err != nil {
+		if WantsJSON(r) {
+			WriteJSON(w, http.StatusUnauthorized, map[string]string{"error": "login required"})
+			return
+		}
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	page := PageFromRequest(r)
+
+	users, total, err := db.SearchUsers(query, UserSearchPageSize, (page-1)*UserSearchPageSize)
+	if err != nil {
+		if WantsJSON(r) {
+			WriteJSON(w, http.StatusInternalServerError, map[string]string{"error": "search failed"})
+			return
+		}
+		RenderError(w, "Search failed", http.StatusInternalServerError)
+		return
+	}
+
+	data := UserSearchData{
+		Query:      query,
+		Page:       page,
+		Total:      total,
+		TotalPages: (total + UserSearchPageSize - 1) / UserSearchPageSize,
+		Users:      users,
+	}
+	if page > 1 {
+		data.PrevPage = page - 1
+	}
+	if page < data.TotalPages {
+		data.NextPage = page + 1
+	}
+
+	if WantsJSON(r) {
+		WriteJSON(w, http.StatusOK, data)
+		return
+	}
+	InitTemplate(w, "templates/users.html", data)
+}
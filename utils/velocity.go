@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"net/http"
+	"time"
+)
+
+// VelocityLimit caps the number of accounts listed on the velocity dashboard
+const VelocityLimit = 25
+
+// velocityWindows are the time windows a moderator can pick
+var velocityWindows = map[string]time.Duration{
+	"hour": time.Hour,
+	"day":  24 * time.Hour,
+}
+
+// UserVelocity counts what one account created within a time window
+type UserVelocity struct {
+	Username  string
+	Role      string
+	Posts     int
+	Comments  int
+	Reactions int
+	Total     int
+}
+
+// ListUserVelocity returns the accounts that created the most content
+// (posts, comments and reactions) since the given time
+func (db *DataBase) ListUserVelocity(since time.Time, limit int) ([]UserVelocity, error) {
+	from := FormatTimestamp(since)
+	rows, err := db.Conn.Query(
+		`SELECT u.username, u.role,
+			SUM(a.kind = 'post'), SUM(a.kind = 'comment'), SUM(a.kind = 'reaction'),
+			COUNT(*) AS total
+		FROM (
+			SELECT author_uuid AS uuid, 'post' AS kind FROM posts WHERE created_at >= ?
+			UNION ALL
+			SELECT comment_author_uuid, 'comment' FROM comments WHERE created_at >= ?
+			UNION ALL
+			SELECT user_uuid, 'reaction' FROM interactions WHERE created_at >= ?
+			UNION ALL
+			SELECT user_uuid, 'reaction' FROM comment_interactions WHERE created_at >= ?
+			UNION ALL
+			SELECT user_uuid, 'reaction' FROM reactions WHERE created_at >= ?
+		) a JOIN users u ON u.uuid = a.uuid
+		GROUP BY a.uuid
+		ORDER BY total DESC, u.username
+		LIMIT ?`,
+		from, from, from, from, from, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []UserVelocity
+	for rows.Next() {
+		var v UserVelocity
+		if err := rows.Scan(&v.Username, &v.Role, &v.Posts, &v.Comments, &v.Reactions, &v.Total); err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, rows.Err()
+}
+
+// VelocityHandler handles GET /admin/velocity?window=hour|day
+func VelocityHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := RequireStaff(w, r); !ok {
+		return
+	}
+
+	window := r.URL.Query().Get("window")
+	duration, ok := velocityWindows[window]
+	if !ok {
+		window, duration = "hour", time.Hour
+	}
+
+	list, err := db.ListUserVelocity(Now().Add(-duration), VelocityLimit)
+	if err != nil {
+		RenderError(w, "Failed to load activity", http.StatusInternalServerError)
+		return
+	}
+
+	InitTemplate(w, "templates/admin_velocity.html", map[string]interface{}{
+		"Window":   window,
+		"Accounts": list,
+	})
+}
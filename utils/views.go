@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// postView is one viewer seeing one post on one day
+type postView struct {
+	PostID int
+	Viewer string
+	Day    string
+}
+
+// pendingViews collects views between runs of the views job, so rendering
+// a post page never waits on a database write
+var pendingViews struct {
+	sync.Mutex
+	views map[postView]bool
+}
+
+// viewDay is the day, in UTC, a view is counted under
+func viewDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// RecordPostView queues a view of a post. Each session counts once per post
+// per day; viewer is the session's user UUID.
+func RecordPostView(postID int, viewer string) {
+	pendingViews.Lock()
+	defer pendingViews.Unlock()
+	if pendingViews.views == nil {
+		pendingViews.views = make(map[postView]bool)
+	}
+	pendingViews.views[postView{postID, viewer, viewDay(Now())}] = true
+}
+
+// FlushPostViews is the views job. It writes the queued views, adding to a
+// post's count only for viewers not already counted that day, and forgets
+// the viewers of earlier days.
+func FlushPostViews() error {
+	pendingViews.Lock()
+	views := pendingViews.views
+	pendingViews.views = nil
+	pendingViews.Unlock()
+
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for v := range views {
+		res, err := tx.Exec("INSERT OR IGNORE INTO post_views (post_id, viewer, day) VALUES (?, ?, ?)", v.PostID, v.Viewer, v.Day)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		if _, err := tx.Exec("UPDATE posts SET views = views + 1 WHERE id = ?", v.PostID); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM post_views WHERE day < ?", viewDay(Now())); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
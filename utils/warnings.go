@@ -0,0 +1,337 @@
+package utils
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"forum/internal/notify"
+)
+
+// WarningSeverities lists the severities staff can pick, mildest first
+var WarningSeverities = []string{"low", "medium", "high"}
+
+// warningPoints is how much each severity counts towards suspension thresholds
+var warningPoints = map[string]int{
+	"low":    1,
+	"medium": 2,
+	"high":   3,
+}
+
+// PermanentSuspension is stored as the end of indefinite suspensions
+var PermanentSuspension = time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
+
+// SuspensionText describes when a suspension ends
+func SuspensionText(until time.Time) string {
+	if !until.Before(PermanentSuspension) {
+		return "indefinitely"
+	}
+	return "until " + until.Format("Jan 2, 2006 15:04 MST")
+}
+
+// warningPointsSQL sums a user's warning points in SQL
+const warningPointsSQL = `SELECT COALESCE(SUM(CASE severity
+		WHEN 'low' THEN 1 WHEN 'medium' THEN 2 WHEN 'high' THEN 3 ELSE 0 END), 0)
+	FROM warnings WHERE user_uuid = ?`
+
+// CanWarn reports whether issuer may warn user. Warnings can suspend, so
+// only admins may warn other staff.
+func CanWarn(issuer, user *User) bool {
+	return !user.IsStaff() || issuer.IsAdmin()
+}
+
+// IssueWarning records a warning, notifies the user of it and suspends
+// them if the new total crosses a suspension threshold. It returns the suspension end, or the
+// zero time if no threshold was crossed.
+func (db *DataBase) IssueWarning(userUUID, issuerUUID, severity, reason string) (time.Time, error) {
+	points, ok := warningPoints[severity]
+	if !ok {
+		return time.Time{}, errors.New("unknown severity")
+	}
+
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	var before int
+	if err := tx.QueryRow(warningPointsSQL, userUUID).Scan(&before); err != nil {
+		return time.Time{}, err
+	}
+
+	if _, err := tx.Exec(
+		"INSERT INTO warnings (user_uuid, issuer_uuid, severity, reason, created_at) VALUES (?, ?, ?, ?, ?)",
+		userUUID, issuerUUID, severity, reason, Timestamp(),
+	); err != nil {
+		return time.Time{}, err
+	}
+	// Warnings can't be turned off, so they skip sendNotification
+	warning := notify.Event{Kind: notify.Warning, Recipient: userUUID, Actor: issuerUUID, At: Now()}
+	if err := notify.Send(tx, warning, notify.InApp); err != nil {
+		return time.Time{}, err
+	}
+
+	// Only the strictest threshold crossed by this warning applies
+	var days int
+	err = tx.QueryRow(
+		`SELECT suspend_days FROM warning_thresholds
+		WHERE points > ? AND points <= ?
+		ORDER BY points DESC LIMIT 1`,
+		before, before+points,
+	).Scan(&days)
+
+	var until time.Time
+	if err == nil {
+		until = PermanentSuspension
+		if days > 0 {
+			until = Now().Add(time.Duration(days) * 24 * time.Hour)
+		}
+		// Never shorten a suspension that is already running for longer
+		if _, err := tx.Exec(
+			"UPDATE users SET suspendeduntil = ?, loggedin = 0 WHERE uuid = ? AND suspendeduntil < ?",
+			FormatTimestamp(until), userUUID, FormatTimestamp(until),
+		); err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	return until, tx.Commit()
+}
+
+// ListWarnings returns the warnings issued to a user, newest first
+func (db *DataBase) ListWarnings(userUUID string) ([]Warning, error) {
+	rows, err := db.Conn.Query(
+		`SELECT w.id, u.username, w.severity, w.reason, w.created_at
+		FROM warnings w JOIN users u ON u.uuid = w.issuer_uuid
+		WHERE w.user_uuid = ?
+		ORDER BY w.id DESC`,
+		userUUID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var warnings []Warning
+	for rows.Next() {
+		var (
+			wn        Warning
+			createdAt string
+		)
+		if err := rows.Scan(&wn.ID, &wn.Issuer, &wn.Severity, &wn.Reason, &createdAt); err != nil {
+			return nil, err
+		}
+		wn.CreatedAt, _ = ParseTimestamp(createdAt)
+		warnings = append(warnings, wn)
+	}
+	return warnings, rows.Err()
+}
+
+// WarningPoints returns the total warning points of a user
+func (db *DataBase) WarningPoints(userUUID string) (int, error) {
+	var points int
+	err := db.Conn.QueryRow(warningPointsSQL, userUUID).Scan(&points)
+	return points, err
+}
+
+// LiftSuspension ends a user's suspension immediately
+func (db *DataBase) LiftSuspension(userUUID string) error {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	_, err := db.Conn.Exec("UPDATE users SET suspendeduntil = '' WHERE uuid = ?", userUUID)
+	return err
+}
+
+// ListWarningThresholds returns the suspension thresholds, lowest first
+func (db *DataBase) ListWarningThresholds() ([]WarningThreshold, error) {
+	rows, err := db.Conn.Query("SELECT points, suspend_days FROM warning_thresholds ORDER BY points")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var thresholds []WarningThreshold
+	for rows.Next() {
+		var t WarningThreshold
+		if err := rows.Scan(&t.Points, &t.SuspendDays); err != nil {
+			return nil, err
+		}
+		thresholds = append(thresholds, t)
+	}
+	return thresholds, rows.Err()
+}
+
+// SetWarningThreshold creates or updates the threshold at the given points
+func (db *DataBase) SetWarningThreshold(t WarningThreshold) error {
+	if t.Points < 1 || t.SuspendDays < 0 {
+		return errors.New("points must be positive and days can't be negative")
+	}
+
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	_, err := db.Conn.Exec(
+		`INSERT INTO warning_thresholds (points, suspend_days) VALUES (?, ?)
+		ON CONFLICT(points) DO UPDATE SET suspend_days = excluded.suspend_days`,
+		t.Points, t.SuspendDays,
+	)
+	return err
+}
+
+// DeleteWarningThreshold removes the threshold at the given points
+func (db *DataBase) DeleteWarningThreshold(points int) error {
+	db.Write.Lock()
+	defer db.Write.Unlock()
+
+	_, err := db.Conn.Exec("DELETE FROM warning_thresholds WHERE points = ?", points)
+	return err
+}
+
+// IssueWarningHandler handles POST /admin/users/{username}/warnings
+func IssueWarningHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	staff, ok := RequireStaff(w, r)
+	if !ok {
+		return
+	}
+
+	user, err := db.GetUserByUsername(r.PathValue("username"))
+	if err != nil {
+		RenderError(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if user.UUID == staff.UUID {
+		RenderError(w, "You can't warn yourself", http.StatusBadRequest)
+		return
+	}
+	if !CanWarn(staff, user) {
+		RenderError(w, "Only admins can warn staff", http.StatusForbidden)
+		return
+	}
+
+	reason, err := withSnippet(r, strings.TrimSpace(r.FormValue("reason")), user.Username, staff.Username, "")
+	if err != nil {
+		RenderError(w, "Failed to issue warning: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if reason == "" {
+		RenderError(w, "A reason is required", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := db.IssueWarning(user.UUID, staff.UUID, r.FormValue("severity"), reason); err != nil {
+		RenderError(w, "Failed to issue warning: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/users/"+url.PathEscape(user.Username), http.StatusSeeOther)
+}
+
+// LiftSuspensionHandler handles POST /admin/users/{username}/unsuspend
+func LiftSuspensionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := RequireStaff(w, r); !ok {
+		return
+	}
+
+	user, err := db.GetUserByUsername(r.PathValue("username"))
+	if err != nil {
+		RenderError(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if err := db.LiftSuspension(user.UUID); err != nil {
+		RenderError(w, "Failed to lift suspension", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/users/"+url.PathEscape(user.Username), http.StatusSeeOther)
+}
+
+// WarningThresholdsHandler handles GET and POST /admin/warnings.
+// POST sets a threshold, or deletes it when action=delete.
+func WarningThresholdsHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := RequireAdmin(w, r); !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		thresholds, err := db.ListWarningThresholds()
+		if err != nil {
+			RenderError(w, "Failed to load thresholds", http.StatusInternalServerError)
+			return
+		}
+		InitTemplate(w, "templates/admin_warnings.html", map[string]interface{}{
+			"Thresholds": thresholds,
+		})
+
+	case http.MethodPost:
+		points, err := strconv.Atoi(r.FormValue("points"))
+		if err != nil {
+			RenderError(w, "Invalid points", http.StatusBadRequest)
+			return
+		}
+
+		if r.FormValue("action") == "delete" {
+			err = db.DeleteWarningThreshold(points)
+		} else {
+			days, convErr := strconv.Atoi(r.FormValue("days"))
+			if convErr != nil {
+				RenderError(w, "Invalid days", http.StatusBadRequest)
+				return
+			}
+			err = db.SetWarningThreshold(WarningThreshold{Points: points, SuspendDays: days})
+		}
+		if err != nil {
+			RenderError(w, "Failed to save threshold: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, "/admin/warnings", http.StatusSeeOther)
+
+	default:
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// MyWarningsHandler handles GET /warnings, where users read warnings issued to them
+func MyWarningsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		RenderError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := CurrentUser(w, r)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	warnings, err := db.ListWarnings(user.UUID)
+	if err != nil {
+		RenderError(w, "Failed to load warnings", http.StatusInternalServerError)
+		return
+	}
+	loc := db.GetLocationPreference(user.UUID)
+	for i := range warnings {
+		warnings[i].CreatedAt = warnings[i].CreatedAt.In(loc)
+	}
+
+	InitTemplate(w, "templates/warnings.html", map[string]interface{}{
+		"Warnings": warnings,
+	})
+}